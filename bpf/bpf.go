@@ -0,0 +1,351 @@
+// Copyright 2017 Intel Corporation.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package bpf provides classic BPF filters for packets. Filters can be
+// compiled from tcpdump-like expressions, for example
+//
+//	tcp port 443 and net 10.0.0.0/8
+//
+// or loaded from instructions, for example printed by "tcpdump -dd".
+// Programs are executed by interpreter over raw bytes of packet starting
+// from Ethernet header.
+//
+// Supported expressions are primitives combined with "and" ("&&"), "or"
+// ("||"), "not" ("!") and parentheses. Primitives are:
+//
+//	ether, ip, ip6, arp, tcp, udp, sctp, icmp, icmp6
+//	[ether] [src|dst] host MAC
+//	ether proto NUMBER
+//	[ip|ip6] [src|dst] host ADDRESS
+//	[ip|ip6] [src|dst] net ADDRESS/LENGTH or net ADDRESS mask MASK
+//	[ip|ip6] proto NUMBER|tcp|udp|sctp|icmp|icmp6
+//	[tcp|udp|sctp] [src|dst] port PORT
+//	[tcp|udp|sctp] [src|dst] portrange PORT-PORT
+//	vlan [ID]
+//	less LENGTH, greater LENGTH
+//
+// Direction can also be "src or dst" which is default and "src and dst".
+// Like in tcpdump identifier without keywords reuses keywords of previous
+// primitive, so "port 80 or 443" is the same as "port 80 or port 443", and
+// "vlan" shifts all following checks by length of VLAN tag.
+package bpf
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/intel-go/yanff/packet"
+)
+
+// Instruction is classic BPF instruction in the same format as Linux
+// struct sock_filter.
+type Instruction struct {
+	Op uint16 // Operation code
+	Jt uint8  // Jump offset if condition is true
+	Jf uint8  // Jump offset if condition is false
+	K  uint32 // Generic field
+}
+
+func (ins Instruction) String() string {
+	return fmt.Sprintf("{ 0x%02x, %d, %d, 0x%08x }", ins.Op, ins.Jt, ins.Jf, ins.K)
+}
+
+// Instruction classes, sizes, modes and operations
+const (
+	classLD   = 0x00
+	classLDX  = 0x01
+	classST   = 0x02
+	classSTX  = 0x03
+	classALU  = 0x04
+	classJMP  = 0x05
+	classRET  = 0x06
+	classMISC = 0x07
+
+	sizeW = 0x00
+	sizeH = 0x08
+	sizeB = 0x10
+
+	modeIMM = 0x00
+	modeABS = 0x20
+	modeIND = 0x40
+	modeMEM = 0x60
+	modeLEN = 0x80
+	modeMSH = 0xa0
+
+	aluADD = 0x00
+	aluSUB = 0x10
+	aluMUL = 0x20
+	aluDIV = 0x30
+	aluOR  = 0x40
+	aluAND = 0x50
+	aluLSH = 0x60
+	aluRSH = 0x70
+	aluNEG = 0x80
+	aluMOD = 0x90
+	aluXOR = 0xa0
+
+	jmpJA   = 0x00
+	jmpJEQ  = 0x10
+	jmpJGT  = 0x20
+	jmpJGE  = 0x30
+	jmpJSET = 0x40
+
+	srcK = 0x00
+	srcX = 0x08
+	retA = 0x10
+
+	miscTAX = 0x00
+	miscTXA = 0x80
+
+	memWords = 16
+	maxInsns = 4096
+)
+
+// Program is validated classic BPF program.
+type Program struct {
+	insns []Instruction
+}
+
+// NewProgram checks instructions and returns program. Program should end
+// with return instruction, all jumps should be forward and inside program,
+// memory cells and division by constant should be correct.
+func NewProgram(insns []Instruction) (*Program, error) {
+	if len(insns) == 0 || len(insns) > maxInsns {
+		return nil, errors.New("bpf: incorrect number of instructions")
+	}
+	for pc, ins := range insns {
+		if err := checkInstruction(ins, len(insns)-pc-1); err != nil {
+			return nil, fmt.Errorf("bpf: instruction %d %v: %v", pc, ins, err)
+		}
+	}
+	if insns[len(insns)-1].Op&0x07 != classRET {
+		return nil, errors.New("bpf: program doesn't end with return")
+	}
+	p := &Program{insns: make([]Instruction, len(insns))}
+	copy(p.insns, insns)
+	return p, nil
+}
+
+// checkInstruction checks one instruction. left is number of instructions
+// after it.
+func checkInstruction(ins Instruction, left int) error {
+	op := ins.Op
+	switch op & 0x07 {
+	case classLD:
+		switch op & 0xe0 {
+		case modeABS, modeIND:
+			if op&0x18 == 0x18 || op&^0xf8 != classLD {
+				return errors.New("unknown operation")
+			}
+			return nil
+		case modeMEM:
+			if ins.K >= memWords {
+				return errors.New("incorrect memory cell")
+			}
+		}
+		if op != classLD|modeIMM && op != classLD|modeMEM && op != classLD|modeLEN {
+			return errors.New("unknown operation")
+		}
+	case classLDX:
+		switch op {
+		case classLDX | modeMEM:
+			if ins.K >= memWords {
+				return errors.New("incorrect memory cell")
+			}
+		case classLDX | modeIMM, classLDX | modeLEN, classLDX | sizeB | modeMSH:
+		default:
+			return errors.New("unknown operation")
+		}
+	case classST, classSTX:
+		if op&^0x07 != 0 {
+			return errors.New("unknown operation")
+		}
+		if ins.K >= memWords {
+			return errors.New("incorrect memory cell")
+		}
+	case classALU:
+		if op&^0xff != 0 || op&0xf0 > aluXOR || (op&0xf0 == aluNEG && op&srcX != 0) {
+			return errors.New("unknown operation")
+		}
+		if (op&0xf0 == aluDIV || op&0xf0 == aluMOD) && op&srcX == 0 && ins.K == 0 {
+			return errors.New("division by zero")
+		}
+	case classJMP:
+		if op&^0xff != 0 || op&0xf0 > jmpJSET || (op&0xf0 == jmpJA && op&srcX != 0) {
+			return errors.New("unknown operation")
+		}
+		if op&0xf0 == jmpJA {
+			if ins.K >= uint32(left) {
+				return errors.New("jump out of program")
+			}
+		} else if int(ins.Jt) >= left || int(ins.Jf) >= left {
+			return errors.New("jump out of program")
+		}
+	case classRET:
+		if op != classRET|srcK && op != classRET|retA {
+			return errors.New("unknown operation")
+		}
+	case classMISC:
+		if op != classMISC|miscTAX && op != classMISC|miscTXA {
+			return errors.New("unknown operation")
+		}
+	}
+	return nil
+}
+
+// Instructions returns copy of program instructions.
+func (p *Program) Instructions() []Instruction {
+	insns := make([]Instruction, len(p.insns))
+	copy(insns, p.insns)
+	return insns
+}
+
+// load reads value of given size in network byte order. Returns false
+// if it is out of data.
+func load(data []byte, offset uint64, size uint16) (uint32, bool) {
+	switch size {
+	case sizeW:
+		if offset+4 > uint64(len(data)) {
+			return 0, false
+		}
+		return uint32(data[offset])<<24 | uint32(data[offset+1])<<16 | uint32(data[offset+2])<<8 | uint32(data[offset+3]), true
+	case sizeH:
+		if offset+2 > uint64(len(data)) {
+			return 0, false
+		}
+		return uint32(data[offset])<<8 | uint32(data[offset+1]), true
+	default:
+		if offset >= uint64(len(data)) {
+			return 0, false
+		}
+		return uint32(data[offset]), true
+	}
+}
+
+// Run executes program over data and returns its result which is number
+// of bytes to accept. Zero means that packet is rejected. Loads outside
+// of data and division by zero reject packet.
+func (p *Program) Run(data []byte) uint32 {
+	var a, x uint32
+	var mem [memWords]uint32
+	var ok bool
+	for pc := 0; pc < len(p.insns); pc++ {
+		ins := &p.insns[pc]
+		op := ins.Op
+		switch op & 0x07 {
+		case classLD:
+			switch op & 0xe0 {
+			case modeIMM:
+				a = ins.K
+			case modeABS:
+				if a, ok = load(data, uint64(ins.K), op&0x18); !ok {
+					return 0
+				}
+			case modeIND:
+				if a, ok = load(data, uint64(x)+uint64(ins.K), op&0x18); !ok {
+					return 0
+				}
+			case modeMEM:
+				a = mem[ins.K]
+			case modeLEN:
+				a = uint32(len(data))
+			}
+		case classLDX:
+			switch op & 0xe0 {
+			case modeIMM:
+				x = ins.K
+			case modeMEM:
+				x = mem[ins.K]
+			case modeLEN:
+				x = uint32(len(data))
+			case modeMSH:
+				if uint64(ins.K) >= uint64(len(data)) {
+					return 0
+				}
+				x = uint32(data[ins.K]&0xf) << 2
+			}
+		case classST:
+			mem[ins.K] = a
+		case classSTX:
+			mem[ins.K] = x
+		case classALU:
+			v := ins.K
+			if op&srcX != 0 {
+				v = x
+			}
+			switch op & 0xf0 {
+			case aluADD:
+				a += v
+			case aluSUB:
+				a -= v
+			case aluMUL:
+				a *= v
+			case aluDIV:
+				if v == 0 {
+					return 0
+				}
+				a /= v
+			case aluMOD:
+				if v == 0 {
+					return 0
+				}
+				a %= v
+			case aluOR:
+				a |= v
+			case aluAND:
+				a &= v
+			case aluXOR:
+				a ^= v
+			case aluLSH:
+				a <<= v
+			case aluRSH:
+				a >>= v
+			case aluNEG:
+				a = -a
+			}
+		case classJMP:
+			v := ins.K
+			if op&srcX != 0 {
+				v = x
+			}
+			var cond bool
+			switch op & 0xf0 {
+			case jmpJA:
+				pc += int(ins.K)
+				continue
+			case jmpJEQ:
+				cond = a == v
+			case jmpJGT:
+				cond = a > v
+			case jmpJGE:
+				cond = a >= v
+			case jmpJSET:
+				cond = a&v != 0
+			}
+			if cond {
+				pc += int(ins.Jt)
+			} else {
+				pc += int(ins.Jf)
+			}
+		case classRET:
+			if op&retA != 0 {
+				return a
+			}
+			return ins.K
+		case classMISC:
+			if op&0xf8 == miscTXA {
+				a = x
+			} else {
+				x = a
+			}
+		}
+	}
+	return 0
+}
+
+// Matches returns true if program accepts packet. All segments of
+// chained packet are checked.
+func (p *Program) Matches(pkt *packet.Packet) bool {
+	return p.Run(pkt.GetRawPacketBytes()) != 0
+}
@@ -0,0 +1,145 @@
+// Copyright 2017 Intel Corporation.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package bpf
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+)
+
+// frame builds Ethernet frame with optional VLAN tags, IP header of given
+// version and L4 header with ports.
+func frame(vlans []uint16, version int, proto uint8, src, dst string, sport, dport uint16) []byte {
+	b := []byte{0, 1, 2, 3, 4, 5, 0xa, 0xb, 0xc, 0xd, 0xe, 0xf}
+	for _, vlan := range vlans {
+		b = append(b, 0x81, 0, byte(vlan>>8), byte(vlan))
+	}
+	if version == 4 {
+		b = append(b, 0x08, 0x00)
+		ip := make([]byte, 20)
+		ip[0], ip[9] = 0x45, proto
+		copy(ip[12:], net.ParseIP(src).To4())
+		copy(ip[16:], net.ParseIP(dst).To4())
+		b = append(b, ip...)
+	} else {
+		b = append(b, 0x86, 0xdd)
+		ip := make([]byte, 40)
+		ip[0], ip[6] = 0x60, proto
+		copy(ip[8:], net.ParseIP(src).To16())
+		copy(ip[24:], net.ParseIP(dst).To16())
+		b = append(b, ip...)
+	}
+	l4 := make([]byte, 20)
+	binary.BigEndian.PutUint16(l4[0:], sport)
+	binary.BigEndian.PutUint16(l4[2:], dport)
+	return append(b, l4...)
+}
+
+func TestCompile(t *testing.T) {
+	tcp4 := frame(nil, 4, protoTCP, "10.1.2.3", "192.168.0.1", 1234, 443)
+	udp6 := frame(nil, 6, protoUDP, "2001:db8::1", "2001:db8::2", 53, 5353)
+	vlan4 := frame([]uint16{100}, 4, protoUDP, "10.0.0.1", "10.0.0.2", 53, 53)
+	icmp4 := frame(nil, 4, protoICMP, "172.16.0.1", "10.0.0.1", 0, 0)
+	fragment := frame(nil, 4, protoTCP, "10.1.2.3", "192.168.0.1", 1234, 443)
+	fragment[14+7] = 1
+	arp := append([]byte{0, 1, 2, 3, 4, 5, 0xa, 0xb, 0xc, 0xd, 0xe, 0xf, 0x08, 0x06}, make([]byte, 28)...)
+
+	tests := []struct {
+		expr    string
+		pkt     []byte
+		matches bool
+	}{
+		{"", arp, true},
+		{"ip", tcp4, true},
+		{"ip", udp6, false},
+		{"ip6", udp6, true},
+		{"arp", arp, true},
+		{"tcp", tcp4, true},
+		{"tcp", udp6, false},
+		{"udp", udp6, true},
+		{"icmp", icmp4, true},
+		{"tcp port 443 and net 10.0.0.0/8", tcp4, true},
+		{"tcp port 443 and net 10.0.0.0/8", icmp4, false},
+		{"tcp port 443 and net 11.0.0.0/8", tcp4, false},
+		{"tcp port 443", fragment, false},
+		{"udp port 443", tcp4, false},
+		{"src port 443", tcp4, false},
+		{"dst port 443", tcp4, true},
+		{"port 80 or 443", tcp4, true},
+		{"port 80 or 8080", tcp4, false},
+		{"portrange 400-500", tcp4, true},
+		{"tcp src portrange 1000-1233", tcp4, false},
+		{"port 5353", udp6, true},
+		{"src host 10.1.2.3", tcp4, true},
+		{"dst host 10.1.2.3", tcp4, false},
+		{"src and dst net 10.0.0.0 mask 255.0.0.0", tcp4, false},
+		{"src or dst net 192.168.0.0/16", tcp4, true},
+		{"host 2001:db8::2", udp6, true},
+		{"ip6 net 2001:db8::/32 and not ip6 net 2001:db8::/127", udp6, false},
+		{"ip proto tcp", tcp4, true},
+		{"proto 17", udp6, true},
+		{"ether proto 0x0806", arp, true},
+		{"ether src 0a:0b:0c:0d:0e:0f", tcp4, true},
+		{"ether dst host 0a:0b:0c:0d:0e:0f", tcp4, false},
+		{"udp port 53", vlan4, false},
+		{"vlan 100 and udp port 53", vlan4, true},
+		{"vlan 101 and udp", vlan4, false},
+		{"vlan and host 10.0.0.2", vlan4, true},
+		{"not (tcp or udp)", icmp4, true},
+		{"!tcp && (udp || icmp)", icmp4, true},
+		{"greater 54", tcp4, true},
+		{"less 53", tcp4, false},
+	}
+	for _, test := range tests {
+		p, err := Compile(test.expr)
+		if err != nil {
+			t.Errorf("%s: %v", test.expr, err)
+			continue
+		}
+		if got := p.Run(test.pkt) != 0; got != test.matches {
+			t.Errorf("%s: got %v, want %v", test.expr, got, test.matches)
+		}
+	}
+
+	for _, expr := range []string{"tcp port", "port 80 or", "(tcp", "foo", "icmp port 80",
+		"ip host 2001:db8::1", "vlan 5000", "tcp 80", "host 10.0.0.300"} {
+		if _, err := Compile(expr); err == nil {
+			t.Errorf("%s: error expected", expr)
+		}
+	}
+}
+
+func TestNewProgram(t *testing.T) {
+	// tcpdump -dd ip
+	p, err := NewProgram([]Instruction{
+		{0x28, 0, 0, 0x0000000c},
+		{0x15, 0, 1, 0x00000800},
+		{0x6, 0, 0, 0x00040000},
+		{0x6, 0, 0, 0x00000000},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Run(frame(nil, 4, protoTCP, "1.1.1.1", "2.2.2.2", 1, 2)) != AcceptLen ||
+		p.Run(frame(nil, 6, protoTCP, "::1", "::2", 1, 2)) != 0 || p.Run([]byte{0}) != 0 {
+		t.Error("Incorrect result of program")
+	}
+
+	bad := [][]Instruction{
+		{},
+		{{0x28, 0, 0, 12}},
+		{{0x15, 0, 5, 0}, {0x6, 0, 0, 0}},
+		{{0x05, 0, 0, 3}, {0x6, 0, 0, 0}},
+		{{0x34, 0, 0, 0}, {0x6, 0, 0, 0}},
+		{{0x02, 0, 0, 16}, {0x6, 0, 0, 0}},
+		{{0xff, 0, 0, 0}, {0x6, 0, 0, 0}},
+	}
+	for i, insns := range bad {
+		if _, err := NewProgram(insns); err == nil {
+			t.Errorf("Program %d: error expected", i)
+		}
+	}
+}
@@ -0,0 +1,690 @@
+// Copyright 2017 Intel Corporation.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package bpf
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// AcceptLen is returned by compiled programs for accepted packets. It is
+// the same as default snapshot length of tcpdump.
+const AcceptLen = 262144
+
+const (
+	etherTypeIPv4  = 0x0800
+	etherTypeARP   = 0x0806
+	etherTypeIPv6  = 0x86dd
+	etherTypeVLAN  = 0x8100
+	etherTypeQinQ  = 0x88a8
+	etherTypeQinQ1 = 0x9100
+
+	protoICMP   = 1
+	protoTCP    = 6
+	protoUDP    = 17
+	protoICMPv6 = 58
+	protoSCTP   = 132
+)
+
+// Direction qualifiers
+const (
+	dirAny = iota // src or dst
+	dirAll        // src and dst
+	dirSrc
+	dirDst
+)
+
+// node is element of parsed expression: andNode, orNode, notNode or
+// *testNode.
+type node interface{}
+
+type andNode []node
+
+type orNode []node
+
+type notNode struct {
+	n node
+}
+
+const (
+	loadAbs = iota // Absolute offset from start of packet
+	loadInd        // Offset from start of L4 after IPv4 header of variable length
+	loadLen        // Packet length
+)
+
+// testNode is elementary check: value is loaded from packet, optionally
+// masked and compared with constant.
+type testNode struct {
+	load   int
+	ihl    uint32 // Offset of IPv4 header for loadInd
+	offset uint32
+	size   uint16
+	mask   uint32
+	jump   uint16
+	value  uint32
+}
+
+// qualifiers are keywords of primitive.
+type qualifiers struct {
+	proto string
+	dir   int
+	typ   string
+}
+
+var protoKeywords = map[string]bool{
+	"ether": true, "ip": true, "ip6": true, "arp": true,
+	"tcp": true, "udp": true, "sctp": true, "icmp": true, "icmp6": true,
+}
+
+var typeKeywords = map[string]bool{
+	"host": true, "net": true, "port": true, "portrange": true, "proto": true,
+}
+
+var protoNumbers = map[string]uint32{
+	"icmp": protoICMP, "tcp": protoTCP, "udp": protoUDP, "icmp6": protoICMPv6, "sctp": protoSCTP,
+}
+
+var etherTypes = map[string]uint32{
+	"ip": etherTypeIPv4, "ip6": etherTypeIPv6, "arp": etherTypeARP,
+}
+
+type compiler struct {
+	tokens  []string
+	pos     int
+	linkOff uint32     // Offset of L3 header, grows after "vlan"
+	last    qualifiers // Keywords of previous primitive
+}
+
+// Compile compiles tcpdump-like filter expression to program. Empty
+// expression accepts all packets. See package description for syntax.
+func Compile(expr string) (*Program, error) {
+	c := compiler{tokens: tokenize(expr), linkOff: 14}
+	var root node = andNode{}
+	if len(c.tokens) != 0 {
+		var err error
+		if root, err = c.parseOr(); err != nil {
+			return nil, fmt.Errorf("bpf: %v", err)
+		}
+		if c.pos != len(c.tokens) {
+			return nil, fmt.Errorf("bpf: unexpected \"%s\"", c.tokens[c.pos])
+		}
+	}
+	var g codegen
+	accept, reject := g.newLabel(), g.newLabel()
+	g.gen(root, accept, reject)
+	g.place(accept)
+	g.emit(Instruction{Op: classRET | srcK, K: AcceptLen})
+	g.place(reject)
+	g.emit(Instruction{Op: classRET | srcK, K: 0})
+	if err := g.resolve(); err != nil {
+		return nil, err
+	}
+	return NewProgram(g.insns)
+}
+
+func tokenize(expr string) []string {
+	var tokens []string
+	for i := 0; i < len(expr); {
+		switch {
+		case expr[i] == ' ' || expr[i] == '\t' || expr[i] == '\n':
+			i++
+		case expr[i] == '(' || expr[i] == ')' || expr[i] == '!':
+			tokens = append(tokens, expr[i:i+1])
+			i++
+		case strings.HasPrefix(expr[i:], "&&") || strings.HasPrefix(expr[i:], "||"):
+			tokens = append(tokens, expr[i:i+2])
+			i += 2
+		default:
+			j := i
+			for j < len(expr) && !strings.ContainsRune(" \t\n()!&|", rune(expr[j])) {
+				j++
+			}
+			if j == i {
+				j++
+			}
+			tokens = append(tokens, expr[i:j])
+			i = j
+		}
+	}
+	return tokens
+}
+
+func (c *compiler) peek(n int) string {
+	if c.pos+n < len(c.tokens) {
+		return c.tokens[c.pos+n]
+	}
+	return ""
+}
+
+func (c *compiler) next() string {
+	tok := c.peek(0)
+	if tok != "" {
+		c.pos++
+	}
+	return tok
+}
+
+// isID returns true if token can be value of primitive.
+func isID(tok string) bool {
+	switch tok {
+	case "", "(", ")", "!", "&&", "||", "and", "or", "not", "src", "dst", "vlan", "less", "greater":
+		return false
+	}
+	return !protoKeywords[tok] && !typeKeywords[tok]
+}
+
+func (c *compiler) parseOr() (node, error) {
+	n, err := c.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	or := orNode{n}
+	for c.peek(0) == "or" || c.peek(0) == "||" {
+		c.next()
+		if n, err = c.parseAnd(); err != nil {
+			return nil, err
+		}
+		or = append(or, n)
+	}
+	if len(or) == 1 {
+		return or[0], nil
+	}
+	return or, nil
+}
+
+func (c *compiler) parseAnd() (node, error) {
+	n, err := c.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	and := andNode{n}
+	for c.peek(0) == "and" || c.peek(0) == "&&" {
+		c.next()
+		if n, err = c.parseUnary(); err != nil {
+			return nil, err
+		}
+		and = append(and, n)
+	}
+	if len(and) == 1 {
+		return and[0], nil
+	}
+	return and, nil
+}
+
+func (c *compiler) parseUnary() (node, error) {
+	switch c.peek(0) {
+	case "not", "!":
+		c.next()
+		n, err := c.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return notNode{n}, nil
+	case "(":
+		c.next()
+		n, err := c.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if c.next() != ")" {
+			return nil, errors.New("missing \")\"")
+		}
+		return n, nil
+	}
+	return c.parsePrimitive()
+}
+
+func (c *compiler) parsePrimitive() (node, error) {
+	switch tok := c.peek(0); tok {
+	case "":
+		return nil, errors.New("unexpected end of expression")
+	case "less", "greater":
+		c.next()
+		n, err := parseNumber(c.next(), 0xffffffff)
+		if err != nil {
+			return nil, err
+		}
+		if tok == "less" {
+			return notNode{&testNode{load: loadLen, jump: jmpJGT, value: n}}, nil
+		}
+		return &testNode{load: loadLen, jump: jmpJGE, value: n}, nil
+	case "vlan":
+		c.next()
+		return c.vlan()
+	}
+
+	q := qualifiers{dir: dirAny}
+	if !isID(c.peek(0)) {
+		if protoKeywords[c.peek(0)] {
+			q.proto = c.next()
+		}
+		if d := c.peek(0); d == "src" || d == "dst" {
+			c.next()
+			q.dir = dirSrc
+			if d == "dst" {
+				q.dir = dirDst
+			}
+			if op, other := c.peek(0), c.peek(1); (op == "or" || op == "and") &&
+				(other == "src" || other == "dst") && other != d {
+				c.pos += 2
+				q.dir = dirAny
+				if op == "and" {
+					q.dir = dirAll
+				}
+			}
+		}
+		if typeKeywords[c.peek(0)] {
+			q.typ = c.next()
+		}
+		if q.typ == "" {
+			if q.dir == dirAny && q.proto != "" {
+				return c.protocol(q.proto)
+			}
+			if q.proto == "" && q.dir == dirAny {
+				return nil, fmt.Errorf("unexpected \"%s\"", c.peek(0))
+			}
+			q.typ = "host"
+		}
+	} else {
+		if c.last.typ == "" {
+			return nil, fmt.Errorf("unknown keyword \"%s\"", c.peek(0))
+		}
+		q = c.last
+	}
+	id := c.next()
+	_, protoName := protoNumbers[id]
+	_, etherName := etherTypes[id]
+	if !isID(id) && !(q.typ == "proto" && (protoName || etherName)) {
+		return nil, fmt.Errorf("missing value after \"%s\"", q.typ)
+	}
+	c.last = q
+	switch q.typ {
+	case "host":
+		return c.host(q, id)
+	case "net":
+		return c.net(q, id)
+	case "port", "portrange":
+		return c.port(q, id)
+	}
+	return c.proto(q, id)
+}
+
+func parseNumber(tok string, max uint32) (uint32, error) {
+	n, err := strconv.ParseUint(tok, 0, 32)
+	if err != nil || n > uint64(max) {
+		return 0, fmt.Errorf("incorrect number \"%s\"", tok)
+	}
+	return uint32(n), nil
+}
+
+func (c *compiler) abs(offset uint32, size uint16, jump uint16, value uint32) *testNode {
+	return &testNode{load: loadAbs, offset: c.linkOff + offset, size: size, jump: jump, value: value}
+}
+
+func (c *compiler) etherType(t uint32) node {
+	return &testNode{load: loadAbs, offset: c.linkOff - 2, size: sizeH, jump: jmpJEQ, value: t}
+}
+
+func (c *compiler) ipProto(p uint32) node {
+	return andNode{c.etherType(etherTypeIPv4), c.abs(9, sizeB, jmpJEQ, p)}
+}
+
+func (c *compiler) ip6Proto(p uint32) node {
+	return andNode{c.etherType(etherTypeIPv6), c.abs(6, sizeB, jmpJEQ, p)}
+}
+
+func (c *compiler) protocol(proto string) (node, error) {
+	switch proto {
+	case "ether":
+		return andNode{}, nil
+	case "ip", "ip6", "arp":
+		return c.etherType(etherTypes[proto]), nil
+	case "icmp":
+		return c.ipProto(protoICMP), nil
+	case "icmp6":
+		return c.ip6Proto(protoICMPv6), nil
+	}
+	return orNode{c.ipProto(protoNumbers[proto]), c.ip6Proto(protoNumbers[proto])}, nil
+}
+
+func (c *compiler) vlan() (node, error) {
+	tpid := orNode{c.etherType(etherTypeVLAN), c.etherType(etherTypeQinQ), c.etherType(etherTypeQinQ1)}
+	c.linkOff += 4
+	if !isID(c.peek(0)) {
+		return tpid, nil
+	}
+	id, err := parseNumber(c.next(), 0xfff)
+	if err != nil {
+		return nil, err
+	}
+	tci := c.abs(0, sizeH, jmpJEQ, id)
+	tci.offset -= 4
+	tci.mask = 0xfff
+	return andNode{tpid, tci}, nil
+}
+
+// direction builds check for source and destination according to
+// direction qualifier.
+func direction(dir int, check func(src bool) node) node {
+	switch dir {
+	case dirSrc:
+		return check(true)
+	case dirDst:
+		return check(false)
+	case dirAll:
+		return andNode{check(true), check(false)}
+	}
+	return orNode{check(true), check(false)}
+}
+
+func (c *compiler) host(q qualifiers, id string) (node, error) {
+	if q.proto == "ether" {
+		mac, err := net.ParseMAC(id)
+		if err != nil || len(mac) != 6 {
+			return nil, fmt.Errorf("incorrect MAC address \"%s\"", id)
+		}
+		return direction(q.dir, func(src bool) node {
+			offset := uint32(0)
+			if src {
+				offset = 6
+			}
+			return andNode{
+				&testNode{load: loadAbs, offset: offset, size: sizeW, jump: jmpJEQ,
+					value: uint32(mac[0])<<24 | uint32(mac[1])<<16 | uint32(mac[2])<<8 | uint32(mac[3])},
+				&testNode{load: loadAbs, offset: offset + 4, size: sizeH, jump: jmpJEQ,
+					value: uint32(mac[4])<<8 | uint32(mac[5])},
+			}
+		}), nil
+	}
+	ip := net.ParseIP(id)
+	if ip == nil {
+		return nil, fmt.Errorf("incorrect address \"%s\"", id)
+	}
+	return c.address(q, ip, nil)
+}
+
+func (c *compiler) net(q qualifiers, id string) (node, error) {
+	if strings.Contains(id, "/") {
+		ip, ipnet, err := net.ParseCIDR(id)
+		if err != nil {
+			return nil, fmt.Errorf("incorrect network \"%s\"", id)
+		}
+		return c.address(q, ip.Mask(ipnet.Mask), ipnet.Mask)
+	}
+	ip := net.ParseIP(id)
+	if ip == nil {
+		return nil, fmt.Errorf("incorrect network \"%s\"", id)
+	}
+	if c.peek(0) != "mask" {
+		return c.address(q, ip, nil)
+	}
+	c.next()
+	maskTok := c.next()
+	mask := net.ParseIP(maskTok)
+	if mask == nil || (ip.To4() == nil) != (mask.To4() == nil) {
+		return nil, fmt.Errorf("incorrect mask \"%s\"", maskTok)
+	}
+	if m := mask.To4(); m != nil {
+		return c.address(q, ip.Mask(net.IPMask(m)), net.IPMask(m))
+	}
+	return c.address(q, ip.Mask(net.IPMask(mask)), net.IPMask(mask))
+}
+
+// address builds check of IPv4 or IPv6 address under mask. Nil mask
+// means full address.
+func (c *compiler) address(q qualifiers, ip net.IP, mask net.IPMask) (node, error) {
+	if v4 := ip.To4(); v4 != nil {
+		if q.proto != "" && q.proto != "ip" {
+			return nil, fmt.Errorf("\"%s\" can't be used with IPv4 address", q.proto)
+		}
+		if mask == nil {
+			mask = net.CIDRMask(32, 32)
+		}
+		return andNode{c.etherType(etherTypeIPv4), direction(q.dir, func(src bool) node {
+			offset := uint32(16)
+			if src {
+				offset = 12
+			}
+			return c.words(offset, v4, mask)
+		})}, nil
+	}
+	if q.proto != "" && q.proto != "ip6" {
+		return nil, fmt.Errorf("\"%s\" can't be used with IPv6 address", q.proto)
+	}
+	if mask == nil {
+		mask = net.CIDRMask(128, 128)
+	}
+	return andNode{c.etherType(etherTypeIPv6), direction(q.dir, func(src bool) node {
+		offset := uint32(24)
+		if src {
+			offset = 8
+		}
+		return c.words(offset, ip.To16(), mask)
+	})}, nil
+}
+
+// words compares address with value under mask word by word.
+func (c *compiler) words(offset uint32, addr []byte, mask []byte) node {
+	and := andNode{}
+	for i := 0; i < len(addr); i += 4 {
+		m := uint32(mask[i])<<24 | uint32(mask[i+1])<<16 | uint32(mask[i+2])<<8 | uint32(mask[i+3])
+		if m == 0 {
+			continue
+		}
+		t := c.abs(offset+uint32(i), sizeW, jmpJEQ,
+			uint32(addr[i])<<24|uint32(addr[i+1])<<16|uint32(addr[i+2])<<8|uint32(addr[i+3]))
+		if m != 0xffffffff {
+			t.mask = m
+			t.value &= m
+		}
+		and = append(and, t)
+	}
+	return and
+}
+
+func parsePort(tok string, proto string) (uint32, error) {
+	if n, err := parseNumber(tok, 0xffff); err == nil {
+		return n, nil
+	}
+	if proto == "" {
+		proto = "tcp"
+	}
+	if n, err := net.LookupPort(proto, tok); err == nil {
+		return uint32(n), nil
+	}
+	return 0, fmt.Errorf("incorrect port \"%s\"", tok)
+}
+
+func (c *compiler) port(q qualifiers, id string) (node, error) {
+	var protos []uint32
+	switch q.proto {
+	case "":
+		protos = []uint32{protoTCP, protoUDP, protoSCTP}
+	case "tcp", "udp", "sctp":
+		protos = []uint32{protoNumbers[q.proto]}
+	default:
+		return nil, fmt.Errorf("\"%s\" can't be used with port", q.proto)
+	}
+	var lo, hi uint32
+	var err error
+	if q.typ == "port" {
+		if lo, err = parsePort(id, q.proto); err != nil {
+			return nil, err
+		}
+		hi = lo
+	} else {
+		bounds := strings.SplitN(id, "-", 2)
+		if len(bounds) != 2 {
+			return nil, fmt.Errorf("incorrect port range \"%s\"", id)
+		}
+		if lo, err = parsePort(bounds[0], q.proto); err != nil {
+			return nil, err
+		}
+		if hi, err = parsePort(bounds[1], q.proto); err != nil {
+			return nil, err
+		}
+		if lo > hi {
+			lo, hi = hi, lo
+		}
+	}
+	check := func(t *testNode) node {
+		if lo == hi {
+			t.jump, t.value = jmpJEQ, lo
+			return t
+		}
+		upper := *t
+		t.jump, t.value = jmpJGE, lo
+		upper.jump, upper.value = jmpJGT, hi
+		return andNode{t, notNode{&upper}}
+	}
+	v4protos, v6protos := orNode{}, orNode{}
+	for _, p := range protos {
+		v4protos = append(v4protos, c.abs(9, sizeB, jmpJEQ, p))
+		v6protos = append(v6protos, c.abs(6, sizeB, jmpJEQ, p))
+	}
+	v4 := andNode{c.etherType(etherTypeIPv4), v4protos,
+		notNode{&testNode{load: loadAbs, offset: c.linkOff + 6, size: sizeH, jump: jmpJSET, value: 0x1fff}},
+		direction(q.dir, func(src bool) node {
+			offset := uint32(2)
+			if src {
+				offset = 0
+			}
+			return check(&testNode{load: loadInd, ihl: c.linkOff, offset: c.linkOff + offset, size: sizeH})
+		})}
+	v6 := andNode{c.etherType(etherTypeIPv6), v6protos,
+		direction(q.dir, func(src bool) node {
+			offset := uint32(42)
+			if src {
+				offset = 40
+			}
+			return check(c.abs(offset, sizeH, 0, 0))
+		})}
+	return orNode{v4, v6}, nil
+}
+
+func (c *compiler) proto(q qualifiers, id string) (node, error) {
+	if q.proto == "ether" {
+		t, ok := etherTypes[id]
+		if !ok {
+			var err error
+			if t, err = parseNumber(id, 0xffff); err != nil {
+				return nil, err
+			}
+		}
+		return c.etherType(t), nil
+	}
+	p, ok := protoNumbers[id]
+	if !ok {
+		var err error
+		if p, err = parseNumber(id, 0xff); err != nil {
+			return nil, err
+		}
+	}
+	switch q.proto {
+	case "":
+		return orNode{c.ipProto(p), c.ip6Proto(p)}, nil
+	case "ip":
+		return c.ipProto(p), nil
+	case "ip6":
+		return c.ip6Proto(p), nil
+	}
+	return nil, fmt.Errorf("\"%s\" can't be used with proto", q.proto)
+}
+
+// codegen emits instructions with symbolic jump targets which are
+// resolved when all labels are placed.
+type codegen struct {
+	insns  []Instruction
+	labels []int
+	refs   []labelRef
+}
+
+type labelRef struct {
+	insn   int
+	jt, jf int // Labels of conditional jump or jt for unconditional
+}
+
+func (g *codegen) newLabel() int {
+	g.labels = append(g.labels, -1)
+	return len(g.labels) - 1
+}
+
+func (g *codegen) place(label int) {
+	g.labels[label] = len(g.insns)
+}
+
+func (g *codegen) emit(ins Instruction) {
+	g.insns = append(g.insns, ins)
+}
+
+func (g *codegen) emitJump(ins Instruction, jt, jf int) {
+	g.refs = append(g.refs, labelRef{insn: len(g.insns), jt: jt, jf: jf})
+	g.emit(ins)
+}
+
+// gen emits code of node which jumps to label t if node is true and to
+// label f otherwise.
+func (g *codegen) gen(n node, t, f int) {
+	switch n := n.(type) {
+	case andNode:
+		if len(n) == 0 {
+			g.emitJump(Instruction{Op: classJMP | jmpJA}, t, -1)
+			return
+		}
+		for _, child := range n[:len(n)-1] {
+			next := g.newLabel()
+			g.gen(child, next, f)
+			g.place(next)
+		}
+		g.gen(n[len(n)-1], t, f)
+	case orNode:
+		if len(n) == 0 {
+			g.emitJump(Instruction{Op: classJMP | jmpJA}, f, -1)
+			return
+		}
+		for _, child := range n[:len(n)-1] {
+			next := g.newLabel()
+			g.gen(child, t, next)
+			g.place(next)
+		}
+		g.gen(n[len(n)-1], t, f)
+	case notNode:
+		g.gen(n.n, f, t)
+	case *testNode:
+		switch n.load {
+		case loadLen:
+			g.emit(Instruction{Op: classLD | modeLEN})
+		case loadAbs:
+			g.emit(Instruction{Op: classLD | n.size | modeABS, K: n.offset})
+		case loadInd:
+			g.emit(Instruction{Op: classLDX | sizeB | modeMSH, K: n.ihl})
+			g.emit(Instruction{Op: classLD | n.size | modeIND, K: n.offset})
+		}
+		if n.mask != 0 {
+			g.emit(Instruction{Op: classALU | aluAND | srcK, K: n.mask})
+		}
+		g.emitJump(Instruction{Op: classJMP | n.jump | srcK, K: n.value}, t, f)
+	}
+}
+
+func (g *codegen) resolve() error {
+	for _, ref := range g.refs {
+		ins := &g.insns[ref.insn]
+		jt := g.labels[ref.jt] - ref.insn - 1
+		if ins.Op == classJMP|jmpJA {
+			ins.K = uint32(jt)
+			continue
+		}
+		jf := g.labels[ref.jf] - ref.insn - 1
+		if jt > 0xff || jf > 0xff {
+			return errors.New("bpf: expression is too long")
+		}
+		ins.Jt, ins.Jf = uint8(jt), uint8(jf)
+	}
+	return nil
+}
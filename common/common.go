@@ -15,6 +15,7 @@ import (
 // Length of addresses.
 const (
 	EtherAddrLen = 6
+	IPv4AddrLen  = 4
 	IPv6AddrLen  = 16
 )
 
@@ -22,6 +23,11 @@ const (
 const (
 	IPV4Number = 0x0800
 	IPV6Number = 0x86dd
+	ARPNumber  = 0x0806
+	VLANNumber = 0x8100
+	QinQNumber = 0x88a8
+	MPLSNumber = 0x8847
+	TEBNumber  = 0x6558 // Transparent Ethernet Bridging, used by tunnels
 )
 
 // Supported L4 types
@@ -30,7 +36,60 @@ const (
 	IPNumber         = 0x04
 	TCPNumber        = 0x06
 	UDPNumber        = 0x11
+	IPv6EncapNumber  = 0x29
+	GRENumber        = 0x2F
+	ICMPv6Number     = 0x3A
 	IPv6NoNextHeader = 0x3B
+	SCTPNumber       = 0x84
+)
+
+// Supported IPv6 extension headers
+const (
+	IPv6HopByHopNumber    = 0x00
+	IPv6RoutingNumber     = 0x2B
+	IPv6FragmentNumber    = 0x2C
+	IPv6AuthHeaderNumber  = 0x33
+	IPv6DestOptionsNumber = 0x3C
+)
+
+// UDP ports of supported tunnels
+const (
+	VXLANPort  = 4789
+	GenevePort = 6081
+	GTPUPort   = 2152
+)
+
+// Supported GTP-U message types
+const (
+	GTPUEchoRequest     uint8 = 1
+	GTPUEchoResponse    uint8 = 2
+	GTPUErrorIndication uint8 = 26
+	GTPUEndMarker       uint8 = 254
+	GTPUGPDU            uint8 = 255 // Encapsulated user data
+)
+
+// Flags of GTP-U header
+const (
+	GTPUVersion1     uint8 = 0x20
+	GTPUProtocolType uint8 = 0x10
+	GTPUExtFlag      uint8 = 0x04
+	GTPUSeqFlag      uint8 = 0x02
+	GTPUNPDUFlag     uint8 = 0x01
+)
+
+// Supported GTP-U extension header types
+const (
+	GTPUExtNone                uint8 = 0x00
+	GTPUExtUDPPort             uint8 = 0x40
+	GTPUExtPDUSessionContainer uint8 = 0x85
+	GTPUExtPDCPPDUNumber       uint8 = 0xc0
+)
+
+// Flags of GRE header
+const (
+	GREChecksumFlag = 0x8000
+	GREKeyFlag      = 0x2000
+	GRESeqFlag      = 0x1000
 )
 
 // Supported ICMP Types
@@ -39,6 +98,74 @@ const (
 	ICMPTypeEchoResponse uint8 = 0
 )
 
+// Supported ICMPv6 Types
+const (
+	ICMPv6TypeEchoRequest           uint8 = 128
+	ICMPv6TypeEchoResponse          uint8 = 129
+	ICMPv6TypeRouterSolicitation    uint8 = 133
+	ICMPv6TypeRouterAdvertisement   uint8 = 134
+	ICMPv6TypeNeighborSolicitation  uint8 = 135
+	ICMPv6TypeNeighborAdvertisement uint8 = 136
+)
+
+// Supported NDP option types
+const (
+	NDPOptionSourceLinkLayerAddr uint8 = 1
+	NDPOptionTargetLinkLayerAddr uint8 = 2
+	NDPOptionPrefixInfo          uint8 = 3
+	NDPOptionMTU                 uint8 = 5
+)
+
+// SCTP chunk types
+const (
+	SCTPChunkData             uint8 = 0
+	SCTPChunkInit             uint8 = 1
+	SCTPChunkInitAck          uint8 = 2
+	SCTPChunkSACK             uint8 = 3
+	SCTPChunkHeartbeat        uint8 = 4
+	SCTPChunkHeartbeatAck     uint8 = 5
+	SCTPChunkAbort            uint8 = 6
+	SCTPChunkShutdown         uint8 = 7
+	SCTPChunkShutdownAck      uint8 = 8
+	SCTPChunkError            uint8 = 9
+	SCTPChunkCookieEcho       uint8 = 10
+	SCTPChunkCookieAck        uint8 = 11
+	SCTPChunkShutdownComplete uint8 = 14
+)
+
+// Supported TCP option kinds
+const (
+	TCPOptionEnd           uint8 = 0
+	TCPOptionNop           uint8 = 1
+	TCPOptionMSS           uint8 = 2
+	TCPOptionWindowScale   uint8 = 3
+	TCPOptionSACKPermitted uint8 = 4
+	TCPOptionSACK          uint8 = 5
+	TCPOptionTimestamps    uint8 = 8
+)
+
+// Flags of NDP Neighbor Advertisement message
+const (
+	NDPRouterFlag    = 0x80000000
+	NDPSolicitedFlag = 0x40000000
+	NDPOverrideFlag  = 0x20000000
+)
+
+// Flags of NDP Prefix Information option
+const (
+	NDPPrefixOnLinkFlag     uint8 = 0x80
+	NDPPrefixAutonomousFlag uint8 = 0x40
+)
+
+// Supported ARP operations
+const (
+	ARPRequest = 1
+	ARPReply   = 2
+)
+
+// ARPHardwareEthernet is ARP hardware type of Ethernet
+const ARPHardwareEthernet = 1
+
 // These constants keep length of supported headers in bytes.
 //
 // IPv6Len - minimum length of IPv6 header in bytes. It can be higher and it
@@ -49,12 +176,47 @@ const (
 // In parsing we take actual length of TCP header from DataOff field and length of
 // IPv4 take from Ihl field.
 const (
-	EtherLen   = 14
-	IPv4MinLen = 20
-	IPv6Len    = 40
-	ICMPLen    = 8
-	TCPMinLen  = 20
-	UDPLen     = 8
+	EtherLen        = 14
+	VLANLen         = 4
+	ARPLen          = 28
+	IPv4MinLen      = 20
+	IPv6Len         = 40
+	IPv6FragmentLen = 8
+	ICMPLen         = 8
+	TCPMinLen       = 20
+	UDPLen          = 8
+	SCTPLen         = 12
+	SCTPChunkHdrLen = 4
+	VXLANLen        = 8
+	GeneveMinLen    = 8
+	GREMinLen       = 4
+	MPLSLen         = 4
+	GTPUMinLen      = 8
+	GTPUOptLen      = 4
+)
+
+// These constants keep length of NDP messages without options and
+// length of NDP options in bytes. Message lengths include ICMPv6 header.
+const (
+	NDPNeighborSolicitationLen  = 24
+	NDPNeighborAdvertisementLen = 24
+	NDPRouterSolicitationLen    = 8
+	NDPRouterAdvertisementLen   = 16
+	NDPLinkLayerAddrOptionLen   = 8
+	NDPPrefixInfoOptionLen      = 32
+	NDPMTUOptionLen             = 8
+)
+
+// These constants keep length of TCP options in bytes including kind
+// and length fields. SACK option has variable length which is
+// TCPOptionSACKMinLen plus TCPSACKBlockLen for each block.
+const (
+	TCPOptionMSSLen           = 4
+	TCPOptionWindowScaleLen   = 3
+	TCPOptionSACKPermittedLen = 2
+	TCPOptionSACKMinLen       = 2
+	TCPOptionTimestampsLen    = 10
+	TCPSACKBlockLen           = 8
 )
 
 // LogType - type of logging, used in flow package
@@ -12,6 +12,7 @@ import (
 
 	"github.com/intel-go/yanff/common"
 	"github.com/intel-go/yanff/flow"
+	"github.com/intel-go/yanff/packet"
 )
 
 type ipv4Subnet struct {
@@ -137,12 +138,24 @@ func InitFlows() {
 
 		// Initialize public to private flow
 		publicToPrivate := flow.SetReceiver(Natconfig.PortPairs[i].PublicPort.Index)
+		flow.SetARPResponder(publicToPrivate, Natconfig.PortPairs[i].PublicPort.Index,
+			newARPResponder(Natconfig.PortPairs[i].PublicPort, PublicMAC[i]))
 		flow.SetHandler(publicToPrivate, PublicToPrivateTranslation, context)
 		flow.SetSender(publicToPrivate, Natconfig.PortPairs[i].PrivatePort.Index)
 
 		// Initialize private to public flow
 		privateToPublic := flow.SetReceiver(Natconfig.PortPairs[i].PrivatePort.Index)
+		flow.SetARPResponder(privateToPublic, Natconfig.PortPairs[i].PrivatePort.Index,
+			newARPResponder(Natconfig.PortPairs[i].PrivatePort, PrivateMAC[i]))
 		flow.SetHandler(privateToPublic, PrivateToPublicTranslation, context)
 		flow.SetSender(privateToPublic, Natconfig.PortPairs[i].PublicPort.Index)
 	}
 }
+
+// newARPResponder creates responder which answers ARP requests for
+// port subnet address with port MAC address.
+func newARPResponder(port ipv4Port, mac [common.EtherAddrLen]uint8) *flow.ARPResponder {
+	responder := flow.NewARPResponder()
+	responder.AddAddress(packet.SwapBytesUint32(port.Subnet.Addr), mac)
+	return responder
+}
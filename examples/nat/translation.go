@@ -79,13 +79,16 @@ func allocateNewEgressConnection(protocol uint8, privEntry Tuple, publicAddr uin
 
 // PublicToPrivateTranslation does ingress translation.
 func PublicToPrivateTranslation(pkt *packet.Packet, ctx flow.UserContext) bool {
-	// Parse packet type and address
-	pktIPv4, _ := pkt.ParseAllKnownL3()
-	if pktIPv4 == nil {
+	// Parse packet type and address. Malformed packets are dropped
+	pktIPv4, _, err := pkt.SafeParseL3()
+	if err != nil || pktIPv4 == nil {
 		// We don't currently support anything except for IPv4
 		return false
 	}
-	pktTCP, pktUDP, pktICMP := pkt.ParseAllKnownL4ForIPv4()
+	pktTCP, pktUDP, pktICMP, err := pkt.SafeParseL4ForIPv4()
+	if err != nil {
+		return false
+	}
 	// Create a lookup key
 	protocol := pktIPv4.NextProtoID
 	pub2priKey := Tuple{
@@ -134,12 +137,11 @@ func PublicToPrivateTranslation(pkt *packet.Packet, ctx flow.UserContext) bool {
 	// Do packet translation
 	pkt.Ether.DAddr = Natconfig.PortPairs[pi.index].PrivatePort.DstMACAddress
 	pkt.Ether.SAddr = PrivateMAC[pi.index]
-	pktIPv4.DstAddr = packet.SwapBytesUint32(value.addr)
+	// Checksums are adjusted incrementally
+	pkt.SetIPv4DstAddr(packet.SwapBytesUint32(value.addr))
 
-	if pktTCP != nil {
-		pktTCP.DstPort = packet.SwapBytesUint16(value.port)
-	} else if pktUDP != nil {
-		pktUDP.DstPort = packet.SwapBytesUint16(value.port)
+	if pktTCP != nil || pktUDP != nil {
+		pkt.SetL4DstPort(value.port)
 	} else {
 		// Only address is not modified in ICMP packets
 	}
@@ -149,13 +151,16 @@ func PublicToPrivateTranslation(pkt *packet.Packet, ctx flow.UserContext) bool {
 
 // PrivateToPublicTranslation does egress translation.
 func PrivateToPublicTranslation(pkt *packet.Packet, ctx flow.UserContext) bool {
-	// Parse packet type and address
-	pktIPv4, _ := pkt.ParseAllKnownL3()
-	if pktIPv4 == nil {
+	// Parse packet type and address. Malformed packets are dropped
+	pktIPv4, _, err := pkt.SafeParseL3()
+	if err != nil || pktIPv4 == nil {
 		// We don't currently support anything except for IPv4
 		return false
 	}
-	pktTCP, pktUDP, pktICMP := pkt.ParseAllKnownL4ForIPv4()
+	pktTCP, pktUDP, pktICMP, err := pkt.SafeParseL4ForIPv4()
+	if err != nil {
+		return false
+	}
 
 	// Create a lookup key
 	protocol := pktIPv4.NextProtoID
@@ -200,12 +205,11 @@ func PrivateToPublicTranslation(pkt *packet.Packet, ctx flow.UserContext) bool {
 	// Do packet translation
 	pkt.Ether.DAddr = Natconfig.PortPairs[pi.index].PublicPort.DstMACAddress
 	pkt.Ether.SAddr = PublicMAC[pi.index]
-	pktIPv4.SrcAddr = packet.SwapBytesUint32(value.addr)
+	// Checksums are adjusted incrementally
+	pkt.SetIPv4SrcAddr(packet.SwapBytesUint32(value.addr))
 
-	if pktTCP != nil {
-		pktTCP.SrcPort = packet.SwapBytesUint16(value.port)
-	} else if pktUDP != nil {
-		pktUDP.SrcPort = packet.SwapBytesUint16(value.port)
+	if pktTCP != nil || pktUDP != nil {
+		pkt.SetL4SrcPort(value.port)
 	} else {
 		// Only address is not modified in ICMP packets
 	}
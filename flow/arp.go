@@ -0,0 +1,128 @@
+// Copyright 2017 Intel Corporation.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package flow
+
+import (
+	"sync"
+
+	"github.com/intel-go/yanff/common"
+	"github.com/intel-go/yanff/packet"
+)
+
+// ARPResponder keeps IPv4 addresses which should be answered by ARP
+// and neighbors which were learned from received ARP packets.
+// All IPv4 addresses have IPv4Hdr field format, e.g. constructed by packet.IPv4.
+type ARPResponder struct {
+	// Configured addresses. They are only read after SystemStart
+	addresses map[uint32][common.EtherAddrLen]uint8
+	// Learned neighbors. It is used by all clones of responder and user handlers
+	neighbors sync.Map
+}
+
+// NewARPResponder creates empty ARP responder. Addresses should be added
+// to it by AddAddress before SystemStart.
+func NewARPResponder() *ARPResponder {
+	responder := new(ARPResponder)
+	responder.addresses = make(map[uint32][common.EtherAddrLen]uint8)
+	return responder
+}
+
+// AddAddress adds IPv4 address for which ARP requests should be answered
+// with given MAC address. Usually it is MAC address of port returned by GetPortMACAddress.
+func (responder *ARPResponder) AddAddress(ip uint32, mac [common.EtherAddrLen]uint8) {
+	responder.addresses[ip] = mac
+}
+
+// LookupNeighbor returns MAC address of neighbor with given IPv4 address
+// if it was learned from ARP packets. Can be used in parallel from any handler.
+func (responder *ARPResponder) LookupNeighbor(ip uint32) ([common.EtherAddrLen]uint8, bool) {
+	v, found := responder.neighbors.Load(ip)
+	if !found {
+		return [common.EtherAddrLen]uint8{}, false
+	}
+	return v.([common.EtherAddrLen]uint8), true
+}
+
+// AddNeighbor adds or updates neighbor entry manually.
+func (responder *ARPResponder) AddNeighbor(ip uint32, mac [common.EtherAddrLen]uint8) {
+	responder.neighbors.Store(ip, mac)
+}
+
+// Outputs of ARP splitter
+const (
+	arpDrop = iota
+	arpPass
+	arpReply
+	arpOutputsNumber
+)
+
+func (responder *ARPResponder) split(current *packet.Packet, context UserContext) uint {
+	current.ParseL3()
+	arp := current.GetARP()
+	if arp == nil {
+		return arpPass
+	}
+	// Only Ethernet and IPv4 addresses of correct length are used
+	if uintptr(current.L3)-current.Start()+common.ARPLen > uintptr(current.GetPacketSegmentLen()) ||
+		arp.HType != packet.SwapBytesUint16(common.ARPHardwareEthernet) ||
+		arp.PType != packet.SwapBytesUint16(common.IPV4Number) ||
+		arp.HLen != common.EtherAddrLen || arp.PLen != common.IPv4AddrLen {
+		return arpDrop
+	}
+	// Both requests and replies are used for learning, except probes with zero sender
+	spa := packet.ArrayToIPv4(arp.SPA)
+	if spa != 0 {
+		responder.neighbors.Store(spa, arp.SHA)
+	}
+	if arp.Operation != packet.SwapBytesUint16(common.ARPRequest) {
+		return arpDrop
+	}
+	mac, found := responder.addresses[packet.ArrayToIPv4(arp.TPA)]
+	if !found {
+		return arpDrop
+	}
+	// Request is turned into reply in place
+	current.Ether.DAddr = arp.SHA
+	current.Ether.SAddr = mac
+	arp.Operation = packet.SwapBytesUint16(common.ARPReply)
+	arp.THA = arp.SHA
+	arp.SHA = mac
+	arp.TPA, arp.SPA = arp.SPA, arp.TPA
+	return arpReply
+}
+
+// SetARPResponder adds ARP handling to flow graph. Gets flow with packets
+// received from port, target port and responder with configured addresses.
+// All ARP packets are removed from input flow and are used for learning
+// neighbors. Requests for configured addresses are answered with replies
+// sent to port. Other packets remain in input flow.
+// Function can panic during execution.
+func SetARPResponder(IN *Flow, port uint8, responder *ARPResponder) {
+	must(TrySetARPResponder(IN, port, responder))
+}
+
+// TrySetARPResponder is the same as SetARPResponder but returns error instead
+// of terminating the process.
+func TrySetARPResponder(IN *Flow, port uint8, responder *ARPResponder) error {
+	if err := checkFlow(IN); err != nil {
+		return err
+	}
+	if err := checkPort(port, "send"); err != nil {
+		return err
+	}
+	outs, err := TrySetSplitter(IN, responder.split, arpOutputsNumber, nil)
+	if err != nil {
+		return err
+	}
+	if err := TrySetStopper(outs[arpDrop]); err != nil {
+		return err
+	}
+	if err := TrySetSender(outs[arpReply], port); err != nil {
+		return err
+	}
+	// Input flow continues with not ARP packets
+	IN.current = outs[arpPass].current
+	return nil
+}
@@ -0,0 +1,135 @@
+// Copyright 2017 Intel Corporation.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package flow
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/intel-go/yanff/common"
+)
+
+// Every Set function which can panic during execution has Try variant
+// which returns error instead of terminating the process. Try functions
+// check all arguments before flow graph is changed, so graph construction
+// can continue after error.
+
+// ErrorCode is kind of error returned by Try functions.
+type ErrorCode int
+
+// Values of ErrorCode
+const (
+	// UseClosedFlow means that flow is used after it was closed
+	UseClosedFlow ErrorCode = iota + 1
+	// OpenedFlowAtTheEnd means that some flows are left open when
+	// system is started
+	OpenedFlowAtTheEnd
+	// BadPort means that port number exceeds number of ports which
+	// can be used by DPDK
+	BadPort
+	// ManualPort means that port was configured as manual port and
+	// can't be used as auto port
+	ManualPort
+	// BadFunctionType means that user function doesn't match any
+	// applicable prototype
+	BadFunctionType
+	// BadArgument means that other argument is incorrect
+	BadArgument
+	// PortHasNoQueues means that port is used without send and receive
+	// queues
+	PortHasNoQueues
+	// NotAllQueuesUsed means that port doesn't use all receive queues
+	NotAllQueuesUsed
+	// FailToInitDPDK means that DPDK can't be initialized
+	FailToInitDPDK
+	// FailToInitPort means that port can't be initialized
+	FailToInitPort
+	// UseStartedPort means that queues are added to port which is
+	// already started
+	UseStartedPort
+	// ChangeStartedGraph means that started flow graph is changed
+	// outside Reconfigure
+	ChangeStartedGraph
+	// StoppedSystem means that flow graph is changed while system is
+	// stopped
+	StoppedSystem
+	// NotEnoughCores means that there are not enough cores for flow
+	// functions at start or no free cores for new flow functions
+	NotEnoughCores
+	// BadPoint means that point can't be used for requested change
+	BadPoint
+	// FailToWrite means that file of writer can't be created or written
+	FailToWrite
+)
+
+// Error is returned by Try functions. Code can be used to check kind of
+// error, for example
+//
+//	if err, ok := err.(*flow.Error); ok && err.Code == flow.BadPort {
+type Error struct {
+	Code    ErrorCode
+	Message string
+}
+
+func (err *Error) Error() string {
+	return err.Message
+}
+
+func newError(code ErrorCode, v ...interface{}) *Error {
+	return &Error{Code: code, Message: strings.TrimSuffix(fmt.Sprintln(v...), "\n")}
+}
+
+func errBadFunction(function string) *Error {
+	return newError(BadFunctionType, "Function argument of", function, "function doesn't match any applicable prototype")
+}
+
+// ErrorList is returned by TrySystemStart and TryReconfigure if CheckSystem
+// finds errors in flow graph. TrySystemStart also returns ErrorList with
+// errors which happened in started flow functions after system is stopped.
+type ErrorList []error
+
+func (list ErrorList) Error() string {
+	messages := make([]string, len(list))
+	for i := range list {
+		messages[i] = list[i].Error()
+	}
+	return strings.Join(messages, "\n")
+}
+
+// runtimeErrors are errors of started flow functions. Flow function which
+// can't continue reports error and drops packets instead of terminating
+// the process.
+var runtimeErrors struct {
+	sync.Mutex
+	list ErrorList
+}
+
+func reportError(err *Error) {
+	common.LogWarning(common.Initialization, err)
+	runtimeErrors.Lock()
+	runtimeErrors.list = append(runtimeErrors.list, err)
+	runtimeErrors.Unlock()
+}
+
+// takeRuntimeErrors returns reported errors and forgets them.
+func takeRuntimeErrors() error {
+	runtimeErrors.Lock()
+	defer runtimeErrors.Unlock()
+	list := runtimeErrors.list
+	runtimeErrors.list = nil
+	if len(list) == 0 {
+		return nil
+	}
+	return list
+}
+
+// must terminates the process if err is not nil. It is used by Set
+// functions which are the same as Try functions but can panic.
+func must(err error) {
+	if err != nil {
+		common.LogError(common.Initialization, err)
+	}
+}
@@ -6,17 +6,18 @@
 
 // Preparations of construction:
 // All construction should be between SystemInit and SystemStart functions.
+// Started flow graph can be changed only inside Reconfigure function.
 // User command line options should be added as flags before SystemInit option - it will
 // parse them as well as internal library options.
 
 // Packet processing graph construction:
-// YANFF library provides nine so-called Flow Functions for packet processing graph
+// YANFF library provides ten so-called Flow Functions for packet processing graph
 // construction. They operate term "flow" however it is just abstraction for connecting
-// them. Not anything beyond this. These nine flow functions are:
+// them. Not anything beyond this. These ten flow functions are:
 // Receive, Generate - for adding packets to graph
 // Send, Stop - for removing packets from graph
 // Handle - for handling packets inside graph
-// Separate, Split, Count, Merge for combining flows inside graph
+// Separate, Split, Copy, Count, Merge for combining flows inside graph
 // All this functions can be added to the graph be "Set" functions like
 // SetReceiver, SetSplitter, etc.
 
@@ -30,16 +31,26 @@
 package flow
 
 import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"io"
 	"os"
+	"path/filepath"
 	"runtime"
 	"strconv"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
+	"unsafe"
 
 	"github.com/intel-go/yanff/asm"
+	"github.com/intel-go/yanff/bpf"
 	"github.com/intel-go/yanff/common"
 	"github.com/intel-go/yanff/low"
 	"github.com/intel-go/yanff/packet"
+	"github.com/intel-go/yanff/pcap"
 	"github.com/intel-go/yanff/scheduler"
 )
 
@@ -168,6 +179,38 @@ func makePartitioner(in *low.Queue, outFirst *low.Queue, outSecond *low.Queue, N
 	return schedState.NewUnclonableFlowFunction("partitioner", ffCount, partition, par)
 }
 
+// copiesMempool is shared by all copy functions. It is created with
+// first copy function and freed with other mempools when system stops.
+var copiesMempool *low.Mempool
+
+func copyMempool() *low.Mempool {
+	if copiesMempool == nil {
+		copiesMempool = low.CreateMempool()
+	}
+	return copiesMempool
+}
+
+type copyParameters struct {
+	in      *low.Queue
+	out     *low.Queue
+	outCopy *low.Queue
+	mempool *low.Mempool
+	N       uint64
+	snaplen uint
+}
+
+func makeCopier(in *low.Queue, out *low.Queue, outCopy *low.Queue, N uint64, snaplen uint) *scheduler.FlowFunction {
+	par := new(copyParameters)
+	par.in = in
+	par.out = out
+	par.outCopy = outCopy
+	par.mempool = copyMempool()
+	par.N = N
+	par.snaplen = snaplen
+	ffCount++
+	return schedState.NewUnclonableFlowFunction("copier", ffCount, copier, par)
+}
+
 type separateParameters struct {
 	in                     *low.Queue
 	outTrue                *low.Queue
@@ -227,14 +270,16 @@ func makeHandler(in *low.Queue, out *low.Queue,
 }
 
 type writeParameters struct {
-	in       *low.Queue
-	filename string
+	in      *low.Queue
+	options WriterOptions
+	writer  *captureWriter
 }
 
-func makeWriter(filename string, in *low.Queue) *scheduler.FlowFunction {
+func makeWriter(writer *captureWriter, in *low.Queue, options WriterOptions) *scheduler.FlowFunction {
 	par := new(writeParameters)
 	par.in = in
-	par.filename = filename
+	par.options = options
+	par.writer = writer
 	ffCount++
 	return schedState.NewUnclonableFlowFunction("writer", ffCount, write, par)
 }
@@ -242,16 +287,20 @@ func makeWriter(filename string, in *low.Queue) *scheduler.FlowFunction {
 type readParameters struct {
 	out      *low.Queue
 	filename string
+	stream   io.Reader
 	mempool  *low.Mempool
 	repcount int32
+	options  ReplayOptions
 }
 
-func makeReader(filename string, out *low.Queue, repcount int32) *scheduler.FlowFunction {
+func makeReader(filename string, stream io.Reader, out *low.Queue, repcount int32, options ReplayOptions) *scheduler.FlowFunction {
 	par := new(readParameters)
 	par.out = out
 	par.filename = filename
+	par.stream = stream
 	par.mempool = low.CreateMempool()
 	par.repcount = repcount
+	par.options = options
 	ffCount++
 	return schedState.NewUnclonableFlowFunction("reader", ffCount, read, par)
 }
@@ -261,6 +310,7 @@ var sizeMultiplier uint
 var schedTime uint
 var maxPacketsToClone uint32
 var hwtxchecksum bool
+var epochRXTimestamp bool
 
 type port struct {
 	rxQueues       []bool
@@ -269,6 +319,7 @@ type port struct {
 	rxQueuesNumber uint16
 	txQueuesNumber uint16
 	port           uint8
+	started        bool
 }
 
 var schedState scheduler.Scheduler
@@ -300,6 +351,11 @@ type Config struct {
 	// modify many packets, it may chose to calculate checksums in SW
 	// and leave this flag off. Default value is false.
 	HWTXChecksum bool
+	// If true, RX timestamps of NICs are nanoseconds since epoch and
+	// capture writers write them to files. DPDK PMDs usually report
+	// device specific counter, so default value is false and packets
+	// are written with time when they were dequeued.
+	EpochRXTimestamp bool
 	// Specifies number of mbufs in mempool per port. Default value is
 	// 8191.
 	MbufNumber uint
@@ -334,6 +390,12 @@ type Config struct {
 // to place flow functions and their clones. This number can be always changed by cores-number option.
 // Function can panic during execution.
 func SystemInit(args *Config) {
+	must(TrySystemInit(args))
+}
+
+// TrySystemInit is the same as SystemInit but returns error instead of
+// terminating the process.
+func TrySystemInit(args *Config) error {
 	CPUCoresNumber := uint(runtime.GOMAXPROCS(0))
 	if args.CPUCoresNumber != 0 {
 		CPUCoresNumber = args.CPUCoresNumber
@@ -343,6 +405,7 @@ func SystemInit(args *Config) {
 	schedulerOffRemove := args.PersistentClones
 	stopDedicatedCore := args.StopOnDedicatedCore
 	hwtxchecksum = args.HWTXChecksum
+	epochRXTimestamp = args.EpochRXTimestamp
 
 	mbufNumber := uint(4 * 8191)
 	if args.MbufNumber != 0 {
@@ -391,7 +454,9 @@ func SystemInit(args *Config) {
 	// TODO all low level initialization here! Now everything is default.
 	// Init eal
 	common.LogTitle(common.Initialization, "------------***-------- Initializing DPDK --------***------------")
-	low.InitDPDK(argc, argv, burstSize, mbufNumber, mbufCacheSize)
+	if err := low.InitDPDK(argc, argv, burstSize, mbufNumber, mbufCacheSize); err != nil {
+		return newError(FailToInitDPDK, err)
+	}
 	// Init Ports
 	common.LogTitle(common.Initialization, "------------***-------- Initializing ports -------***------------")
 	createdPorts = make([]port, low.GetPortsNumber(), low.GetPortsNumber())
@@ -406,18 +471,50 @@ func SystemInit(args *Config) {
 	common.LogTitle(common.Initialization, "------------***------ Filling FlowFunctions ------***------------")
 	// Init packet processing
 	packet.SetHWTXChecksumFlag(hwtxchecksum)
+	return nil
 }
 
 // SystemStart starts system - begin packet receiving and packet sending.
 // This functions should be always called after flow graph construction.
+// Function returns after system is stopped by SystemStop.
 // Function can panic during execution.
 func SystemStart() {
+	must(TrySystemStart())
+}
+
+// TrySystemStart is the same as SystemStart but returns error instead of
+// terminating the process. If flow graph is incorrect ErrorList with all
+// errors found by CheckSystem is returned. Function returns after system
+// is stopped by SystemStop, errors of flow functions like failed writes
+// are returned as ErrorList then.
+func TrySystemStart() error {
+	return TrySystemStartContext(context.Background())
+}
+
+// SystemStartContext is the same as SystemStart but system is also stopped
+// when ctx is done.
+// Function can panic during execution.
+func SystemStartContext(ctx context.Context) {
+	must(TrySystemStartContext(ctx))
+}
+
+// TrySystemStartContext is the same as SystemStartContext but returns error
+// instead of terminating the process.
+func TrySystemStartContext(ctx context.Context) error {
 	common.LogTitle(common.Initialization, "------------***--------- Checking system ---------***------------")
-	checkSystem()
+	if errs := CheckSystem(); len(errs) != 0 {
+		return ErrorList(errs)
+	}
+	request, done := startRequest()
+	defer finishRequest(done)
 	common.LogTitle(common.Initialization, "------------***---------- Creating ports ---------***------------")
 	for i := range createdPorts {
 		if createdPorts[i].config != inactivePort {
-			low.CreatePort(createdPorts[i].port, createdPorts[i].rxQueuesNumber, createdPorts[i].txQueuesNumber, hwtxchecksum)
+			if err := low.CreatePort(createdPorts[i].port, createdPorts[i].rxQueuesNumber, createdPorts[i].txQueuesNumber, hwtxchecksum); err != nil {
+				stopPorts()
+				return newError(FailToInitPort, err)
+			}
+			createdPorts[i].started = true
 		}
 	}
 	// Timeout is needed for ports to start up. This way is used in pktgen.
@@ -427,9 +524,214 @@ func SystemStart() {
 	time.Sleep(time.Second * 2)
 
 	common.LogTitle(common.Initialization, "------------***------ Starting FlowFunctions -----***------------")
+	atomic.StoreInt32(&graphState, graphStarted)
 	schedState.SystemStart()
 	common.LogTitle(common.Initialization, "------------***--------- YANFF-GO Started --------***------------")
-	schedState.Schedule(schedTime)
+	go func() {
+		select {
+		case <-ctx.Done():
+			SystemStop()
+		case <-done:
+		}
+	}()
+	schedState.Schedule(schedTime, request)
+
+	common.LogTitle(common.Initialization, "------------***------ Stopping FlowFunctions -----***------------")
+	stopFlowFunctions()
+	common.LogTitle(common.Initialization, "------------***---------- Stopping ports ---------***------------")
+	stopPorts()
+	low.FreeMempools()
+	copiesMempool = nil
+	resetGraph()
+	common.LogTitle(common.Initialization, "------------***--------- YANFF-GO Stopped --------***------------")
+	return takeRuntimeErrors()
+}
+
+// stopRequest is closed by SystemStop and stopDone is closed when started
+// system is stopped. Both are nil if system isn't started.
+var stopLock sync.Mutex
+var stopRequest, stopDone chan struct{}
+
+func startRequest() (chan struct{}, chan struct{}) {
+	stopLock.Lock()
+	defer stopLock.Unlock()
+	stopRequest = make(chan struct{})
+	stopDone = make(chan struct{})
+	return stopRequest, stopDone
+}
+
+func finishRequest(done chan struct{}) {
+	stopLock.Lock()
+	stopRequest, stopDone = nil, nil
+	stopLock.Unlock()
+	close(done)
+}
+
+// SystemStop stops system which is started by SystemStart and waits until
+// SystemStart returns. Receivers, generators and readers are stopped first,
+// then packets which are left in rings are processed by the rest of flow
+// graph, writers flush and close their files, ports are stopped and all
+// mempools are freed. After this new flow graph can be constructed and
+// started without SystemInit. SystemStop does nothing if system isn't
+// started. It shouldn't be called from user functions of flow graph
+// because they are waited to return, "go SystemStop()" can be used there.
+func SystemStop() {
+	stopLock.Lock()
+	request, done := stopRequest, stopDone
+	if request != nil {
+		select {
+		case <-request:
+		default:
+			close(request)
+		}
+	}
+	stopLock.Unlock()
+	if done != nil {
+		<-done
+	}
+}
+
+// stopFlowFunctions stops all flow functions, so all packets which are left
+// in rings are processed.
+func stopFlowFunctions() {
+	stopInOrder(flowFunctions())
+	// Every flow function can drop packets to stop ring, so it is
+	// stopped the last.
+	schedState.StopStopRing()
+}
+
+// stopInOrder stops flow functions in order of packets movement. Flow
+// function is stopped when all functions which put packets to its input
+// rings are stopped and these rings are empty. Functions without input
+// rings are stopped first. Functions which aren't in ffs but put packets
+// to their rings should be stopped before. Writers close their files.
+func stopInOrder(ffs []*scheduler.FlowFunction) {
+	left := append([]*scheduler.FlowFunction(nil), ffs...)
+	producers := make(map[*low.Queue]int)
+	for _, ff := range left {
+		_, out := flowFunctionRings(ff)
+		for _, ring := range out {
+			producers[ring]++
+		}
+	}
+	for len(left) != 0 {
+		running := left[:0]
+		for _, ff := range left {
+			in, out := flowFunctionRings(ff)
+			if !ringsDrained(in, producers) {
+				running = append(running, ff)
+				continue
+			}
+			schedState.StopFlowFunction(ff)
+			finishFlowFunction(ff)
+			for _, ring := range out {
+				producers[ring]--
+			}
+		}
+		if len(running) == len(left) {
+			time.Sleep(time.Millisecond)
+		}
+		left = running
+	}
+}
+
+// finishFlowFunction releases resources which are kept by stopped flow
+// function between starts.
+func finishFlowFunction(ff *scheduler.FlowFunction) {
+	if wp, ok := ff.Parameters.(*writeParameters); ok && wp.writer != nil {
+		if !wp.writer.failed {
+			if err := wp.writer.close(); err != nil {
+				reportError(newError(FailToWrite, err))
+			}
+		}
+		wp.writer = nil
+	}
+}
+
+func flowFunctions() []*scheduler.FlowFunction {
+	var ffs []*scheduler.FlowFunction
+	ffs = append(ffs, schedState.UnClonable...)
+	ffs = append(ffs, schedState.Clonable...)
+	return append(ffs, schedState.Generate...)
+}
+
+func ringsDrained(rings []*low.Queue, producers map[*low.Queue]int) bool {
+	for _, ring := range rings {
+		if producers[ring] != 0 || ring.GetQueueCount() != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// flowFunctionRings returns rings from which flow function takes packets
+// and rings to which it puts packets. Stop ring isn't returned.
+func flowFunctionRings(ff *scheduler.FlowFunction) (in []*low.Queue, out []*low.Queue) {
+	in, out = flowFunctionAllRings(ff)
+	for i := 0; i < len(out); i++ {
+		if out[i] == schedState.StopRing {
+			out = append(out[:i], out[i+1:]...)
+			i--
+		}
+	}
+	return in, out
+}
+
+// flowFunctionAllRings is the same as flowFunctionRings but stop ring is
+// returned too.
+func flowFunctionAllRings(ff *scheduler.FlowFunction) (in []*low.Queue, out []*low.Queue) {
+	switch p := ff.Parameters.(type) {
+	case *receiveParameters:
+		out = []*low.Queue{p.out}
+	case *generateParameters:
+		out = []*low.Queue{p.out}
+	case *readParameters:
+		out = []*low.Queue{p.out}
+	case *sendParameters:
+		in = []*low.Queue{p.in}
+	case *writeParameters:
+		in = []*low.Queue{p.in}
+	case *partitionParameters:
+		in = []*low.Queue{p.in}
+		out = []*low.Queue{p.outFirst, p.outSecond}
+	case *copyParameters:
+		in = []*low.Queue{p.in}
+		out = []*low.Queue{p.out, p.outCopy}
+	case *separateParameters:
+		in = []*low.Queue{p.in}
+		out = []*low.Queue{p.outTrue, p.outFalse}
+	case *splitParameters:
+		in = []*low.Queue{p.in}
+		out = append(out, p.outs[:p.flowNumber]...)
+	case *handleParameters:
+		in = []*low.Queue{p.in}
+		out = []*low.Queue{p.out}
+	}
+	return in, out
+}
+
+func stopPorts() {
+	for i := range createdPorts {
+		if createdPorts[i].started {
+			low.StopPort(createdPorts[i].port)
+			createdPorts[i].started = false
+		}
+	}
+}
+
+// resetGraph removes stopped flow graph, so new graph can be constructed.
+func resetGraph() {
+	schedState.Reset()
+	openFlowsNumber = 0
+	for i := range createdPorts {
+		createdPorts[i] = port{port: uint8(i), config: inactivePort}
+	}
+	for _, p := range points {
+		p.ring = nil
+	}
+	points = nil
+	removedRings = make(map[*low.Queue]bool)
+	atomic.StoreInt32(&graphState, graphConstruction)
 }
 
 func generateRingName() string {
@@ -440,29 +742,208 @@ func generateRingName() string {
 
 // SetWriter adds write function to flow graph.
 // Gets flow which packets will be written to file and
-// target file name.
+// target file name. File is written in pcapng format if its
+// name has ".pcapng" extension and in pcap format otherwise.
+// File is compressed by gzip or zstd if name ends with ".gz" or
+// ".zst", for example dump.pcap.gz. Zstd requires package pcap/zstd
+// to be imported.
 // Function can panic during execution.
 func SetWriter(IN *Flow, filename string) {
-	checkFlow(IN)
-	write := makeWriter(filename, IN.current)
+	must(TrySetWriter(IN, filename))
+}
+
+// TrySetWriter is the same as SetWriter but returns error instead of
+// terminating the process.
+func TrySetWriter(IN *Flow, filename string) error {
+	return TrySetCaptureWriter(IN, filename, WriterOptions{})
+}
+
+// WriterOptions describes how SetCaptureWriter writes packets to files.
+// Zero values mean no limits.
+type WriterOptions struct {
+	// Snaplen is maximum number of bytes of each packet which are written.
+	Snaplen uint
+	// Current file is closed and the next one is started when any of
+	// rotation limits is reached. Files are named by adding their number
+	// before extension of filename, for example dump-1.pcap, dump-2.pcap.
+	RotateSize     uint64        // Size of file in bytes
+	RotateInterval time.Duration // Time since file was started
+	RotateCount    uint64        // Number of packets in file
+	// MaxFiles is number of the latest files which are kept when files
+	// are rotated. Older files are removed.
+	MaxFiles uint
+	// BatchSize is maximum number of packets which are dequeued and
+	// written to file at once. Zero means burst size of the system.
+	BatchSize uint
+	// Filter selects packets which are written, other packets are
+	// dropped. It can be made by bpf.Compile. Nil means all packets.
+	Filter *bpf.Program
+}
+
+// SetCaptureWriter is the same as SetWriter but filters packets and limits
+// size of packets and files according to options, so it can be used for
+// long running capture. Packets are written with time when they were
+// dequeued. If Config.EpochRXTimestamp is set, RX timestamp of NIC is
+// written instead for packets which have it. Size of compressed file is
+// counted after compression. The first file is created by SetCaptureWriter.
+// If file can't be created or written later, writer is closed and drops
+// packets, error is returned by TrySystemStart after system is stopped.
+// Function can panic during execution.
+func SetCaptureWriter(IN *Flow, filename string, options WriterOptions) {
+	must(TrySetCaptureWriter(IN, filename, options))
+}
+
+// TrySetCaptureWriter is the same as SetCaptureWriter but returns error
+// instead of terminating the process.
+func TrySetCaptureWriter(IN *Flow, filename string, options WriterOptions) error {
+	return setWriter(IN, filename, nil, options)
+}
+
+// SetStreamWriter is the same as SetCaptureWriter but writes packets to
+// pcap stream, for example to pipe or socket. Packets are converted to
+// link type of stream by pcap.FromEthernet, packets which can't be
+// converted are dropped. Rotation options are ignored. Stream is flushed
+// after each batch of packets and is never closed by flow.
+// Function can panic during execution.
+func SetStreamWriter(IN *Flow, w *pcap.Writer, options WriterOptions) {
+	must(TrySetStreamWriter(IN, w, options))
+}
+
+// TrySetStreamWriter is the same as SetStreamWriter but returns error
+// instead of terminating the process.
+func TrySetStreamWriter(IN *Flow, w *pcap.Writer, options WriterOptions) error {
+	if w == nil {
+		return newError(BadArgument, "Stream of SetStreamWriter function is nil")
+	}
+	options.RotateSize, options.RotateInterval, options.RotateCount, options.MaxFiles = 0, 0, 0, 0
+	return setWriter(IN, "", w, options)
+}
+
+func setWriter(IN *Flow, filename string, stream *pcap.Writer, options WriterOptions) error {
+	if err := checkFlow(IN); err != nil {
+		return err
+	}
+	if options.BatchSize == 0 {
+		options.BatchSize = burstSize
+	}
+	// File is created here, so errors are returned to caller
+	w := newCaptureWriter(filename, stream, options)
+	if err := w.open(); err != nil {
+		return newError(FailToWrite, err)
+	}
+	write := makeWriter(w, IN.current, options)
 	schedState.UnClonable = append(schedState.UnClonable, write)
 	IN.current = nil
 	openFlowsNumber--
+	return nil
 }
 
 // SetReader adds read function to flow graph.
-// Gets name of pcap formatted file and number of reads. If repcount = -1,
-// file is read infinitely in circle.
+// Gets name of pcap or pcapng formatted file and number of reads. Format
+// and gzip or zstd compression are detected automatically, zstd requires
+// package pcap/zstd to be imported. Packets of raw IP and Linux cooked
+// capture link types are converted to Ethernet frames.
+// If repcount = -1, file is read infinitely in circle.
+// Packets are read as fast as possible, use SetReplayReader to pace them.
 // Returns new opened flow with read packets.
 // Function can panic during execution.
 func SetReader(filename string, repcount int32) (OUT *Flow) {
+	OUT, err := TrySetReader(filename, repcount)
+	must(err)
+	return OUT
+}
+
+// TrySetReader is the same as SetReader but returns error instead of
+// terminating the process. Error is returned if file can't be opened.
+func TrySetReader(filename string, repcount int32) (OUT *Flow, err error) {
+	return TrySetReplayReader(filename, repcount, ReplayOptions{})
+}
+
+// ReplayMode defines how SetReplayReader paces packets read from file.
+type ReplayMode int
+
+// Values of ReplayMode
+const (
+	// ReplayAsFast reads packets as fast as output ring accepts them
+	ReplayAsFast ReplayMode = iota
+	// ReplayOriginal keeps inter-packet timing of file divided by Speed
+	ReplayOriginal
+	// ReplayPPS reads Rate packets per second
+	ReplayPPS
+	// ReplayBPS reads Rate bits of packet data per second
+	ReplayBPS
+)
+
+// ReplayOptions describes pacing of packets read by SetReplayReader.
+type ReplayOptions struct {
+	Mode ReplayMode
+	// Speed multiplier for ReplayOriginal mode. For example 2 replays
+	// file twice faster. Zero means original speed.
+	Speed float64
+	// Rate in packets or bits per second for ReplayPPS and ReplayBPS modes.
+	// Bits are counted over Ethernet frame without preamble and CRC.
+	Rate uint64
+}
+
+// SetReplayReader is the same as SetReader but paces packets according to
+// options. Timestamps of packets are taken from pcap or pcapng records, so
+// incidents can be reproduced with original timing. Each repetition of file
+// starts immediately after previous one.
+// Function can panic during execution.
+func SetReplayReader(filename string, repcount int32, options ReplayOptions) (OUT *Flow) {
+	OUT, err := TrySetReplayReader(filename, repcount, options)
+	must(err)
+	return OUT
+}
+
+// TrySetReplayReader is the same as SetReplayReader but returns error
+// instead of terminating the process.
+func TrySetReplayReader(filename string, repcount int32, options ReplayOptions) (OUT *Flow, err error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, newError(BadArgument, err)
+	}
+	f.Close()
+	return setReader(filename, nil, repcount, options)
+}
+
+// SetStreamReader is the same as SetReplayReader but reads pcap or pcapng
+// stream once, for example from pipe or socket. Stream can be compressed
+// by gzip or zstd, see SetReader. Stream is not closed by flow except
+// when system is stopped while reader waits for data: read deadline of
+// stream is set if it has SetReadDeadline method like net.Conn and
+// os.File, otherwise stream is closed if it is io.Closer. SystemStop waits
+// for the next packet of other streams.
+// Function can panic during execution.
+func SetStreamReader(r io.Reader, options ReplayOptions) (OUT *Flow) {
+	OUT, err := TrySetStreamReader(r, options)
+	must(err)
+	return OUT
+}
+
+// TrySetStreamReader is the same as SetStreamReader but returns error
+// instead of terminating the process.
+func TrySetStreamReader(r io.Reader, options ReplayOptions) (OUT *Flow, err error) {
+	if r == nil {
+		return nil, newError(BadArgument, "Stream of SetStreamReader function is nil")
+	}
+	return setReader("", r, 1, options)
+}
+
+func setReader(filename string, stream io.Reader, repcount int32, options ReplayOptions) (OUT *Flow, err error) {
+	if err := checkGraphChange(); err != nil {
+		return nil, err
+	}
+	if options.Speed < 0 || ((options.Mode == ReplayPPS || options.Mode == ReplayBPS) && options.Rate == 0) {
+		return nil, newError(BadArgument, "Incorrect replay options for", filename)
+	}
 	ring := low.CreateQueue(generateRingName(), burstSize*sizeMultiplier)
-	read := makeReader(filename, ring, repcount)
+	read := makeReader(filename, stream, ring, repcount, options)
 	schedState.UnClonable = append(schedState.UnClonable, read)
 	OUT = new(Flow)
 	OUT.current = ring
 	openFlowsNumber++
-	return OUT
+	return OUT, nil
 }
 
 // SetReceiver adds receive function to flow graph.
@@ -471,11 +952,19 @@ func SetReader(filename string, repcount int32) (OUT *Flow) {
 // Returns new opened flow with received packets
 // Function can panic during execution.
 func SetReceiver(port uint8) (OUT *Flow) {
-	if port >= uint8(len(createdPorts)) {
-		common.LogError(common.Initialization, "Requested receive port exceeds number of ports which can be used by DPDK (bind to DPDK).")
+	OUT, err := TrySetReceiver(port)
+	must(err)
+	return OUT
+}
+
+// TrySetReceiver is the same as SetReceiver but returns error instead of
+// terminating the process.
+func TrySetReceiver(port uint8) (OUT *Flow, err error) {
+	if err := checkGraphChange(); err != nil {
+		return nil, err
 	}
-	if createdPorts[port].config == manualPort {
-		common.LogError(common.Initialization, "Requested receive port was previously configured as manual port. It can't be used as auto port.")
+	if err := checkPort(port, "receive"); err != nil {
+		return nil, err
 	}
 	createdPorts[port].config = autoPort
 	createdPorts[port].rxQueues = append(createdPorts[port].rxQueues, true)
@@ -486,7 +975,7 @@ func SetReceiver(port uint8) (OUT *Flow) {
 	OUT.current = ring
 	openFlowsNumber++
 	createdPorts[port].rxQueuesNumber++
-	return OUT
+	return OUT, nil
 }
 
 // SetGenerator adds generate function to flow graph.
@@ -497,6 +986,26 @@ func SetReceiver(port uint8) (OUT *Flow) {
 // tries to achieve this speed by cloning.
 // Function can panic during execution.
 func SetGenerator(generateFunction interface{}, targetSpeed uint64, context UserContext) (OUT *Flow) {
+	OUT, err := TrySetGenerator(generateFunction, targetSpeed, context)
+	must(err)
+	return OUT
+}
+
+// TrySetGenerator is the same as SetGenerator but returns error instead of
+// terminating the process.
+func TrySetGenerator(generateFunction interface{}, targetSpeed uint64, context UserContext) (OUT *Flow, err error) {
+	if err := checkGraphChange(); err != nil {
+		return nil, err
+	}
+	switch generateFunction.(type) {
+	case func(*packet.Packet, UserContext):
+	case func([]*packet.Packet, uint, UserContext):
+		if targetSpeed == 0 {
+			return nil, errBadFunction("SetGenerator")
+		}
+	default:
+		return nil, errBadFunction("SetGenerator")
+	}
 	ring := low.CreateQueue(generateRingName(), burstSize*sizeMultiplier)
 	var generate *scheduler.FlowFunction
 	if targetSpeed > 0 {
@@ -504,22 +1013,18 @@ func SetGenerator(generateFunction interface{}, targetSpeed uint64, context User
 			generate = makeGeneratorPerf(ring, GenerateFunction(f), nil, targetSpeed, context)
 		} else if f, t := generateFunction.(func([]*packet.Packet, uint, UserContext)); t {
 			generate = makeGeneratorPerf(ring, nil, VectorGenerateFunction(f), targetSpeed, context)
-		} else {
-			common.LogError(common.Initialization, "Function argument of SetGenerator function doesn't match any applicable prototype")
 		}
 		schedState.Generate = append(schedState.Generate, generate)
 	} else {
 		if f, t := generateFunction.(func(*packet.Packet, UserContext)); t {
 			generate = makeGeneratorOne(ring, GenerateFunction(f))
-		} else {
-			common.LogError(common.Initialization, "Function argument of SetGenerator function doesn't match any applicable prototype")
 		}
 		schedState.UnClonable = append(schedState.UnClonable, generate)
 	}
 	OUT = new(Flow)
 	OUT.current = ring
 	openFlowsNumber++
-	return OUT
+	return OUT, nil
 }
 
 // SetSender adds send function to flow graph.
@@ -527,12 +1032,17 @@ func SetGenerator(generateFunction interface{}, targetSpeed uint64, context User
 // Send queue will be added to port automatically.
 // Function can panic during execution.
 func SetSender(IN *Flow, port uint8) {
-	checkFlow(IN)
-	if port >= uint8(len(createdPorts)) {
-		common.LogError(common.Initialization, "Requested send port exceeds number of ports which can be used by DPDK (bind to DPDK).")
+	must(TrySetSender(IN, port))
+}
+
+// TrySetSender is the same as SetSender but returns error instead of
+// terminating the process.
+func TrySetSender(IN *Flow, port uint8) error {
+	if err := checkFlow(IN); err != nil {
+		return err
 	}
-	if createdPorts[port].config == manualPort {
-		common.LogError(common.Initialization, "Requested send port was previously configured as manual port. It can't be used like auto port.")
+	if err := checkPort(port, "send"); err != nil {
+		return err
 	}
 	createdPorts[port].config = autoPort
 	createdPorts[port].txQueues = append(createdPorts[port].txQueues, true)
@@ -541,6 +1051,7 @@ func SetSender(IN *Flow, port uint8) {
 	IN.current = nil
 	openFlowsNumber--
 	createdPorts[port].txQueuesNumber++
+	return nil
 }
 
 // SetPartitioner adds partition function to flow graph.
@@ -549,7 +1060,17 @@ func SetSender(IN *Flow, port uint8) {
 // It is advised not to use this function less then (75, 75) for performance reasons.
 // Function can panic during execution.
 func SetPartitioner(IN *Flow, N uint64, M uint64) (OUT *Flow) {
-	checkFlow(IN)
+	OUT, err := TrySetPartitioner(IN, N, M)
+	must(err)
+	return OUT
+}
+
+// TrySetPartitioner is the same as SetPartitioner but returns error instead
+// of terminating the process.
+func TrySetPartitioner(IN *Flow, N uint64, M uint64) (OUT *Flow, err error) {
+	if err := checkFlow(IN); err != nil {
+		return nil, err
+	}
 	OUT = new(Flow)
 	if N == 0 || M == 0 {
 		common.LogWarning(common.Initialization, "One of SetPartitioner function's arguments is zero.")
@@ -564,16 +1085,82 @@ func SetPartitioner(IN *Flow, N uint64, M uint64) (OUT *Flow) {
 	schedState.UnClonable = append(schedState.UnClonable, partition)
 	IN.current = ringFirst
 	OUT.current = ringSecond
+	return OUT, nil
+}
+
+// SetCopier adds copy function to flow graph.
+// Gets input flow. Returns new opened flow.
+// Each packet from input flow remains in input flow and its copy
+// is sent to new flow. Copies are allocated from separate mempool which
+// is shared by all copy functions.
+// Function can panic during execution.
+func SetCopier(IN *Flow) (OUT *Flow) {
+	OUT, err := TrySetCopier(IN)
+	must(err)
+	return OUT
+}
+
+// TrySetCopier is the same as SetCopier but returns error instead of
+// terminating the process.
+func TrySetCopier(IN *Flow) (OUT *Flow, err error) {
+	return TrySetSampledCopier(IN, 1, 0)
+}
+
+// SetSampledCopier adds copy function to flow graph.
+// Gets input flow, N and snaplen constants. Returns new opened flow.
+// Each packet from input flow remains in input flow, copy of each N-th
+// packet is sent to new flow. If snaplen is not zero copies are truncated
+// to snaplen bytes. Packets are not copied if mempool for copies is empty,
+// so copying doesn't slow down input flow.
+// Function can panic during execution.
+func SetSampledCopier(IN *Flow, N uint64, snaplen uint) (OUT *Flow) {
+	OUT, err := TrySetSampledCopier(IN, N, snaplen)
+	must(err)
 	return OUT
 }
 
+// TrySetSampledCopier is the same as SetSampledCopier but returns error
+// instead of terminating the process.
+func TrySetSampledCopier(IN *Flow, N uint64, snaplen uint) (OUT *Flow, err error) {
+	if err := checkFlow(IN); err != nil {
+		return nil, err
+	}
+	if N == 0 {
+		return nil, newError(BadArgument, "N argument of SetSampledCopier function is zero.")
+	}
+	OUT = new(Flow)
+	ring := low.CreateQueue(generateRingName(), burstSize*sizeMultiplier)
+	ringCopy := low.CreateQueue(generateRingName(), burstSize*sizeMultiplier)
+	openFlowsNumber++
+	copier := makeCopier(IN.current, ring, ringCopy, N, snaplen)
+	schedState.UnClonable = append(schedState.UnClonable, copier)
+	IN.current = ring
+	OUT.current = ringCopy
+	return OUT, nil
+}
+
 // SetSeparator adds separate function to flow graph.
 // Gets flow and user defined separate function. Returns new opened flow.
 // Each packet from input flow will be remain inside input packet if
 // user defined function returns "true" and is sent to new flow otherwise.
 // Function can panic during execution.
 func SetSeparator(IN *Flow, separateFunction interface{}, context UserContext) (OUT *Flow) {
-	checkFlow(IN)
+	OUT, err := TrySetSeparator(IN, separateFunction, context)
+	must(err)
+	return OUT
+}
+
+// TrySetSeparator is the same as SetSeparator but returns error instead of
+// terminating the process.
+func TrySetSeparator(IN *Flow, separateFunction interface{}, context UserContext) (OUT *Flow, err error) {
+	if err := checkFlow(IN); err != nil {
+		return nil, err
+	}
+	switch separateFunction.(type) {
+	case func(*packet.Packet, UserContext) bool, func([]*packet.Packet, []bool, uint, UserContext):
+	default:
+		return nil, errBadFunction("SetSeparator")
+	}
 	OUT = new(Flow)
 	ringTrue := low.CreateQueue(generateRingName(), burstSize*sizeMultiplier)
 	ringFalse := low.CreateQueue(generateRingName(), burstSize*sizeMultiplier)
@@ -583,13 +1170,11 @@ func SetSeparator(IN *Flow, separateFunction interface{}, context UserContext) (
 		separate = makeSeparator(IN.current, ringTrue, ringFalse, SeparateFunction(f), nil, "separator", context)
 	} else if f, t := separateFunction.(func([]*packet.Packet, []bool, uint, UserContext)); t {
 		separate = makeSeparator(IN.current, ringTrue, ringFalse, nil, VectorSeparateFunction(f), "vector separator", context)
-	} else {
-		common.LogError(common.Initialization, "Function argument of SetSeparator function doesn't match any applicable prototype")
 	}
 	schedState.Clonable = append(schedState.Clonable, separate)
 	IN.current = ringTrue
 	OUT.current = ringFalse
-	return OUT
+	return OUT, nil
 }
 
 // SetSplitter adds split function to flow graph.
@@ -599,7 +1184,20 @@ func SetSeparator(IN *Flow, separateFunction interface{}, context UserContext) (
 // user defined function output for this packet.
 // Function can panic during execution.
 func SetSplitter(IN *Flow, splitFunction SplitFunction, flowNumber uint, context UserContext) (OutArray [](*Flow)) {
-	checkFlow(IN)
+	OutArray, err := TrySetSplitter(IN, splitFunction, flowNumber, context)
+	must(err)
+	return OutArray
+}
+
+// TrySetSplitter is the same as SetSplitter but returns error instead of
+// terminating the process.
+func TrySetSplitter(IN *Flow, splitFunction SplitFunction, flowNumber uint, context UserContext) (OutArray [](*Flow), err error) {
+	if err := checkFlow(IN); err != nil {
+		return nil, err
+	}
+	if splitFunction == nil || flowNumber == 0 {
+		return nil, newError(BadArgument, "Split function or number of flows of SetSplitter function is zero.")
+	}
 	OutArray = make([](*Flow), flowNumber, flowNumber)
 	rings := make([](*low.Queue), flowNumber, flowNumber)
 	for i := range OutArray {
@@ -612,17 +1210,26 @@ func SetSplitter(IN *Flow, splitFunction SplitFunction, flowNumber uint, context
 	schedState.Clonable = append(schedState.Clonable, split)
 	IN.current = nil
 	openFlowsNumber--
-	return OutArray
+	return OutArray, nil
 }
 
 // SetStopper adds stop function to flow graph.
 // Gets flow which will be closed and all packets from each will be dropped.
 // Function can panic during execution.
 func SetStopper(IN *Flow) {
-	checkFlow(IN)
+	must(TrySetStopper(IN))
+}
+
+// TrySetStopper is the same as SetStopper but returns error instead of
+// terminating the process.
+func TrySetStopper(IN *Flow) error {
+	if err := checkFlow(IN); err != nil {
+		return err
+	}
 	merge(IN.current, schedState.StopRing)
 	IN.current = nil
 	openFlowsNumber--
+	return nil
 }
 
 // SetHandler adds handle function to flow graph.
@@ -633,32 +1240,71 @@ func SetStopper(IN *Flow) {
 // If user function returns false after handling a packet it is dropped automatically.
 // Function can panic during execution.
 func SetHandler(IN *Flow, handleFunction interface{}, context UserContext) {
-	checkFlow(IN)
+	must(TrySetHandler(IN, handleFunction, context))
+}
+
+// TrySetHandler is the same as SetHandler but returns error instead of
+// terminating the process.
+func TrySetHandler(IN *Flow, handleFunction interface{}, context UserContext) error {
+	if err := checkFlow(IN); err != nil {
+		return err
+	}
+	switch handleFunction.(type) {
+	case func(*packet.Packet, UserContext), func([]*packet.Packet, uint, UserContext),
+		func(*packet.Packet, UserContext) bool, func([]*packet.Packet, []bool, uint, UserContext):
+	default:
+		return errBadFunction("SetHandler")
+	}
 	ring := low.CreateQueue(generateRingName(), burstSize*sizeMultiplier)
-	var handle *scheduler.FlowFunction
+	handle := makeHandleFunction(IN.current, ring, handleFunction, context)
+	schedState.Clonable = append(schedState.Clonable, handle)
+	IN.current = ring
+	return nil
+}
+
+// makeHandleFunction makes handler or separator which drops packets
+// according to type of handleFunction, which should be already checked.
+func makeHandleFunction(in *low.Queue, out *low.Queue, handleFunction interface{}, context UserContext) *scheduler.FlowFunction {
 	if f, t := handleFunction.(func(*packet.Packet, UserContext)); t {
-		handle = makeHandler(IN.current, ring, HandleFunction(f), nil, "handler", context)
+		return makeHandler(in, out, HandleFunction(f), nil, "handler", context)
 	} else if f, t := handleFunction.(func([]*packet.Packet, uint, UserContext)); t {
-		handle = makeHandler(IN.current, ring, nil, VectorHandleFunction(f), "vector handler", context)
+		return makeHandler(in, out, nil, VectorHandleFunction(f), "vector handler", context)
 	} else if f, t := handleFunction.(func(*packet.Packet, UserContext) bool); t {
-		handle = makeSeparator(IN.current, ring, schedState.StopRing, SeparateFunction(f), nil, "handler", context)
-	} else if f, t := handleFunction.(func([]*packet.Packet, []bool, uint, UserContext)); t {
-		handle = makeSeparator(IN.current, ring, schedState.StopRing, nil, VectorSeparateFunction(f), "vector handler", context)
-	} else {
-		common.LogError(common.Initialization, "Function argument of SetHandler function doesn't match any applicable prototype")
+		return makeSeparator(in, out, schedState.StopRing, SeparateFunction(f), nil, "handler", context)
 	}
-	schedState.Clonable = append(schedState.Clonable, handle)
-	IN.current = ring
+	f := handleFunction.(func([]*packet.Packet, []bool, uint, UserContext))
+	return makeSeparator(in, out, schedState.StopRing, nil, VectorSeparateFunction(f), "vector handler", context)
 }
 
 // SetMerger adds merge function to flow graph.
 // Gets any number of flows. Returns new opened flow.
 // All input flows will be closed. All packets from all these flows will be sent to new flow.
 // This function isn't use any cores. It changes output flows of other functions at initialization stage.
+// Function can panic during execution.
 func SetMerger(InArray ...*Flow) (OUT *Flow) {
+	OUT, err := TrySetMerger(InArray...)
+	must(err)
+	return OUT
+}
+
+// TrySetMerger is the same as SetMerger but returns error instead of
+// terminating the process.
+func TrySetMerger(InArray ...*Flow) (OUT *Flow, err error) {
+	if err := checkGraphChange(); err != nil {
+		return nil, err
+	}
+	for i := range InArray {
+		if err := checkFlow(InArray[i]); err != nil {
+			return nil, err
+		}
+		for j := 0; j < i; j++ {
+			if InArray[j] == InArray[i] {
+				return nil, errClosedFlow()
+			}
+		}
+	}
 	ring := low.CreateQueue(generateRingName(), burstSize*sizeMultiplier)
 	for i := range InArray {
-		checkFlow(InArray[i])
 		merge(InArray[i].current, ring)
 		InArray[i].current = nil
 		openFlowsNumber--
@@ -666,7 +1312,7 @@ func SetMerger(InArray ...*Flow) (OUT *Flow) {
 	OUT = new(Flow)
 	OUT.current = ring
 	openFlowsNumber++
-	return OUT
+	return OUT, nil
 }
 
 // GetPortMACAddress returns default MAC address of an Ethernet port.
@@ -674,12 +1320,12 @@ func GetPortMACAddress(port uint8) [common.EtherAddrLen]uint8 {
 	return low.GetPortMACAddress(port)
 }
 
-func receive(parameters interface{}, coreID uint8) {
+func receive(parameters interface{}, stop *int32, coreID uint8) {
 	srp := parameters.(*receiveParameters)
-	low.Receive(srp.port, srp.queue, srp.out, coreID)
+	low.Receive(srp.port, srp.queue, srp.out, stop, coreID)
 }
 
-func generateOne(parameters interface{}, core uint8) {
+func generateOne(parameters interface{}, stop *int32, core uint8) {
 	gp := parameters.(*generateParameters)
 	OUT := gp.out
 	generateFunction := gp.generateFunction
@@ -689,7 +1335,7 @@ func generateOne(parameters interface{}, core uint8) {
 	buf := make([]uintptr, 1)
 	var tempPacket *packet.Packet
 
-	for {
+	for atomic.LoadInt32(stop) == 0 {
 		low.AllocateMbufs(buf, mempool)
 		tempPacket = packet.ExtractPacket(buf[0])
 		generateFunction(tempPacket, nil)
@@ -723,7 +1369,11 @@ func generatePerf(parameters interface{}, stopper chan int, report chan uint64,
 				return
 			}
 		case <-tick:
-			report <- currentSpeed
+			// Report isn't read by scheduler while system is stopped
+			select {
+			case report <- currentSpeed:
+			default:
+			}
 			currentSpeed = 0
 		default:
 			low.AllocateMbufs(bufs, mempool)
@@ -751,61 +1401,62 @@ func generatePerf(parameters interface{}, stopper chan int, report chan uint64,
 	}
 }
 
-func send(parameters interface{}, coreID uint8) {
+func send(parameters interface{}, stop *int32, coreID uint8) {
 	srp := parameters.(*sendParameters)
-	low.Send(srp.port, srp.queue, srp.in, coreID)
+	low.Send(srp.port, srp.queue, srp.in, stop, coreID)
 }
 
 func merge(from *low.Queue, to *low.Queue) {
 	// We should change out rings in all flow functions which we added before
 	// and change them to one "after merge" ring.
-	// We don't proceed stop and send functions here because they don't have
-	// out rings. Also we don't proceed merge function because they are added
-	// strictly one after another. The next merge will change previous "after merge"
-	// ring automatically.
-	for i := range schedState.UnClonable {
-		switch schedState.UnClonable[i].Parameters.(type) {
-		case *receiveParameters:
-			if schedState.UnClonable[i].Parameters.(*receiveParameters).out == from {
-				schedState.UnClonable[i].Parameters.(*receiveParameters).out = to
-			}
-		case *partitionParameters:
-			if schedState.UnClonable[i].Parameters.(*partitionParameters).outFirst == from {
-				schedState.UnClonable[i].Parameters.(*partitionParameters).outFirst = to
-			}
-			if schedState.UnClonable[i].Parameters.(*partitionParameters).outSecond == from {
-				schedState.UnClonable[i].Parameters.(*partitionParameters).outSecond = to
-			}
-		case *generateParameters:
-			if schedState.UnClonable[i].Parameters.(*generateParameters).out == from {
-				schedState.UnClonable[i].Parameters.(*generateParameters).out = to
-			}
+	// Stop and send functions don't have out rings, so they aren't changed.
+	// Merge functions are added strictly one after another. The next merge
+	// will change previous "after merge" ring automatically.
+	for _, ff := range flowFunctions() {
+		replaceRing(ff, from, to)
+	}
+	movePoints(from, to)
+}
+
+// replaceRing changes ring from to ring to in all input and output rings
+// of flow function. Flow function should be stopped.
+func replaceRing(ff *scheduler.FlowFunction, from *low.Queue, to *low.Queue) {
+	replace := func(ring **low.Queue) {
+		if *ring == from {
+			*ring = to
 		}
 	}
-	for i := range schedState.Clonable {
-		switch schedState.Clonable[i].Parameters.(type) {
-		case *splitParameters:
-			for j := uint(0); j < schedState.Clonable[i].Parameters.(*splitParameters).flowNumber; j++ {
-				if schedState.Clonable[i].Parameters.(*splitParameters).outs[j] == from {
-					schedState.Clonable[i].Parameters.(*splitParameters).outs[j] = to
-				}
-			}
-		case *separateParameters:
-			if schedState.Clonable[i].Parameters.(*separateParameters).outTrue == from {
-				schedState.Clonable[i].Parameters.(*separateParameters).outTrue = to
-			}
-			if schedState.Clonable[i].Parameters.(*separateParameters).outFalse == from {
-				schedState.Clonable[i].Parameters.(*separateParameters).outFalse = to
-			}
-		case *handleParameters:
-			if schedState.Clonable[i].Parameters.(*handleParameters).out == from {
-				schedState.Clonable[i].Parameters.(*handleParameters).out = to
-			}
-		case *generateParameters:
-			if schedState.Clonable[i].Parameters.(*generateParameters).out == from {
-				schedState.Clonable[i].Parameters.(*generateParameters).out = to
-			}
+	switch p := ff.Parameters.(type) {
+	case *receiveParameters:
+		replace(&p.out)
+	case *generateParameters:
+		replace(&p.out)
+	case *readParameters:
+		replace(&p.out)
+	case *sendParameters:
+		replace(&p.in)
+	case *writeParameters:
+		replace(&p.in)
+	case *partitionParameters:
+		replace(&p.in)
+		replace(&p.outFirst)
+		replace(&p.outSecond)
+	case *copyParameters:
+		replace(&p.in)
+		replace(&p.out)
+		replace(&p.outCopy)
+	case *separateParameters:
+		replace(&p.in)
+		replace(&p.outTrue)
+		replace(&p.outFalse)
+	case *splitParameters:
+		replace(&p.in)
+		for i := range p.outs {
+			replace(&p.outs[i])
 		}
+	case *handleParameters:
+		replace(&p.in)
+		replace(&p.out)
 	}
 }
 
@@ -853,7 +1504,11 @@ func separate(parameters interface{}, stopper chan int, report chan uint64, cont
 				return
 			}
 		case <-tick:
-			report <- currentSpeed
+			// Report isn't read by scheduler while system is stopped
+			select {
+			case report <- currentSpeed:
+			default:
+			}
 			currentSpeed = 0
 		default:
 			n := IN.DequeueBurst(bufsIn, burstSize)
@@ -910,7 +1565,7 @@ func separate(parameters interface{}, stopper chan int, report chan uint64, cont
 	}
 }
 
-func partition(parameters interface{}, core uint8) {
+func partition(parameters interface{}, stop *int32, core uint8) {
 	cp := parameters.(*partitionParameters)
 	IN := cp.in
 	OUTFirst := cp.outFirst
@@ -926,7 +1581,7 @@ func partition(parameters interface{}, core uint8) {
 	var countOfPackets uint
 	currentPacketNumber := uint64(0)
 	sw := true
-	for {
+	for atomic.LoadInt32(stop) == 0 {
 		n := IN.DequeueBurst(bufsIn, burstSize)
 		if n == 0 {
 			continue
@@ -959,6 +1614,45 @@ func partition(parameters interface{}, core uint8) {
 	}
 }
 
+func copier(parameters interface{}, stop *int32, core uint8) {
+	cp := parameters.(*copyParameters)
+	IN := cp.in
+	OUT := cp.out
+	OUTCopy := cp.outCopy
+	mempool := cp.mempool
+	N := cp.N
+	snaplen := cp.snaplen
+
+	low.SetAffinity(core)
+
+	bufs := make([]uintptr, burstSize)
+	bufsCopy := make([]uintptr, burstSize)
+	var countOfCopies uint
+	currentPacketNumber := uint64(0)
+	for atomic.LoadInt32(stop) == 0 {
+		n := IN.DequeueBurst(bufs, burstSize)
+		if n == 0 {
+			continue
+		}
+		countOfCopies = 0
+		for i := uint(0); i < n; i++ {
+			currentPacketNumber++
+			if currentPacketNumber != N {
+				continue
+			}
+			currentPacketNumber = 0
+			if clone, ok := packet.ExtractPacket(bufs[i]).Clone(mempool, snaplen); ok {
+				bufsCopy[countOfCopies] = uintptr(unsafe.Pointer(clone.CMbuf))
+				countOfCopies++
+			}
+		}
+		safeEnqueue(OUT, bufs, n)
+		if countOfCopies != 0 {
+			safeEnqueue(OUTCopy, bufsCopy, countOfCopies)
+		}
+	}
+}
+
 func splitCheck(parameters interface{}, debug bool) bool {
 	sp := parameters.(*splitParameters)
 	IN := sp.in
@@ -1002,7 +1696,11 @@ func split(parameters interface{}, stopper chan int, report chan uint64, context
 				return
 			}
 		case <-tick:
-			report <- currentSpeed
+			// Report isn't read by scheduler while system is stopped
+			select {
+			case report <- currentSpeed:
+			default:
+			}
 			currentSpeed = 0
 		default:
 			n := IN.DequeueBurst(InputMbufs, burstSize)
@@ -1076,7 +1774,11 @@ func handle(parameters interface{}, stopper chan int, report chan uint64, contex
 				return
 			}
 		case <-tick:
-			report <- currentSpeed
+			// Report isn't read by scheduler while system is stopped
+			select {
+			case report <- currentSpeed:
+			default:
+			}
 			currentSpeed = 0
 		default:
 			n := IN.DequeueBurst(bufs, burstSize)
@@ -1106,68 +1808,466 @@ func handle(parameters interface{}, stopper chan int, report chan uint64, contex
 	}
 }
 
-func write(parameters interface{}, coreID uint8) {
+// captureWriter writes packets to pcap or pcapng file which is rotated
+// according to WriterOptions.
+type captureWriter struct {
+	filename    string
+	options     WriterOptions
+	pcapng      bool
+	compression pcap.Compression
+	stream      bool     // Packets are written to pcap stream given by user
+	index       int      // Number of current file if files are rotated
+	files       []string // Names of kept files
+
+	f        *os.File
+	buf      *bufio.Writer
+	comp     io.WriteCloser
+	writer   *pcap.Writer
+	ngWriter *pcap.NgWriter
+	started  time.Time
+	size     uint64 // Size of current file in bytes
+	count    uint64 // Number of packets in current file
+	// failed means that writing failed, writer is closed and packets
+	// are dropped.
+	failed bool
+}
+
+func newCaptureWriter(filename string, stream *pcap.Writer, options WriterOptions) *captureWriter {
+	w := &captureWriter{
+		filename:    filename,
+		options:     options,
+		compression: pcap.CompressionFromName(filename),
+		stream:      stream != nil,
+		writer:      stream,
+	}
+	w.pcapng = strings.HasSuffix(strings.TrimSuffix(filename, w.compression.Extension()), ".pcapng")
+	return w
+}
+
+func (w *captureWriter) rotated() bool {
+	return w.options.RotateSize != 0 || w.options.RotateInterval != 0 || w.options.RotateCount != 0
+}
+
+// Write counts bytes which are written to current file.
+func (w *captureWriter) Write(data []byte) (int, error) {
+	w.size += uint64(len(data))
+	return w.buf.Write(data)
+}
+
+func (w *captureWriter) open() error {
+	if w.stream {
+		return nil
+	}
+	name := w.filename
+	if w.rotated() {
+		w.index++
+		compExt := w.compression.Extension()
+		name = strings.TrimSuffix(name, compExt)
+		ext := filepath.Ext(name)
+		name = strings.TrimSuffix(name, ext) + "-" + strconv.Itoa(w.index) + ext + compExt
+	}
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	w.buf = bufio.NewWriter(f)
+	w.started = time.Now()
+	w.size = 0
+	w.count = 0
+	w.comp, err = pcap.NewCompressor(w, w.compression)
+	if err == nil && w.pcapng {
+		w.ngWriter, err = pcap.NewNgWriter(w.comp)
+		if err == nil {
+			_, err = w.ngWriter.AddInterface(pcap.NgInterface{
+				LinkType: pcap.LinkTypeEthernet,
+				SnapLen:  uint32(w.options.Snaplen),
+				TsResol:  9,
+			})
+		}
+	} else if err == nil {
+		w.writer, err = pcap.NewWriter(w.comp, pcap.WriterOptions{SnapLen: uint32(w.options.Snaplen)})
+	}
+	if err == nil {
+		err = w.buf.Flush()
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(name)
+		return err
+	}
+	w.f = f
+
+	w.files = append(w.files, name)
+	if w.options.MaxFiles != 0 && uint(len(w.files)) > w.options.MaxFiles {
+		if err := os.Remove(w.files[0]); err != nil {
+			common.LogWarning(common.Debug, err)
+		}
+		w.files = w.files[1:]
+	}
+	return nil
+}
+
+// close finishes current file. The first error is returned, but file is
+// closed anyway. Nothing is done if file isn't opened.
+func (w *captureWriter) close() error {
+	if w.stream {
+		return w.flush()
+	}
+	if w.f == nil {
+		return nil
+	}
+	err := w.comp.Close()
+	if ferr := w.flush(); err == nil {
+		err = ferr
+	}
+	if cerr := w.f.Close(); err == nil {
+		err = cerr
+	}
+	w.f = nil
+	return err
+}
+
+func (w *captureWriter) flush() error {
+	if w.stream {
+		return w.writer.Flush()
+	}
+	return w.buf.Flush()
+}
+
+// fail reports error of writer and closes it. Packets are dropped after it.
+func (w *captureWriter) fail(err error) {
+	name := w.filename
+	if w.stream {
+		name = "stream"
+	}
+	reportError(newError(FailToWrite, "Writer of", name, "is stopped:", err))
+	w.failed = true
+	w.close()
+}
+
+func (w *captureWriter) write(pkt *packet.Packet, ts time.Time) error {
+	if w.count != 0 && ((w.options.RotateSize != 0 && w.size >= w.options.RotateSize) ||
+		(w.options.RotateCount != 0 && w.count >= w.options.RotateCount) ||
+		(w.options.RotateInterval != 0 && time.Since(w.started) >= w.options.RotateInterval)) {
+		if err := w.close(); err != nil {
+			return err
+		}
+		if err := w.open(); err != nil {
+			return err
+		}
+	}
+	data := pkt.GetRawPacketBytes()
+	var err error
+	if w.pcapng {
+		err = w.ngWriter.WritePacketData(data, pcap.NgPacketInfo{Timestamp: ts})
+	} else {
+		if data, err = pcap.FromEthernet(w.writer.LinkType(), data); err != nil {
+			common.LogWarning(common.Debug, err)
+			return nil
+		}
+		info := pcap.PacketInfo{Timestamp: ts, OrigLen: uint32(len(data))}
+		if w.options.Snaplen != 0 && uint(len(data)) > w.options.Snaplen {
+			data = data[:w.options.Snaplen]
+		}
+		err = w.writer.WritePacketData(data, info)
+	}
+	if err != nil {
+		return err
+	}
+	w.count++
+	return nil
+}
+
+func write(parameters interface{}, stop *int32, coreID uint8) {
 	wp := parameters.(*writeParameters)
 	IN := wp.in
-	filename := wp.filename
+	options := wp.options
 
-	bufIn := make([]uintptr, 1)
+	bufIn := make([]uintptr, options.BatchSize)
 	var tempPacket *packet.Packet
 
-	f, err := os.Create(filename)
+	// Writer is opened by SetCaptureWriter and kept open if function is
+	// stopped to change flow graph, it is closed by finishFlowFunction.
+	w := wp.writer
+
+	for atomic.LoadInt32(stop) == 0 {
+		n := IN.DequeueBurst(bufIn, options.BatchSize)
+		if n == 0 {
+			continue
+		}
+		if w.failed {
+			low.DirectStop(int(n), bufIn)
+			continue
+		}
+		now := time.Now()
+		for i := uint(0); i < n && !w.failed; i++ {
+			tempPacket = packet.ExtractPacket(bufIn[i])
+			if options.Filter != nil && !options.Filter.Matches(tempPacket) {
+				continue
+			}
+			ts := now
+			if epochRXTimestamp {
+				if rx, ok := tempPacket.GetRXTimestamp(); ok {
+					ts = time.Unix(0, int64(rx))
+				}
+			}
+			if err := w.write(tempPacket, ts); err != nil {
+				w.fail(err)
+			}
+		}
+		if !w.failed {
+			if err := w.flush(); err != nil {
+				w.fail(err)
+			}
+		}
+		low.DirectStop(int(n), bufIn)
+	}
+}
+
+// maxReplaySleep limits time which reader sleeps without checking whether
+// it is stopped.
+const maxReplaySleep = 100 * time.Millisecond
+
+// replayPacer delays packets read from file according to ReplayOptions.
+type replayPacer struct {
+	options ReplayOptions
+	start   time.Time // Time when pacing or pass of file started
+	first   time.Time // Timestamp of the first packet of pass
+	count   uint64    // Number of packets or bits read since start
+	stop    *int32    // Stop flag of reader
+}
+
+// restart makes the next packet the first one of new pass of file.
+func (p *replayPacer) restart() {
+	if p.options.Mode == ReplayOriginal {
+		p.start = time.Time{}
+	}
+}
+
+// wait returns true when packet with given timestamp and length in bytes
+// should be read. It returns false earlier if reader is stopped.
+func (p *replayPacer) wait(ts time.Time, length uint) bool {
+	if p.options.Mode == ReplayAsFast {
+		return true
+	}
+	if p.start.IsZero() {
+		p.start = time.Now()
+		p.first = ts
+	}
+	var due time.Duration
+	switch p.options.Mode {
+	case ReplayOriginal:
+		speed := p.options.Speed
+		if speed == 0 {
+			speed = 1
+		}
+		due = time.Duration(float64(ts.Sub(p.first)) / speed)
+	case ReplayPPS:
+		due = time.Duration(float64(p.count) * float64(time.Second) / float64(p.options.Rate))
+		p.count++
+	case ReplayBPS:
+		due = time.Duration(float64(p.count) * float64(time.Second) / float64(p.options.Rate))
+		p.count += uint64(length) * 8
+	}
+	// Long gaps are slept by parts to notice stop of reader, the rest is
+	// waited in loop like in generatePerf because Sleep lasts more time
+	// than our precision
+	for gap := due - time.Since(p.start); gap > time.Millisecond; gap = due - time.Since(p.start) {
+		if atomic.LoadInt32(p.stop) != 0 {
+			return false
+		}
+		if gap > maxReplaySleep {
+			gap = maxReplaySleep
+		}
+		time.Sleep(gap - time.Millisecond)
+	}
+	for time.Since(p.start) < due {
+	}
+	return true
+}
+
+// pcapSource reads packets from pcap or pcapng stream, which can be
+// compressed, and converts them to Ethernet frames.
+type pcapSource struct {
+	dec      io.ReadCloser
+	reader   *pcap.Reader
+	ngReader *pcap.NgReader
+}
+
+func openPcapSource(r io.Reader) (*pcapSource, error) {
+	dec, err := pcap.NewDecompressor(r)
+	if err != nil {
+		return nil, err
+	}
+	s := &pcapSource{dec: dec}
+	br := bufio.NewReader(dec)
+	magic, err := br.Peek(4)
+	if err == nil && binary.LittleEndian.Uint32(magic) == pcap.MagicNg {
+		s.ngReader, err = pcap.NewNgReader(br)
+	} else {
+		s.reader, err = pcap.NewUncompressedReader(br)
+	}
 	if err != nil {
-		common.LogError(common.Debug, err)
+		dec.Close()
+		return nil, err
 	}
-	defer f.Close()
+	return s, nil
+}
 
-	packet.WritePcapGlobalHdr(f)
+// read returns the next packet which can be converted to Ethernet frame
+// and its timestamp. Returns io.EOF at the end of stream.
+func (s *pcapSource) read() ([]byte, time.Time, error) {
 	for {
-		n := IN.DequeueBurst(bufIn, 1)
-		if n == 0 {
+		var data []byte
+		var ts time.Time
+		var linkType uint32
+		var err error
+		if s.ngReader != nil {
+			var info pcap.NgPacketInfo
+			data, info, err = s.ngReader.ReadPacketData()
+			ts = info.Timestamp
+			if err == nil {
+				linkType = uint32(s.ngReader.Interfaces()[info.Interface].LinkType)
+			}
+		} else {
+			var info pcap.PacketInfo
+			data, info, err = s.reader.ReadPacketData()
+			ts = info.Timestamp
+			linkType = s.reader.LinkType()
+		}
+		if err != nil {
+			return nil, ts, err
+		}
+		if data, err = pcap.ToEthernet(linkType, data); err != nil {
+			common.LogWarning(common.Debug, err)
 			continue
 		}
-		tempPacket = packet.ExtractPacket(bufIn[0])
-		tempPacket.WritePcapOnePacket(f)
-		low.DirectStop(1, bufIn)
+		return data, ts, nil
+	}
+}
+
+func (s *pcapSource) close() {
+	if s.reader != nil {
+		s.reader.Close()
+	}
+	s.dec.Close()
+}
+
+// readDeadliner is implemented by streams which reading can be
+// interrupted, for example by pipes and sockets.
+type readDeadliner interface {
+	SetReadDeadline(t time.Time) error
+}
+
+// interruptOnStop unblocks reading of stream when stop flag is set, so
+// reader doesn't wait for the next packet forever. Read deadline is set
+// for stream if it is supported, otherwise stream is closed if it is
+// io.Closer. Returned function should be called when reading is finished.
+func interruptOnStop(r io.Reader, stop *int32) func() {
+	d, deadline := r.(readDeadliner)
+	if deadline {
+		// Deadline can be left by previous start of reader
+		d.SetReadDeadline(time.Time{})
 	}
+	done := make(chan struct{})
+	go func() {
+		tick := time.NewTicker(maxReplaySleep)
+		defer tick.Stop()
+		for atomic.LoadInt32(stop) == 0 {
+			select {
+			case <-done:
+				return
+			case <-tick.C:
+			}
+		}
+		if deadline && d.SetReadDeadline(time.Now()) == nil {
+			return
+		}
+		if c, ok := r.(io.Closer); ok {
+			c.Close()
+		}
+	}()
+	return func() { close(done) }
 }
 
-func read(parameters interface{}, coreID uint8) {
+func read(parameters interface{}, stop *int32, coreID uint8) {
 	rp := parameters.(*readParameters)
 	OUT := rp.out
-	filename := rp.filename
 	mempool := rp.mempool
 	repcount := rp.repcount
+	pacer := replayPacer{options: rp.options, stop: stop}
 
 	buf := make([]uintptr, 1)
 	var tempPacket *packet.Packet
 
-	f, err := os.Open(filename)
-	if err != nil {
-		common.LogError(common.Debug, err)
+	// Stream is read once, file is opened again for each repetition
+	var f *os.File
+	var src *pcapSource
+	open := func() {
+		r := rp.stream
+		var err error
+		if r == nil {
+			if f, err = os.Open(rp.filename); err != nil {
+				common.LogError(common.Debug, err)
+			}
+			r = f
+		}
+		if src, err = openPcapSource(r); err != nil {
+			// Reading of stream header is interrupted by stop
+			if rp.stream != nil && atomic.LoadInt32(stop) != 0 {
+				return
+			}
+			common.LogError(common.Debug, err)
+		}
+	}
+	closeSource := func() {
+		if src != nil {
+			src.close()
+		}
+		if f != nil {
+			f.Close()
+		}
+	}
+	if rp.stream != nil {
+		defer interruptOnStop(rp.stream, stop)()
+	}
+	open()
+	defer closeSource()
+	if src == nil {
+		return
 	}
-	defer f.Close()
-
-	// Read pcap global header once
-	var glHdr packet.PcapGlobHdr
-	packet.ReadPcapGlobalHdr(f, &glHdr)
 
 	count := int32(0)
 
-	for {
-		low.AllocateMbufs(buf, mempool)
-		tempPacket = packet.ExtractPacket(buf[0])
-		isEOF := tempPacket.ReadPcapOnePacket(f)
-		if isEOF {
+	for atomic.LoadInt32(stop) == 0 {
+		data, ts, err := src.read()
+		// Reading of stream is interrupted by stop
+		if err != nil && atomic.LoadInt32(stop) != 0 {
+			break
+		}
+		if err == io.EOF {
 			atomic.AddInt32(&count, 1)
 			if count == repcount {
 				break
 			}
-			_, err := f.Seek(packet.PcapGlobHdrSize, 0)
-			if err != nil {
-				common.LogError(common.Debug, err)
+			closeSource()
+			open()
+			pacer.restart()
+			data, ts, err = src.read()
+			// File without packets is read once
+			if err == io.EOF {
+				break
 			}
-			tempPacket.ReadPcapOnePacket(f)
+		}
+		if err != nil {
+			common.LogError(common.Debug, err)
+		}
+		low.AllocateMbufs(buf, mempool)
+		tempPacket = packet.ExtractPacket(buf[0])
+		packet.GeneratePacketFromByte(tempPacket, data)
+		if !pacer.wait(ts, tempPacket.GetPacketLen()) {
+			low.DirectStop(1, buf)
+			break
 		}
 		// TODO we need packet reassembly here. However we don't
 		// use mbuf packet_type here, so it is impossible.
@@ -1196,26 +2296,54 @@ func safeEnqueue(place *low.Queue, data []uintptr, number uint) {
 	// to use actual number or to use simply number of packets processed by a function like now.
 }
 
-func checkFlow(f *Flow) {
-	if f.current == nil {
-		common.LogError(common.Initialization, "One of the flows is used after it was closed!")
+func errClosedFlow() *Error {
+	return newError(UseClosedFlow, "One of the flows is used after it was closed!")
+}
+
+func checkFlow(f *Flow) error {
+	if f == nil || f.current == nil || removedRings[f.current] {
+		return errClosedFlow()
 	}
+	return nil
 }
 
-func checkSystem() {
+func checkPort(port uint8, direction string) error {
+	if int(port) >= len(createdPorts) {
+		return newError(BadPort, "Requested", direction, "port exceeds number of ports which can be used by DPDK (bind to DPDK).")
+	}
+	if createdPorts[port].config == manualPort {
+		return newError(ManualPort, "Requested", direction, "port was previously configured as manual port. It can't be used as auto port.")
+	}
+	if createdPorts[port].started {
+		return newError(UseStartedPort, "Requested", direction, "port is already started. Its queues can't be changed.")
+	}
+	return nil
+}
+
+// CheckSystem checks that flow graph is complete and ports are used
+// correctly. It is called by SystemStart and can be used to check graph
+// before start. Returns list of all found errors, empty if there are none.
+// Problems which don't prevent start are only logged as warnings.
+func CheckSystem() []error {
+	var errs []error
 	if openFlowsNumber != 0 {
-		common.LogError(common.Initialization, "Some flows are left open at the end of configuration!")
+		errs = append(errs, newError(OpenedFlowAtTheEnd, "Some flows are left open at the end of configuration!"))
+	}
+	// Cores of started graph are checked by Reconfigure for new functions only
+	if atomic.LoadInt32(&graphState) == graphConstruction && schedState.StartCoresNumber() > schedState.FreeCoresNumber() {
+		errs = append(errs, newError(NotEnoughCores, "Requested number of cores isn't enough. System needs",
+			schedState.StartCoresNumber(), "cores: one core per each Set function (except Merger and Stopper) plus one additional core."))
 	}
 	for i := range createdPorts {
 		if createdPorts[i].config == inactivePort {
 			continue
 		}
 		if createdPorts[i].rxQueuesNumber == 0 && createdPorts[i].txQueuesNumber == 0 {
-			common.LogError(common.Initialization, "Port", createdPorts[i].port, "has no send and receive queues. It is an error in DPDK.")
+			errs = append(errs, newError(PortHasNoQueues, "Port", createdPorts[i].port, "has no send and receive queues. It is an error in DPDK."))
 		}
 		for j := range createdPorts[i].rxQueues {
 			if createdPorts[i].rxQueues[j] != true {
-				common.LogError(common.Initialization, "Port", createdPorts[i].port, "doesn't use all receive queues, packets can be missed due to RSS!")
+				errs = append(errs, newError(NotAllQueuesUsed, "Port", createdPorts[i].port, "doesn't use all receive queues, packets can be missed due to RSS!"))
 			}
 		}
 		for j := range createdPorts[i].txQueues {
@@ -1224,4 +2352,5 @@ func checkSystem() {
 			}
 		}
 	}
+	return errs
 }
@@ -0,0 +1,272 @@
+// Copyright 2017 Intel Corporation.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package flow
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/intel-go/yanff/common"
+	"github.com/intel-go/yanff/low"
+	"github.com/intel-go/yanff/packet"
+	"github.com/intel-go/yanff/pcap"
+	"github.com/intel-go/yanff/scheduler"
+)
+
+func init() {
+	argc, argv := low.InitDPDKArguments([]string{})
+	// burstSize=32, mbufNumber=8191, mbufCacheSize=250
+	low.InitDPDK(argc, argv, 32, 8191, 250)
+	schedState = scheduler.NewScheduler(4, true, true, false, low.CreateQueue("stop", 1024), 10000, 1000)
+	testMempool = low.CreateMempool()
+}
+
+var testMempool *low.Mempool
+
+// stopLog records order in which test flow functions return.
+type stopLog struct {
+	sync.Mutex
+	names []string
+}
+
+func (l *stopLog) add(name string) {
+	l.Lock()
+	l.names = append(l.names, name)
+	l.Unlock()
+}
+
+func TestRingsDrained(t *testing.T) {
+	ring := low.CreateQueue("drained", 1024)
+	producers := map[*low.Queue]int{ring: 1}
+	if ringsDrained([]*low.Queue{ring}, producers) {
+		t.Error("Ring with running producer is drained")
+	}
+	producers[ring] = 0
+	if !ringsDrained([]*low.Queue{ring}, producers) {
+		t.Error("Empty ring without producers isn't drained")
+	}
+	ring.EnqueueBurst([]uintptr{1}, 1)
+	if ringsDrained([]*low.Queue{ring}, producers) {
+		t.Error("Ring with packets is drained")
+	}
+	ring.DequeueBurst(make([]uintptr, 1), 1)
+}
+
+func TestStopInOrder(t *testing.T) {
+	first := low.CreateQueue("first", 1024)
+	second := low.CreateQueue("second", 1024)
+	var log stopLog
+	var produced, consumed uint32
+
+	// Producer puts elements to the first ring until it is stopped,
+	// handler moves them slowly to the second ring, so both rings have
+	// elements when handler is asked to stop.
+	producer := schedState.NewUnclonableFlowFunction("producer", 0, func(par interface{}, stop *int32, coreID uint8) {
+		out := par.(*generateParameters).out
+		for atomic.LoadInt32(stop) == 0 {
+			if out.EnqueueBurst([]uintptr{1}, 1) == 1 {
+				atomic.AddUint32(&produced, 1)
+			}
+		}
+		log.add("producer")
+	}, &generateParameters{out: first})
+	handler := schedState.NewUnclonableFlowFunction("handler", 1, func(par interface{}, stop *int32, coreID uint8) {
+		p := par.(*handleParameters)
+		buf := make([]uintptr, 32)
+		for atomic.LoadInt32(stop) == 0 {
+			n := p.in.DequeueBurst(buf, 32)
+			for done := uint(0); done < n; {
+				done += p.out.EnqueueBurst(buf[done:n], n-done)
+			}
+			time.Sleep(time.Millisecond)
+		}
+		log.add("handler")
+	}, &handleParameters{in: first, out: second})
+	consumer := schedState.NewUnclonableFlowFunction("consumer", 2, func(par interface{}, stop *int32, coreID uint8) {
+		in := par.(*writeParameters).in
+		buf := make([]uintptr, 32)
+		for atomic.LoadInt32(stop) == 0 {
+			atomic.AddUint32(&consumed, uint32(in.DequeueBurst(buf, 32)))
+		}
+		log.add("consumer")
+	}, &writeParameters{in: second})
+
+	ffs := []*scheduler.FlowFunction{consumer, handler, producer}
+	for _, ff := range ffs {
+		if !schedState.StartFlowFunction(ff) {
+			t.Fatal("No free core for flow function")
+		}
+	}
+	time.Sleep(10 * time.Millisecond)
+	stopInOrder(ffs)
+
+	if want := []string{"producer", "handler", "consumer"}; !reflect.DeepEqual(log.names, want) {
+		t.Errorf("Incorrect stop order %v, want %v", log.names, want)
+	}
+	if first.GetQueueCount() != 0 || second.GetQueueCount() != 0 || produced != consumed {
+		t.Errorf("Rings aren't drained: %d and %d left, %d produced, %d consumed",
+			first.GetQueueCount(), second.GetQueueCount(), produced, consumed)
+	}
+}
+
+func TestStopStreamReader(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	defer w.Close()
+	if _, err := pcap.NewWriter(w, pcap.WriterOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Reader waits for the first packet which is never written
+	rp := &readParameters{out: low.CreateQueue("stream", 1024), stream: r, repcount: 1}
+	var stop int32
+	done := make(chan struct{})
+	go func() {
+		read(rp, &stop, 0)
+		close(done)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	atomic.StoreInt32(&stop, 1)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Reader of stream isn't stopped")
+	}
+	if _, err := w.Write([]byte{0}); err != nil {
+		t.Errorf("Stream is closed: %v", err)
+	}
+}
+
+func TestNDPResponderTruncated(t *testing.T) {
+	sha := [common.EtherAddrLen]uint8{0x00, 0x11, 0x22, 0x33, 0x44, 0x55}
+	mac := [common.EtherAddrLen]uint8{0x00, 0x66, 0x77, 0x88, 0x99, 0xaa}
+	src := [common.IPv6AddrLen]uint8{0xfe, 0x80, 15: 1}
+	target := [common.IPv6AddrLen]uint8{0xfe, 0x80, 15: 2}
+	responder := NewNDPResponder()
+	responder.AddAddress(target, mac)
+
+	mb := make([]uintptr, 3)
+	low.AllocateMbufs(mb, testMempool)
+	defer low.DirectStop(len(mb), mb)
+	pkts := make([]*packet.Packet, len(mb))
+	for i := range mb {
+		pkts[i] = packet.ExtractPacket(mb[i])
+		packet.InitNDPNeighborSolicitation(pkts[i], sha, src, target)
+	}
+	// Payload length claims options which are not in packet
+	pkts[1].ParseL3()
+	ipv6 := pkts[1].GetIPv6()
+	ipv6.PayloadLen = packet.SwapBytesUint16(packet.SwapBytesUint16(ipv6.PayloadLen) + 16)
+	// Link-layer address option is cut
+	low.TrimMbuf(pkts[2].CMbuf, 4)
+
+	if out := responder.split(pkts[0], nil); out != ndpReply {
+		t.Errorf("Neighbor Solicitation isn't answered: %d", out)
+	}
+	if out := responder.split(pkts[1], nil); out != ndpDrop {
+		t.Errorf("Neighbor Solicitation with incorrect payload length isn't dropped: %d", out)
+	}
+	if out := responder.split(pkts[2], nil); out != ndpDrop {
+		t.Errorf("Truncated Neighbor Solicitation isn't dropped: %d", out)
+	}
+}
+
+// failingWriter fails after limit bytes are written.
+type failingWriter struct {
+	limit int
+}
+
+func (w *failingWriter) Write(data []byte) (int, error) {
+	if len(data) > w.limit {
+		return 0, errors.New("disk is full")
+	}
+	w.limit -= len(data)
+	return len(data), nil
+}
+
+func TestCaptureWriterErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "writer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// File which can't be created is reported by Try function
+	in := &Flow{current: low.CreateQueue("writer", 1024)}
+	err = TrySetCaptureWriter(in, filepath.Join(dir, "missing", "dump.pcap"), WriterOptions{})
+	if e, ok := err.(*Error); !ok || e.Code != FailToWrite || in.current == nil {
+		t.Errorf("Incorrect error for missing directory: %v", err)
+	}
+
+	// Failed write is reported after writer drops packets
+	pw, err := pcap.NewWriter(&failingWriter{limit: 24}, pcap.WriterOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	wp := &writeParameters{in: in.current, options: WriterOptions{BatchSize: 32}, writer: newCaptureWriter("", pw, WriterOptions{})}
+	mb := make([]uintptr, 2)
+	low.AllocateMbufs(mb, testMempool)
+	for i := range mb {
+		packet.GeneratePacketFromByte(packet.ExtractPacket(mb[i]), make([]byte, 60))
+	}
+	in.current.EnqueueBurst(mb, 2)
+	var stop int32
+	done := make(chan struct{})
+	go func() {
+		write(wp, &stop, 0)
+		close(done)
+	}()
+	for i := 0; i < 100 && in.current.GetQueueCount() != 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	atomic.StoreInt32(&stop, 1)
+	<-done
+	if !wp.writer.failed || in.current.GetQueueCount() != 0 {
+		t.Errorf("Writer isn't failed or doesn't take packets")
+	}
+	finishFlowFunction(&scheduler.FlowFunction{Parameters: wp})
+	list, ok := takeRuntimeErrors().(ErrorList)
+	if !ok || len(list) != 1 || list[0].(*Error).Code != FailToWrite {
+		t.Errorf("Incorrect runtime errors %v", list)
+	}
+}
+
+// useScheduler replaces scheduler by new one with given number of cores,
+// so test constructs its own flow graph. Returned function removes this
+// graph and restores scheduler.
+func useScheduler(cores uint) func() {
+	saved := schedState
+	schedState = scheduler.NewScheduler(cores, true, true, false, saved.StopRing, 10000, 1000)
+	return func() {
+		resetGraph()
+		schedState = saved
+	}
+}
+
+func TestCheckSystemCores(t *testing.T) {
+	defer useScheduler(2)()
+
+	// Scheduler needs one core in addition to flow functions
+	ff := func(par interface{}, stop *int32, coreID uint8) {}
+	schedState.UnClonable = append(schedState.UnClonable, schedState.NewUnclonableFlowFunction("first", 0, ff, nil))
+	if errs := CheckSystem(); len(errs) != 0 {
+		t.Errorf("Unexpected errors %v", errs)
+	}
+	schedState.UnClonable = append(schedState.UnClonable, schedState.NewUnclonableFlowFunction("second", 1, ff, nil))
+	errs := CheckSystem()
+	if len(errs) != 1 || errs[0].(*Error).Code != NotEnoughCores {
+		t.Errorf("NotEnoughCores expected, got %v", errs)
+	}
+}
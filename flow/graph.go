@@ -0,0 +1,155 @@
+// Copyright 2017 Intel Corporation.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package flow
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync/atomic"
+
+	"github.com/intel-go/yanff/low"
+	"github.com/intel-go/yanff/scheduler"
+)
+
+// Types of graph nodes
+const (
+	NodeUnclonable = "unclonable"
+	NodeClonable   = "clonable"
+	NodeGenerate   = "generate"
+)
+
+// Graph is a snapshot of flow graph. Nodes are flow functions and edges
+// are rings between them.
+type Graph struct {
+	Nodes []GraphNode `json:"nodes"`
+	Edges []GraphEdge `json:"edges"`
+}
+
+// GraphNode describes flow function.
+type GraphNode struct {
+	Name       string `json:"name"`
+	Identifier int    `json:"id"`
+	// Type is NodeUnclonable, NodeClonable or NodeGenerate.
+	Type string `json:"type"`
+	// Clones is number of started clones of flow function.
+	Clones int `json:"clones"`
+}
+
+// GraphEdge describes ring. Ring can have several producers after merge.
+// To is zero if ring has no consumer because its flow is open or packets
+// of ring are dropped.
+type GraphEdge struct {
+	Ring     string `json:"ring"`
+	Capacity uint32 `json:"capacity"`
+	Count    uint32 `json:"count"`
+	From     []int  `json:"from"`
+	To       int    `json:"to"`
+	// Dropped means that packets of ring are freed.
+	Dropped bool `json:"dropped"`
+}
+
+// GetGraph returns snapshot of flow graph. It can be called during
+// construction and from any goroutine after system is started, clone
+// numbers and ring counts are taken between scheduling steps then.
+// Returns nil if system is being stopped.
+func GetGraph() *Graph {
+	if atomic.LoadInt32(&graphState) == graphReconfiguration {
+		return buildGraph()
+	}
+	var g *Graph
+	if err := execute(func() error {
+		g = buildGraph()
+		return nil
+	}); err != nil {
+		return nil
+	}
+	return g
+}
+
+func buildGraph() *Graph {
+	g := &Graph{Nodes: []GraphNode{}, Edges: []GraphEdge{}}
+	edges := make(map[*low.Queue]int)
+	edge := func(ring *low.Queue) *GraphEdge {
+		i, ok := edges[ring]
+		if !ok {
+			i = len(g.Edges)
+			edges[ring] = i
+			g.Edges = append(g.Edges, GraphEdge{
+				Ring:     ring.GetQueueName(),
+				Capacity: ring.GetQueueCapacity(),
+				Count:    ring.GetQueueCount(),
+				From:     []int{},
+				Dropped:  ring == schedState.StopRing,
+			})
+		}
+		return &g.Edges[i]
+	}
+	add := func(ffs []*scheduler.FlowFunction, nodeType string) {
+		for _, ff := range ffs {
+			g.Nodes = append(g.Nodes, GraphNode{
+				Name:       ff.Name(),
+				Identifier: ff.Identifier(),
+				Type:       nodeType,
+				Clones:     ff.CloneNumber(),
+			})
+			in, out := flowFunctionAllRings(ff)
+			for _, ring := range in {
+				edge(ring).To = ff.Identifier()
+			}
+			for _, ring := range out {
+				e := edge(ring)
+				e.From = append(e.From, ff.Identifier())
+			}
+		}
+	}
+	add(schedState.UnClonable, NodeUnclonable)
+	add(schedState.Clonable, NodeClonable)
+	add(schedState.Generate, NodeGenerate)
+	return g
+}
+
+// WriteJSON writes graph to w in JSON format.
+func (g *Graph) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "\t")
+	return enc.Encode(g)
+}
+
+// WriteDOT writes graph to w in Graphviz DOT format. Edges are labeled by
+// ring name and its fill. Open flows and dropped packets end in point nodes.
+func (g *Graph) WriteDOT(w io.Writer) error {
+	b := bufio.NewWriter(w)
+	fmt.Fprintln(b, "digraph yanff {")
+	fmt.Fprintln(b, "\trankdir=LR;")
+	for _, n := range g.Nodes {
+		label := fmt.Sprintf("%s %d", n.Name, n.Identifier)
+		if n.Clones != 0 {
+			label += fmt.Sprintf("\nclones: %d", n.Clones)
+		}
+		shape := "box"
+		if n.Type != NodeUnclonable {
+			shape = "box3d"
+		}
+		fmt.Fprintf(b, "\tn%d [label=%q, shape=%s];\n", n.Identifier, label, shape)
+	}
+	for _, e := range g.Edges {
+		to := fmt.Sprintf("n%d", e.To)
+		if e.To == 0 {
+			to = "open" + e.Ring
+			if e.Dropped {
+				to = "stop"
+			}
+			fmt.Fprintf(b, "\t%s [label=\"\", shape=point];\n", to)
+		}
+		label := fmt.Sprintf("%s\n%d/%d", e.Ring, e.Count, e.Capacity)
+		for _, from := range e.From {
+			fmt.Fprintf(b, "\tn%d -> %s [label=%q];\n", from, to, label)
+		}
+	}
+	fmt.Fprintln(b, "}")
+	return b.Flush()
+}
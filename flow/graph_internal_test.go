@@ -0,0 +1,139 @@
+// Copyright 2017 Intel Corporation.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package flow
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/intel-go/yanff/low"
+)
+
+// testGraph has receiver, handler with clones, open flow and dropped packets.
+var testGraph = &Graph{
+	Nodes: []GraphNode{
+		{Name: "receiver", Identifier: 1, Type: NodeUnclonable},
+		{Name: "handler", Identifier: 2, Type: NodeClonable, Clones: 2},
+	},
+	Edges: []GraphEdge{
+		{Ring: "1", Capacity: 1023, Count: 5, From: []int{1}, To: 2},
+		{Ring: "2", Capacity: 1023, From: []int{2}},
+		{Ring: "stop", Capacity: 1023, From: []int{1, 2}, Dropped: true},
+	},
+}
+
+const testGraphJSON = `{
+	"nodes": [
+		{
+			"name": "receiver",
+			"id": 1,
+			"type": "unclonable",
+			"clones": 0
+		},
+		{
+			"name": "handler",
+			"id": 2,
+			"type": "clonable",
+			"clones": 2
+		}
+	],
+	"edges": [
+		{
+			"ring": "1",
+			"capacity": 1023,
+			"count": 5,
+			"from": [
+				1
+			],
+			"to": 2,
+			"dropped": false
+		},
+		{
+			"ring": "2",
+			"capacity": 1023,
+			"count": 0,
+			"from": [
+				2
+			],
+			"to": 0,
+			"dropped": false
+		},
+		{
+			"ring": "stop",
+			"capacity": 1023,
+			"count": 0,
+			"from": [
+				1,
+				2
+			],
+			"to": 0,
+			"dropped": true
+		}
+	]
+}
+`
+
+const testGraphDOT = `digraph yanff {
+	rankdir=LR;
+	n1 [label="receiver 1", shape=box];
+	n2 [label="handler 2\nclones: 2", shape=box3d];
+	n1 -> n2 [label="1\n5/1023"];
+	open2 [label="", shape=point];
+	n2 -> open2 [label="2\n0/1023"];
+	stop [label="", shape=point];
+	n1 -> stop [label="stop\n0/1023"];
+	n2 -> stop [label="stop\n0/1023"];
+}
+`
+
+func TestWriteGraph(t *testing.T) {
+	var b bytes.Buffer
+	if err := testGraph.WriteJSON(&b); err != nil || b.String() != testGraphJSON {
+		t.Errorf("Incorrect JSON graph %v:\n%s", err, b.String())
+	}
+	b.Reset()
+	if err := testGraph.WriteDOT(&b); err != nil || b.String() != testGraphDOT {
+		t.Errorf("Incorrect DOT graph %v:\n%s", err, b.String())
+	}
+}
+
+func TestBuildGraph(t *testing.T) {
+	defer useScheduler(4)()
+	// Generator, handler and copier which copies are left open
+	src := SetGenerator(generateNothing, 0, nil)
+	SetHandler(src, handleNothing, nil)
+	copies := SetCopier(src)
+	SetStopper(src)
+	generator, copier := schedState.UnClonable[0], schedState.UnClonable[1]
+	handler := schedState.Clonable[0]
+	handled := handler.Parameters.(*handleParameters)
+
+	edge := func(ring *low.Queue, from int, to int) GraphEdge {
+		return GraphEdge{
+			Ring:     ring.GetQueueName(),
+			Capacity: ring.GetQueueCapacity(),
+			From:     []int{from},
+			To:       to,
+			Dropped:  ring == schedState.StopRing,
+		}
+	}
+	want := &Graph{
+		Nodes: []GraphNode{
+			{Name: "generator", Identifier: generator.Identifier(), Type: NodeUnclonable},
+			{Name: "copier", Identifier: copier.Identifier(), Type: NodeUnclonable},
+			{Name: "handler", Identifier: handler.Identifier(), Type: NodeClonable},
+		},
+		Edges: []GraphEdge{
+			edge(handled.in, generator.Identifier(), handler.Identifier()),
+			edge(handled.out, handler.Identifier(), copier.Identifier()),
+			edge(schedState.StopRing, copier.Identifier(), 0),
+			edge(copies.current, copier.Identifier(), 0),
+		},
+	}
+	if g := buildGraph(); !reflect.DeepEqual(g, want) {
+		t.Errorf("Incorrect graph %+v, want %+v", g, want)
+	}
+}
@@ -0,0 +1,33 @@
+// Copyright 2017 Intel Corporation.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package flow
+
+import (
+	"github.com/intel-go/yanff/bpf"
+	"github.com/intel-go/yanff/packet"
+)
+
+// Built-in user defined functions which can be passed to Set functions.
+
+// MSSClampingHandler returns handle function which can be used with
+// SetHandler. It reduces maximum segment size in MSS option of TCP SYN
+// segments to mss if it is higher, so that segments fit into tunnels
+// with smaller MTU. IPv4 and IPv6 packets are supported, all other
+// packets are passed unchanged.
+func MSSClampingHandler(mss uint16) func(*packet.Packet, UserContext) {
+	return func(pkt *packet.Packet, context UserContext) {
+		pkt.ClampTCPMSS(mss)
+	}
+}
+
+// BPFSeparateFunction returns separate function which can be used with
+// SetSeparator. Packets accepted by filter are sent to the first flow,
+// all other packets to the second one. Filter can be made by bpf.Compile
+// from tcpdump-like expression.
+func BPFSeparateFunction(filter *bpf.Program) func(*packet.Packet, UserContext) bool {
+	return func(pkt *packet.Packet, context UserContext) bool {
+		return filter.Matches(pkt)
+	}
+}
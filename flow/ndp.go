@@ -0,0 +1,187 @@
+// Copyright 2017 Intel Corporation.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package flow
+
+import (
+	"sync"
+	"unsafe"
+
+	"github.com/intel-go/yanff/common"
+	"github.com/intel-go/yanff/low"
+	"github.com/intel-go/yanff/packet"
+)
+
+// NDPResponder keeps IPv6 addresses which should be answered by NDP
+// Neighbor Advertisements and neighbors which were learned from received
+// Neighbor Solicitations and Advertisements. It is IPv6 analogue of ARPResponder.
+type NDPResponder struct {
+	// Configured addresses. They are only read after SystemStart
+	addresses map[[common.IPv6AddrLen]uint8][common.EtherAddrLen]uint8
+	// Learned neighbors. It is used by all clones of responder and user handlers
+	neighbors sync.Map
+}
+
+// NewNDPResponder creates empty NDP responder. Addresses should be added
+// to it by AddAddress before SystemStart.
+func NewNDPResponder() *NDPResponder {
+	responder := new(NDPResponder)
+	responder.addresses = make(map[[common.IPv6AddrLen]uint8][common.EtherAddrLen]uint8)
+	return responder
+}
+
+// AddAddress adds IPv6 address for which Neighbor Solicitations should be
+// answered with given MAC address. Usually it is MAC address of port returned by GetPortMACAddress.
+func (responder *NDPResponder) AddAddress(ip [common.IPv6AddrLen]uint8, mac [common.EtherAddrLen]uint8) {
+	responder.addresses[ip] = mac
+}
+
+// LookupNeighbor returns MAC address of neighbor with given IPv6 address
+// if it was learned from NDP packets. Can be used in parallel from any handler.
+func (responder *NDPResponder) LookupNeighbor(ip [common.IPv6AddrLen]uint8) ([common.EtherAddrLen]uint8, bool) {
+	v, found := responder.neighbors.Load(ip)
+	if !found {
+		return [common.EtherAddrLen]uint8{}, false
+	}
+	return v.([common.EtherAddrLen]uint8), true
+}
+
+// AddNeighbor adds or updates neighbor entry manually.
+func (responder *NDPResponder) AddNeighbor(ip [common.IPv6AddrLen]uint8, mac [common.EtherAddrLen]uint8) {
+	responder.neighbors.Store(ip, mac)
+}
+
+// Outputs of NDP splitter
+const (
+	ndpDrop = iota
+	ndpPass
+	ndpReply
+	ndpOutputsNumber
+)
+
+func (responder *NDPResponder) split(current *packet.Packet, context UserContext) uint {
+	current.ParseL3()
+	if current.GetIPv6() == nil {
+		return ndpPass
+	}
+	// Payload length and extension headers are checked against packet length
+	_, ipv6, err := current.SafeParseL3()
+	if err != nil {
+		return ndpDrop
+	}
+	if _, _, _, err = current.SafeParseL4ForIPv6(); err != nil {
+		return ndpDrop
+	}
+	icmp := current.GetICMPForIPv6()
+	if icmp == nil || (icmp.Type != common.ICMPv6TypeNeighborSolicitation &&
+		icmp.Type != common.ICMPv6TypeNeighborAdvertisement) {
+		return ndpPass
+	}
+	// Message and its options are read through pointers, so they should
+	// be in the first segment
+	if uintptr(current.L3)-current.Start()+common.IPv6Len+uintptr(packet.SwapBytesUint16(ipv6.PayloadLen)) >
+		uintptr(current.GetPacketSegmentLen()) {
+		return ndpDrop
+	}
+	// Messages which could be forwarded by router are invalid
+	if ipv6.HopLimits != 255 || icmp.Code != 0 {
+		return ndpDrop
+	}
+	if na := current.GetNDPNeighborAdvertisement(); na != nil {
+		if mac, found := current.GetNDPLinkLayerAddr(common.NDPOptionTargetLinkLayerAddr); found {
+			responder.neighbors.Store(na.TargetAddr, mac)
+		}
+		return ndpDrop
+	}
+	ns := current.GetNDPNeighborSolicitation()
+	if ns == nil {
+		return ndpDrop
+	}
+	dha, hasSource := current.GetNDPLinkLayerAddr(common.NDPOptionSourceLinkLayerAddr)
+	dad := ipv6.SrcAddr == [common.IPv6AddrLen]uint8{}
+	if hasSource && !dad {
+		responder.neighbors.Store(ipv6.SrcAddr, dha)
+	}
+	mac, found := responder.addresses[ns.TargetAddr]
+	if !found {
+		return ndpDrop
+	}
+
+	// Solicitation is turned into advertisement in place
+	flags := uint32(common.NDPSolicitedFlag | common.NDPOverrideFlag)
+	dst := ipv6.SrcAddr
+	if dad {
+		// Reply to Duplicate Address Detection is sent to all nodes
+		flags = common.NDPOverrideFlag
+		dst = packet.AllNodesMulticastAddr
+		dha = packet.IPv6MulticastMAC(dst)
+	} else if !hasSource {
+		dha = current.Ether.SAddr
+	}
+	msgLen := uint(common.NDPNeighborAdvertisementLen + common.NDPLinkLayerAddrOptionLen)
+	if !resizeNDPReply(current, msgLen) {
+		return ndpDrop
+	}
+	current.Ether.DAddr = dha
+	current.Ether.SAddr = mac
+	ipv6.DstAddr = dst
+	ipv6.SrcAddr = ns.TargetAddr
+	ipv6.PayloadLen = packet.SwapBytesUint16(uint16(uintptr(current.L4) - uintptr(current.L3) - common.IPv6Len + uintptr(msgLen)))
+
+	// Target address is placed at the same offset in both messages
+	na := (*packet.NDPNeighborAdvertisementHdr)(current.L4)
+	na.Type = common.ICMPv6TypeNeighborAdvertisement
+	na.Flags = packet.SwapBytesUint32(flags)
+	opt := (*packet.NDPLinkLayerAddrOption)(unsafe.Pointer(uintptr(current.L4) + common.NDPNeighborAdvertisementLen))
+	opt.Type = common.NDPOptionTargetLinkLayerAddr
+	opt.Length = common.NDPLinkLayerAddrOptionLen >> 3
+	opt.Addr = mac
+	packet.SetNDPChecksum(current)
+	return ndpReply
+}
+
+// resizeNDPReply changes packet length so that NDP message has given length.
+func resizeNDPReply(current *packet.Packet, msgLen uint) bool {
+	need := uint(uintptr(current.L4)-current.Start()) + msgLen
+	length := current.GetPacketLen()
+	if need > length {
+		return low.AppendMbuf(current.CMbuf, need-length)
+	}
+	return low.TrimMbuf(current.CMbuf, length-need)
+}
+
+// SetNDPResponder adds IPv6 Neighbor Discovery handling to flow graph.
+// Gets flow with packets received from port, target port and responder
+// with configured addresses. Neighbor Solicitations and Advertisements are
+// removed from input flow and are used for learning neighbors. Solicitations
+// for configured addresses are answered with advertisements sent to port.
+// Other packets remain in input flow.
+// Function can panic during execution.
+func SetNDPResponder(IN *Flow, port uint8, responder *NDPResponder) {
+	must(TrySetNDPResponder(IN, port, responder))
+}
+
+// TrySetNDPResponder is the same as SetNDPResponder but returns error instead
+// of terminating the process.
+func TrySetNDPResponder(IN *Flow, port uint8, responder *NDPResponder) error {
+	if err := checkFlow(IN); err != nil {
+		return err
+	}
+	if err := checkPort(port, "send"); err != nil {
+		return err
+	}
+	outs, err := TrySetSplitter(IN, responder.split, ndpOutputsNumber, nil)
+	if err != nil {
+		return err
+	}
+	if err := TrySetStopper(outs[ndpDrop]); err != nil {
+		return err
+	}
+	if err := TrySetSender(outs[ndpReply], port); err != nil {
+		return err
+	}
+	// Input flow continues with not NDP packets
+	IN.current = outs[ndpPass].current
+	return nil
+}
@@ -0,0 +1,602 @@
+// Copyright 2017 Intel Corporation.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package flow
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/intel-go/yanff/common"
+	"github.com/intel-go/yanff/low"
+	"github.com/intel-go/yanff/packet"
+	"github.com/intel-go/yanff/scheduler"
+)
+
+// Started flow graph can be changed without stopping the system.
+// Reconfigure adds new branches: Set functions are called inside it and
+// new flow functions are started together after the whole change is checked.
+// Existing parts of graph are addressed by points which are set by SetPoint
+// during construction: SetTap adds copy of packets which pass point,
+// SwapHandler replaces handler which takes packets from point and
+// RemoveBranch removes everything which is reachable only through point.
+// Flow functions which are changed are stopped after they finish packets
+// which they have already taken, changed and started again, so packets in
+// rings between them are not lost.
+// Set functions aren't safe for concurrent use, so graph should be changed
+// from one goroutine.
+
+// Point is a place between flow functions in flow graph.
+type Point struct {
+	ring *low.Queue
+}
+
+// points are moved by merge together with rings.
+var points []*Point
+
+// removedRings are ends of flows which were left open in branches removed
+// by RemoveBranch. These flows are closed.
+var removedRings = make(map[*low.Queue]bool)
+
+// States of flow graph
+const (
+	graphConstruction = iota
+	graphStarted
+	graphReconfiguration
+)
+
+var graphState int32
+
+// current is reconfiguration which is done by Reconfigure now.
+var current *reconfiguration
+
+// reconfiguration keeps state of started flow graph before Reconfigure, so
+// changes can be discarded if new graph is incorrect.
+type reconfiguration struct {
+	existing        map[*scheduler.FlowFunction]bool
+	ports           []port
+	points          int
+	openFlowsNumber uint32
+	// inputs are new input rings of started flow functions. They are
+	// changed when functions are stopped.
+	inputs map[*scheduler.FlowFunction]*low.Queue
+}
+
+func checkGraphChange() error {
+	if atomic.LoadInt32(&graphState) == graphStarted {
+		return newError(ChangeStartedGraph, "Started flow graph can be changed only inside Reconfigure")
+	}
+	return nil
+}
+
+// SetPoint marks current end of flow, so this place of flow graph can be
+// changed later by SetTap, SwapHandler and RemoveBranch. Flow isn't changed.
+// Function can panic during execution.
+func SetPoint(IN *Flow) *Point {
+	p, err := TrySetPoint(IN)
+	must(err)
+	return p
+}
+
+// TrySetPoint is the same as SetPoint but returns error instead of
+// terminating the process.
+func TrySetPoint(IN *Flow) (*Point, error) {
+	if err := checkFlow(IN); err != nil {
+		return nil, err
+	}
+	p := &Point{ring: IN.current}
+	points = append(points, p)
+	return p, nil
+}
+
+func movePoints(from *low.Queue, to *low.Queue) {
+	for _, p := range points {
+		if p.ring == from {
+			p.ring = to
+		}
+	}
+}
+
+// Reconfigure changes started flow graph. Function f is called between
+// scheduling steps and can add new branches by Set functions and taps by
+// SetTap. New branches should be closed. After f returns graph is checked by
+// CheckSystem, new ports are started and new flow functions are started. If
+// f returns error or new graph is incorrect all changes made by f are
+// discarded. If system isn't started f is simply called. Reconfigure
+// shouldn't be called from f and from user functions of flow graph.
+// Function can panic during execution.
+func Reconfigure(f func() error) {
+	must(TryReconfigure(f))
+}
+
+// TryReconfigure is the same as Reconfigure but returns error instead of
+// terminating the process.
+func TryReconfigure(f func() error) error {
+	return execute(func() error {
+		if atomic.LoadInt32(&graphState) != graphStarted {
+			return f()
+		}
+		return reconfigure(f)
+	})
+}
+
+// execute runs f which changes flow graph. If system is started f is run
+// by scheduler between scheduling steps.
+func execute(f func() error) error {
+	if atomic.LoadInt32(&graphState) == graphReconfiguration {
+		return newError(ChangeStartedGraph, "Flow graph is already changed by Reconfigure")
+	}
+	stopLock.Lock()
+	request := stopRequest
+	stopLock.Unlock()
+	if request == nil {
+		return f()
+	}
+	var err error
+	if !schedState.Execute(func() { err = f() }, request) {
+		return newError(StoppedSystem, "System is stopped, flow graph can't be changed")
+	}
+	return err
+}
+
+func reconfigure(f func() error) error {
+	r := &reconfiguration{
+		existing:        make(map[*scheduler.FlowFunction]bool),
+		ports:           make([]port, len(createdPorts)),
+		points:          len(points),
+		openFlowsNumber: openFlowsNumber,
+		inputs:          make(map[*scheduler.FlowFunction]*low.Queue),
+	}
+	for _, ff := range flowFunctions() {
+		r.existing[ff] = true
+	}
+	for i := range createdPorts {
+		r.ports[i] = createdPorts[i]
+		r.ports[i].rxQueues = append([]bool(nil), createdPorts[i].rxQueues...)
+		r.ports[i].txQueues = append([]bool(nil), createdPorts[i].txQueues...)
+	}
+	current = r
+	atomic.StoreInt32(&graphState, graphReconfiguration)
+	err := f()
+	atomic.StoreInt32(&graphState, graphStarted)
+	current = nil
+	if err == nil {
+		err = r.commit()
+	}
+	if err != nil {
+		r.discard()
+	}
+	return err
+}
+
+func (r *reconfiguration) commit() error {
+	if errs := CheckSystem(); len(errs) != 0 {
+		return ErrorList(errs)
+	}
+	var added []*scheduler.FlowFunction
+	for _, ff := range flowFunctions() {
+		if !r.existing[ff] {
+			added = append(added, ff)
+		}
+	}
+	if len(added) > schedState.FreeCoresNumber() {
+		return newError(NotEnoughCores, "There are no free cores for", len(added), "new flow functions")
+	}
+	var created []int
+	for i := range createdPorts {
+		if createdPorts[i].config != inactivePort && !createdPorts[i].started {
+			if err := low.CreatePort(createdPorts[i].port, createdPorts[i].rxQueuesNumber, createdPorts[i].txQueuesNumber, hwtxchecksum); err != nil {
+				for _, j := range created {
+					low.StopPort(createdPorts[j].port)
+				}
+				return newError(FailToInitPort, err)
+			}
+			created = append(created, i)
+		}
+	}
+	for _, i := range created {
+		createdPorts[i].started = true
+	}
+	var restarted []*scheduler.FlowFunction
+	for ff := range r.inputs {
+		if schedState.StopFlowFunction(ff) {
+			restarted = append(restarted, ff)
+		}
+	}
+	for ff, in := range r.inputs {
+		setInput(ff, in)
+	}
+	for _, ff := range added {
+		schedState.StartFlowFunction(ff)
+	}
+	for _, ff := range restarted {
+		schedState.StartFlowFunction(ff)
+	}
+	return nil
+}
+
+func (r *reconfiguration) discard() {
+	schedState.UnClonable = r.filter(schedState.UnClonable)
+	schedState.Clonable = r.filter(schedState.Clonable)
+	schedState.Generate = r.filter(schedState.Generate)
+	copy(createdPorts, r.ports)
+	for _, p := range points[r.points:] {
+		p.ring = nil
+	}
+	points = points[:r.points]
+	openFlowsNumber = r.openFlowsNumber
+}
+
+func (r *reconfiguration) filter(ffs []*scheduler.FlowFunction) []*scheduler.FlowFunction {
+	left := ffs[:0]
+	for _, ff := range ffs {
+		if r.existing[ff] {
+			left = append(left, ff)
+		} else {
+			// Files of new writers are already created
+			finishFlowFunction(ff)
+		}
+	}
+	return left
+}
+
+// input returns ring from which flow function takes packets including
+// changes which are not applied yet.
+func input(ff *scheduler.FlowFunction) *low.Queue {
+	if current != nil {
+		if in, ok := current.inputs[ff]; ok {
+			return in
+		}
+	}
+	in, _ := flowFunctionRings(ff)
+	if len(in) == 0 {
+		return nil
+	}
+	return in[0]
+}
+
+// setInput changes input ring of flow function. Started flow function is
+// changed when it is stopped by Reconfigure.
+func setInput(ff *scheduler.FlowFunction, ring *low.Queue) {
+	if current != nil && current.existing[ff] {
+		current.inputs[ff] = ring
+		return
+	}
+	if in := input(ff); in != nil {
+		replaceRing(ff, in, ring)
+	}
+}
+
+// consumer returns flow function which takes packets from point.
+func consumer(p *Point) (*scheduler.FlowFunction, error) {
+	if p == nil || p.ring == nil {
+		return nil, newError(BadPoint, "Point is removed from flow graph")
+	}
+	if p.ring == schedState.StopRing {
+		return nil, newError(BadPoint, "Packets of point are dropped")
+	}
+	for _, ff := range flowFunctions() {
+		if input(ff) == p.ring {
+			return ff, nil
+		}
+	}
+	return nil, newError(BadPoint, "Point has no flow function which takes its packets")
+}
+
+// SetTap adds copy function at point of flow graph. Packets which pass
+// point aren't changed. Returns new opened flow with copies of these packets.
+// If system is started SetTap can be called only inside Reconfigure.
+// Function can panic during execution.
+func SetTap(p *Point) (OUT *Flow) {
+	OUT, err := TrySetTap(p)
+	must(err)
+	return OUT
+}
+
+// TrySetTap is the same as SetTap but returns error instead of
+// terminating the process.
+func TrySetTap(p *Point) (OUT *Flow, err error) {
+	if err := checkGraphChange(); err != nil {
+		return nil, err
+	}
+	next, err := consumer(p)
+	if err != nil {
+		return nil, err
+	}
+	ring := low.CreateQueue(generateRingName(), burstSize*sizeMultiplier)
+	ringCopy := low.CreateQueue(generateRingName(), burstSize*sizeMultiplier)
+	tap := makeCopier(p.ring, ring, ringCopy, 1, 0)
+	schedState.UnClonable = append(schedState.UnClonable, tap)
+	setInput(next, ring)
+	OUT = new(Flow)
+	OUT.current = ringCopy
+	openFlowsNumber++
+	return OUT, nil
+}
+
+// SwapHandler replaces handler which takes packets from point by new
+// handler with the same output flow. Gets the same arguments as SetHandler.
+// Old handler finishes packets which it has already taken, other packets
+// are handled by new handler. SwapHandler shouldn't be called inside
+// Reconfigure and from user functions of flow graph.
+// Function can panic during execution.
+func SwapHandler(p *Point, handleFunction interface{}, context UserContext) {
+	must(TrySwapHandler(p, handleFunction, context))
+}
+
+// TrySwapHandler is the same as SwapHandler but returns error instead of
+// terminating the process.
+func TrySwapHandler(p *Point, handleFunction interface{}, context UserContext) error {
+	switch handleFunction.(type) {
+	case func(*packet.Packet, UserContext), func([]*packet.Packet, uint, UserContext),
+		func(*packet.Packet, UserContext) bool, func([]*packet.Packet, []bool, uint, UserContext):
+	default:
+		return errBadFunction("SwapHandler")
+	}
+	return execute(func() error {
+		old, err := consumer(p)
+		if err != nil {
+			return err
+		}
+		var out *low.Queue
+		switch par := old.Parameters.(type) {
+		case *handleParameters:
+			out = par.out
+		case *separateParameters:
+			if par.outFalse != schedState.StopRing {
+				return newError(BadPoint, "Point is followed by separator, not by handler")
+			}
+			out = par.outTrue
+		default:
+			return newError(BadPoint, "Point isn't followed by handler")
+		}
+		handle := makeHandleFunction(p.ring, out, handleFunction, context)
+		started := schedState.StopFlowFunction(old)
+		for i := range schedState.Clonable {
+			if schedState.Clonable[i] == old {
+				schedState.Clonable[i] = handle
+			}
+		}
+		if started {
+			schedState.StartFlowFunction(handle)
+		}
+		return nil
+	})
+}
+
+// RemoveBranch removes part of flow graph which begins at point. Flow
+// functions are removed if all their input flows or all their output flows
+// are removed, so functions which only send packets to removed part are
+// removed too. Packets which other functions send to removed part are
+// dropped, copy functions which make copies only to removed part are
+// removed from graph. Packets which are left in removed part are processed
+// before it is removed. Ports which aren't used anymore are stopped. Flows
+// which are left open in removed part are closed.
+// RemoveBranch shouldn't be called inside Reconfigure and from user
+// functions of flow graph.
+// Function can panic during execution.
+func RemoveBranch(p *Point) {
+	must(TryRemoveBranch(p))
+}
+
+// TryRemoveBranch is the same as RemoveBranch but returns error instead of
+// terminating the process.
+func TryRemoveBranch(p *Point) error {
+	return execute(func() error {
+		return removeBranch(p)
+	})
+}
+
+func removeBranch(p *Point) error {
+	if p == nil || p.ring == nil {
+		return newError(BadPoint, "Point is removed from flow graph")
+	}
+	if p.ring == schedState.StopRing {
+		return newError(BadPoint, "Packets of point are dropped")
+	}
+	all := flowFunctions()
+	producers := make(map[*low.Queue][]*scheduler.FlowFunction)
+	for _, ff := range all {
+		_, out := flowFunctionRings(ff)
+		for _, ring := range out {
+			producers[ring] = append(producers[ring], ff)
+		}
+	}
+	// Ring is removed if it is point, if all its producers are removed or
+	// if its consumer is removed.
+	dead := map[*low.Queue]bool{p.ring: true}
+	removed := make(map[*scheduler.FlowFunction]bool)
+	for changed := true; changed; {
+		changed = false
+		for _, ff := range all {
+			in, out := flowFunctionRings(ff)
+			if removed[ff] || !(allDead(in, dead) || allDead(out, dead)) {
+				continue
+			}
+			removed[ff] = true
+			changed = true
+			for _, ring := range in {
+				dead[ring] = true
+			}
+			for _, ring := range out {
+				if allRemoved(producers[ring], removed) {
+					dead[ring] = true
+				}
+			}
+		}
+	}
+
+	rx := make(map[uint8]uint16)
+	for ff := range removed {
+		if par, ok := ff.Parameters.(*receiveParameters); ok {
+			rx[par.port]++
+		}
+	}
+	for port, n := range rx {
+		if n != createdPorts[port].rxQueuesNumber {
+			return newError(NotAllQueuesUsed, "Branch can't be removed because it uses only part of receive queues of port", port)
+		}
+	}
+
+	// Flows which are left open in removed part are closed. Their rings
+	// don't have consumers.
+	consumed := make(map[*low.Queue]bool)
+	for _, ff := range all {
+		in, _ := flowFunctionRings(ff)
+		for _, ring := range in {
+			consumed[ring] = true
+		}
+	}
+	for ring := range dead {
+		if !consumed[ring] {
+			removedRings[ring] = true
+			openFlowsNumber--
+		}
+	}
+
+	// Copiers which make copies only to removed part are bypassed, other
+	// functions drop packets of removed output flows.
+	var bypassed, changed, left []*scheduler.FlowFunction
+	for _, ff := range all {
+		if removed[ff] {
+			continue
+		}
+		left = append(left, ff)
+		_, out := flowFunctionRings(ff)
+		if !anyDead(out, dead) {
+			continue
+		}
+		if par, ok := ff.Parameters.(*copyParameters); ok && dead[par.outCopy] && len(producers[par.out]) == 1 {
+			bypassed = append(bypassed, ff)
+		} else {
+			changed = append(changed, ff)
+		}
+	}
+	var restarted []*scheduler.FlowFunction
+	consumers := make(map[*scheduler.FlowFunction]*scheduler.FlowFunction)
+	for _, ff := range bypassed {
+		schedState.StopFlowFunction(ff)
+	}
+	for _, ff := range bypassed {
+		out := ff.Parameters.(*copyParameters).out
+		for out.GetQueueCount() != 0 {
+			time.Sleep(time.Millisecond)
+		}
+		for _, next := range left {
+			if input(next) == out {
+				consumers[ff] = next
+				changed = append(changed, next)
+			}
+		}
+	}
+	for _, ff := range changed {
+		if schedState.StopFlowFunction(ff) {
+			restarted = append(restarted, ff)
+		}
+	}
+	var removedList []*scheduler.FlowFunction
+	for _, ff := range all {
+		if removed[ff] {
+			removedList = append(removedList, ff)
+		}
+	}
+	stopInOrder(removedList)
+
+	for _, ff := range changed {
+		_, out := flowFunctionRings(ff)
+		for _, ring := range out {
+			if dead[ring] {
+				replaceRing(ff, ring, schedState.StopRing)
+			}
+		}
+	}
+	for ff, next := range consumers {
+		par := ff.Parameters.(*copyParameters)
+		replaceRing(next, par.out, par.in)
+		movePoints(par.out, par.in)
+		removed[ff] = true
+	}
+	for _, p := range points {
+		if dead[p.ring] {
+			p.ring = nil
+		}
+	}
+	keep := func(ffs []*scheduler.FlowFunction) []*scheduler.FlowFunction {
+		left := ffs[:0]
+		for _, ff := range ffs {
+			if !removed[ff] {
+				left = append(left, ff)
+			}
+		}
+		return left
+	}
+	schedState.UnClonable = keep(schedState.UnClonable)
+	schedState.Clonable = keep(schedState.Clonable)
+	schedState.Generate = keep(schedState.Generate)
+	releasePorts(rx)
+	for _, ff := range restarted {
+		if !removed[ff] {
+			schedState.StartFlowFunction(ff)
+		}
+	}
+	return nil
+}
+
+func allDead(rings []*low.Queue, dead map[*low.Queue]bool) bool {
+	for _, ring := range rings {
+		if !dead[ring] {
+			return false
+		}
+	}
+	return len(rings) != 0
+}
+
+func anyDead(rings []*low.Queue, dead map[*low.Queue]bool) bool {
+	for _, ring := range rings {
+		if dead[ring] {
+			return true
+		}
+	}
+	return false
+}
+
+func allRemoved(ffs []*scheduler.FlowFunction, removed map[*scheduler.FlowFunction]bool) bool {
+	for _, ff := range ffs {
+		if !removed[ff] {
+			return false
+		}
+	}
+	return true
+}
+
+// releasePorts stops ports which aren't used by flow functions anymore.
+// Ports which receive queues are removed are logged if they are still
+// used for sending.
+func releasePorts(removedRx map[uint8]uint16) {
+	rx := make([]bool, len(createdPorts))
+	tx := make([]bool, len(createdPorts))
+	for _, ff := range flowFunctions() {
+		switch par := ff.Parameters.(type) {
+		case *receiveParameters:
+			rx[par.port] = true
+		case *sendParameters:
+			tx[par.port] = true
+		}
+	}
+	for i := range createdPorts {
+		if createdPorts[i].config == inactivePort {
+			continue
+		}
+		if rx[i] || tx[i] {
+			if removedRx[uint8(i)] != 0 {
+				common.LogWarning(common.Initialization, "Port", i, "doesn't receive packets anymore")
+			}
+			continue
+		}
+		if createdPorts[i].started {
+			low.StopPort(createdPorts[i].port)
+		}
+		createdPorts[i] = port{port: uint8(i), config: inactivePort}
+	}
+}
@@ -0,0 +1,157 @@
+// Copyright 2017 Intel Corporation.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package flow
+
+import (
+	"errors"
+	"reflect"
+	"sync/atomic"
+	"testing"
+
+	"github.com/intel-go/yanff/packet"
+	"github.com/intel-go/yanff/scheduler"
+)
+
+func generateNothing(pkt *packet.Packet, context UserContext) {}
+
+func handleNothing(pkt *packet.Packet, context UserContext) {}
+
+// startedGraph constructs generator and handler which takes packets from
+// returned point. Graph is marked as started, but flow functions are not
+// started, so Reconfigure changes it directly.
+func startedGraph(t *testing.T) (*Point, *scheduler.FlowFunction) {
+	src := SetGenerator(generateNothing, 0, nil)
+	p := SetPoint(src)
+	SetHandler(src, handleNothing, nil)
+	SetStopper(src)
+	if errs := CheckSystem(); len(errs) != 0 {
+		t.Fatal(errs)
+	}
+	atomic.StoreInt32(&graphState, graphStarted)
+	handler, err := consumer(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p, handler
+}
+
+func TestReconfigureDiscard(t *testing.T) {
+	defer useScheduler(4)()
+	p, handler := startedGraph(t)
+	before := flowFunctions()
+
+	// Error of user function and incorrect new graph discard changes
+	for _, f := range []func() error{
+		func() error {
+			SetStopper(SetTap(p))
+			return errors.New("cancelled")
+		},
+		func() error {
+			SetTap(p)
+			return nil
+		},
+	} {
+		if err := TryReconfigure(f); err == nil {
+			t.Error("Reconfiguration isn't failed")
+		}
+		if !reflect.DeepEqual(flowFunctions(), before) || input(handler) != p.ring ||
+			openFlowsNumber != 0 || len(points) != 1 || graphState != graphStarted {
+			t.Errorf("Reconfiguration isn't discarded: %d flow functions, %d open flows",
+				len(flowFunctions()), openFlowsNumber)
+		}
+	}
+}
+
+func TestReconfigureCommit(t *testing.T) {
+	defer useScheduler(4)()
+	p, handler := startedGraph(t)
+	ring := p.ring
+
+	var tap *Point
+	err := TryReconfigure(func() error {
+		copies := SetTap(p)
+		tap = SetPoint(copies)
+		SetStopper(copies)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ffs := flowFunctions()
+	if len(ffs) != 3 {
+		t.Fatalf("Tap isn't added: %d flow functions", len(ffs))
+	}
+	copier := ffs[1]
+	defer schedState.StopFlowFunction(copier)
+	par, ok := copier.Parameters.(*copyParameters)
+	if !ok || par.in != ring || input(handler) != par.out || tap.ring != schedState.StopRing {
+		t.Errorf("Tap isn't inserted between generator and handler")
+	}
+	if openFlowsNumber != 0 || len(points) != 2 {
+		t.Errorf("Incorrect graph after reconfiguration: %d open flows, %d points", openFlowsNumber, len(points))
+	}
+	if schedState.FreeCoresNumber() != 3 {
+		t.Errorf("Tap isn't started, %d free cores", schedState.FreeCoresNumber())
+	}
+}
+
+func TestRemoveBranch(t *testing.T) {
+	defer useScheduler(4)()
+	// The first branch has handler and copier which copies are left
+	// open, the second branch only drops generated packets.
+	first := SetGenerator(generateNothing, 0, nil)
+	p := SetPoint(first)
+	SetHandler(first, handleNothing, nil)
+	copies := SetCopier(first)
+	SetStopper(first)
+	second := SetGenerator(generateNothing, 0, nil)
+	SetStopper(second)
+	kept := schedState.UnClonable[len(schedState.UnClonable)-1]
+	if openFlowsNumber != 1 {
+		t.Fatalf("Incorrect number of open flows %d", openFlowsNumber)
+	}
+
+	if err := TryRemoveBranch(p); err != nil {
+		t.Fatal(err)
+	}
+	if ffs := flowFunctions(); len(ffs) != 1 || ffs[0] != kept {
+		t.Errorf("Incorrect flow functions are left: %d", len(ffs))
+	}
+	if openFlowsNumber != 0 || len(CheckSystem()) != 0 {
+		t.Errorf("Open flow of removed branch is counted: %d", openFlowsNumber)
+	}
+	if err := TrySetStopper(copies); err == nil || err.(*Error).Code != UseClosedFlow {
+		t.Errorf("Flow of removed branch can be used: %v", err)
+	}
+	if openFlowsNumber != 0 {
+		t.Errorf("Closed flow changes number of open flows: %d", openFlowsNumber)
+	}
+	if err := TryRemoveBranch(p); err == nil || err.(*Error).Code != BadPoint {
+		t.Errorf("Removed point is accepted: %v", err)
+	}
+}
+
+func TestSwapHandler(t *testing.T) {
+	defer useScheduler(4)()
+	p, old := startedGraph(t)
+	out := old.Parameters.(*handleParameters).out
+
+	err := TrySwapHandler(p, func(pkt *packet.Packet) {}, nil)
+	if e, ok := err.(*Error); !ok || e.Code != BadFunctionType {
+		t.Errorf("BadFunctionType expected, got %v", err)
+	}
+	if next, _ := consumer(p); next != old {
+		t.Errorf("Handler is replaced by function of incorrect type")
+	}
+
+	if err := TrySwapHandler(p, func(pkt *packet.Packet, context UserContext) bool { return true }, nil); err != nil {
+		t.Fatal(err)
+	}
+	next, _ := consumer(p)
+	par, ok := next.Parameters.(*separateParameters)
+	if next == old || !ok || par.outTrue != out || par.outFalse != schedState.StopRing {
+		t.Errorf("Handler isn't replaced by separator with the same output")
+	}
+}
@@ -61,6 +61,10 @@ const float multiplier = 84.0 * 8.0 / 1000.0 / 1000.0;
 
 uint32_t BURST_SIZE;
 
+// Stop flag is set by Go code while polling loop is running, so it
+// should be reread from memory on each check.
+#define stopRequested(stop) (*(volatile int32_t *)(stop))
+
 void initCPUSet(uint8_t coreId, cpu_set_t* cpuset) {
 	CPU_ZERO(cpuset);
 	CPU_SET(coreId, cpuset);
@@ -181,7 +185,7 @@ struct rte_mbuf* reassemble(struct rte_ip_frag_tbl* tbl, struct rte_mbuf *buf, s
 	return buf;
 }
 
-void yanff_recv(uint8_t port, uint16_t queue, struct rte_ring *out_ring, uint8_t coreId) {
+void yanff_recv(uint8_t port, uint16_t queue, struct rte_ring *out_ring, int32_t *stop, uint8_t coreId) {
 	setAffinity(coreId);
 
 	struct rte_mbuf *bufs[BURST_SIZE];
@@ -193,8 +197,8 @@ void yanff_recv(uint8_t port, uint16_t queue, struct rte_ring *out_ring, uint8_t
 	death_row.cnt = 0; // DPDK doesn't initialize this field. It is probably a bug.
 	struct rte_mbuf *temp;
 #endif
-	// Run until the application is quit. Recv can't be stopped now.
-	for (;;) {
+	// Run until stop flag is set.
+	while (stopRequested(stop) == 0) {
 		// Get RX packets from port
 		uint16_t rx_pkts_number = rte_eth_rx_burst(port, queue, bufs, BURST_SIZE);
 #ifdef REASSEMBLY
@@ -246,13 +250,13 @@ void yanff_recv(uint8_t port, uint16_t queue, struct rte_ring *out_ring, uint8_t
 	}
 }
 
-void yanff_send(uint8_t port, uint16_t queue, struct rte_ring *in_ring, uint8_t coreId) {
+void yanff_send(uint8_t port, uint16_t queue, struct rte_ring *in_ring, int32_t *stop, uint8_t coreId) {
 	setAffinity(coreId);
 
 	struct rte_mbuf *bufs[BURST_SIZE];
 	uint16_t buf;
-	// Run until the application is quit. Send can't be stopped now.
-	for (;;) {
+	// Run until stop flag is set.
+	while (stopRequested(stop) == 0) {
 		// Get packets for TX from ring
 		uint16_t pkts_for_tx_number = rte_ring_mc_dequeue_burst(in_ring, (void*)bufs, BURST_SIZE, NULL);
 
@@ -273,16 +277,19 @@ void yanff_send(uint8_t port, uint16_t queue, struct rte_ring *in_ring, uint8_t
 	}
 }
 
-void yanff_stop(struct rte_ring *in_ring) {
+void yanff_stop(struct rte_ring *in_ring, int32_t *stop) {
 	struct rte_mbuf *bufs[BURST_SIZE];
 	uint16_t buf;
-	// Run until the application is quit. Stop can't be stopped now.
+	// Run until stop flag is set and ring is empty.
 	for (;;) {
 		// Get packets for freeing from ring
 		uint16_t pkts_for_free_number = rte_ring_mc_dequeue_burst(in_ring, (void*)bufs, BURST_SIZE, NULL);
 
-		if (unlikely(pkts_for_free_number == 0))
+		if (unlikely(pkts_for_free_number == 0)) {
+			if (stopRequested(stop))
+				return;
 			continue;
+		}
 
 		// Free all this packets
 		for (buf = 0; buf < pkts_for_free_number; buf++)
@@ -335,19 +342,22 @@ void statistics(float N) {
 }
 
 // Initialize the Environment Abstraction Layer (EAL) in DPDK.
-void eal_init(int argc, char *argv[], uint32_t burstSize)
+// Returns -1 if EAL can't be initialized and -2 if not all parameters
+// are parsed.
+int eal_init(int argc, char *argv[], uint32_t burstSize)
 {
 	int ret = rte_eal_init(argc, argv);
 	if (ret < 0)
-		rte_exit(EXIT_FAILURE, "Error with EAL initialization\n");
+		return -1;
 	if (ret < argc-1)
-		rte_exit(EXIT_FAILURE, "rte_eal_init can't parse all parameters\n");
+		return -2;
 	free(argv[argc-1]);
 	free(argv);
 	BURST_SIZE = burstSize;
 	mbufStructSize = sizeof(struct rte_mbuf);
 	headroomSize = RTE_PKTMBUF_HEADROOM;
 	defaultStart = mbufStructSize + headroomSize;
+	return 0;
 }
 
 int allocateMbufs(struct rte_mempool *mempool, struct rte_mbuf **bufs, unsigned count);
@@ -394,3 +404,11 @@ int allocateMbufs(struct rte_mempool *mempool, struct rte_mbuf **bufs, unsigned
 int getMempoolSpace(struct rte_mempool * m) {
 	return rte_mempool_in_use_count(m);
 }
+
+int chainMbuf(struct rte_mbuf *head, struct rte_mbuf *tail) {
+	return rte_pktmbuf_chain(head, tail);
+}
+
+int linearizeMbuf(struct rte_mbuf *m) {
+	return rte_pktmbuf_linearize(m);
+}
@@ -7,10 +7,10 @@ package low
 /*
 #include "yanff_queue.h"
 
-extern void eal_init(int argc, char **argv, uint32_t burstSize);
-extern void yanff_recv(uint8_t port, uint16_t queue, struct rte_ring *, uint8_t coreID);
-extern void yanff_send(uint8_t port, uint16_t queue, struct rte_ring *, uint8_t coreID);
-extern void yanff_stop(struct rte_ring *);
+extern int eal_init(int argc, char **argv, uint32_t burstSize);
+extern void yanff_recv(uint8_t port, uint16_t queue, struct rte_ring *, int32_t *stop, uint8_t coreID);
+extern void yanff_send(uint8_t port, uint16_t queue, struct rte_ring *, int32_t *stop, uint8_t coreID);
+extern void yanff_stop(struct rte_ring *, int32_t *stop);
 extern void initCPUSet(uint8_t coreID, cpu_set_t* cpuset);
 extern int port_init(uint8_t port, uint16_t receiveQueuesNumber, uint16_t sendQueuesNumber, struct rte_mempool *mbuf_pool,
     struct ether_addr *addr, bool hwtxchecksum);
@@ -21,11 +21,15 @@ extern void handleArgv(char **, char* s, int i);
 extern int allocateMbufs(struct rte_mempool *mempool, struct rte_mbuf **bufs, unsigned count);
 extern void statistics(float N);
 extern int getMempoolSpace(struct rte_mempool * m);
+extern int chainMbuf(struct rte_mbuf *head, struct rte_mbuf *tail);
+extern int linearizeMbuf(struct rte_mbuf *m);
 */
 import "C"
 
 import (
 	"encoding/hex"
+	"errors"
+	"fmt"
 	"math"
 	"os"
 	"runtime"
@@ -113,6 +117,12 @@ func AppendMbuf(mb *Mbuf, length uint) bool {
 	return true
 }
 
+// GetMbufTailroom returns number of bytes which can be appended to mbuf.
+// Heavily based on DPDK rte_pktmbuf_tailroom
+func GetMbufTailroom(mb *Mbuf) uint {
+	return uint(mb.buf_len - mb.data_off - mb.data_len)
+}
+
 // AdjMbuf removes length bytes at mbuf beginning.
 // Heavily based on DPDK rte_pktmbuf_adj
 func AdjMbuf(m *Mbuf, length uint) bool {
@@ -136,6 +146,18 @@ func TrimMbuf(m *Mbuf, length uint) bool {
 	return true
 }
 
+// ChainMbuf appends chain of mbufs tail to the end of chain head.
+// Length of packet in head is increased. Return false if error.
+func ChainMbuf(head *Mbuf, tail *Mbuf) bool {
+	return C.chainMbuf((*C.struct_rte_mbuf)(head), (*C.struct_rte_mbuf)(tail)) == 0
+}
+
+// LinearizeMbuf copies data of all chained mbufs to the first one
+// and frees others. Return false if first mbuf doesn't have enough space.
+func LinearizeMbuf(mb *Mbuf) bool {
+	return C.linearizeMbuf((*C.struct_rte_mbuf)(mb)) == 0
+}
+
 // SetTXIPv4OLFlags sets mbuf flags for IPv4 header
 // checksum calculation offloading.
 func SetTXIPv4OLFlags(mb *Mbuf, l2len, l3len uint32) {
@@ -211,6 +233,52 @@ func SetTXIPv6TCPOLFlags(mb *Mbuf, l2len, l3len uint32) {
 	mb.anon3[7] = 0
 }
 
+// TX checksum offloading flags of mbuf which are set by SetTX*OLFlags
+// functions and are returned by GetTXOLFlags.
+const (
+	TXL4Checksum = 3 << 52 // PKT_TX_L4_MASK
+	TXIPChecksum = 1 << 54 // PKT_TX_IP_CKSUM
+)
+
+// GetTXOLFlags returns offloading flags which were set for transmit.
+func GetTXOLFlags(mb *Mbuf) uint64 {
+	return uint64(mb.ol_flags)
+}
+
+// SetTXL2Len changes L2 header length which was set by one of
+// SetTX*OLFlags functions. Is used if L2 header grows after that.
+func SetTXL2Len(mb *Mbuf, l2len uint32) {
+	mb.anon3[0] = uint8((l2len & 0x7f) | (uint32(mb.anon3[0]) & 0x80))
+}
+
+// RX checksum offloading flags of mbuf which are returned by GetRXOLFlags.
+// If both good and bad flags are set checksum in packet is not correct but
+// integrity of header or data was verified by NIC.
+const (
+	RXL4ChecksumBad  = 1 << 3 // PKT_RX_L4_CKSUM_BAD
+	RXIPChecksumBad  = 1 << 4 // PKT_RX_IP_CKSUM_BAD
+	RXIPChecksumGood = 1 << 7 // PKT_RX_IP_CKSUM_GOOD
+	RXL4ChecksumGood = 1 << 8 // PKT_RX_L4_CKSUM_GOOD
+)
+
+// GetRXOLFlags returns offloading flags which were set by NIC on receive.
+func GetRXOLFlags(mb *Mbuf) uint64 {
+	return uint64(mb.ol_flags)
+}
+
+// RXTimestamp is offloading flag which means that NIC set RX timestamp
+// of mbuf. It is PKT_RX_TIMESTAMP.
+const RXTimestamp = 1 << 17
+
+// GetMbufTimestamp returns RX timestamp of mbuf which was set by NIC.
+// Its unit depends on NIC. Return false if timestamp was not set.
+func GetMbufTimestamp(mb *Mbuf) (uint64, bool) {
+	if uint64(mb.ol_flags)&RXTimestamp == 0 {
+		return 0, false
+	}
+	return uint64(mb.timestamp), true
+}
+
 // These constants are used by packet package to parse protocol headers
 const (
 	RtePtypeL2Ether = C.RTE_PTYPE_L2_ETHER
@@ -431,27 +499,41 @@ func (queue *Queue) GetQueueCount() uint32 {
 	return uint32((queue.ring.DPDK_ring.prod.tail - queue.ring.DPDK_ring.cons.tail) & queue.ring.DPDK_ring.mask)
 }
 
+// GetQueueName gets name of queue.
+func (queue *Queue) GetQueueName() string {
+	return C.GoString(&queue.ring.DPDK_ring.name[0])
+}
+
+// GetQueueCapacity gets maximum number of objects in queue.
+func (queue *Queue) GetQueueCapacity() uint32 {
+	return uint32(queue.ring.DPDK_ring.mask)
+}
+
 // Receive - get packets and enqueue on a Queue.
-func Receive(port uint8, queue uint16, OUT *Queue, coreID uint8) {
+// Returns when stop is set to non zero value.
+func Receive(port uint8, queue uint16, OUT *Queue, stop *int32, coreID uint8) {
 	t := C.rte_eth_dev_socket_id(C.uint8_t(port))
 	if t > 0 && t != C.int(C.rte_lcore_to_socket_id(C.uint(coreID))) {
 		common.LogWarning(common.Initialization, "Receive port", port, "is on remote NUMA node to polling thread - not optimal performance.")
 	}
-	C.yanff_recv(C.uint8_t(port), C.uint16_t(queue), OUT.ring.DPDK_ring, C.uint8_t(coreID))
+	C.yanff_recv(C.uint8_t(port), C.uint16_t(queue), OUT.ring.DPDK_ring, (*C.int32_t)(unsafe.Pointer(stop)), C.uint8_t(coreID))
 }
 
 // Send - dequeue packets and send.
-func Send(port uint8, queue uint16, IN *Queue, coreID uint8) {
+// Returns when stop is set to non zero value. Packets which are left in
+// queue can be sent after next call.
+func Send(port uint8, queue uint16, IN *Queue, stop *int32, coreID uint8) {
 	t := C.rte_eth_dev_socket_id(C.uint8_t(port))
 	if t > 0 && t != C.int(C.rte_lcore_to_socket_id(C.uint(coreID))) {
 		common.LogWarning(common.Initialization, "Send port", port, "is on remote NUMA node to polling thread - not optimal performance.")
 	}
-	C.yanff_send(C.uint8_t(port), C.uint16_t(queue), IN.ring.DPDK_ring, C.uint8_t(coreID))
+	C.yanff_send(C.uint8_t(port), C.uint16_t(queue), IN.ring.DPDK_ring, (*C.int32_t)(unsafe.Pointer(stop)), C.uint8_t(coreID))
 }
 
 // Stop - dequeue and free packets.
-func Stop(IN *Queue) {
-	C.yanff_stop(IN.ring.DPDK_ring)
+// Returns when stop is set to non zero value and queue is empty.
+func Stop(IN *Queue, stop *int32) {
+	C.yanff_stop(IN.ring.DPDK_ring, (*C.int32_t)(unsafe.Pointer(stop)))
 }
 
 // InitDPDKArguments allocates and initializes arguments for dpdk.
@@ -468,11 +550,18 @@ func InitDPDKArguments(args []string) (C.int, **C.char) {
 }
 
 // InitDPDK initializes the Environment Abstraction Layer (EAL) in DPDK.
-func InitDPDK(argc C.int, argv **C.char, burstSize uint, mbufNumber uint, mbufCacheSize uint) {
-	C.eal_init(argc, argv, C.uint32_t(burstSize))
+// Returns error if EAL can't be initialized with given arguments.
+func InitDPDK(argc C.int, argv **C.char, burstSize uint, mbufNumber uint, mbufCacheSize uint) error {
+	switch C.eal_init(argc, argv, C.uint32_t(burstSize)) {
+	case -1:
+		return errors.New("Error with EAL initialization")
+	case -2:
+		return errors.New("rte_eal_init can't parse all parameters")
+	}
 
 	mbufNumberT = mbufNumber
 	mbufCacheSizeT = mbufCacheSize
+	return nil
 }
 
 // GetPortsNumber gets total number of available Ethernet devices.
@@ -481,7 +570,8 @@ func GetPortsNumber() int {
 }
 
 // CreatePort initializes a new port using global settings and parameters.
-func CreatePort(port uint8, receiveQueuesNumber uint16, sendQueuesNumber uint16, hwtxchecksum bool) {
+// Returns error if port can't be initialized.
+func CreatePort(port uint8, receiveQueuesNumber uint16, sendQueuesNumber uint16, hwtxchecksum bool) error {
 	addr := make([]byte, C.ETHER_ADDR_LEN)
 	var mempool *C.struct_rte_mempool
 	if receiveQueuesNumber != 0 {
@@ -492,10 +582,16 @@ func CreatePort(port uint8, receiveQueuesNumber uint16, sendQueuesNumber uint16,
 	}
 	if C.port_init(C.uint8_t(port), C.uint16_t(receiveQueuesNumber), C.uint16_t(sendQueuesNumber),
 		mempool, (*C.struct_ether_addr)(unsafe.Pointer(&(addr[0]))), C._Bool(hwtxchecksum)) != 0 {
-		common.LogError(common.Initialization, "Cannot init port ", port, "!")
+		return fmt.Errorf("Cannot init port %d!", port)
 	}
 	t := hex.Dump(addr)
 	common.LogDebug(common.Initialization, "Port", port, "MAC address:", t[10:27])
+	return nil
+}
+
+// StopPort stops given port. Port can be initialized again by CreatePort.
+func StopPort(port uint8) {
+	C.rte_eth_dev_stop(C.uint8_t(port))
 }
 
 // CreateMempool creates and returns a new memory pool.
@@ -506,6 +602,15 @@ func CreateMempool() *Mempool {
 	return (*Mempool)(mempool)
 }
 
+// FreeMempools frees all memory pools created by CreatePort and
+// CreateMempool. Mbufs from these pools shouldn't be used after this.
+func FreeMempools() {
+	for _, m := range usedMempools {
+		C.rte_mempool_free(m)
+	}
+	usedMempools = nil
+}
+
 // SetAffinity sets cpu affinity mask.
 func SetAffinity(coreID uint8) {
 	// go tool trace shows that each proc executes different goroutine. However it is expected behavior
@@ -525,6 +630,12 @@ func AllocateMbufs(mb []uintptr, mempool *Mempool) {
 	}
 }
 
+// TryAllocateMbufs allocates a bulk of mbufs. Unlike AllocateMbufs
+// it doesn't stop application if mempool is empty, it returns false.
+func TryAllocateMbufs(mb []uintptr, mempool *Mempool) bool {
+	return C.allocateMbufs((*C.struct_rte_mempool)(mempool), (**C.struct_rte_mbuf)(unsafe.Pointer(&mb[0])), C.unsigned(len(mb))) == 0
+}
+
 // WriteDataToMbuf copies data to mbuf.
 func WriteDataToMbuf(mb *Mbuf, data []byte) {
 	d := unsafe.Pointer(GetPacketDataStartPointer(mb))
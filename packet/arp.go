@@ -0,0 +1,117 @@
+// Copyright 2017 Intel Corporation.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package packet
+
+import (
+	"fmt"
+	"unsafe"
+
+	. "github.com/intel-go/yanff/common"
+	"github.com/intel-go/yanff/low"
+)
+
+// ARPHdr is ARP header for IPv4 over Ethernet (RFC 826).
+// IPv4 addresses are stored as byte arrays because they are not aligned
+// inside header. Use ArrayToIPv4 and IPv4ToBytes to convert them.
+type ARPHdr struct {
+	HType     uint16              // Hardware type, ARPHardwareEthernet
+	PType     uint16              // Protocol type, IPV4Number
+	HLen      uint8               // Hardware address length
+	PLen      uint8               // Protocol address length
+	Operation uint16              // ARPRequest or ARPReply
+	SHA       [EtherAddrLen]uint8 // Sender hardware address
+	SPA       [IPv4AddrLen]uint8  // Sender protocol address
+	THA       [EtherAddrLen]uint8 // Target hardware address
+	TPA       [IPv4AddrLen]uint8  // Target protocol address
+}
+
+func (hdr *ARPHdr) String() string {
+	r0 := "    L3 protocol: ARP\n"
+	r1 := fmt.Sprintf("    ARP Operation: %d\n", SwapBytesUint16(hdr.Operation))
+	s := hdr.SHA
+	r2 := fmt.Sprintf("    ARP Sender: %02x:%02x:%02x:%02x:%02x:%02x %d.%d.%d.%d\n", s[0], s[1], s[2], s[3], s[4], s[5],
+		hdr.SPA[0], hdr.SPA[1], hdr.SPA[2], hdr.SPA[3])
+	t := hdr.THA
+	r3 := fmt.Sprintf("    ARP Target: %02x:%02x:%02x:%02x:%02x:%02x %d.%d.%d.%d\n", t[0], t[1], t[2], t[3], t[4], t[5],
+		hdr.TPA[0], hdr.TPA[1], hdr.TPA[2], hdr.TPA[3])
+	return r0 + r1 + r2 + r3
+}
+
+// BroadcastMAC is a broadcast Ethernet address.
+var BroadcastMAC = [EtherAddrLen]uint8{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+
+// GetARP ensures if EtherType is ARP and cast L3 pointer to *ARPHdr type.
+func (packet *Packet) GetARP() *ARPHdr {
+	if packet.GetEtherType() == SwapBytesUint16(ARPNumber) {
+		return (*ARPHdr)(packet.L3)
+	}
+	return nil
+}
+
+// IPv4ToBytes converts IPv4 address from IPv4Hdr field format to byte array.
+func IPv4ToBytes(addr uint32) [IPv4AddrLen]uint8 {
+	return [IPv4AddrLen]uint8{byte(addr), byte(addr >> 8), byte(addr >> 16), byte(addr >> 24)}
+}
+
+// ArrayToIPv4 converts byte array to IPv4 address in IPv4Hdr field format.
+func ArrayToIPv4(a [IPv4AddrLen]uint8) uint32 {
+	return IPv4(a[0], a[1], a[2], a[3])
+}
+
+func initEmptyARPPacket(packet *Packet) bool {
+	bufSize := uint(EtherLen + ARPLen)
+	if low.AppendMbuf(packet.CMbuf, bufSize) == false {
+		LogWarning(Debug, "initEmptyARPPacket: Cannot append mbuf")
+		return false
+	}
+	packet.Ether.EtherType = SwapBytesUint16(ARPNumber)
+	packet.ParseL3()
+	packet.Data = unsafe.Pointer(packet.unparsed() + ARPLen)
+
+	arp := packet.GetARP()
+	arp.HType = SwapBytesUint16(ARPHardwareEthernet)
+	arp.PType = SwapBytesUint16(IPV4Number)
+	arp.HLen = EtherAddrLen
+	arp.PLen = IPv4AddrLen
+	return true
+}
+
+// InitARPRequest initializes input packet as broadcast ARP request which
+// asks MAC address of tpa. IPv4 addresses have IPv4Hdr field format, e.g.
+// constructed by IPv4 function.
+func InitARPRequest(packet *Packet, sha [EtherAddrLen]uint8, spa, tpa uint32) bool {
+	if initEmptyARPPacket(packet) == false {
+		return false
+	}
+	packet.Ether.DAddr = BroadcastMAC
+	packet.Ether.SAddr = sha
+
+	arp := packet.GetARP()
+	arp.Operation = SwapBytesUint16(ARPRequest)
+	arp.SHA = sha
+	arp.SPA = IPv4ToBytes(spa)
+	arp.THA = [EtherAddrLen]uint8{}
+	arp.TPA = IPv4ToBytes(tpa)
+	return true
+}
+
+// InitARPReply initializes input packet as ARP reply which tells tha
+// owner of tpa that MAC address of spa is sha. IPv4 addresses have
+// IPv4Hdr field format, e.g. constructed by IPv4 function.
+func InitARPReply(packet *Packet, sha, tha [EtherAddrLen]uint8, spa, tpa uint32) bool {
+	if initEmptyARPPacket(packet) == false {
+		return false
+	}
+	packet.Ether.DAddr = tha
+	packet.Ether.SAddr = sha
+
+	arp := packet.GetARP()
+	arp.Operation = SwapBytesUint16(ARPReply)
+	arp.SHA = sha
+	arp.SPA = IPv4ToBytes(spa)
+	arp.THA = tha
+	arp.TPA = IPv4ToBytes(tpa)
+	return true
+}
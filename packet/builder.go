@@ -0,0 +1,334 @@
+// Copyright 2017 Intel Corporation.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package packet
+
+import (
+	"net"
+	"unsafe"
+
+	. "github.com/intel-go/yanff/common"
+	"github.com/intel-go/yanff/low"
+)
+
+// Builder generates packet layer by layer. All values are given in host
+// byte order, addresses are given as net.HardwareAddr and net.IP. Typical
+// usage is:
+//
+//	ok := packet.Build(pkt).
+//		Ether(dstMAC, srcMAC).
+//		VLAN(100).
+//		IPv4(net.IPv4(10, 0, 0, 1), net.IPv4(10, 0, 0, 2)).
+//		UDP(1234, 5678).
+//		Payload(data)
+//
+// Layers should be added from L2 to L4. Packet is written only by Payload,
+// which fills EtherTypes, protocol numbers, lengths and checksums. If
+// hardware checksum offloading is enabled by SetHWTXChecksumFlag only
+// pseudo header checksums are calculated and offloading flags are set.
+// Any error is remembered, so Payload returns false and packet is not
+// changed.
+type Builder struct {
+	packet *Packet
+	failed bool
+
+	dstMAC [EtherAddrLen]uint8
+	srcMAC [EtherAddrLen]uint8
+	tags   []uint16 // TCI of VLAN tags from outer to inner
+
+	l3      uint16 // IPV4Number, IPV6Number or zero if absent
+	srcIPv4 uint32
+	dstIPv4 uint32
+	srcIPv6 [IPv6AddrLen]uint8
+	dstIPv6 [IPv6AddrLen]uint8
+
+	l4       uint8 // TCPNumber, UDPNumber, ICMPNumber or zero if absent
+	srcPort  uint16
+	dstPort  uint16
+	seq      uint32
+	ack      uint32
+	tcpFlags TCPFlags
+	icmpType uint8
+	icmpCode uint8
+	icmpID   uint16
+	icmpSeq  uint16
+}
+
+// Build returns builder which writes headers to packet. Packet should
+// be empty, for example just allocated.
+func Build(packet *Packet) *Builder {
+	return &Builder{packet: packet}
+}
+
+func (b *Builder) fail(msg string) *Builder {
+	LogWarning(Debug, "Builder:", msg)
+	b.failed = true
+	return b
+}
+
+// Ether sets destination and source MAC addresses. Zero addresses are
+// used if Ether is not called or address is nil.
+func (b *Builder) Ether(dst, src net.HardwareAddr) *Builder {
+	if b.tags != nil || b.l3 != 0 {
+		return b.fail("Ethernet header should be the first layer")
+	}
+	if (dst != nil && len(dst) != EtherAddrLen) || (src != nil && len(src) != EtherAddrLen) {
+		return b.fail("Incorrect MAC address")
+	}
+	copy(b.dstMAC[:], dst)
+	copy(b.srcMAC[:], src)
+	return b
+}
+
+// VLAN adds VLAN tag with given TCI after previously added tags. If there
+// are several tags outer ones get QinQNumber TPID and the last one gets
+// VLANNumber TPID.
+func (b *Builder) VLAN(tci uint16) *Builder {
+	if b.l3 != 0 {
+		return b.fail("VLAN tag should be added before L3 header")
+	}
+	b.tags = append(b.tags, tci)
+	return b
+}
+
+func (b *Builder) setL3(proto uint16) bool {
+	if b.l3 != 0 {
+		b.fail("L3 header is already added")
+		return false
+	}
+	b.l3 = proto
+	return true
+}
+
+// IPv4 adds IPv4 header without options. Time to live is 64.
+func (b *Builder) IPv4(src, dst net.IP) *Builder {
+	src4, dst4 := src.To4(), dst.To4()
+	if src4 == nil || dst4 == nil {
+		return b.fail("Incorrect IPv4 address")
+	}
+	if !b.setL3(IPV4Number) {
+		return b
+	}
+	b.srcIPv4 = IPv4(src4[0], src4[1], src4[2], src4[3])
+	b.dstIPv4 = IPv4(dst4[0], dst4[1], dst4[2], dst4[3])
+	return b
+}
+
+// IPv6 adds IPv6 header without extension headers. Hop limit is 64.
+func (b *Builder) IPv6(src, dst net.IP) *Builder {
+	if len(src) != IPv6AddrLen || len(dst) != IPv6AddrLen || src.To4() != nil || dst.To4() != nil {
+		return b.fail("Incorrect IPv6 address")
+	}
+	if !b.setL3(IPV6Number) {
+		return b
+	}
+	copy(b.srcIPv6[:], src)
+	copy(b.dstIPv6[:], dst)
+	return b
+}
+
+func (b *Builder) setL4(proto uint8) bool {
+	if b.l3 == 0 {
+		b.fail("L4 header should be added after L3 header")
+		return false
+	}
+	if b.l4 != 0 {
+		b.fail("L4 header is already added")
+		return false
+	}
+	b.l4 = proto
+	return true
+}
+
+// TCP adds TCP header without options with given ports, sequence number
+// and flags. Window is 65535, acknowledgement number is set by Ack.
+func (b *Builder) TCP(srcPort, dstPort uint16, seq uint32, flags TCPFlags) *Builder {
+	if b.setL4(TCPNumber) {
+		b.srcPort, b.dstPort = srcPort, dstPort
+		b.seq = seq
+		b.tcpFlags = flags
+	}
+	return b
+}
+
+// Ack sets acknowledgement number of TCP header and TCPFlagAck flag.
+func (b *Builder) Ack(ack uint32) *Builder {
+	if b.l4 != TCPNumber {
+		return b.fail("Acknowledgement number is set without TCP header")
+	}
+	b.ack = ack
+	b.tcpFlags |= TCPFlagAck
+	return b
+}
+
+// UDP adds UDP header with given ports.
+func (b *Builder) UDP(srcPort, dstPort uint16) *Builder {
+	if b.setL4(UDPNumber) {
+		b.srcPort, b.dstPort = srcPort, dstPort
+	}
+	return b
+}
+
+// ICMP adds ICMP header for IPv4 or ICMPv6 header for IPv6 with given
+// type, code, identifier and sequence number.
+func (b *Builder) ICMP(msgType, code uint8, id, seq uint16) *Builder {
+	if b.setL4(ICMPNumber) {
+		b.icmpType, b.icmpCode = msgType, code
+		b.icmpID, b.icmpSeq = id, seq
+	}
+	return b
+}
+
+func (b *Builder) l3Len() uint {
+	switch b.l3 {
+	case IPV4Number:
+		return IPv4MinLen
+	case IPV6Number:
+		return IPv6Len
+	}
+	return 0
+}
+
+func (b *Builder) l4Len() uint {
+	switch b.l4 {
+	case TCPNumber:
+		return TCPMinLen
+	case UDPNumber:
+		return UDPLen
+	case ICMPNumber:
+		return ICMPLen
+	}
+	return 0
+}
+
+// Payload appends all added headers and payload to packet and fills
+// lengths and checksums. L3, L4 and Data pointers are set. Return false
+// if error.
+func (b *Builder) Payload(data []byte) bool {
+	if b.failed {
+		return false
+	}
+	packet := b.packet
+	l2Len := EtherLen + uint(len(b.tags))*VLANLen
+	l3Len, l4Len := b.l3Len(), b.l4Len()
+	hdrLen := l2Len + l3Len + l4Len
+	if low.AppendMbuf(packet.CMbuf, hdrLen+uint(len(data))) == false {
+		LogWarning(Debug, "Builder: Cannot append mbuf")
+		return false
+	}
+	hdrs := (*[1 << 16]byte)(unsafe.Pointer(packet.Start()))[:hdrLen]
+	for i := range hdrs {
+		hdrs[i] = 0
+	}
+	copy((*[1 << 30]byte)(unsafe.Pointer(packet.Start() + uintptr(hdrLen)))[:len(data)], data)
+
+	packet.Ether.DAddr = b.dstMAC
+	packet.Ether.SAddr = b.srcMAC
+	etherType := &packet.Ether.EtherType
+	for i, tci := range b.tags {
+		*etherType = SwapBytesUint16(QinQNumber)
+		if i == len(b.tags)-1 {
+			*etherType = SwapBytesUint16(VLANNumber)
+		}
+		vlan := (*VLANHdr)(unsafe.Pointer(packet.Start() + EtherLen + uintptr(i)*VLANLen))
+		vlan.TCI = SwapBytesUint16(tci)
+		etherType = &vlan.EtherType
+	}
+	*etherType = SwapBytesUint16(b.l3)
+
+	packet.L3 = nil
+	packet.L4 = nil
+	packet.Data = unsafe.Pointer(packet.Start() + uintptr(hdrLen))
+	l4Proto := b.l4
+	if b.l3 == IPV6Number && b.l4 == ICMPNumber {
+		l4Proto = ICMPv6Number
+	}
+	payloadLen := l4Len + uint(len(data))
+	switch b.l3 {
+	case IPV4Number:
+		packet.ParseL3()
+		ipv4 := packet.GetIPv4()
+		ipv4.VersionIhl = 0x45 // Ipv4, IHL = 5 (min header len)
+		ipv4.TotalLength = SwapBytesUint16(uint16(IPv4MinLen + payloadLen))
+		ipv4.TimeToLive = 64
+		ipv4.NextProtoID = l4Proto
+		ipv4.SrcAddr = b.srcIPv4
+		ipv4.DstAddr = b.dstIPv4
+	case IPV6Number:
+		packet.ParseL3()
+		ipv6 := packet.GetIPv6()
+		ipv6.VtcFlow = SwapBytesUint32(0x60 << 24) // IP version
+		ipv6.PayloadLen = SwapBytesUint16(uint16(payloadLen))
+		ipv6.Proto = IPv6NoNextHeader
+		if l4Proto != 0 {
+			ipv6.Proto = l4Proto
+		}
+		ipv6.HopLimits = 64
+		ipv6.SrcAddr = b.srcIPv6
+		ipv6.DstAddr = b.dstIPv6
+	default:
+		return true
+	}
+
+	if b.l4 != 0 {
+		packet.L4 = unsafe.Pointer(packet.Start() + uintptr(l2Len+l3Len))
+	}
+	switch b.l4 {
+	case TCPNumber:
+		tcp := (*TCPHdr)(packet.L4)
+		tcp.SrcPort = SwapBytesUint16(b.srcPort)
+		tcp.DstPort = SwapBytesUint16(b.dstPort)
+		tcp.SentSeq = SwapBytesUint32(b.seq)
+		tcp.RecvAck = SwapBytesUint32(b.ack)
+		tcp.DataOff = 0x50
+		tcp.TCPFlags = b.tcpFlags
+		tcp.RxWin = SwapBytesUint16(0xffff)
+	case UDPNumber:
+		udp := (*UDPHdr)(packet.L4)
+		udp.SrcPort = SwapBytesUint16(b.srcPort)
+		udp.DstPort = SwapBytesUint16(b.dstPort)
+		udp.DgramLen = SwapBytesUint16(uint16(payloadLen))
+	case ICMPNumber:
+		icmp := (*ICMPHdr)(packet.L4)
+		icmp.Type = b.icmpType
+		icmp.Code = b.icmpCode
+		icmp.Identifier = SwapBytesUint16(b.icmpID)
+		icmp.SeqNum = SwapBytesUint16(b.icmpSeq)
+	}
+	b.setChecksums()
+	return true
+}
+
+// setChecksums fills IPv4 header and L4 checksums of built packet.
+func (b *Builder) setChecksums() {
+	packet := b.packet
+	if hwtxchecksum {
+		SetHWCksumOLFlags(packet)
+		SetPseudoHdrChecksum(packet)
+	} else if b.l3 == IPV4Number {
+		packet.GetIPv4().HdrChecksum = SwapBytesUint16(CalculateIPv4Checksum(packet))
+	}
+	if b.l4 == ICMPNumber {
+		// ICMP checksum is never offloaded
+		if b.l3 == IPV4Number {
+			packet.GetICMPForIPv4().Cksum = SwapBytesUint16(CalculateIPv4ICMPChecksum(packet))
+		} else {
+			packet.GetICMPForIPv6().Cksum = SwapBytesUint16(CalculateIPv6ICMPChecksum(packet))
+		}
+		return
+	}
+	if hwtxchecksum {
+		return
+	}
+	switch {
+	case b.l3 == IPV4Number && b.l4 == TCPNumber:
+		packet.GetTCPForIPv4().Cksum = SwapBytesUint16(CalculateIPv4TCPChecksum(packet))
+	case b.l3 == IPV4Number && b.l4 == UDPNumber:
+		packet.GetUDPForIPv4().DgramCksum = SwapBytesUint16(CalculateIPv4UDPChecksum(packet))
+	case b.l3 == IPV6Number && b.l4 == TCPNumber:
+		packet.GetTCPForIPv6().Cksum = SwapBytesUint16(CalculateIPv6TCPChecksum(packet))
+	case b.l3 == IPV6Number && b.l4 == UDPNumber:
+		packet.GetUDPForIPv6().DgramCksum = SwapBytesUint16(CalculateIPv6UDPChecksum(packet))
+	}
+}
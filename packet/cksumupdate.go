@@ -0,0 +1,269 @@
+// Copyright 2017 Intel Corporation.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package packet
+
+import (
+	. "github.com/intel-go/yanff/common"
+	"github.com/intel-go/yanff/low"
+)
+
+// Incremental checksum update (RFC 1624). Functions below adjust existing
+// checksum for changed header fields without reading the whole packet.
+// Checksums and field values have host byte order, like values returned
+// by Calculate functions from swcksum.go.
+// If hardware checksum offloading is enabled, packets which are prepared
+// for it by SetTX*OLFlags functions have not negated pseudo header checksum
+// in L4 header and IPv4 header checksum is calculated by NIC. Packet methods
+// check offloading flags of mbuf, so received packets and packets without
+// these flags have their full checksums adjusted. Header methods don't have
+// access to mbuf, so they suppose that header is prepared for offloading
+// if it is enabled.
+
+// updateSum replaces old 16 bit word with new one in one's complement sum.
+func updateSum(sum uint16, old, new uint16) uint16 {
+	return reduceChecksum(uint32(sum) + uint32(^old) + uint32(new))
+}
+
+// UpdateChecksum16 returns checksum adjusted for change of 16 bit
+// field from old to new value.
+func UpdateChecksum16(cksum uint16, old, new uint16) uint16 {
+	return ^updateSum(^cksum, old, new)
+}
+
+// UpdateChecksum32 returns checksum adjusted for change of 32 bit
+// field from old to new value.
+func UpdateChecksum32(cksum uint16, old, new uint32) uint16 {
+	sum := updateSum(^cksum, uint16(old>>16), uint16(new>>16))
+	return ^updateSum(sum, uint16(old), uint16(new))
+}
+
+// UpdateChecksumIPv6Addr returns checksum adjusted for change of IPv6
+// address from old to new value.
+func UpdateChecksumIPv6Addr(cksum uint16, old, new [IPv6AddrLen]uint8) uint16 {
+	sum := ^cksum
+	for i := 0; i < IPv6AddrLen; i += 2 {
+		sum = updateSum(sum, uint16(old[i])<<8|uint16(old[i+1]), uint16(new[i])<<8|uint16(new[i+1]))
+	}
+	return ^sum
+}
+
+// updateL4Cksum adjusts L4 checksum given in header field format for change
+// of 32 bit pseudo header field. If hardware offloading is used checksum
+// field contains not negated pseudo header checksum and it is adjusted too.
+func updateL4Cksum(field *uint16, old, new uint32, udp bool, offload bool) {
+	cksum := SwapBytesUint16(*field)
+	if offload {
+		cksum = updateSum(updateSum(cksum, uint16(old>>16), uint16(new>>16)), uint16(old), uint16(new))
+	} else if udp && cksum == 0 {
+		// Zero checksum means that UDP checksum is not used
+		return
+	} else {
+		cksum = UpdateChecksum32(cksum, old, new)
+		if udp && cksum == 0 {
+			cksum = 0xffff
+		}
+	}
+	*field = SwapBytesUint16(cksum)
+}
+
+// updateL4CksumIPv6Addr is updateL4Cksum for change of IPv6 address.
+func updateL4CksumIPv6Addr(field *uint16, old, new [IPv6AddrLen]uint8, udp bool, offload bool) {
+	cksum := SwapBytesUint16(*field)
+	if offload {
+		// Pseudo header checksum is not negated
+		cksum = ^UpdateChecksumIPv6Addr(^cksum, old, new)
+	} else {
+		cksum = UpdateChecksumIPv6Addr(cksum, old, new)
+		if udp && cksum == 0 {
+			cksum = 0xffff
+		}
+	}
+	*field = SwapBytesUint16(cksum)
+}
+
+// updatePortCksum adjusts L4 checksum for change of port. Ports are not
+// part of pseudo header, so nothing is done if hardware offloading is used.
+func updatePortCksum(field *uint16, old, new uint16, udp bool, offload bool) {
+	if offload || (udp && *field == 0) {
+		return
+	}
+	cksum := UpdateChecksum16(SwapBytesUint16(*field), SwapBytesUint16(old), SwapBytesUint16(new))
+	if udp && cksum == 0 {
+		cksum = 0xffff
+	}
+	*field = SwapBytesUint16(cksum)
+}
+
+// SetSrcAddr sets source address given in IPv4Hdr field format and
+// adjusts header checksum. Checksum isn't changed if hardware offloading
+// is enabled. Use Packet.SetIPv4SrcAddr to adjust L4 checksum too and to
+// check offloading flags of packet.
+func (hdr *IPv4Hdr) SetSrcAddr(addr uint32) {
+	hdr.setAddr(&hdr.SrcAddr, addr, hwtxchecksum)
+}
+
+// SetDstAddr sets destination address in the same way as SetSrcAddr.
+func (hdr *IPv4Hdr) SetDstAddr(addr uint32) {
+	hdr.setAddr(&hdr.DstAddr, addr, hwtxchecksum)
+}
+
+func (hdr *IPv4Hdr) setAddr(field *uint32, addr uint32, offload bool) {
+	if !offload {
+		hdr.HdrChecksum = SwapBytesUint16(UpdateChecksum32(SwapBytesUint16(hdr.HdrChecksum),
+			SwapBytesUint32(*field), SwapBytesUint32(addr)))
+	}
+	*field = addr
+}
+
+// SetTTL sets time to live and adjusts header checksum. Checksum isn't
+// changed if hardware offloading is enabled.
+func (hdr *IPv4Hdr) SetTTL(ttl uint8) {
+	if !hwtxchecksum {
+		// TTL is upper byte of 16 bit word with protocol
+		hdr.HdrChecksum = SwapBytesUint16(UpdateChecksum16(SwapBytesUint16(hdr.HdrChecksum),
+			uint16(hdr.TimeToLive)<<8|uint16(hdr.NextProtoID), uint16(ttl)<<8|uint16(hdr.NextProtoID)))
+	}
+	hdr.TimeToLive = ttl
+}
+
+// SetSrcPort sets source port given in host byte order and adjusts checksum.
+// Checksum isn't changed if hardware offloading is enabled because ports
+// are not part of pseudo header. Use Packet.SetL4SrcPort to check
+// offloading flags of packet.
+func (hdr *TCPHdr) SetSrcPort(port uint16) {
+	updatePortCksum(&hdr.Cksum, hdr.SrcPort, SwapBytesUint16(port), false, hwtxchecksum)
+	hdr.SrcPort = SwapBytesUint16(port)
+}
+
+// SetDstPort sets destination port given in host byte order and adjusts checksum.
+func (hdr *TCPHdr) SetDstPort(port uint16) {
+	updatePortCksum(&hdr.Cksum, hdr.DstPort, SwapBytesUint16(port), false, hwtxchecksum)
+	hdr.DstPort = SwapBytesUint16(port)
+}
+
+// SetSrcPort sets source port given in host byte order and adjusts checksum
+// in the same way as TCPHdr.SetSrcPort. Zero checksum of IPv4 datagram is
+// not changed.
+func (hdr *UDPHdr) SetSrcPort(port uint16) {
+	updatePortCksum(&hdr.DgramCksum, hdr.SrcPort, SwapBytesUint16(port), true, hwtxchecksum)
+	hdr.SrcPort = SwapBytesUint16(port)
+}
+
+// SetDstPort sets destination port given in host byte order and adjusts checksum.
+// Zero checksum of IPv4 datagram is not changed.
+func (hdr *UDPHdr) SetDstPort(port uint16) {
+	updatePortCksum(&hdr.DgramCksum, hdr.DstPort, SwapBytesUint16(port), true, hwtxchecksum)
+	hdr.DstPort = SwapBytesUint16(port)
+}
+
+// l4CksumField returns pointer to checksum of L4 header which includes
+// pseudo header and true for UDP. Returns nil for other protocols and
+// for non first fragments. ICMP checksum includes pseudo header only in
+// IPv6 packets.
+func (packet *Packet) l4CksumField(proto uint8, firstFragment bool, ipv6 bool) (*uint16, bool) {
+	if !firstFragment {
+		return nil, false
+	}
+	switch proto {
+	case TCPNumber:
+		return &(*TCPHdr)(packet.L4).Cksum, false
+	case UDPNumber:
+		return &(*UDPHdr)(packet.L4).DgramCksum, true
+	case ICMPv6Number:
+		if ipv6 {
+			return &(*ICMPHdr)(packet.L4).Cksum, false
+		}
+	}
+	return nil, false
+}
+
+// txOffload returns whether IPv4 header checksum and L4 checksum of packet
+// are calculated by NIC according to offloading flags of mbuf.
+func (packet *Packet) txOffload() (ip bool, l4 bool) {
+	if !hwtxchecksum {
+		return false, false
+	}
+	flags := low.GetTXOLFlags(packet.CMbuf)
+	return flags&low.TXIPChecksum != 0, flags&low.TXL4Checksum != 0
+}
+
+// SetIPv4SrcAddr sets source address given in IPv4Hdr field format and
+// adjusts IPv4 header checksum and TCP or UDP checksum. L3 and L4
+// supposed to be parsed before and L3 should be of IPv4 type.
+func (packet *Packet) SetIPv4SrcAddr(addr uint32) {
+	packet.setIPv4Addr(&packet.GetIPv4().SrcAddr, addr)
+}
+
+// SetIPv4DstAddr sets destination address in the same way as SetIPv4SrcAddr.
+func (packet *Packet) SetIPv4DstAddr(addr uint32) {
+	packet.setIPv4Addr(&packet.GetIPv4().DstAddr, addr)
+}
+
+func (packet *Packet) setIPv4Addr(field *uint32, addr uint32) {
+	ipv4 := packet.GetIPv4()
+	first := SwapBytesUint16(ipv4.FragmentOffset)&0x1fff == 0
+	ip, l4 := packet.txOffload()
+	if cksum, udp := packet.l4CksumField(ipv4.NextProtoID, first, false); cksum != nil {
+		updateL4Cksum(cksum, SwapBytesUint32(*field), SwapBytesUint32(addr), udp, l4)
+	}
+	ipv4.setAddr(field, addr, ip)
+}
+
+// SetIPv6SrcAddr sets source address and adjusts TCP, UDP or ICMPv6
+// checksum. L3 and L4 supposed to be parsed before and L3 should be
+// of IPv6 type.
+func (packet *Packet) SetIPv6SrcAddr(addr [IPv6AddrLen]uint8) {
+	packet.setIPv6Addr(&packet.GetIPv6().SrcAddr, addr)
+}
+
+// SetIPv6DstAddr sets destination address in the same way as SetIPv6SrcAddr.
+func (packet *Packet) SetIPv6DstAddr(addr [IPv6AddrLen]uint8) {
+	packet.setIPv6Addr(&packet.GetIPv6().DstAddr, addr)
+}
+
+func (packet *Packet) setIPv6Addr(field *[IPv6AddrLen]uint8, addr [IPv6AddrLen]uint8) {
+	proto := packet.getL4TypeForIPv6()
+	if cksum, udp := packet.l4CksumField(proto, proto != IPv6NoNextHeader, true); cksum != nil {
+		_, l4 := packet.txOffload()
+		updateL4CksumIPv6Addr(cksum, *field, addr, udp, l4)
+	}
+	*field = addr
+}
+
+// SetL4SrcPort sets source port of TCP or UDP header given in host byte
+// order and adjusts checksum according to offloading flags of packet.
+// Other L4 protocols are not changed. L3 and L4 supposed to be parsed before.
+func (packet *Packet) SetL4SrcPort(port uint16) {
+	packet.setL4Port(port, true)
+}
+
+// SetL4DstPort sets destination port in the same way as SetL4SrcPort.
+func (packet *Packet) SetL4DstPort(port uint16) {
+	packet.setL4Port(port, false)
+}
+
+func (packet *Packet) setL4Port(port uint16, src bool) {
+	var proto uint8
+	var first bool
+	if ipv4 := packet.GetIPv4(); ipv4 != nil {
+		proto, first = ipv4.NextProtoID, SwapBytesUint16(ipv4.FragmentOffset)&0x1fff == 0
+	} else if packet.GetIPv6() != nil {
+		proto = packet.getL4TypeForIPv6()
+		first = proto != IPv6NoNextHeader
+	}
+	cksum, udp := packet.l4CksumField(proto, first, false)
+	if cksum == nil {
+		return
+	}
+	// Ports of TCP and UDP headers have the same offsets
+	tcp := (*TCPHdr)(packet.L4)
+	field := &tcp.DstPort
+	if src {
+		field = &tcp.SrcPort
+	}
+	_, l4 := packet.txOffload()
+	updatePortCksum(cksum, *field, SwapBytesUint16(port), udp, l4)
+	*field = SwapBytesUint16(port)
+}
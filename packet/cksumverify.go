@@ -0,0 +1,192 @@
+// Copyright 2017 Intel Corporation.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package packet
+
+import (
+	"unsafe"
+
+	. "github.com/intel-go/yanff/common"
+	"github.com/intel-go/yanff/low"
+)
+
+// Checksum verification functions calculate one's complement sum over
+// header or data together with checksum field. Checksum is correct if the
+// sum is 0xffff. L3 and L4 supposed to be parsed before, for example by
+// SafeParseL3 and SafeParseL4ForIPv4. L4 data can be located in several
+// chained segments of packet.
+
+// VerifyIPv4Checksum returns true if IPv4 header checksum is correct.
+// L3 supposed to be parsed before and be of IPv4 type.
+func VerifyIPv4Checksum(p *Packet) bool {
+	hdr := p.GetIPv4()
+	ihl := int(hdr.VersionIhl&0x0f) << 2
+	return reduceChecksum(calculateDataChecksum(unsafe.Pointer(hdr), ihl, 0)) == 0xffff
+}
+
+// verifyL4 checks checksum of L4 header and data which has given length.
+// pseudo is sum of pseudo header, it is zero for ICMP over IPv4.
+func (packet *Packet) verifyL4(length int, pseudo uint32) bool {
+	sum, ok := packet.sumChained(uintptr(packet.L4), length)
+	return ok && reduceChecksum(sum+pseudo) == 0xffff
+}
+
+func (packet *Packet) ipv4L4Len() int {
+	hdr := packet.GetIPv4()
+	return int(SwapBytesUint16(hdr.TotalLength)) - int(hdr.VersionIhl&0x0f)<<2
+}
+
+func ipv4PseudoHdrSum(hdr *IPv4Hdr, length int) uint32 {
+	return calculateIPv4AddrChecksum(hdr) + uint32(hdr.NextProtoID) + uint32(length)
+}
+
+func ipv6PseudoHdrSum(hdr *IPv6Hdr, proto uint8, length int) uint32 {
+	return calculateIPv6AddrChecksum(hdr) + uint32(proto) + uint32(length)
+}
+
+// VerifyIPv4TCPChecksum returns true if TCP checksum is correct for case
+// if L3 protocol is IPv4.
+func VerifyIPv4TCPChecksum(p *Packet) bool {
+	length := p.ipv4L4Len()
+	return p.verifyL4(length, ipv4PseudoHdrSum(p.GetIPv4(), length))
+}
+
+// VerifyIPv4UDPChecksum returns true if UDP checksum is correct for case
+// if L3 protocol is IPv4. Zero checksum means that checksum is not used,
+// so it is treated as correct.
+func VerifyIPv4UDPChecksum(p *Packet) bool {
+	udp := p.GetUDPForIPv4()
+	if udp.DgramCksum == 0 {
+		return true
+	}
+	length := int(SwapBytesUint16(udp.DgramLen))
+	return p.verifyL4(length, ipv4PseudoHdrSum(p.GetIPv4(), length))
+}
+
+// VerifyIPv4ICMPChecksum returns true if ICMP checksum is correct for case
+// if L3 protocol is IPv4.
+func VerifyIPv4ICMPChecksum(p *Packet) bool {
+	return p.verifyL4(p.ipv4L4Len(), 0)
+}
+
+// VerifyIPv6TCPChecksum returns true if TCP checksum is correct for case
+// if L3 protocol is IPv6.
+func VerifyIPv6TCPChecksum(p *Packet) bool {
+	length := int(p.getL4LenForIPv6())
+	return p.verifyL4(length, ipv6PseudoHdrSum(p.GetIPv6(), TCPNumber, length))
+}
+
+// VerifyIPv6UDPChecksum returns true if UDP checksum is correct for case
+// if L3 protocol is IPv6. Zero checksum is not allowed for IPv6.
+func VerifyIPv6UDPChecksum(p *Packet) bool {
+	udp := p.GetUDPForIPv6()
+	if udp.DgramCksum == 0 {
+		return false
+	}
+	length := int(SwapBytesUint16(udp.DgramLen))
+	return p.verifyL4(length, ipv6PseudoHdrSum(p.GetIPv6(), UDPNumber, length))
+}
+
+// VerifyIPv6ICMPChecksum returns true if ICMPv6 checksum is correct for case
+// if L3 protocol is IPv6.
+func VerifyIPv6ICMPChecksum(p *Packet) bool {
+	length := int(p.getL4LenForIPv6())
+	return p.verifyL4(length, ipv6PseudoHdrSum(p.GetIPv6(), ICMPv6Number, length))
+}
+
+// VerifyL4Checksum returns true if TCP, UDP, ICMP or SCTP checksum is correct for
+// IPv4 or IPv6 packet. Packets with other L4 protocols and non first fragments
+// are treated as correct because their checksums can't be verified.
+func VerifyL4Checksum(p *Packet) bool {
+	if p.GetIPv4() != nil {
+		if SwapBytesUint16(p.GetIPv4().FragmentOffset)&0x3fff != 0 {
+			return true
+		}
+		switch p.GetIPv4().NextProtoID {
+		case TCPNumber:
+			return VerifyIPv4TCPChecksum(p)
+		case UDPNumber:
+			return VerifyIPv4UDPChecksum(p)
+		case ICMPNumber:
+			return VerifyIPv4ICMPChecksum(p)
+		case SCTPNumber:
+			return VerifySCTPChecksum(p)
+		}
+	} else if p.GetIPv6() != nil {
+		if frag := p.GetIPv6Fragment(); frag != nil && (frag.GetFragmentOffset() != 0 || frag.MoreFragments()) {
+			return true
+		}
+		switch p.getL4TypeForIPv6() {
+		case TCPNumber:
+			return VerifyIPv6TCPChecksum(p)
+		case UDPNumber:
+			return VerifyIPv6UDPChecksum(p)
+		case ICMPv6Number:
+			return VerifyIPv6ICMPChecksum(p)
+		case SCTPNumber:
+			return VerifySCTPChecksum(p)
+		}
+	}
+	return true
+}
+
+// VerifyChecksums returns true if IPv4 header checksum and L4 checksum
+// are correct. It is verified in software, use HasRXChecksumError to
+// check result of hardware verification.
+func VerifyChecksums(p *Packet) bool {
+	if p.GetIPv4() != nil && !VerifyIPv4Checksum(p) {
+		return false
+	}
+	return VerifyL4Checksum(p)
+}
+
+// RXChecksumStatus is result of checksum verification by NIC on receive.
+type RXChecksumStatus uint8
+
+// Values of RXChecksumStatus
+const (
+	// RXChecksumUnknown means that NIC didn't verify checksum
+	RXChecksumUnknown RXChecksumStatus = iota
+	// RXChecksumBad means that checksum is incorrect
+	RXChecksumBad
+	// RXChecksumGood means that checksum is correct
+	RXChecksumGood
+	// RXChecksumNone means that checksum in packet is incorrect but
+	// integrity of data was verified by NIC
+	RXChecksumNone
+)
+
+func rxChecksumStatus(flags uint64, bad, good uint64) RXChecksumStatus {
+	switch flags & (bad | good) {
+	case bad:
+		return RXChecksumBad
+	case good:
+		return RXChecksumGood
+	case bad | good:
+		return RXChecksumNone
+	}
+	return RXChecksumUnknown
+}
+
+// GetRXIPChecksumStatus returns result of IPv4 header checksum verification
+// which was done by NIC on receive.
+func (packet *Packet) GetRXIPChecksumStatus() RXChecksumStatus {
+	return rxChecksumStatus(low.GetRXOLFlags(packet.CMbuf), low.RXIPChecksumBad, low.RXIPChecksumGood)
+}
+
+// GetRXL4ChecksumStatus returns result of L4 checksum verification
+// which was done by NIC on receive.
+func (packet *Packet) GetRXL4ChecksumStatus() RXChecksumStatus {
+	return rxChecksumStatus(low.GetRXOLFlags(packet.CMbuf), low.RXL4ChecksumBad, low.RXL4ChecksumGood)
+}
+
+// HasRXChecksumError returns true if NIC reported incorrect IPv4 header
+// or L4 checksum on receive. It doesn't read packet data, so it can be
+// used to drop corrupt packets cheaply. Packets which were not verified
+// by NIC are reported as correct.
+func (packet *Packet) HasRXChecksumError() bool {
+	flags := low.GetRXOLFlags(packet.CMbuf)
+	return flags&(low.RXIPChecksumBad|low.RXIPChecksumGood) == low.RXIPChecksumBad ||
+		flags&(low.RXL4ChecksumBad|low.RXL4ChecksumGood) == low.RXL4ChecksumBad
+}
@@ -0,0 +1,72 @@
+// Copyright 2017 Intel Corporation.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package packet
+
+import (
+	"unsafe"
+
+	"github.com/intel-go/yanff/low"
+)
+
+// Clone allocates new packet from mempool and copies data of packet to it.
+// If snaplen is not zero only first snaplen bytes of packet are copied.
+// Data which doesn't fit into one mbuf is copied to chained mbufs. L3, L4
+// and Data pointers of copy point to the same bytes as in original packet,
+// pointers to bytes which were truncated are nil. Offloading flags are not
+// copied. Returns false if mempool is empty.
+func (packet *Packet) Clone(mempool *low.Mempool, snaplen uint) (*Packet, bool) {
+	length := packet.getChainedLen()
+	if snaplen != 0 && snaplen < length {
+		length = snaplen
+	}
+	buf := make([]uintptr, 1)
+	var clone *Packet
+	for offset := uint(0); clone == nil || offset < length; {
+		if low.TryAllocateMbufs(buf, mempool) == false {
+			if clone != nil {
+				buf[0] = uintptr(unsafe.Pointer(clone.CMbuf))
+				low.DirectStop(1, buf)
+			}
+			return nil, false
+		}
+		seg := ExtractPacket(buf[0])
+		n := low.GetMbufTailroom(seg.CMbuf)
+		if n > length-offset {
+			n = length - offset
+		}
+		low.AppendMbuf(seg.CMbuf, n)
+		packet.ReadBytes(offset, low.GetRawPacketBytesMbuf(seg.CMbuf))
+		offset += n
+		if clone == nil {
+			clone = seg
+		} else if clone.AppendSegment(seg) == false {
+			buf = append(buf, uintptr(unsafe.Pointer(clone.CMbuf)))
+			low.DirectStop(2, buf)
+			return nil, false
+		}
+	}
+	clone.L3 = packet.clonePointer(clone, packet.L3, length)
+	clone.L4 = packet.clonePointer(clone, packet.L4, length)
+	clone.Data = packet.clonePointer(clone, packet.Data, length)
+	return clone, true
+}
+
+// clonePointer returns pointer to the byte of clone which has the same
+// offset as byte pointed by ptr in packet. Returns nil if this byte was
+// not copied to clone which has given length.
+func (packet *Packet) clonePointer(clone *Packet, ptr unsafe.Pointer, length uint) unsafe.Pointer {
+	if ptr == nil {
+		return nil
+	}
+	offset, ok := packet.offsetOf(uintptr(ptr))
+	if !ok || offset >= length {
+		return nil
+	}
+	addr, ok := clone.addrOf(offset)
+	if !ok {
+		return nil
+	}
+	return unsafe.Pointer(addr)
+}
@@ -0,0 +1,231 @@
+// Copyright 2017 Intel Corporation.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package packet
+
+import (
+	"fmt"
+	"unsafe"
+
+	. "github.com/intel-go/yanff/common"
+)
+
+// GREHdr is fixed part of GRE header (RFC 2784, RFC 2890). It is placed
+// at L4 pointer and followed by optional checksum, key and sequence
+// number fields which are present according to Flags.
+type GREHdr struct {
+	Flags    uint16 // GREChecksumFlag, GREKeyFlag, GRESeqFlag and version
+	Protocol uint16 // EtherType of payload, TEBNumber for Ethernet frame
+}
+
+func (hdr *GREHdr) String() string {
+	r0 := "        L4 protocol: GRE\n"
+	r1 := fmt.Sprintf("        GRE Flags: %04x\n", SwapBytesUint16(hdr.Flags))
+	r2 := fmt.Sprintf("        GRE Protocol: %04x\n", SwapBytesUint16(hdr.Protocol))
+	return r0 + r1 + r2
+}
+
+func (hdr *GREHdr) hasFlag(flag uint16) bool {
+	return SwapBytesUint16(hdr.Flags)&flag != 0
+}
+
+// GetHdrLen returns length of GRE header with all optional fields in bytes.
+func (hdr *GREHdr) GetHdrLen() uint {
+	length := uint(GREMinLen)
+	for _, flag := range []uint16{GREChecksumFlag, GREKeyFlag, GRESeqFlag} {
+		if hdr.hasFlag(flag) {
+			length += 4
+		}
+	}
+	return length
+}
+
+// field returns pointer to optional field which follows fields for given flags.
+func (hdr *GREHdr) field(previous ...uint16) *uint32 {
+	offset := uintptr(GREMinLen)
+	for _, flag := range previous {
+		if hdr.hasFlag(flag) {
+			offset += 4
+		}
+	}
+	return (*uint32)(unsafe.Pointer(uintptr(unsafe.Pointer(hdr)) + offset))
+}
+
+// GetKey returns GRE key in host byte order. Return false if key is absent.
+func (hdr *GREHdr) GetKey() (uint32, bool) {
+	if !hdr.hasFlag(GREKeyFlag) {
+		return 0, false
+	}
+	return SwapBytesUint32(*hdr.field(GREChecksumFlag)), true
+}
+
+// GetSeq returns GRE sequence number in host byte order. Return false
+// if sequence number is absent.
+func (hdr *GREHdr) GetSeq() (uint32, bool) {
+	if !hdr.hasFlag(GRESeqFlag) {
+		return 0, false
+	}
+	return SwapBytesUint32(*hdr.field(GREChecksumFlag, GREKeyFlag)), true
+}
+
+// GREParams describes optional fields of GRE header built by EncapGRE.
+type GREParams struct {
+	Ethernet bool   // Encapsulate whole Ethernet frame instead of L3 packet
+	Checksum bool   // Add checksum field
+	UseKey   bool   // Add key field
+	Key      uint32 // Key in host byte order
+	UseSeq   bool   // Add sequence number field
+	Seq      uint32 // Sequence number in host byte order
+}
+
+// GetGRE ensures if L4 type is GRE and cast L4 pointer to *GREHdr type.
+// L4 supposed to be parsed before.
+func (packet *Packet) GetGRE() *GREHdr {
+	if ipv4 := packet.GetIPv4(); ipv4 != nil {
+		if ipv4.NextProtoID != GRENumber {
+			return nil
+		}
+	} else if packet.GetIPv6() == nil || packet.getL4TypeForIPv6() != GRENumber {
+		return nil
+	}
+	gre := (*GREHdr)(packet.L4)
+	if packet.getTunnelPayloadLen() < GREMinLen || packet.getTunnelPayloadLen() < gre.GetHdrLen() {
+		return nil
+	}
+	return gre
+}
+
+// GetGREInnerPacket fills inner with view of Ethernet frame encapsulated
+// into GRE in the same way as GetVXLANInnerPacket. L4 supposed to be
+// parsed before. Return false if packet is not GRE with Ethernet payload.
+func (packet *Packet) GetGREInnerPacket(inner *Packet) bool {
+	gre := packet.GetGRE()
+	if gre == nil || gre.Protocol != SwapBytesUint16(TEBNumber) {
+		return false
+	}
+	packet.initInnerView(inner, uintptr(unsafe.Pointer(gre))+uintptr(gre.GetHdrLen()))
+	return true
+}
+
+// EncapGRE encapsulates packet into GRE. By default L3 packet is
+// encapsulated and L2 header is replaced with outer Ethernet header.
+// If params.Ethernet is set whole frame is encapsulated. Outer Ethernet
+// and IP headers are built from endpoints, outer lengths and checksums are
+// set. After encapsulation packet is parsed up to outer L4.
+// Return false if error.
+func (packet *Packet) EncapGRE(endpoints *TunnelEndpoints, params *GREParams) bool {
+	protocol := packet.GetEtherType()
+	if params.Ethernet {
+		protocol = SwapBytesUint16(TEBNumber)
+	} else if protocol != SwapBytesUint16(IPV4Number) && protocol != SwapBytesUint16(IPV6Number) {
+		LogWarning(Debug, "EncapGRE: Only IPv4 and IPv6 packets can be encapsulated")
+		return false
+	}
+
+	greLen := uint(GREMinLen)
+	var flags uint16
+	if params.Checksum {
+		greLen += 4
+		flags |= GREChecksumFlag
+	}
+	if params.UseKey {
+		greLen += 4
+		flags |= GREKeyFlag
+	}
+	if params.UseSeq {
+		greLen += 4
+		flags |= GRESeqFlag
+	}
+	outerLen := EtherLen + endpoints.l3Len() + greLen
+	if params.Ethernet {
+		if packet.EncapsulateHead(0, outerLen) == false {
+			return false
+		}
+	} else if packet.replaceL2(outerLen) == false {
+		return false
+	}
+
+	initOuterIP(packet, endpoints, GRENumber)
+	gre := (*GREHdr)(packet.L4)
+	gre.Flags = SwapBytesUint16(flags)
+	gre.Protocol = protocol
+	if params.UseKey {
+		*gre.field(GREChecksumFlag) = SwapBytesUint32(params.Key)
+	}
+	if params.UseSeq {
+		*gre.field(GREChecksumFlag, GREKeyFlag) = SwapBytesUint32(params.Seq)
+	}
+	packet.Data = unsafe.Pointer(uintptr(packet.L4) + uintptr(greLen))
+	if params.Checksum {
+		// Checksum field is followed by reserved field
+		*gre.field() = 0
+		*(*uint16)(unsafe.Pointer(gre.field())) = SwapBytesUint16(CalculateGREChecksum(packet))
+	}
+	if !endpoints.IPv6 {
+		setOuterIPv4Checksum(packet)
+	}
+	return true
+}
+
+// DecapGRE removes outer IP and GRE headers. If GRE payload is Ethernet frame
+// it becomes packet, otherwise outer Ethernet header is kept and its EtherType
+// is set to GRE protocol. L3 pointer is set to inner L3 header.
+// Return false if packet is not GRE or if error.
+func (packet *Packet) DecapGRE() bool {
+	if packet.parseTunnelProto() != GRENumber {
+		return false
+	}
+	gre := packet.GetGRE()
+	if gre == nil {
+		return false
+	}
+	start := uintptr(unsafe.Pointer(gre)) + uintptr(gre.GetHdrLen())
+	if gre.Protocol == SwapBytesUint16(TEBNumber) {
+		return packet.decapTunnel(start)
+	}
+	return packet.decapL3Tunnel(start, gre.Protocol)
+}
+
+// EncapIPinIP encapsulates IPv4 or IPv6 packet into outer IPv4 or IPv6
+// header built from endpoints (RFC 2003, RFC 2473). L2 header is replaced
+// with outer Ethernet header, outer lengths and checksums are set. After
+// encapsulation packet is parsed up to outer L4 which points to inner
+// L3 header. Return false if error.
+func (packet *Packet) EncapIPinIP(endpoints *TunnelEndpoints) bool {
+	var proto uint8
+	switch packet.GetEtherType() {
+	case SwapBytesUint16(IPV4Number):
+		proto = IPNumber
+	case SwapBytesUint16(IPV6Number):
+		proto = IPv6EncapNumber
+	default:
+		LogWarning(Debug, "EncapIPinIP: Only IPv4 and IPv6 packets can be encapsulated")
+		return false
+	}
+	if packet.replaceL2(EtherLen+endpoints.l3Len()) == false {
+		return false
+	}
+	initOuterIP(packet, endpoints, proto)
+	if !endpoints.IPv6 {
+		setOuterIPv4Checksum(packet)
+	}
+	return true
+}
+
+// DecapIPinIP removes outer IPv4 or IPv6 header of IP-in-IP packet. Outer
+// Ethernet header is kept and its EtherType is set according to inner packet.
+// L3 pointer is set to inner L3 header. Return false if packet is not
+// IP-in-IP or if error.
+func (packet *Packet) DecapIPinIP() bool {
+	var etherType uint16
+	switch packet.parseTunnelProto() {
+	case IPNumber:
+		etherType = SwapBytesUint16(IPV4Number)
+	case IPv6EncapNumber:
+		etherType = SwapBytesUint16(IPV6Number)
+	default:
+		return false
+	}
+	return packet.decapL3Tunnel(uintptr(packet.L4), etherType)
+}
@@ -0,0 +1,295 @@
+// Copyright 2017 Intel Corporation.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package packet
+
+import (
+	"fmt"
+	"unsafe"
+
+	. "github.com/intel-go/yanff/common"
+)
+
+// GTPUHdr is mandatory part of GTPv1-U header (3GPP TS 29.281). It is
+// placed after outer UDP header. If any of GTPUExtFlag, GTPUSeqFlag and
+// GTPUNPDUFlag is set it is followed by optional fields and chain of
+// extension headers. Payload of G-PDU message is IPv4 or IPv6 packet.
+type GTPUHdr struct {
+	Flags   uint8  // Version, protocol type and E, S, PN flags
+	MsgType uint8  // Message type, GTPUGPDU for user data
+	Length  uint16 // Length of message after mandatory part in bytes
+	TEID    uint32 // Tunnel endpoint identifier
+}
+
+// gtpuOptHdr is optional part of GTPv1-U header.
+type gtpuOptHdr struct {
+	SeqNum      uint16 // Sequence number
+	NPDU        uint8  // N-PDU number
+	NextExtType uint8  // Type of the first extension header
+}
+
+func (hdr *GTPUHdr) String() string {
+	r0 := "            Tunnel protocol: GTP-U\n"
+	r1 := fmt.Sprintf("            GTP-U message type: %d\n", hdr.MsgType)
+	r2 := fmt.Sprintf("            GTP-U TEID: %#x\n", hdr.GetTEID())
+	return r0 + r1 + r2
+}
+
+// GetTEID returns tunnel endpoint identifier in host byte order.
+func (hdr *GTPUHdr) GetTEID() uint32 {
+	return SwapBytesUint32(hdr.TEID)
+}
+
+// SetTEID sets tunnel endpoint identifier given in host byte order.
+func (hdr *GTPUHdr) SetTEID(teid uint32) {
+	hdr.TEID = SwapBytesUint32(teid)
+}
+
+func (hdr *GTPUHdr) hasOpt() bool {
+	return hdr.Flags&(GTPUExtFlag|GTPUSeqFlag|GTPUNPDUFlag) != 0
+}
+
+func (hdr *GTPUHdr) opt() *gtpuOptHdr {
+	return (*gtpuOptHdr)(unsafe.Pointer(uintptr(unsafe.Pointer(hdr)) + GTPUMinLen))
+}
+
+// GetSeq returns sequence number in host byte order. Return false if
+// sequence number is absent.
+func (hdr *GTPUHdr) GetSeq() (uint16, bool) {
+	if hdr.Flags&GTPUSeqFlag == 0 {
+		return 0, false
+	}
+	return SwapBytesUint16(hdr.opt().SeqNum), true
+}
+
+// GetNPDU returns N-PDU number. Return false if it is absent.
+func (hdr *GTPUHdr) GetNPDU() (uint8, bool) {
+	if hdr.Flags&GTPUNPDUFlag == 0 {
+		return 0, false
+	}
+	return hdr.opt().NPDU, true
+}
+
+// GetHdrLen returns length of GTP-U header with optional fields and
+// extension headers in bytes. Chain of extension headers supposed to be
+// checked before, for example by GetGTPU.
+func (hdr *GTPUHdr) GetHdrLen() uint {
+	if !hdr.hasOpt() {
+		return GTPUMinLen
+	}
+	it := hdr.IterateExtHdrs()
+	for ; it.Valid(); it.Next() {
+	}
+	return uint(it.hdr - uintptr(unsafe.Pointer(hdr)))
+}
+
+// GTPUExtIterator walks through chain of GTP-U extension headers.
+// Typical usage is:
+//
+//	for it := gtpu.IterateExtHdrs(); it.Valid(); it.Next() {
+//		if it.Type() == GTPUExtPDUSessionContainer {
+//			content := it.Content()
+//		}
+//	}
+//
+// Chain is never walked beyond the end of GTP-U message. When iteration is
+// finished Type returns GTPUExtNone if chain is correct.
+type GTPUExtIterator struct {
+	hdr uintptr // Current extension header
+	typ uint8   // Type of current extension header
+	end uintptr // End of GTP-U message
+}
+
+// IterateExtHdrs returns iterator pointing to the first extension header.
+// Header length isn't checked against packet length, so header should be
+// returned by GetGTPU.
+func (hdr *GTPUHdr) IterateExtHdrs() GTPUExtIterator {
+	start := uintptr(unsafe.Pointer(hdr))
+	it := GTPUExtIterator{
+		hdr: start + GTPUMinLen,
+		typ: GTPUExtNone,
+		end: start + GTPUMinLen + uintptr(SwapBytesUint16(hdr.Length)),
+	}
+	if hdr.hasOpt() {
+		it.hdr += GTPUOptLen
+		if hdr.Flags&GTPUExtFlag != 0 {
+			it.typ = hdr.opt().NextExtType
+		}
+	}
+	return it
+}
+
+// Valid returns true if iterator points to extension header.
+func (it *GTPUExtIterator) Valid() bool {
+	if it.typ == GTPUExtNone || it.hdr+4 > it.end {
+		return false
+	}
+	return it.Len() != 0 && it.hdr+it.Len() <= it.end
+}
+
+// Next moves iterator to the following extension header.
+func (it *GTPUExtIterator) Next() {
+	next := it.hdr + it.Len()
+	it.typ = *(*uint8)(unsafe.Pointer(next - 1))
+	it.hdr = next
+}
+
+// Type returns type of current extension header.
+func (it *GTPUExtIterator) Type() uint8 {
+	return it.typ
+}
+
+// Len returns length of current extension header in bytes.
+func (it *GTPUExtIterator) Len() uintptr {
+	return uintptr(*(*uint8)(unsafe.Pointer(it.hdr))) << 2
+}
+
+// Content returns content of current extension header without length and
+// next extension header type fields. Slice points to packet data.
+func (it *GTPUExtIterator) Content() []byte {
+	return (*[1 << 10]byte)(unsafe.Pointer(it.hdr + 1))[:it.Len()-2]
+}
+
+// GetGTPU ensures if L4 type is UDP with GTPUPort destination port and
+// cast UDP payload to *GTPUHdr type. Version, message length and chain
+// of extension headers are checked. Datagram should fit into the first
+// segment of packet. L4 supposed to be parsed before.
+func (packet *Packet) GetGTPU() *GTPUHdr {
+	udp := packet.getTunnelUDP()
+	if udp == nil || udp.DstPort != SwapBytesUint16(GTPUPort) ||
+		SwapBytesUint16(udp.DgramLen) < UDPLen+GTPUMinLen {
+		return nil
+	}
+	// Length fields are taken from packet, so they can exceed its data
+	if uintptr(packet.L4)-packet.Start()+uintptr(SwapBytesUint16(udp.DgramLen)) > uintptr(packet.GetPacketSegmentLen()) {
+		return nil
+	}
+	gtpu := (*GTPUHdr)(unsafe.Pointer(uintptr(packet.L4) + UDPLen))
+	if gtpu.Flags&0xf0 != GTPUVersion1|GTPUProtocolType ||
+		uint(SwapBytesUint16(udp.DgramLen)) < UDPLen+GTPUMinLen+uint(SwapBytesUint16(gtpu.Length)) {
+		return nil
+	}
+	if gtpu.hasOpt() {
+		if SwapBytesUint16(gtpu.Length) < GTPUOptLen {
+			return nil
+		}
+		it := gtpu.IterateExtHdrs()
+		for ; it.Valid(); it.Next() {
+		}
+		if it.Type() != GTPUExtNone {
+			return nil
+		}
+	}
+	return gtpu
+}
+
+// GTPUExtHdr is extension header added by EncapGTPU.
+type GTPUExtHdr struct {
+	Type    uint8  // Type of extension header
+	Content []byte // Content, its length plus 2 should be multiple of 4 bytes
+}
+
+// GTPUParams describes GTP-U header built by EncapGTPU.
+type GTPUParams struct {
+	TEID    uint32       // Tunnel endpoint identifier in host byte order
+	UseSeq  bool         // Add sequence number
+	Seq     uint16       // Sequence number in host byte order
+	ExtHdrs []GTPUExtHdr // Extension headers in order of chain
+}
+
+// EncapGTPU encapsulates IPv4 or IPv6 packet into G-PDU message of GTP-U.
+// L2 header is replaced with outer Ethernet header. Outer IP and UDP headers
+// are built from endpoints in the same way as in EncapVXLAN, destination
+// port is GTPUPort. After encapsulation packet is parsed up to outer L4
+// and Data points to GTP-U header. Return false if error.
+func (packet *Packet) EncapGTPU(endpoints *TunnelEndpoints, params *GTPUParams) bool {
+	if etherType := packet.GetEtherType(); etherType != SwapBytesUint16(IPV4Number) && etherType != SwapBytesUint16(IPV6Number) {
+		LogWarning(Debug, "EncapGTPU: Only IPv4 and IPv6 packets can be encapsulated")
+		return false
+	}
+	gtpuLen := uint(GTPUMinLen)
+	if params.UseSeq || len(params.ExtHdrs) != 0 {
+		gtpuLen += GTPUOptLen
+	}
+	for _, ext := range params.ExtHdrs {
+		extLen := uint(len(ext.Content)) + 2
+		if extLen&3 != 0 || extLen > 0xff<<2 {
+			LogWarning(Debug, "EncapGTPU: Incorrect length of extension header", len(ext.Content))
+			return false
+		}
+		gtpuLen += extLen
+	}
+	srcPort := endpoints.SrcPort
+	if srcPort == 0 {
+		srcPort = packet.tunnelSrcPort()
+	}
+	innerLen := packet.GetPacketLen() - uint(packet.l2Len())
+	outerLen := EtherLen + endpoints.l3Len() + UDPLen
+	if packet.replaceL2(outerLen+gtpuLen) == false {
+		return false
+	}
+
+	gtpu := (*GTPUHdr)(unsafe.Pointer(packet.Start() + uintptr(outerLen)))
+	gtpu.Flags = GTPUVersion1 | GTPUProtocolType
+	gtpu.MsgType = GTPUGPDU
+	gtpu.Length = SwapBytesUint16(uint16(gtpuLen - GTPUMinLen + innerLen))
+	gtpu.SetTEID(params.TEID)
+	if gtpuLen > GTPUMinLen {
+		opt := gtpu.opt()
+		opt.SeqNum = 0
+		opt.NPDU = 0
+		opt.NextExtType = GTPUExtNone
+		if params.UseSeq {
+			gtpu.Flags |= GTPUSeqFlag
+			opt.SeqNum = SwapBytesUint16(params.Seq)
+		}
+		if len(params.ExtHdrs) != 0 {
+			gtpu.Flags |= GTPUExtFlag
+			opt.NextExtType = params.ExtHdrs[0].Type
+		}
+	}
+	ext := uintptr(unsafe.Pointer(gtpu)) + GTPUMinLen + GTPUOptLen
+	for i := range params.ExtHdrs {
+		extLen := uintptr(len(params.ExtHdrs[i].Content)) + 2
+		*(*uint8)(unsafe.Pointer(ext)) = uint8(extLen >> 2)
+		copy((*[1 << 10]byte)(unsafe.Pointer(ext + 1))[:extLen-2], params.ExtHdrs[i].Content)
+		next := GTPUExtNone
+		if i+1 < len(params.ExtHdrs) {
+			next = params.ExtHdrs[i+1].Type
+		}
+		*(*uint8)(unsafe.Pointer(ext + extLen - 1)) = next
+		ext += extLen
+	}
+	initOuterUDP(packet, endpoints, srcPort, GTPUPort)
+	return true
+}
+
+// DecapGTPU removes outer IP, UDP and GTP-U headers of G-PDU message.
+// Outer Ethernet header is kept and its EtherType is set according to
+// version of inner IP packet. L3 pointer is set to inner L3 header.
+// Return false if packet is not G-PDU with IP payload or if error.
+func (packet *Packet) DecapGTPU() bool {
+	if packet.parseTunnelUDP() == nil {
+		return false
+	}
+	gtpu := packet.GetGTPU()
+	if gtpu == nil || gtpu.MsgType != GTPUGPDU {
+		return false
+	}
+	hdrLen := gtpu.GetHdrLen()
+	if uint(SwapBytesUint16(gtpu.Length))+GTPUMinLen <= hdrLen {
+		return false
+	}
+	start := uintptr(unsafe.Pointer(gtpu)) + uintptr(hdrLen)
+	var etherType uint16
+	switch *(*uint8)(unsafe.Pointer(start)) >> 4 {
+	case 4:
+		etherType = IPV4Number
+	case 6:
+		etherType = IPV6Number
+	default:
+		return false
+	}
+	return packet.decapL3Tunnel(start, SwapBytesUint16(etherType))
+}
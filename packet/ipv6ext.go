@@ -0,0 +1,177 @@
+// Copyright 2017 Intel Corporation.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package packet
+
+import (
+	"fmt"
+	"unsafe"
+
+	. "github.com/intel-go/yanff/common"
+)
+
+// IPv6ExtHdr is common beginning of IPv6 extension headers which
+// have variable length: Hop-by-Hop Options, Routing, Destination
+// Options and Authentication headers.
+type IPv6ExtHdr struct {
+	NextHeader uint8 // Type of next header
+	HdrExtLen  uint8 // Header length, units depend on header type
+}
+
+// IPv6FragmentHdr is IPv6 Fragment extension header (RFC 8200).
+type IPv6FragmentHdr struct {
+	NextHeader     uint8  // Type of next header
+	Reserved       uint8  // Reserved field
+	FragmentOffset uint16 // Fragment offset in 8 bytes units and more fragments flag
+	Identification uint32 // Fragment identification
+}
+
+func (hdr *IPv6FragmentHdr) String() string {
+	r0 := "    IPv6 Fragment header\n"
+	r1 := fmt.Sprintf("    Fragment offset: %d\n", hdr.GetFragmentOffset())
+	r2 := fmt.Sprintf("    More fragments: %t\n", hdr.MoreFragments())
+	r3 := fmt.Sprintf("    Identification: %d\n", SwapBytesUint32(hdr.Identification))
+	return r0 + r1 + r2 + r3
+}
+
+// GetFragmentOffset returns offset of fragment data in bytes.
+func (hdr *IPv6FragmentHdr) GetFragmentOffset() uint16 {
+	return SwapBytesUint16(hdr.FragmentOffset) & 0xfff8
+}
+
+// MoreFragments returns true if M flag is set, so fragment is not the last one.
+func (hdr *IPv6FragmentHdr) MoreFragments() bool {
+	return SwapBytesUint16(hdr.FragmentOffset)&0x1 != 0
+}
+
+func isIPv6ExtHdr(proto uint8) bool {
+	switch proto {
+	case IPv6HopByHopNumber, IPv6RoutingNumber, IPv6FragmentNumber,
+		IPv6AuthHeaderNumber, IPv6DestOptionsNumber:
+		return true
+	}
+	return false
+}
+
+// IPv6ExtHdrIterator walks through chain of IPv6 extension headers.
+// Typical usage is:
+//
+//	for it := pkt.IterateIPv6ExtHdrs(); it.Valid(); it.Next() {
+//		if it.Type() == IPv6FragmentNumber {
+//			frag := (*IPv6FragmentHdr)(it.Header())
+//		}
+//	}
+//
+// When iteration is finished Type and Header return upper layer protocol
+// and pointer to its header. Chain is never walked beyond IPv6 payload length.
+type IPv6ExtHdrIterator struct {
+	hdr   uintptr // Current header
+	proto uint8   // Type of current header
+	end   uintptr // End of IPv6 payload
+}
+
+// IterateIPv6ExtHdrs returns iterator pointing to the first extension
+// header. L3 should be parsed before and be of IPv6 type.
+func (packet *Packet) IterateIPv6ExtHdrs() IPv6ExtHdrIterator {
+	ipv6 := (*IPv6Hdr)(packet.L3)
+	start := uintptr(packet.L3) + IPv6Len
+	return IPv6ExtHdrIterator{
+		hdr:   start,
+		proto: ipv6.Proto,
+		end:   start + uintptr(SwapBytesUint16(ipv6.PayloadLen)),
+	}
+}
+
+// Valid returns true if iterator points to extension header.
+func (it *IPv6ExtHdrIterator) Valid() bool {
+	return isIPv6ExtHdr(it.proto) && it.hdr+it.Len() <= it.end
+}
+
+// Next moves iterator to the following header.
+func (it *IPv6ExtHdrIterator) Next() {
+	next := it.hdr + it.Len()
+	it.proto = (*IPv6ExtHdr)(unsafe.Pointer(it.hdr)).NextHeader
+	it.hdr = next
+}
+
+// Type returns type of current header.
+func (it *IPv6ExtHdrIterator) Type() uint8 {
+	return it.proto
+}
+
+// Header returns pointer to current header.
+func (it *IPv6ExtHdrIterator) Header() unsafe.Pointer {
+	return unsafe.Pointer(it.hdr)
+}
+
+// Len returns length of current extension header in bytes.
+func (it *IPv6ExtHdrIterator) Len() uintptr {
+	if it.hdr+2 > it.end {
+		// Header is truncated, its length can't be read
+		return IPv6FragmentLen
+	}
+	switch it.proto {
+	case IPv6FragmentNumber:
+		return IPv6FragmentLen
+	case IPv6AuthHeaderNumber:
+		return (uintptr((*IPv6ExtHdr)(unsafe.Pointer(it.hdr)).HdrExtLen) + 2) << 2
+	default:
+		return (uintptr((*IPv6ExtHdr)(unsafe.Pointer(it.hdr)).HdrExtLen) + 1) << 3
+	}
+}
+
+// walkIPv6ExtHdrs returns upper layer protocol, pointer to its header and
+// Fragment header if packet has it.
+func (packet *Packet) walkIPv6ExtHdrs() (uint8, uintptr, *IPv6FragmentHdr) {
+	var frag *IPv6FragmentHdr
+	it := packet.IterateIPv6ExtHdrs()
+	for ; it.Valid(); it.Next() {
+		if it.Type() == IPv6FragmentNumber {
+			frag = (*IPv6FragmentHdr)(it.Header())
+		}
+	}
+	return it.Type(), it.hdr, frag
+}
+
+// GetL4ProtoForIPv6 returns type of upper layer protocol located after
+// all extension headers. For non first fragments this protocol header is
+// absent in the packet. L3 supposed to be parsed before and of IPv6 type.
+func (packet *Packet) GetL4ProtoForIPv6() uint8 {
+	proto := packet.GetIPv6().Proto
+	if isIPv6ExtHdr(proto) {
+		proto, _, _ = packet.walkIPv6ExtHdrs()
+	}
+	return proto
+}
+
+// GetIPv6Fragment returns pointer to Fragment header or nil if packet
+// is not fragmented. L3 supposed to be parsed before and of IPv6 type.
+func (packet *Packet) GetIPv6Fragment() *IPv6FragmentHdr {
+	if !isIPv6ExtHdr(packet.GetIPv6().Proto) {
+		return nil
+	}
+	_, _, frag := packet.walkIPv6ExtHdrs()
+	return frag
+}
+
+// getL4TypeForIPv6 returns upper layer protocol only if its header is
+// present in the packet and IPv6NoNextHeader otherwise.
+func (packet *Packet) getL4TypeForIPv6() uint8 {
+	proto := packet.GetIPv6().Proto
+	if !isIPv6ExtHdr(proto) {
+		return proto
+	}
+	proto, _, frag := packet.walkIPv6ExtHdrs()
+	if frag != nil && frag.GetFragmentOffset() != 0 {
+		return IPv6NoNextHeader
+	}
+	return proto
+}
+
+// getL4LenForIPv6 returns length of upper layer part of IPv6 payload.
+// L4 supposed to be parsed before.
+func (packet *Packet) getL4LenForIPv6() uint16 {
+	extLen := uint16(uintptr(packet.L4) - uintptr(packet.L3) - IPv6Len)
+	return SwapBytesUint16(packet.GetIPv6().PayloadLen) - extLen
+}
@@ -0,0 +1,163 @@
+// Copyright 2017 Intel Corporation.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package packet
+
+import (
+	"fmt"
+	"unsafe"
+
+	. "github.com/intel-go/yanff/common"
+)
+
+// MPLSHdr is MPLS label stack entry (RFC 3032). Label stack is placed
+// after Ethernet header and VLAN tags if EtherType is MPLSNumber.
+type MPLSHdr struct {
+	Entry uint32 // Label, traffic class, bottom of stack flag and TTL
+}
+
+func (hdr *MPLSHdr) String() string {
+	r0 := "    MPLS label\n"
+	r1 := fmt.Sprintf("    MPLS Label: %d\n", hdr.GetLabel())
+	r2 := fmt.Sprintf("    MPLS TC: %d, Bottom of stack: %t, TTL: %d\n", hdr.GetTC(), hdr.IsBottomOfStack(), hdr.GetTTL())
+	return r0 + r1 + r2
+}
+
+// GetLabel returns 20 bits MPLS label in host byte order.
+func (hdr *MPLSHdr) GetLabel() uint32 {
+	return SwapBytesUint32(hdr.Entry) >> 12
+}
+
+// SetLabel sets MPLS label. Other fields are not changed.
+func (hdr *MPLSHdr) SetLabel(label uint32) {
+	hdr.Entry = SwapBytesUint32(SwapBytesUint32(hdr.Entry)&0xfff | label<<12)
+}
+
+// GetTC returns traffic class (3 bits).
+func (hdr *MPLSHdr) GetTC() uint8 {
+	return uint8(SwapBytesUint32(hdr.Entry)>>9) & 0x7
+}
+
+// SetTC sets traffic class. Other fields are not changed.
+func (hdr *MPLSHdr) SetTC(tc uint8) {
+	hdr.Entry = SwapBytesUint32(SwapBytesUint32(hdr.Entry)&^0xe00 | uint32(tc&0x7)<<9)
+}
+
+// IsBottomOfStack returns true if this entry is the last one in label stack.
+func (hdr *MPLSHdr) IsBottomOfStack() bool {
+	return SwapBytesUint32(hdr.Entry)&0x100 != 0
+}
+
+// GetTTL returns MPLS TTL.
+func (hdr *MPLSHdr) GetTTL() uint8 {
+	return uint8(SwapBytesUint32(hdr.Entry))
+}
+
+// SetTTL sets MPLS TTL. Other fields are not changed.
+func (hdr *MPLSHdr) SetTTL(ttl uint8) {
+	hdr.Entry = SwapBytesUint32(SwapBytesUint32(hdr.Entry)&^0xff | uint32(ttl))
+}
+
+// skipMPLS returns length of L2 header after label stack which starts
+// at given offset and EtherType of packet below label stack. L3 protocol
+// isn't recorded in label stack, so it is determined by IP version.
+// MPLSNumber is returned if payload is not IP.
+func (packet *Packet) skipMPLS(offset uintptr) (uintptr, uint16) {
+	end := uintptr(packet.GetPacketSegmentLen())
+	for offset+MPLSLen <= end {
+		entry := (*MPLSHdr)(unsafe.Pointer(packet.Start() + offset))
+		offset += MPLSLen
+		if entry.IsBottomOfStack() {
+			break
+		}
+	}
+	if offset < end {
+		switch *(*uint8)(unsafe.Pointer(packet.Start() + offset)) >> 4 {
+		case 4:
+			return offset, SwapBytesUint16(IPV4Number)
+		case 6:
+			return offset, SwapBytesUint16(IPV6Number)
+		}
+	}
+	return offset, SwapBytesUint16(MPLSNumber)
+}
+
+// GetMPLS returns pointer to top MPLS label stack entry or nil if packet
+// is not MPLS.
+func (packet *Packet) GetMPLS() *MPLSHdr {
+	offset, etherType := packet.skipVLAN()
+	if etherType != SwapBytesUint16(MPLSNumber) {
+		return nil
+	}
+	return (*MPLSHdr)(unsafe.Pointer(packet.Start() + offset))
+}
+
+// GetMPLSLabels returns view of whole MPLS label stack from top to bottom
+// entry. Slice points to packet data, so entries can be changed in place.
+// Returns nil if packet is not MPLS.
+func (packet *Packet) GetMPLSLabels() []MPLSHdr {
+	top := packet.GetMPLS()
+	if top == nil {
+		return nil
+	}
+	offset := uintptr(unsafe.Pointer(top)) - packet.Start()
+	end, _ := packet.skipMPLS(offset)
+	return (*[1 << 10]MPLSHdr)(unsafe.Pointer(top))[:(end-offset)/MPLSLen]
+}
+
+// PushMPLS adds new top MPLS label stack entry with given label, traffic
+// class and TTL after Ethernet header and VLAN tags. If packet was not
+// MPLS new entry becomes bottom of stack. L3, L4 and Data pointers
+// remain valid. Return false if error.
+func (packet *Packet) PushMPLS(label uint32, tc uint8, ttl uint8) bool {
+	offset, etherType := packet.skipVLAN()
+	if packet.EncapsulateHead(uint(offset), MPLSLen) == false {
+		return false
+	}
+	entry := (*MPLSHdr)(unsafe.Pointer(packet.Start() + offset))
+	entry.Entry = 0
+	if etherType != SwapBytesUint16(MPLSNumber) {
+		entry.Entry = SwapBytesUint32(0x100)
+		*(*uint16)(unsafe.Pointer(packet.Start() + offset - 2)) = SwapBytesUint16(MPLSNumber)
+	}
+	entry.SetLabel(label)
+	entry.SetTC(tc)
+	entry.SetTTL(ttl)
+	return true
+}
+
+// PopMPLS removes top MPLS label stack entry. If it was bottom of stack
+// EtherType is set according to IP version of payload. L3, L4 and Data
+// pointers remain valid. Return false if packet is not MPLS, if bottom of
+// stack entry is removed but payload is not IP or if error.
+func (packet *Packet) PopMPLS() bool {
+	top := packet.GetMPLS()
+	if top == nil {
+		return false
+	}
+	offset := uintptr(unsafe.Pointer(top)) - packet.Start()
+	etherType := SwapBytesUint16(MPLSNumber)
+	if top.IsBottomOfStack() {
+		if _, etherType = packet.skipMPLS(offset); etherType == SwapBytesUint16(MPLSNumber) {
+			return false
+		}
+	}
+	if packet.DecapsulateHead(uint(offset), MPLSLen) == false {
+		return false
+	}
+	*(*uint16)(unsafe.Pointer(packet.Start() + offset - 2)) = etherType
+	return true
+}
+
+// SwapMPLS replaces label of top MPLS label stack entry. Traffic class,
+// bottom of stack flag and TTL are not changed. Return false if packet
+// is not MPLS.
+func (packet *Packet) SwapMPLS(label uint32) bool {
+	top := packet.GetMPLS()
+	if top == nil {
+		return false
+	}
+	top.SetLabel(label)
+	return true
+}
@@ -0,0 +1,356 @@
+// Copyright 2017 Intel Corporation.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package packet
+
+import (
+	"fmt"
+	"unsafe"
+
+	. "github.com/intel-go/yanff/common"
+)
+
+// Neighbor Discovery Protocol (RFC 4861) messages. All of them are
+// placed at L4 pointer and include ICMPv6 Type, Code and Cksum fields,
+// options follow message and can be walked by IterateNDPOptions.
+
+// NDPNeighborSolicitationHdr is NDP Neighbor Solicitation message.
+type NDPNeighborSolicitationHdr struct {
+	Type       uint8              // ICMPv6TypeNeighborSolicitation
+	Code       uint8              // Always 0
+	Cksum      uint16             // ICMPv6 checksum
+	Reserved   uint32             // Reserved field
+	TargetAddr [IPv6AddrLen]uint8 // Address which is resolved
+}
+
+// NDPNeighborAdvertisementHdr is NDP Neighbor Advertisement message.
+type NDPNeighborAdvertisementHdr struct {
+	Type       uint8              // ICMPv6TypeNeighborAdvertisement
+	Code       uint8              // Always 0
+	Cksum      uint16             // ICMPv6 checksum
+	Flags      uint32             // NDPRouterFlag, NDPSolicitedFlag and NDPOverrideFlag
+	TargetAddr [IPv6AddrLen]uint8 // Address which is advertised
+}
+
+// NDPRouterSolicitationHdr is NDP Router Solicitation message.
+type NDPRouterSolicitationHdr struct {
+	Type     uint8  // ICMPv6TypeRouterSolicitation
+	Code     uint8  // Always 0
+	Cksum    uint16 // ICMPv6 checksum
+	Reserved uint32 // Reserved field
+}
+
+// NDPRouterAdvertisementHdr is NDP Router Advertisement message.
+type NDPRouterAdvertisementHdr struct {
+	Type           uint8  // ICMPv6TypeRouterAdvertisement
+	Code           uint8  // Always 0
+	Cksum          uint16 // ICMPv6 checksum
+	CurHopLimit    uint8  // Hop limit which should be used by hosts
+	Flags          uint8  // Managed and Other configuration flags
+	RouterLifetime uint16 // Lifetime of default router in seconds
+	ReachableTime  uint32 // Reachable time in milliseconds
+	RetransTimer   uint32 // Retransmission timer in milliseconds
+}
+
+// NDPOptionHdr is common beginning of all NDP options.
+type NDPOptionHdr struct {
+	Type   uint8 // Option type
+	Length uint8 // Option length in 8 bytes units
+}
+
+// NDPLinkLayerAddrOption is Source or Target Link-Layer Address option.
+type NDPLinkLayerAddrOption struct {
+	Type   uint8               // NDPOptionSourceLinkLayerAddr or NDPOptionTargetLinkLayerAddr
+	Length uint8               // Always 1
+	Addr   [EtherAddrLen]uint8 // MAC address
+}
+
+// NDPPrefixInfoOption is Prefix Information option of Router Advertisement.
+type NDPPrefixInfoOption struct {
+	Type              uint8              // NDPOptionPrefixInfo
+	Length            uint8              // Always 4
+	PrefixLength      uint8              // Number of valid leading bits in Prefix
+	Flags             uint8              // NDPPrefixOnLinkFlag and NDPPrefixAutonomousFlag
+	ValidLifetime     uint32             // Valid lifetime in seconds
+	PreferredLifetime uint32             // Preferred lifetime in seconds
+	Reserved          uint32             // Reserved field
+	Prefix            [IPv6AddrLen]uint8 // IPv6 prefix
+}
+
+// NDPMTUOption is MTU option of Router Advertisement.
+type NDPMTUOption struct {
+	Type     uint8  // NDPOptionMTU
+	Length   uint8  // Always 1
+	Reserved uint16 // Reserved field
+	MTU      uint32 // Recommended MTU
+}
+
+func (hdr *NDPNeighborSolicitationHdr) String() string {
+	r0 := "        L4 protocol: NDP Neighbor Solicitation\n"
+	r1 := fmt.Sprintf("        NDP Target: %s\n", ipv6AddrString(hdr.TargetAddr))
+	return r0 + r1
+}
+
+func (hdr *NDPNeighborAdvertisementHdr) String() string {
+	r0 := "        L4 protocol: NDP Neighbor Advertisement\n"
+	r1 := fmt.Sprintf("        NDP Flags: %08x\n", SwapBytesUint32(hdr.Flags))
+	r2 := fmt.Sprintf("        NDP Target: %s\n", ipv6AddrString(hdr.TargetAddr))
+	return r0 + r1 + r2
+}
+
+func ipv6AddrString(a [IPv6AddrLen]uint8) string {
+	return fmt.Sprintf("%02x%02x:%02x%02x:%02x%02x:%02x%02x:%02x%02x:%02x%02x:%02x%02x:%02x%02x",
+		a[0], a[1], a[2], a[3], a[4], a[5], a[6], a[7], a[8], a[9], a[10], a[11], a[12], a[13], a[14], a[15])
+}
+
+// AllNodesMulticastAddr is IPv6 link-local all nodes multicast address ff02::1.
+var AllNodesMulticastAddr = [IPv6AddrLen]uint8{0xff, 0x02, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0x01}
+
+// AllRoutersMulticastAddr is IPv6 link-local all routers multicast address ff02::2.
+var AllRoutersMulticastAddr = [IPv6AddrLen]uint8{0xff, 0x02, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0x02}
+
+// SolicitedNodeMulticastAddr returns solicited-node multicast address
+// ff02::1:ffXX:XXXX which is used as destination of Neighbor Solicitation for addr.
+func SolicitedNodeMulticastAddr(addr [IPv6AddrLen]uint8) [IPv6AddrLen]uint8 {
+	return [IPv6AddrLen]uint8{0xff, 0x02, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0x01, 0xff, addr[13], addr[14], addr[15]}
+}
+
+// IPv6MulticastMAC returns Ethernet multicast address 33:33:XX:XX:XX:XX
+// corresponding to IPv6 multicast address.
+func IPv6MulticastMAC(addr [IPv6AddrLen]uint8) [EtherAddrLen]uint8 {
+	return [EtherAddrLen]uint8{0x33, 0x33, addr[12], addr[13], addr[14], addr[15]}
+}
+
+func (packet *Packet) getNDPMessage(msgType uint8, minLen uint16) unsafe.Pointer {
+	icmp := packet.GetICMPForIPv6()
+	if icmp == nil || icmp.Type != msgType || packet.getL4LenForIPv6() < minLen {
+		return nil
+	}
+	return packet.L4
+}
+
+// GetNDPNeighborSolicitation ensures if L4 is NDP Neighbor Solicitation and
+// cast L4 pointer to *NDPNeighborSolicitationHdr type. L4 supposed to be parsed before.
+func (packet *Packet) GetNDPNeighborSolicitation() *NDPNeighborSolicitationHdr {
+	return (*NDPNeighborSolicitationHdr)(packet.getNDPMessage(ICMPv6TypeNeighborSolicitation, NDPNeighborSolicitationLen))
+}
+
+// GetNDPNeighborAdvertisement ensures if L4 is NDP Neighbor Advertisement and
+// cast L4 pointer to *NDPNeighborAdvertisementHdr type. L4 supposed to be parsed before.
+func (packet *Packet) GetNDPNeighborAdvertisement() *NDPNeighborAdvertisementHdr {
+	return (*NDPNeighborAdvertisementHdr)(packet.getNDPMessage(ICMPv6TypeNeighborAdvertisement, NDPNeighborAdvertisementLen))
+}
+
+// GetNDPRouterSolicitation ensures if L4 is NDP Router Solicitation and
+// cast L4 pointer to *NDPRouterSolicitationHdr type. L4 supposed to be parsed before.
+func (packet *Packet) GetNDPRouterSolicitation() *NDPRouterSolicitationHdr {
+	return (*NDPRouterSolicitationHdr)(packet.getNDPMessage(ICMPv6TypeRouterSolicitation, NDPRouterSolicitationLen))
+}
+
+// GetNDPRouterAdvertisement ensures if L4 is NDP Router Advertisement and
+// cast L4 pointer to *NDPRouterAdvertisementHdr type. L4 supposed to be parsed before.
+func (packet *Packet) GetNDPRouterAdvertisement() *NDPRouterAdvertisementHdr {
+	return (*NDPRouterAdvertisementHdr)(packet.getNDPMessage(ICMPv6TypeRouterAdvertisement, NDPRouterAdvertisementLen))
+}
+
+// NDPOptionIterator walks through options of NDP message in the same
+// way as IPv6ExtHdrIterator walks through IPv6 extension headers.
+// Malformed options with zero length stop iteration.
+type NDPOptionIterator struct {
+	hdr uintptr // Current option
+	end uintptr // End of ICMPv6 message
+}
+
+// IterateNDPOptions returns iterator pointing to the first option of NDP
+// message. Iterator is not valid if L4 is not NDP message. L4 supposed
+// to be parsed before.
+func (packet *Packet) IterateNDPOptions() NDPOptionIterator {
+	icmp := packet.GetICMPForIPv6()
+	if icmp == nil {
+		return NDPOptionIterator{}
+	}
+	var msgLen uintptr
+	switch icmp.Type {
+	case ICMPv6TypeNeighborSolicitation:
+		msgLen = NDPNeighborSolicitationLen
+	case ICMPv6TypeNeighborAdvertisement:
+		msgLen = NDPNeighborAdvertisementLen
+	case ICMPv6TypeRouterSolicitation:
+		msgLen = NDPRouterSolicitationLen
+	case ICMPv6TypeRouterAdvertisement:
+		msgLen = NDPRouterAdvertisementLen
+	default:
+		return NDPOptionIterator{}
+	}
+	return NDPOptionIterator{
+		hdr: uintptr(packet.L4) + msgLen,
+		end: uintptr(packet.L4) + uintptr(packet.getL4LenForIPv6()),
+	}
+}
+
+// Valid returns true if iterator points to option.
+func (it *NDPOptionIterator) Valid() bool {
+	if it.hdr+2 > it.end {
+		return false
+	}
+	length := it.Len()
+	return length != 0 && it.hdr+length <= it.end
+}
+
+// Next moves iterator to the following option.
+func (it *NDPOptionIterator) Next() {
+	it.hdr += it.Len()
+}
+
+// Type returns type of current option.
+func (it *NDPOptionIterator) Type() uint8 {
+	return (*NDPOptionHdr)(unsafe.Pointer(it.hdr)).Type
+}
+
+// Header returns pointer to current option.
+func (it *NDPOptionIterator) Header() unsafe.Pointer {
+	return unsafe.Pointer(it.hdr)
+}
+
+// Len returns length of current option in bytes.
+func (it *NDPOptionIterator) Len() uintptr {
+	return uintptr((*NDPOptionHdr)(unsafe.Pointer(it.hdr)).Length) << 3
+}
+
+// GetNDPLinkLayerAddr returns MAC address from the first option of given
+// type, which should be NDPOptionSourceLinkLayerAddr or NDPOptionTargetLinkLayerAddr.
+// Returns false if NDP message doesn't have such option.
+func (packet *Packet) GetNDPLinkLayerAddr(optType uint8) ([EtherAddrLen]uint8, bool) {
+	for it := packet.IterateNDPOptions(); it.Valid(); it.Next() {
+		if it.Type() == optType && it.Len() == NDPLinkLayerAddrOptionLen {
+			return (*NDPLinkLayerAddrOption)(it.Header()).Addr, true
+		}
+	}
+	return [EtherAddrLen]uint8{}, false
+}
+
+// SetNDPChecksum calculates and sets ICMPv6 checksum of NDP message.
+// It should be called after any change of NDP message or IPv6 addresses.
+func SetNDPChecksum(packet *Packet) {
+	icmp := packet.GetICMPForIPv6()
+	icmp.Cksum = 0
+	icmp.Cksum = SwapBytesUint16(CalculateIPv6ICMPChecksum(packet))
+}
+
+func initEmptyNDPPacket(packet *Packet, msgLen uint, sha, dha [EtherAddrLen]uint8, src, dst [IPv6AddrLen]uint8) bool {
+	if InitEmptyIPv6ICMPPacket(packet, msgLen-ICMPLen) == false {
+		return false
+	}
+	packet.Data = unsafe.Pointer(uintptr(packet.L4) + uintptr(msgLen))
+	// Reserved fields of message should be zero
+	msg := (*[1 << 16]uint8)(packet.L4)[:msgLen]
+	for i := range msg {
+		msg[i] = 0
+	}
+	packet.Ether.DAddr = dha
+	packet.Ether.SAddr = sha
+	ipv6 := packet.GetIPv6()
+	// NDP messages are accepted only with maximum hop limit
+	ipv6.HopLimits = 255
+	ipv6.SrcAddr = src
+	ipv6.DstAddr = dst
+	return true
+}
+
+// addNDPLinkLayerAddr fills link-layer address option at given offset from L4.
+func addNDPLinkLayerAddr(packet *Packet, offset uintptr, optType uint8, addr [EtherAddrLen]uint8) {
+	opt := (*NDPLinkLayerAddrOption)(unsafe.Pointer(uintptr(packet.L4) + offset))
+	opt.Type = optType
+	opt.Length = NDPLinkLayerAddrOptionLen >> 3
+	opt.Addr = addr
+}
+
+// InitNDPNeighborSolicitation initializes input packet as Neighbor
+// Solicitation sent from sha and src which asks MAC address of target.
+// Packet is sent to solicited-node multicast address of target. If src
+// is unspecified address (Duplicate Address Detection) Source Link-Layer
+// Address option is omitted.
+func InitNDPNeighborSolicitation(packet *Packet, sha [EtherAddrLen]uint8, src, target [IPv6AddrLen]uint8) bool {
+	msgLen := uint(NDPNeighborSolicitationLen)
+	if src != [IPv6AddrLen]uint8{} {
+		msgLen += NDPLinkLayerAddrOptionLen
+	}
+	dst := SolicitedNodeMulticastAddr(target)
+	if initEmptyNDPPacket(packet, msgLen, sha, IPv6MulticastMAC(dst), src, dst) == false {
+		return false
+	}
+	ns := (*NDPNeighborSolicitationHdr)(packet.L4)
+	ns.Type = ICMPv6TypeNeighborSolicitation
+	ns.TargetAddr = target
+	if msgLen != NDPNeighborSolicitationLen {
+		addNDPLinkLayerAddr(packet, NDPNeighborSolicitationLen, NDPOptionSourceLinkLayerAddr, sha)
+	}
+	SetNDPChecksum(packet)
+	return true
+}
+
+// InitNDPNeighborAdvertisement initializes input packet as Neighbor
+// Advertisement which tells dha and dst that MAC address of target is sha.
+// Target is also used as source IPv6 address. Flags are combination of
+// NDPRouterFlag, NDPSolicitedFlag and NDPOverrideFlag.
+func InitNDPNeighborAdvertisement(packet *Packet, sha, dha [EtherAddrLen]uint8, target, dst [IPv6AddrLen]uint8, flags uint32) bool {
+	msgLen := uint(NDPNeighborAdvertisementLen + NDPLinkLayerAddrOptionLen)
+	if initEmptyNDPPacket(packet, msgLen, sha, dha, target, dst) == false {
+		return false
+	}
+	na := (*NDPNeighborAdvertisementHdr)(packet.L4)
+	na.Type = ICMPv6TypeNeighborAdvertisement
+	na.Flags = SwapBytesUint32(flags)
+	na.TargetAddr = target
+	addNDPLinkLayerAddr(packet, NDPNeighborAdvertisementLen, NDPOptionTargetLinkLayerAddr, sha)
+	SetNDPChecksum(packet)
+	return true
+}
+
+// InitNDPRouterSolicitation initializes input packet as Router Solicitation
+// sent from sha and src to all routers multicast address.
+func InitNDPRouterSolicitation(packet *Packet, sha [EtherAddrLen]uint8, src [IPv6AddrLen]uint8) bool {
+	msgLen := uint(NDPRouterSolicitationLen)
+	if src != [IPv6AddrLen]uint8{} {
+		msgLen += NDPLinkLayerAddrOptionLen
+	}
+	dst := AllRoutersMulticastAddr
+	if initEmptyNDPPacket(packet, msgLen, sha, IPv6MulticastMAC(dst), src, dst) == false {
+		return false
+	}
+	(*NDPRouterSolicitationHdr)(packet.L4).Type = ICMPv6TypeRouterSolicitation
+	if msgLen != NDPRouterSolicitationLen {
+		addNDPLinkLayerAddr(packet, NDPRouterSolicitationLen, NDPOptionSourceLinkLayerAddr, sha)
+	}
+	SetNDPChecksum(packet)
+	return true
+}
+
+// InitNDPRouterAdvertisement initializes input packet as Router Advertisement
+// sent from sha and src to dha and dst with Source Link-Layer Address option
+// and given Prefix Information options. Type and Length of prefix options are
+// set by this function, other fields should have network byte order.
+// Message has hop limit 64 and router lifetime 1800 seconds, they can be
+// changed by user with following SetNDPChecksum call.
+func InitNDPRouterAdvertisement(packet *Packet, sha, dha [EtherAddrLen]uint8, src, dst [IPv6AddrLen]uint8, prefixes ...NDPPrefixInfoOption) bool {
+	msgLen := uint(NDPRouterAdvertisementLen + NDPLinkLayerAddrOptionLen + NDPPrefixInfoOptionLen*len(prefixes))
+	if initEmptyNDPPacket(packet, msgLen, sha, dha, src, dst) == false {
+		return false
+	}
+	ra := (*NDPRouterAdvertisementHdr)(packet.L4)
+	ra.Type = ICMPv6TypeRouterAdvertisement
+	ra.CurHopLimit = 64
+	ra.RouterLifetime = SwapBytesUint16(1800)
+	addNDPLinkLayerAddr(packet, NDPRouterAdvertisementLen, NDPOptionSourceLinkLayerAddr, sha)
+	offset := uintptr(NDPRouterAdvertisementLen + NDPLinkLayerAddrOptionLen)
+	for i := range prefixes {
+		opt := (*NDPPrefixInfoOption)(unsafe.Pointer(uintptr(packet.L4) + offset))
+		*opt = prefixes[i]
+		opt.Type = NDPOptionPrefixInfo
+		opt.Length = NDPPrefixInfoOptionLen >> 3
+		offset += NDPPrefixInfoOptionLen
+	}
+	SetNDPChecksum(packet)
+	return true
+}
@@ -5,10 +5,11 @@
 // Package packet provides functionality for fast parsing and generating
 // of packets with known structure.
 // The following header types are supported:
-//      * L2 Ethernet
-//      * L3 IPv4 and IPv6
-//      * L4 TCP, UDP and ICMP
-// At the moment IPv6 is supported without extension headers.
+//      * L2 Ethernet, optionally with 802.1Q VLAN or 802.1ad QinQ tags
+//      * L3 IPv4, IPv6 and ARP
+//      * L4 TCP, UDP, ICMP and ICMPv6 including NDP messages
+//      * Tunnels VXLAN, Geneve, GRE, IPv4-in-IPv4 and IPv6-in-IPv6
+// IPv6 extension headers are skipped when L4 header is parsed.
 //
 // For performance
 // reasons YANFF provides a set of functions each of them parse exact network level.
@@ -26,10 +27,14 @@
 //
 // Conditional parsing functions are used to parse any supported protocols.
 //
+// Safe parsing functions like SafeParseL3 and SafeParseL4ForIPv4 check header
+// lengths and length fields against real packet length and return error for
+// truncated or malformed packets. They should be used for untrusted traffic.
+//
 // Packet generation
 //
 // Packets should be placed in special memory to be sent, so user should use
-// additional functions to generate packets. There are two possibilities to do this:
+// additional functions to generate packets. There are three possibilities to do this:
 //		GeneratePacketFromByte function
 // This function get slice of bytes of any size. Returns packet which contains only these bytes.
 //              CreateEmpty function family
@@ -39,6 +44,10 @@
 // All these functions get size of payload as argument. After using one of
 // this functions user can fill any required fields headers of the packet and
 // also fill payload.
+//		Build function
+// Builder returned by Build adds headers layer by layer from values in host
+// byte order and fills lengths and checksums, so fields don't need to be
+// filled through pointers after generation.
 package packet
 
 import (
@@ -199,7 +208,7 @@ type Packet struct {
 }
 
 func (packet *Packet) unparsed() uintptr {
-	return uintptr(unsafe.Pointer(packet.Ether)) + EtherLen
+	return uintptr(unsafe.Pointer(packet.Ether)) + packet.l2Len()
 }
 
 // Start function return pointer to first byte of packet
@@ -208,14 +217,15 @@ func (packet *Packet) Start() uintptr {
 	return uintptr(unsafe.Pointer(packet.Ether))
 }
 
-// ParseL3 set poinetr to start of L3 header
+// ParseL3 set poinetr to start of L3 header. VLAN tags are skipped
+// if they are present.
 func (packet *Packet) ParseL3() {
 	packet.L3 = unsafe.Pointer(packet.unparsed())
 }
 
 // GetIPv4 ensures if EtherType is IPv4 and cast L3 poinetr to IPv4Hdr type.
 func (packet *Packet) GetIPv4() *IPv4Hdr {
-	if packet.Ether.EtherType == SwapBytesUint16(IPV4Number) {
+	if packet.GetEtherType() == SwapBytesUint16(IPV4Number) {
 		return (*IPv4Hdr)(packet.L3)
 	}
 	return nil
@@ -223,7 +233,7 @@ func (packet *Packet) GetIPv4() *IPv4Hdr {
 
 // GetIPv6 ensures if EtherType is IPv6 and cast L3 poinetr to IPv6Hdr type.
 func (packet *Packet) GetIPv6() *IPv6Hdr {
-	if packet.Ether.EtherType == SwapBytesUint16(IPV6Number) {
+	if packet.GetEtherType() == SwapBytesUint16(IPV6Number) {
 		return (*IPv6Hdr)(packet.L3)
 	}
 	return nil
@@ -235,8 +245,14 @@ func (packet *Packet) ParseL4ForIPv4() {
 }
 
 // ParseL4ForIPv6 set L4 to start of L4 header, if L3 protocol is IPv6.
+// All extension headers before L4 header are skipped.
 func (packet *Packet) ParseL4ForIPv6() {
-	packet.L4 = unsafe.Pointer(packet.unparsed() + uintptr(IPv6Len))
+	if !isIPv6ExtHdr(packet.GetIPv6().Proto) {
+		packet.L4 = unsafe.Pointer(packet.unparsed() + uintptr(IPv6Len))
+		return
+	}
+	_, l4, _ := packet.walkIPv6ExtHdrs()
+	packet.L4 = unsafe.Pointer(l4)
 }
 
 // GetTCPForIPv4 ensures if L4 type is TCP and cast L4 pointer to TCPHdr type.
@@ -248,8 +264,9 @@ func (packet *Packet) GetTCPForIPv4() *TCPHdr {
 }
 
 // GetTCPForIPv6 ensures if L4 type is TCP and cast L4 pointer to *TCPHdr type.
+// Returns nil for non first fragments which don't contain L4 header.
 func (packet *Packet) GetTCPForIPv6() *TCPHdr {
-	if packet.GetIPv6().Proto == TCPNumber {
+	if packet.getL4TypeForIPv6() == TCPNumber {
 		return (*TCPHdr)(packet.L4)
 	}
 	return nil
@@ -264,8 +281,9 @@ func (packet *Packet) GetUDPForIPv4() *UDPHdr {
 }
 
 // GetUDPForIPv6 ensures if L4 type is UDP and cast L4 pointer to *UDPHdr type.
+// Returns nil for non first fragments which don't contain L4 header.
 func (packet *Packet) GetUDPForIPv6() *UDPHdr {
-	if packet.GetIPv6().Proto == UDPNumber {
+	if packet.getL4TypeForIPv6() == UDPNumber {
 		return (*UDPHdr)(packet.L4)
 	}
 	return nil
@@ -280,10 +298,11 @@ func (packet *Packet) GetICMPForIPv4() *ICMPHdr {
 	return nil
 }
 
-// GetICMPForIPv6 ensures if L4 type is ICMP and cast L4 poinetr to *ICMPHdr type.
+// GetICMPForIPv6 ensures if L4 type is ICMPv6 and cast L4 poinetr to *ICMPHdr type.
 // L3 supposed to be parsed before and of IPv6 type.
+// Returns nil for non first fragments which don't contain L4 header.
 func (packet *Packet) GetICMPForIPv6() *ICMPHdr {
-	if packet.GetIPv6().Proto == ICMPNumber {
+	if packet.getL4TypeForIPv6() == ICMPv6Number {
 		return (*ICMPHdr)(packet.L4)
 	}
 	return nil
@@ -316,6 +335,8 @@ func (packet *Packet) ParseL7(protocol uint) {
 		packet.Data = unsafe.Pointer(uintptr(packet.L4) + uintptr(UDPLen))
 	case ICMPNumber:
 		packet.Data = unsafe.Pointer(uintptr(packet.L4) + uintptr(ICMPLen))
+	case SCTPNumber:
+		packet.Data = unsafe.Pointer(uintptr(packet.L4) + uintptr(SCTPLen))
 	}
 }
 
@@ -340,6 +361,8 @@ func (packet *Packet) ParseData() int {
 		packet.Data = unsafe.Pointer(uintptr(packet.L4) + uintptr(UDPLen))
 	} else if pktICMP != nil {
 		packet.Data = unsafe.Pointer(uintptr(packet.L4) + uintptr(ICMPLen))
+	} else if (pktIPv4 != nil && packet.GetSCTPForIPv4() != nil) || (pktIPv6 != nil && packet.GetSCTPForIPv6() != nil) {
+		packet.Data = unsafe.Pointer(uintptr(packet.L4) + uintptr(SCTPLen))
 	} else {
 		return -1
 	}
@@ -396,7 +419,7 @@ func InitEmptyPacket(packet *Packet, plSize uint) bool {
 		LogWarning(Debug, "InitEmptyPacket: Cannot append mbuf")
 		return false
 	}
-	packet.Data = unsafe.Pointer(packet.unparsed())
+	packet.Data = unsafe.Pointer(packet.Start() + EtherLen)
 	return true
 }
 
@@ -528,6 +551,33 @@ func InitEmptyIPv4ICMPPacket(packet *Packet, plSize uint) bool {
 	return true
 }
 
+// InitEmptyIPv4SCTPPacket initializes input packet with preallocated plSize of bytes for
+// SCTP chunks and init pointers to Ethernet, IPv4 and SCTP headers. This function supposes
+// that IPv4 header has minimum length. SCTP checksum should be calculated by
+// CalculateSCTPChecksum after chunks are filled.
+func InitEmptyIPv4SCTPPacket(packet *Packet, plSize uint) bool {
+	bufSize := plSize + EtherLen + IPv4MinLen + SCTPLen
+	if low.AppendMbuf(packet.CMbuf, bufSize) == false {
+		LogWarning(Debug, "InitEmptyIPv4SCTPPacket: Cannot append mbuf")
+		return false
+	}
+	packet.Ether.EtherType = SwapBytesUint16(IPV4Number)
+	packet.Data = unsafe.Pointer(packet.unparsed() + IPv4MinLen + SCTPLen)
+
+	// Next fields not required by pktgen to accept packet. But set anyway
+	packet.ParseL3()
+	packet.GetIPv4().NextProtoID = SCTPNumber
+	packet.GetIPv4().VersionIhl = 0x45 // Ipv4, IHL = 5 (min header len)
+	packet.GetIPv4().TotalLength = SwapBytesUint16(uint16(IPv4MinLen + SCTPLen + plSize))
+	packet.ParseL4ForIPv4()
+
+	if hwtxchecksum {
+		packet.GetIPv4().HdrChecksum = 0
+		low.SetTXIPv4OLFlags(packet.CMbuf, EtherLen, IPv4MinLen)
+	}
+	return true
+}
+
 // InitEmptyIPv6TCPPacket initializes input packet with preallocated plSize of bytes for payload
 // and init pointers to Ethernet, IPv6 and TCP headers. This function supposes that IPv6 and TCP
 // headers have minimum length. In fact length can be higher due to optional fields.
@@ -584,7 +634,7 @@ func InitEmptyIPv6UDPPacket(packet *Packet, plSize uint) bool {
 }
 
 // InitEmptyIPv6ICMPPacket initializes input packet with preallocated plSize of bytes for payload
-// and init pointers to Ethernet, IPv6 and ICMP headers.
+// and init pointers to Ethernet, IPv6 and ICMPv6 headers.
 func InitEmptyIPv6ICMPPacket(packet *Packet, plSize uint) bool {
 	bufSize := plSize + EtherLen + IPv6Len + ICMPLen
 	if low.AppendMbuf(packet.CMbuf, bufSize) == false {
@@ -596,8 +646,28 @@ func InitEmptyIPv6ICMPPacket(packet *Packet, plSize uint) bool {
 
 	// Next fields not required by pktgen to accept packet. But set anyway
 	packet.ParseL3()
-	packet.GetIPv6().Proto = ICMPNumber
-	packet.GetIPv6().PayloadLen = SwapBytesUint16(uint16(UDPLen + plSize))
+	packet.GetIPv6().Proto = ICMPv6Number
+	packet.GetIPv6().PayloadLen = SwapBytesUint16(uint16(ICMPLen + plSize))
+	packet.GetIPv6().VtcFlow = SwapBytesUint32(0x60 << 24) // IP version
+	packet.ParseL4ForIPv6()
+	return true
+}
+
+// InitEmptyIPv6SCTPPacket initializes input packet with preallocated plSize of bytes for
+// SCTP chunks and init pointers to Ethernet, IPv6 and SCTP headers. SCTP checksum should
+// be calculated by CalculateSCTPChecksum after chunks are filled.
+func InitEmptyIPv6SCTPPacket(packet *Packet, plSize uint) bool {
+	bufSize := plSize + EtherLen + IPv6Len + SCTPLen
+	if low.AppendMbuf(packet.CMbuf, bufSize) == false {
+		LogWarning(Debug, "InitEmptyIPv6SCTPPacket: Cannot append mbuf")
+		return false
+	}
+	packet.Ether.EtherType = SwapBytesUint16(IPV6Number)
+	packet.Data = unsafe.Pointer(packet.unparsed() + IPv6Len + SCTPLen)
+
+	packet.ParseL3()
+	packet.GetIPv6().Proto = SCTPNumber
+	packet.GetIPv6().PayloadLen = SwapBytesUint16(uint16(SCTPLen + plSize))
 	packet.GetIPv6().VtcFlow = SwapBytesUint32(0x60 << 24) // IP version
 	packet.ParseL4ForIPv6()
 	return true
@@ -605,21 +675,25 @@ func InitEmptyIPv6ICMPPacket(packet *Packet, plSize uint) bool {
 
 // SetHWCksumOLFlags sets hardware offloading flags to packet
 func SetHWCksumOLFlags(packet *Packet) {
+	l2len := uint32(packet.l2Len())
 	ipv4, ipv6 := packet.ParseAllKnownL3()
 	if ipv4 != nil {
 		packet.GetIPv4().HdrChecksum = 0
 		tcp, udp, _ := packet.ParseAllKnownL4ForIPv4()
 		if tcp != nil {
-			low.SetTXIPv4TCPOLFlags(packet.CMbuf, EtherLen, IPv4MinLen)
+			low.SetTXIPv4TCPOLFlags(packet.CMbuf, l2len, IPv4MinLen)
 		} else if udp != nil {
-			low.SetTXIPv4UDPOLFlags(packet.CMbuf, EtherLen, IPv4MinLen)
+			low.SetTXIPv4UDPOLFlags(packet.CMbuf, l2len, IPv4MinLen)
+		} else {
+			// Other protocols including tunnels need only IPv4 header checksum
+			low.SetTXIPv4OLFlags(packet.CMbuf, l2len, IPv4MinLen)
 		}
 	} else if ipv6 != nil {
 		tcp, udp, _ := packet.ParseAllKnownL4ForIPv6()
 		if tcp != nil {
-			low.SetTXIPv6TCPOLFlags(packet.CMbuf, EtherLen, IPv6Len)
+			low.SetTXIPv6TCPOLFlags(packet.CMbuf, l2len, IPv6Len)
 		} else if udp != nil {
-			low.SetTXIPv6UDPOLFlags(packet.CMbuf, EtherLen, IPv6Len)
+			low.SetTXIPv6UDPOLFlags(packet.CMbuf, l2len, IPv6Len)
 		}
 	}
 }
@@ -635,8 +709,16 @@ func SwapBytesUint32(x uint32) uint32 {
 }
 
 // GetRawPacketBytes returns all bytes from this packet. Not zero-copy.
+// Bytes of all segments are returned for chained packet.
 func (packet *Packet) GetRawPacketBytes() []byte {
-	return low.GetRawPacketBytesMbuf(packet.CMbuf)
+	if packet.Next == nil {
+		return low.GetRawPacketBytesMbuf(packet.CMbuf)
+	}
+	bytes := make([]byte, 0, packet.getChainedLen())
+	for it := packet.IterateSegments(); it.Valid(); it.Next() {
+		bytes = append(bytes, it.Bytes()...)
+	}
+	return bytes
 }
 
 // GetPacketLen returns length of this packet. Sum of length of all segments if scattered.
@@ -649,6 +731,12 @@ func (packet *Packet) GetPacketSegmentLen() uint {
 	return low.GetDataLenMbuf(packet.CMbuf)
 }
 
+// GetRXTimestamp returns timestamp which was set by NIC on receive. Its unit
+// and reference depend on NIC. Return false if NIC didn't set timestamp.
+func (packet *Packet) GetRXTimestamp() (uint64, bool) {
+	return low.GetMbufTimestamp(packet.CMbuf)
+}
+
 // TODO change this for scattered packet case (multiple mbufs)
 // EncapsulateHead adds bytes to packet. start - number of beginning byte, length - number of
 // added bytes. This function should be used to add bytes to the first half
@@ -710,16 +798,10 @@ func (packet *Packet) DecapsulateTail(start uint, length uint) bool {
 }
 
 // PacketBytesChange changes packet bytes from start byte to given bytes.
+// Bytes can be located in several segments of chained packet.
 // Return false if error.
 func (packet *Packet) PacketBytesChange(start uint, bytes []byte) bool {
-	length := uint(len(bytes))
-	if start+length > packet.GetPacketLen() {
-		return false
-	}
-	for i := uint(0); i < length; i++ {
-		*(*byte)(unsafe.Pointer(packet.Start() + uintptr(start+i))) = bytes[i]
-	}
-	return true
+	return packet.WriteBytes(start, bytes)
 }
 
 // IPv4 converts four element address to uint32 representation
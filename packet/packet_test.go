@@ -8,8 +8,12 @@ import (
 	"bytes"
 	"encoding/binary"
 	"encoding/hex"
+	"io"
+	"io/ioutil"
 	"net"
+	"os"
 	"reflect"
+	"strings"
 	"testing"
 	"unsafe"
 
@@ -631,3 +635,1086 @@ func TestInitEmptyIPv6UDPPacket(t *testing.T) {
 	}
 
 }
+
+// Tested functions
+// ParseL3 with VLAN tags
+// GetVLAN
+// GetInnerVLAN
+// PushVLAN
+// PopVLAN
+func TestVLAN(t *testing.T) {
+	untagged := lines[0]
+	tagged := untagged[:24] + "8100a064" + untagged[24:]
+	doubleTagged := untagged[:24] + "88a80123" + "8100a064" + untagged[24:]
+
+	for i, line := range []string{tagged, doubleTagged} {
+		decoded, _ := hex.DecodeString(line)
+		mb := make([]uintptr, 1)
+		low.AllocateMbufs(mb, mempool)
+		pkt := ExtractPacket(mb[0])
+		GeneratePacketFromByte(pkt, decoded)
+
+		pkt.ParseAllKnownL3()
+		pkt.ParseAllKnownL4ForIPv4()
+		if !reflect.DeepEqual(pkt.GetIPv4(), pkts[0].GetIPv4()) {
+			t.Errorf("Parse tagged packet %d: wrong IPv4 header:\ngot: %+v, \nwant: %+v\n\n", i, pkt.GetIPv4(), pkts[0].GetIPv4())
+		}
+		if !reflect.DeepEqual(pkt.GetTCPForIPv4(), pkts[0].GetTCPForIPv4()) {
+			t.Errorf("Parse tagged packet %d: wrong TCP header:\ngot: %+v, \nwant: %+v\n\n", i, pkt.GetTCPForIPv4(), pkts[0].GetTCPForIPv4())
+		}
+
+		if i == 1 {
+			if pkt.GetVLAN().GetVLANTagIdentifier() != 0x123 || pkt.GetInnerVLAN() == nil {
+				t.Errorf("Incorrect outer VLAN tag %+v of double tagged packet", pkt.GetVLAN())
+			}
+			pkt.PopVLAN()
+		}
+		vlan := pkt.GetVLAN()
+		if vlan == nil || vlan.GetVLANTagIdentifier() != 100 || vlan.GetPriority() != 5 || pkt.GetInnerVLAN() != nil {
+			t.Errorf("Incorrect VLAN tag %+v", vlan)
+		}
+
+		pkt.PopVLAN()
+		want, _ := hex.DecodeString(untagged)
+		if !bytes.Equal(pkt.GetRawPacketBytes(), want) || pkt.GetVLAN() != nil {
+			t.Errorf("PopVLAN incorrect result:\ngot:  %x\nwant: %x\n", pkt.GetRawPacketBytes(), want)
+		}
+
+		pkt.PushVLAN(0xa064)
+		want, _ = hex.DecodeString(tagged)
+		if !bytes.Equal(pkt.GetRawPacketBytes(), want) {
+			t.Errorf("PushVLAN incorrect result:\ngot:  %x\nwant: %x\n", pkt.GetRawPacketBytes(), want)
+		}
+	}
+
+	// Frames which consist of VLAN TPIDs and truncated tag
+	for _, line := range []string{untagged[:24] + strings.Repeat("8100", 40), untagged[:24] + "8100a0"} {
+		decoded, _ := hex.DecodeString(line)
+		mb := make([]uintptr, 1)
+		low.AllocateMbufs(mb, mempool)
+		pkt := ExtractPacket(mb[0])
+		GeneratePacketFromByte(pkt, decoded)
+		if pkt.GetEtherType() != SwapBytesUint16(VLANNumber) {
+			t.Errorf("Incorrect EtherType %x of malformed tagged packet", pkt.GetEtherType())
+		}
+		if len(decoded) < EtherLen+VLANLen && pkt.GetVLAN() != nil {
+			t.Errorf("Truncated VLAN tag is returned")
+		}
+	}
+}
+
+func TestInitARPPackets(t *testing.T) {
+	if unsafe.Sizeof(ARPHdr{}) != ARPLen {
+		t.Fatalf("Incorrect ARPHdr size %d", unsafe.Sizeof(ARPHdr{}))
+	}
+	sha := [6]uint8{0x00, 0x11, 0x22, 0x33, 0x44, 0x55}
+	tha := [6]uint8{0x01, 0x11, 0x21, 0x31, 0x41, 0x51}
+	spa := IPv4(10, 0, 0, 1)
+	tpa := IPv4(10, 0, 0, 2)
+
+	mb := make([]uintptr, 1)
+	low.AllocateMbufs(mb, mempool)
+	pkt := ExtractPacket(mb[0])
+	InitARPRequest(pkt, sha, spa, tpa)
+	want, _ := hex.DecodeString("ffffffffffff0011223344550806000108000604000100112233445" +
+		"50a0000010000000000000a000002")
+	if !bytes.Equal(pkt.GetRawPacketBytes(), want) {
+		t.Errorf("InitARPRequest incorrect result:\ngot:  %x\nwant: %x\n", pkt.GetRawPacketBytes(), want)
+	}
+
+	low.AllocateMbufs(mb, mempool)
+	pkt = ExtractPacket(mb[0])
+	InitARPReply(pkt, sha, tha, spa, tpa)
+	want, _ = hex.DecodeString("0111213141510011223344550806000108000604000200112233445" +
+		"50a0000010111213141510a000002")
+	if !bytes.Equal(pkt.GetRawPacketBytes(), want) {
+		t.Errorf("InitARPReply incorrect result:\ngot:  %x\nwant: %x\n", pkt.GetRawPacketBytes(), want)
+	}
+	pkt.ParseL3()
+	if pkt.GetARP() == nil || ArrayToIPv4(pkt.GetARP().TPA) != tpa {
+		t.Errorf("Incorrect ARP header parsing %v", pkt.GetARP())
+	}
+}
+
+func TestIPv6ExtHdrs(t *testing.T) {
+	// IPv6 packet with Hop-by-Hop Options and Fragment headers before TCP
+	line := "00112233445501112131415186dd6000000000240040" +
+		"dead000000000000000000000000beaf" + "dead000000000000000000000000ddfd" +
+		"2c00010400000000" + "0600000112345678" + "04d2162e123456781234569050102000495b0000"
+	decoded, _ := hex.DecodeString(line)
+	mb := make([]uintptr, 1)
+	low.AllocateMbufs(mb, mempool)
+	pkt := ExtractPacket(mb[0])
+	GeneratePacketFromByte(pkt, decoded)
+
+	pkt.ParseAllKnownL3()
+	var types []uint8
+	for it := pkt.IterateIPv6ExtHdrs(); it.Valid(); it.Next() {
+		types = append(types, it.Type())
+	}
+	if !reflect.DeepEqual(types, []uint8{IPv6HopByHopNumber, IPv6FragmentNumber}) {
+		t.Errorf("Incorrect extension headers chain: %v", types)
+	}
+
+	tcp, udp, icmp := pkt.ParseAllKnownL4ForIPv6()
+	if uintptr(pkt.L4)-uintptr(pkt.L3) != IPv6Len+16 {
+		t.Errorf("Incorrect L4 offset %d", uintptr(pkt.L4)-uintptr(pkt.L3))
+	}
+	if tcp == nil || udp != nil || icmp != nil || pkt.GetL4ProtoForIPv6() != TCPNumber {
+		t.Fatalf("Incorrect L4 headers parsing: %v %v %v", tcp, udp, icmp)
+	}
+	if SwapBytesUint16(tcp.SrcPort) != 1234 || SwapBytesUint16(tcp.DstPort) != 5678 {
+		t.Errorf("Incorrect TCP header: %+v", tcp)
+	}
+
+	frag := pkt.GetIPv6Fragment()
+	if frag == nil || frag.GetFragmentOffset() != 0 || !frag.MoreFragments() {
+		t.Fatalf("Incorrect Fragment header: %+v", frag)
+	}
+	// Non first fragment doesn't contain L4 header
+	frag.FragmentOffset = SwapBytesUint16(1480)
+	if pkt.GetTCPForIPv6() != nil || pkt.GetL4ProtoForIPv6() != TCPNumber {
+		t.Errorf("TCP header is found in non first fragment")
+	}
+
+	// Truncated chain should stop at IPv6 payload end
+	pkt.GetIPv6().PayloadLen = SwapBytesUint16(12)
+	it := pkt.IterateIPv6ExtHdrs()
+	it.Next()
+	if it.Valid() {
+		t.Errorf("Iterator is valid beyond IPv6 payload")
+	}
+}
+
+func TestNDP(t *testing.T) {
+	sha := [6]uint8{0x00, 0x11, 0x22, 0x33, 0x44, 0x55}
+	tha := [6]uint8{0x01, 0x11, 0x21, 0x31, 0x41, 0x51}
+	src := [16]uint8{0xfe, 0x80, 15: 0x01}
+	target := [16]uint8{0xfe, 0x80, 15: 0x02}
+
+	mb := make([]uintptr, 1)
+	low.AllocateMbufs(mb, mempool)
+	pkt := ExtractPacket(mb[0])
+	InitNDPNeighborSolicitation(pkt, sha, src, target)
+	want, _ := hex.DecodeString("3333ff00000200112233445586dd6000000000203afffe80000000000000000000000000" +
+		"0001ff0200000000000000000001ff000002870015ff00000000fe8000000000000000000000000000020101001122334455")
+	if !bytes.Equal(pkt.GetRawPacketBytes(), want) {
+		t.Errorf("Incorrect Neighbor Solicitation:\ngot:  %x\nwant: %x\n", pkt.GetRawPacketBytes(), want)
+	}
+
+	pkt.ParseL3()
+	pkt.ParseL4ForIPv6()
+	ns := pkt.GetNDPNeighborSolicitation()
+	if ns == nil || ns.TargetAddr != target || pkt.GetNDPNeighborAdvertisement() != nil {
+		t.Fatalf("Incorrect Neighbor Solicitation parsing: %+v", ns)
+	}
+	if mac, ok := pkt.GetNDPLinkLayerAddr(NDPOptionSourceLinkLayerAddr); !ok || mac != sha {
+		t.Errorf("Incorrect Source Link-Layer Address option %x", mac)
+	}
+	if _, ok := pkt.GetNDPLinkLayerAddr(NDPOptionTargetLinkLayerAddr); ok {
+		t.Errorf("Target Link-Layer Address option is found in Neighbor Solicitation")
+	}
+	if CalculateIPv6ICMPChecksum(pkt) != 0 {
+		t.Errorf("Checksum of Neighbor Solicitation is not valid")
+	}
+
+	low.AllocateMbufs(mb, mempool)
+	pkt = ExtractPacket(mb[0])
+	InitNDPNeighborAdvertisement(pkt, tha, sha, target, src, NDPSolicitedFlag|NDPOverrideFlag)
+	pkt.ParseL3()
+	pkt.ParseL4ForIPv6()
+	na := pkt.GetNDPNeighborAdvertisement()
+	if na == nil || na.TargetAddr != target || SwapBytesUint32(na.Flags) != NDPSolicitedFlag|NDPOverrideFlag {
+		t.Fatalf("Incorrect Neighbor Advertisement parsing: %+v", na)
+	}
+	if mac, ok := pkt.GetNDPLinkLayerAddr(NDPOptionTargetLinkLayerAddr); !ok || mac != tha {
+		t.Errorf("Incorrect Target Link-Layer Address option %x", mac)
+	}
+	if CalculateIPv6ICMPChecksum(pkt) != 0 {
+		t.Errorf("Checksum of Neighbor Advertisement is not valid")
+	}
+
+	low.AllocateMbufs(mb, mempool)
+	pkt = ExtractPacket(mb[0])
+	prefix := NDPPrefixInfoOption{PrefixLength: 64, Prefix: [16]uint8{0x20, 0x01, 0x0d, 0xb8}}
+	InitNDPRouterAdvertisement(pkt, sha, tha, src, AllNodesMulticastAddr, prefix, prefix)
+	pkt.ParseL3()
+	pkt.ParseL4ForIPv6()
+	if pkt.GetNDPRouterAdvertisement() == nil {
+		t.Fatalf("Router Advertisement is not parsed")
+	}
+	var types []uint8
+	for it := pkt.IterateNDPOptions(); it.Valid(); it.Next() {
+		types = append(types, it.Type())
+	}
+	if !reflect.DeepEqual(types, []uint8{NDPOptionSourceLinkLayerAddr, NDPOptionPrefixInfo, NDPOptionPrefixInfo}) {
+		t.Errorf("Incorrect Router Advertisement options: %v", types)
+	}
+	if CalculateIPv6ICMPChecksum(pkt) != 0 {
+		t.Errorf("Checksum of Router Advertisement is not valid")
+	}
+}
+
+func TestVXLANGeneve(t *testing.T) {
+	inner, _ := hex.DecodeString(lines[0])
+	endpoints := TunnelEndpoints{
+		SrcMAC:  [6]uint8{0x00, 0x11, 0x22, 0x33, 0x44, 0x55},
+		DstMAC:  [6]uint8{0x01, 0x11, 0x21, 0x31, 0x41, 0x51},
+		SrcIPv4: IPv4(10, 0, 0, 1),
+		DstIPv4: IPv4(10, 0, 0, 2),
+		SrcPort: 50000,
+	}
+	mb := make([]uintptr, 1)
+	low.AllocateMbufs(mb, mempool)
+	pkt := ExtractPacket(mb[0])
+	GeneratePacketFromByte(pkt, inner)
+
+	if !pkt.EncapVXLAN(&endpoints, 0x123456) {
+		t.Fatal("EncapVXLAN failed")
+	}
+	want, _ := hex.DecodeString("01112131415100112233445508004500005a00000000401166910a0000010a000002c35012b5004600000800000012345600")
+	if !bytes.Equal(pkt.GetRawPacketBytes()[:len(want)], want) {
+		t.Errorf("Incorrect VXLAN outer headers:\ngot:  %x\nwant: %x\n", pkt.GetRawPacketBytes()[:len(want)], want)
+	}
+
+	var view Packet
+	pkt.ParseAllKnownL3()
+	pkt.ParseAllKnownL4ForIPv4()
+	if vxlan := pkt.GetVXLAN(); vxlan == nil || vxlan.GetVNI() != 0x123456 || pkt.GetGeneve() != nil {
+		t.Fatalf("Incorrect VXLAN header %+v", vxlan)
+	}
+	if !pkt.GetVXLANInnerPacket(&view) {
+		t.Fatal("VXLAN inner packet is not found")
+	}
+	view.ParseAllKnownL3()
+	view.ParseAllKnownL4ForIPv4()
+	if !reflect.DeepEqual(view.GetTCPForIPv4(), pkts[0].GetTCPForIPv4()) {
+		t.Errorf("Incorrect inner TCP header:\ngot: %+v, \nwant: %+v\n\n", view.GetTCPForIPv4(), pkts[0].GetTCPForIPv4())
+	}
+	if !pkt.DecapVXLAN() || !bytes.Equal(pkt.GetRawPacketBytes(), inner) {
+		t.Errorf("DecapVXLAN incorrect result:\ngot:  %x\nwant: %x\n", pkt.GetRawPacketBytes(), inner)
+	}
+
+	// Geneve with options over IPv6
+	endpoints.IPv6 = true
+	endpoints.SrcIPv6 = [16]uint8{0x20, 0x01, 0x0d, 0xb8, 15: 0x01}
+	endpoints.DstIPv6 = [16]uint8{0x20, 0x01, 0x0d, 0xb8, 15: 0x02}
+	endpoints.SrcPort = 0
+	options := []byte{0x01, 0x02, 0x03, 0x01, 0xaa, 0xbb, 0xcc, 0xdd}
+	if !pkt.EncapGeneve(&endpoints, 7, options) {
+		t.Fatal("EncapGeneve failed")
+	}
+	pkt.ParseAllKnownL3()
+	_, udp, _ := pkt.ParseAllKnownL4ForIPv6()
+	if udp == nil || SwapBytesUint16(udp.SrcPort) < 49152 || SwapBytesUint16(udp.DgramCksum) != CalculateIPv6UDPChecksum(pkt) {
+		t.Fatalf("Incorrect outer UDP header %+v", udp)
+	}
+	geneve := pkt.GetGeneve()
+	if geneve == nil || geneve.GetVNI() != 7 || !bytes.Equal(geneve.GetOptions(), options) || pkt.GetVXLAN() != nil {
+		t.Fatalf("Incorrect Geneve header %+v", geneve)
+	}
+	if !pkt.GetGeneveInnerPacket(&view) || view.Ether.DAddr != pkts[0].Ether.DAddr {
+		t.Errorf("Incorrect Geneve inner packet")
+	}
+	if !pkt.DecapGeneve() || !bytes.Equal(pkt.GetRawPacketBytes(), inner) {
+		t.Errorf("DecapGeneve incorrect result:\ngot:  %x\nwant: %x\n", pkt.GetRawPacketBytes(), inner)
+	}
+}
+
+func TestGREIPinIP(t *testing.T) {
+	inner, _ := hex.DecodeString(lines[0])
+	endpoints := TunnelEndpoints{
+		SrcMAC:  [6]uint8{0x00, 0x11, 0x22, 0x33, 0x44, 0x55},
+		DstMAC:  [6]uint8{0x01, 0x11, 0x21, 0x31, 0x41, 0x51},
+		SrcIPv4: IPv4(10, 0, 0, 1),
+		DstIPv4: IPv4(10, 0, 0, 2),
+	}
+	mb := make([]uintptr, 1)
+	low.AllocateMbufs(mb, mempool)
+	pkt := ExtractPacket(mb[0])
+	GeneratePacketFromByte(pkt, inner)
+
+	params := GREParams{Checksum: true, UseKey: true, Key: 0xabcd, UseSeq: true, Seq: 5}
+	if !pkt.EncapGRE(&endpoints, &params) {
+		t.Fatal("EncapGRE failed")
+	}
+	pkt.ParseL3()
+	pkt.ParseL4ForIPv4()
+	ipv4 := pkt.GetIPv4()
+	if SwapBytesUint16(ipv4.TotalLength) != IPv4MinLen+16+uint16(len(inner)-EtherLen) ||
+		SwapBytesUint16(ipv4.HdrChecksum) != CalculateIPv4Checksum(pkt) {
+		t.Errorf("Incorrect outer IPv4 header %+v", ipv4)
+	}
+	gre := pkt.GetGRE()
+	if gre == nil || gre.GetHdrLen() != 16 || gre.Protocol != SwapBytesUint16(IPV4Number) || CalculateGREChecksum(pkt) != 0 {
+		t.Fatalf("Incorrect GRE header %+v", gre)
+	}
+	if key, ok := gre.GetKey(); !ok || key != 0xabcd {
+		t.Errorf("Incorrect GRE key %x", key)
+	}
+	if seq, ok := gre.GetSeq(); !ok || seq != 5 {
+		t.Errorf("Incorrect GRE sequence number %d", seq)
+	}
+	if !pkt.DecapGRE() || !bytes.Equal(pkt.GetRawPacketBytes()[EtherAddrLen*2:], inner[EtherAddrLen*2:]) {
+		t.Errorf("DecapGRE incorrect result:\ngot:  %x\nwant: %x\n", pkt.GetRawPacketBytes(), inner)
+	}
+
+	// Ethernet frame over GRE is restored completely
+	low.AllocateMbufs(mb, mempool)
+	pkt = ExtractPacket(mb[0])
+	GeneratePacketFromByte(pkt, inner)
+	if !pkt.EncapGRE(&endpoints, &GREParams{Ethernet: true}) {
+		t.Fatal("EncapGRE failed")
+	}
+	var view Packet
+	if !pkt.GetGREInnerPacket(&view) || view.Ether.DAddr != pkts[0].Ether.DAddr {
+		t.Errorf("Incorrect GRE inner packet")
+	}
+	if !pkt.DecapGRE() || !bytes.Equal(pkt.GetRawPacketBytes(), inner) {
+		t.Errorf("DecapGRE incorrect result:\ngot:  %x\nwant: %x\n", pkt.GetRawPacketBytes(), inner)
+	}
+
+	// IPv4 in IPv6
+	endpoints.IPv6 = true
+	endpoints.SrcIPv6 = [16]uint8{0x20, 0x01, 0x0d, 0xb8, 15: 0x01}
+	endpoints.DstIPv6 = [16]uint8{0x20, 0x01, 0x0d, 0xb8, 15: 0x02}
+	if !pkt.EncapIPinIP(&endpoints) {
+		t.Fatal("EncapIPinIP failed")
+	}
+	if pkt.GetIPv6() == nil || pkt.GetIPv6().Proto != IPNumber || SwapBytesUint16(pkt.GetIPv6().PayloadLen) != uint16(len(inner)-EtherLen) {
+		t.Fatalf("Incorrect outer IPv6 header %+v", pkt.GetIPv6())
+	}
+	if pkt.DecapGRE() {
+		t.Errorf("DecapGRE accepts IP-in-IP packet")
+	}
+	if !pkt.DecapIPinIP() || !bytes.Equal(pkt.GetRawPacketBytes()[EtherAddrLen*2:], inner[EtherAddrLen*2:]) {
+		t.Errorf("DecapIPinIP incorrect result:\ngot:  %x\nwant: %x\n", pkt.GetRawPacketBytes(), inner)
+	}
+}
+
+func TestGTPU(t *testing.T) {
+	inner, _ := hex.DecodeString(lines[0])
+	endpoints := TunnelEndpoints{
+		SrcMAC:  [6]uint8{0x00, 0x11, 0x22, 0x33, 0x44, 0x55},
+		DstMAC:  [6]uint8{0x01, 0x11, 0x21, 0x31, 0x41, 0x51},
+		SrcIPv4: IPv4(10, 0, 0, 1),
+		DstIPv4: IPv4(10, 0, 0, 2),
+		SrcPort: GTPUPort,
+	}
+	mb := make([]uintptr, 1)
+	low.AllocateMbufs(mb, mempool)
+	pkt := ExtractPacket(mb[0])
+	GeneratePacketFromByte(pkt, inner)
+
+	// PDU session container with QFI 9
+	container := []byte{0x10, 0x09}
+	params := GTPUParams{TEID: 0x11223344, UseSeq: true, Seq: 7,
+		ExtHdrs: []GTPUExtHdr{{Type: GTPUExtPDUSessionContainer, Content: container}}}
+	if !pkt.EncapGTPU(&endpoints, &params) {
+		t.Fatal("EncapGTPU failed")
+	}
+	pkt.ParseL3()
+	pkt.ParseL4ForIPv4()
+	udp := pkt.GetUDPForIPv4()
+	if udp == nil || SwapBytesUint16(udp.DstPort) != GTPUPort ||
+		SwapBytesUint16(udp.DgramLen) != UDPLen+16+uint16(len(inner)-EtherLen) {
+		t.Fatalf("Incorrect outer UDP header %+v", udp)
+	}
+	gtpu := pkt.GetGTPU()
+	if gtpu == nil || gtpu.MsgType != GTPUGPDU || gtpu.GetTEID() != 0x11223344 || gtpu.GetHdrLen() != 16 {
+		t.Fatalf("Incorrect GTP-U header %+v", gtpu)
+	}
+	if seq, ok := gtpu.GetSeq(); !ok || seq != 7 {
+		t.Errorf("Incorrect GTP-U sequence number %d", seq)
+	}
+	if _, ok := gtpu.GetNPDU(); ok {
+		t.Errorf("N-PDU number is found")
+	}
+	var types []uint8
+	for it := gtpu.IterateExtHdrs(); it.Valid(); it.Next() {
+		types = append(types, it.Type())
+		if !bytes.Equal(it.Content(), container) {
+			t.Errorf("Incorrect extension header content %x", it.Content())
+		}
+	}
+	if !reflect.DeepEqual(types, []uint8{GTPUExtPDUSessionContainer}) {
+		t.Errorf("Incorrect extension headers %v", types)
+	}
+	// Truncated packet which lengths claim extension headers
+	truncatedMb := make([]uintptr, 1)
+	low.AllocateMbufs(truncatedMb, mempool)
+	truncated := ExtractPacket(truncatedMb[0])
+	GeneratePacketFromByte(truncated, pkt.GetRawPacketBytes())
+	low.TrimMbuf(truncated.CMbuf, pkt.GetPacketLen()-(EtherLen+IPv4MinLen+UDPLen+GTPUMinLen+GTPUOptLen))
+	truncated.ParseL3()
+	truncated.ParseL4ForIPv4()
+	if truncated.GetGTPU() != nil {
+		t.Errorf("GTP-U header of truncated packet is accepted")
+	}
+	if !pkt.DecapGTPU() || !bytes.Equal(pkt.GetRawPacketBytes()[EtherAddrLen*2:], inner[EtherAddrLen*2:]) {
+		t.Errorf("DecapGTPU incorrect result:\ngot:  %x\nwant: %x\n", pkt.GetRawPacketBytes(), inner)
+	}
+
+	// Header without optional fields over IPv6
+	endpoints.IPv6 = true
+	endpoints.SrcIPv6 = [16]uint8{0x20, 0x01, 0x0d, 0xb8, 15: 0x01}
+	endpoints.DstIPv6 = [16]uint8{0x20, 0x01, 0x0d, 0xb8, 15: 0x02}
+	if !pkt.EncapGTPU(&endpoints, &GTPUParams{TEID: 5}) {
+		t.Fatal("EncapGTPU failed")
+	}
+	pkt.ParseL3()
+	pkt.ParseL4ForIPv6()
+	gtpu = pkt.GetGTPU()
+	if gtpu == nil || gtpu.GetTEID() != 5 || gtpu.GetHdrLen() != GTPUMinLen || SwapBytesUint16(gtpu.Length) != uint16(len(inner)-EtherLen) {
+		t.Fatalf("Incorrect GTP-U header %+v", gtpu)
+	}
+	// Broken chain of extension headers is not accepted
+	gtpu.Flags |= GTPUExtFlag
+	if pkt.GetGTPU() != nil {
+		t.Errorf("GTP-U header with incorrect extension headers is accepted")
+	}
+	gtpu.Flags &^= GTPUExtFlag
+	if !pkt.DecapGTPU() || !bytes.Equal(pkt.GetRawPacketBytes()[EtherAddrLen*2:], inner[EtherAddrLen*2:]) {
+		t.Errorf("DecapGTPU incorrect result:\ngot:  %x\nwant: %x\n", pkt.GetRawPacketBytes(), inner)
+	}
+	if pkt.EncapGTPU(&endpoints, &GTPUParams{ExtHdrs: []GTPUExtHdr{{Type: GTPUExtUDPPort, Content: []byte{1}}}}) {
+		t.Errorf("Extension header with incorrect length is accepted")
+	}
+}
+
+func TestMPLS(t *testing.T) {
+	untagged := lines[0]
+	// Two labels: 100 and 200 with bottom of stack flag, TTL 64
+	labeled := untagged[:24] + "8847" + "00064040" + "000c8140" + untagged[28:]
+	decoded, _ := hex.DecodeString(labeled)
+	mb := make([]uintptr, 1)
+	low.AllocateMbufs(mb, mempool)
+	pkt := ExtractPacket(mb[0])
+	GeneratePacketFromByte(pkt, decoded)
+
+	pkt.ParseAllKnownL3()
+	pkt.ParseAllKnownL4ForIPv4()
+	if !reflect.DeepEqual(pkt.GetIPv4(), pkts[0].GetIPv4()) || !reflect.DeepEqual(pkt.GetTCPForIPv4(), pkts[0].GetTCPForIPv4()) {
+		t.Errorf("Incorrect parsing of packet below MPLS labels")
+	}
+	labels := pkt.GetMPLSLabels()
+	if len(labels) != 2 || labels[0].GetLabel() != 100 || labels[1].GetLabel() != 200 ||
+		labels[0].IsBottomOfStack() || !labels[1].IsBottomOfStack() || labels[0].GetTTL() != 64 {
+		t.Fatalf("Incorrect MPLS label stack %+v", labels)
+	}
+
+	pkt.SwapMPLS(300)
+	pkt.PushMPLS(400, 5, 32)
+	labels = pkt.GetMPLSLabels()
+	if len(labels) != 3 || labels[0].GetLabel() != 400 || labels[0].GetTC() != 5 || labels[0].GetTTL() != 32 ||
+		labels[0].IsBottomOfStack() || labels[1].GetLabel() != 300 {
+		t.Errorf("Incorrect MPLS label stack after push and swap %+v", labels)
+	}
+	if !reflect.DeepEqual(pkt.GetIPv4(), pkts[0].GetIPv4()) {
+		t.Errorf("L3 pointer is not valid after push")
+	}
+
+	for pkt.PopMPLS() {
+	}
+	want, _ := hex.DecodeString(untagged)
+	if !bytes.Equal(pkt.GetRawPacketBytes(), want) || pkt.GetMPLS() != nil {
+		t.Errorf("PopMPLS incorrect result:\ngot:  %x\nwant: %x\n", pkt.GetRawPacketBytes(), want)
+	}
+	pkt.PushMPLS(100, 0, 64)
+	want, _ = hex.DecodeString(untagged[:24] + "8847" + "00064140" + untagged[28:])
+	if !bytes.Equal(pkt.GetRawPacketBytes(), want) {
+		t.Errorf("PushMPLS incorrect result:\ngot:  %x\nwant: %x\n", pkt.GetRawPacketBytes(), want)
+	}
+}
+
+func TestSafeParse(t *testing.T) {
+	// Correct TCP and UDP packets, first line has incorrect total length
+	tcp := lines[0][:32] + "0028" + lines[0][36:]
+	udp := lines[2][:32] + "001c" + lines[2][36:76] + "0008" + lines[2][80:]
+	ipv6 := "00112233445501112131415186dd" + "6000000000080040" + strings.Repeat("00", 32)
+	tests := []struct {
+		name     string
+		segments []string
+		err      error
+		dataOff  uintptr
+	}{
+		{"TCP", []string{tcp}, nil, 54},
+		{"UDP", []string{udp}, nil, 42},
+		{"IPv4 total length", []string{lines[0]}, ErrTruncated, 0},
+		{"IPv4 total length less than IHL", []string{tcp[:32] + "0010" + tcp[36:]}, ErrBadHeader, 0},
+		{"IPv4 IHL", []string{tcp[:28] + "44" + tcp[30:]}, ErrBadHeader, 0},
+		{"IPv4 header", []string{tcp[:60]}, ErrTruncated, 0},
+		{"TCP data offset", []string{tcp[:92] + "40" + tcp[94:]}, ErrBadHeader, 0},
+		{"TCP data offset beyond end", []string{tcp[:92] + "60" + tcp[94:]}, ErrTruncated, 0},
+		{"UDP datagram length", []string{udp[:76] + "0040" + udp[80:]}, ErrTruncated, 0},
+		{"IPv6 extension header", []string{ipv6 + "0601000000000000"}, ErrTruncated, 0},
+		{"IPv6 without extension headers", []string{ipv6[:40] + "3b" + ipv6[42:] + "0000000000000000"}, nil, 0},
+		{"Chained TCP header", []string{tcp[:88], tcp[88:]}, ErrHeaderSplit, 0},
+		{"Chained TCP payload", []string{tcp[:32] + "002c" + tcp[36:], "01020304"}, nil, 54},
+		{"Chained truncated payload", []string{tcp[:32] + "002d" + tcp[36:], "01020304"}, ErrTruncated, 0},
+	}
+
+	for _, test := range tests {
+		var segments []*Packet
+		for _, line := range test.segments {
+			decoded, _ := hex.DecodeString(line)
+			mb := make([]uintptr, 1)
+			low.AllocateMbufs(mb, mempool)
+			segment := ExtractPacket(mb[0])
+			GeneratePacketFromByte(segment, decoded)
+			if len(segments) != 0 {
+				segments[len(segments)-1].Next = segment
+			}
+			segments = append(segments, segment)
+		}
+		pkt := segments[0]
+		err := pkt.SafeParseData()
+		if test.err == nil && err == ErrUnsupported {
+			// Packet without L4 header
+			err = nil
+		}
+		if err != test.err {
+			t.Errorf("%s: got error %v, want %v", test.name, err, test.err)
+			continue
+		}
+		if err == nil && test.dataOff != 0 && uintptr(pkt.Data)-pkt.Start() != test.dataOff {
+			t.Errorf("%s: incorrect data offset %d, want %d", test.name, uintptr(pkt.Data)-pkt.Start(), test.dataOff)
+		}
+	}
+}
+
+func TestIncrementalChecksum(t *testing.T) {
+	mb := make([]uintptr, 3)
+	low.AllocateMbufs(mb, mempool)
+	payload := []byte("incremental checksum")
+
+	// Checksums should be the same as after full recalculation
+	tcp4 := ExtractPacket(mb[0])
+	InitEmptyIPv4TCPPacket(tcp4, uint(len(payload)))
+	copy((*[64]byte)(tcp4.Data)[:], payload)
+	ipv4 := tcp4.GetIPv4()
+	ipv4.SrcAddr = IPv4(192, 168, 1, 10)
+	ipv4.DstAddr = IPv4(10, 0, 0, 1)
+	ipv4.TimeToLive = 64
+	tcp := tcp4.GetTCPForIPv4()
+	tcp.SrcPort = SwapBytesUint16(1234)
+	tcp.DstPort = SwapBytesUint16(80)
+	ipv4.HdrChecksum = SwapBytesUint16(CalculateIPv4Checksum(tcp4))
+	tcp.Cksum = SwapBytesUint16(CalculateIPv4TCPChecksum(tcp4))
+
+	tcp4.SetIPv4SrcAddr(IPv4(203, 0, 113, 7))
+	tcp4.SetIPv4DstAddr(IPv4(198, 51, 100, 200))
+	ipv4.SetTTL(63)
+	tcp.SetSrcPort(40000)
+	tcp.SetDstPort(8080)
+	if got, want := SwapBytesUint16(ipv4.HdrChecksum), CalculateIPv4Checksum(tcp4); got != want {
+		t.Errorf("Incorrect IPv4 checksum %04x, want %04x", got, want)
+	}
+	if got, want := SwapBytesUint16(tcp.Cksum), CalculateIPv4TCPChecksum(tcp4); got != want {
+		t.Errorf("Incorrect IPv4 TCP checksum %04x, want %04x", got, want)
+	}
+
+	udp4 := ExtractPacket(mb[1])
+	InitEmptyIPv4UDPPacket(udp4, uint(len(payload)))
+	copy((*[64]byte)(udp4.Data)[:], payload)
+	udp4.GetIPv4().SrcAddr = IPv4(192, 168, 1, 10)
+	udp := udp4.GetUDPForIPv4()
+	udp.SrcPort = SwapBytesUint16(5353)
+	udp.DgramCksum = SwapBytesUint16(CalculateIPv4UDPChecksum(udp4))
+	udp4.SetIPv4SrcAddr(IPv4(203, 0, 113, 7))
+	udp.SetSrcPort(1)
+	if got, want := SwapBytesUint16(udp.DgramCksum), CalculateIPv4UDPChecksum(udp4); got != want {
+		t.Errorf("Incorrect IPv4 UDP checksum %04x, want %04x", got, want)
+	}
+	// Zero UDP checksum means no checksum and should stay zero
+	udp.DgramCksum = 0
+	udp.SetDstPort(53)
+	udp4.SetIPv4DstAddr(IPv4(8, 8, 8, 8))
+	if udp.DgramCksum != 0 {
+		t.Errorf("Zero UDP checksum was changed to %04x", SwapBytesUint16(udp.DgramCksum))
+	}
+
+	udp6 := ExtractPacket(mb[2])
+	InitEmptyIPv6UDPPacket(udp6, uint(len(payload)))
+	copy((*[64]byte)(udp6.Data)[:], payload)
+	udp6.GetIPv6().SrcAddr = [IPv6AddrLen]uint8{0xfe, 0x80, 15: 1}
+	udp = udp6.GetUDPForIPv6()
+	udp.DgramCksum = SwapBytesUint16(CalculateIPv6UDPChecksum(udp6))
+	udp6.SetIPv6SrcAddr([IPv6AddrLen]uint8{0x20, 0x01, 0x0d, 0xb8, 14: 0xab, 15: 0xcd})
+	udp6.SetIPv6DstAddr([IPv6AddrLen]uint8{0xff, 0x02, 15: 0xfb})
+	if got, want := SwapBytesUint16(udp.DgramCksum), CalculateIPv6UDPChecksum(udp6); got != want {
+		t.Errorf("Incorrect IPv6 UDP checksum %04x, want %04x", got, want)
+	}
+
+	// Packet without offloading flags has full checksum if offloading is enabled
+	SetHWTXChecksumFlag(true)
+	tcp4.SetIPv4SrcAddr(IPv4(192, 0, 2, 1))
+	tcp4.SetL4SrcPort(1024)
+	tcp4.SetL4DstPort(443)
+	udp6.SetL4DstPort(5353)
+	SetHWTXChecksumFlag(false)
+	if got, want := SwapBytesUint16(ipv4.HdrChecksum), CalculateIPv4Checksum(tcp4); got != want {
+		t.Errorf("Incorrect IPv4 checksum %04x of not offloaded packet, want %04x", got, want)
+	}
+	if got, want := SwapBytesUint16(tcp.Cksum), CalculateIPv4TCPChecksum(tcp4); got != want || SwapBytesUint16(tcp.DstPort) != 443 {
+		t.Errorf("Incorrect IPv4 TCP checksum %04x of not offloaded packet, want %04x", got, want)
+	}
+	if got, want := SwapBytesUint16(udp.DgramCksum), CalculateIPv6UDPChecksum(udp6); got != want || SwapBytesUint16(udp.DstPort) != 5353 {
+		t.Errorf("Incorrect IPv6 UDP checksum %04x of not offloaded packet, want %04x", got, want)
+	}
+
+	// Example from RFC 1624, section 4
+	if got := UpdateChecksum16(0xdd2f, 0x5555, 0x3285); got != 0x0000 {
+		t.Errorf("Incorrect RFC 1624 example result %04x", got)
+	}
+}
+
+func TestVerifyChecksums(t *testing.T) {
+	payload := []byte("checksum verification")
+	mb := make([]uintptr, 5)
+	low.AllocateMbufs(mb, mempool)
+
+	tcp4 := ExtractPacket(mb[0])
+	InitEmptyIPv4TCPPacket(tcp4, uint(len(payload)))
+	copy((*[64]byte)(tcp4.Data)[:], payload)
+	tcp4.GetIPv4().SrcAddr = IPv4(192, 168, 1, 10)
+	tcp4.GetIPv4().HdrChecksum = SwapBytesUint16(CalculateIPv4Checksum(tcp4))
+	tcp4.GetTCPForIPv4().Cksum = SwapBytesUint16(CalculateIPv4TCPChecksum(tcp4))
+	if !VerifyIPv4Checksum(tcp4) || !VerifyIPv4TCPChecksum(tcp4) || !VerifyChecksums(tcp4) {
+		t.Errorf("Correct IPv4 TCP checksums were not verified")
+	}
+	(*[64]byte)(tcp4.Data)[3]++
+	if VerifyL4Checksum(tcp4) || !VerifyIPv4Checksum(tcp4) {
+		t.Errorf("Incorrect IPv4 TCP checksum was verified")
+	}
+	tcp4.GetIPv4().TimeToLive++
+	if VerifyIPv4Checksum(tcp4) {
+		t.Errorf("Incorrect IPv4 header checksum was verified")
+	}
+
+	ns := ExtractPacket(mb[1])
+	InitNDPNeighborSolicitation(ns, [EtherAddrLen]uint8{0, 1, 2, 3, 4, 5},
+		[IPv6AddrLen]uint8{0xfe, 0x80, 15: 1}, [IPv6AddrLen]uint8{0xfe, 0x80, 15: 2})
+	if !VerifyIPv6ICMPChecksum(ns) || !VerifyChecksums(ns) {
+		t.Errorf("Correct ICMPv6 checksum was not verified")
+	}
+
+	// UDP datagram is split between two segments at odd offset
+	udp4 := ExtractPacket(mb[2])
+	InitEmptyIPv4UDPPacket(udp4, uint(len(payload)))
+	copy((*[64]byte)(udp4.Data)[:], payload)
+	udp4.GetUDPForIPv4().DgramLen = SwapBytesUint16(uint16(UDPLen + len(payload)))
+	udp4.GetUDPForIPv4().DgramCksum = SwapBytesUint16(CalculateIPv4UDPChecksum(udp4))
+	data := udp4.GetRawPacketBytes()
+	split := len(data) - 10
+	first := ExtractPacket(mb[3])
+	GeneratePacketFromByte(first, data[:split])
+	second := ExtractPacket(mb[4])
+	GeneratePacketFromByte(second, data[split:])
+	first.Next = second
+	if err := first.SafeParseData(); err != nil {
+		t.Fatalf("Chained packet was not parsed: %v", err)
+	}
+	if !VerifyIPv4UDPChecksum(first) {
+		t.Errorf("Correct checksum of chained UDP packet was not verified")
+	}
+	(*[64]byte)(unsafe.Pointer(second.Start()))[8]++
+	if VerifyIPv4UDPChecksum(first) {
+		t.Errorf("Incorrect checksum of chained UDP packet was verified")
+	}
+	first.Next = nil
+	if VerifyIPv4UDPChecksum(first) {
+		t.Errorf("Checksum of truncated UDP packet was verified")
+	}
+
+	if first.HasRXChecksumError() || first.GetRXL4ChecksumStatus() != RXChecksumUnknown {
+		t.Errorf("Packet which was not verified by NIC has checksum error")
+	}
+}
+
+func TestSegments(t *testing.T) {
+	payload := []byte("payload of chained packet which is split into segments")
+	mb := make([]uintptr, 4)
+	low.AllocateMbufs(mb, mempool)
+	whole := ExtractPacket(mb[0])
+	InitEmptyIPv4UDPPacket(whole, uint(len(payload)))
+	copy((*[64]byte)(whole.Data)[:], payload)
+	whole.GetUDPForIPv4().DgramLen = SwapBytesUint16(uint16(UDPLen + len(payload)))
+	cksum := CalculateIPv4UDPChecksum(whole)
+	data := whole.GetRawPacketBytes()
+
+	// Segments have odd lengths
+	pkt := ExtractPacket(mb[1])
+	GeneratePacketFromByte(pkt, data[:45])
+	for i, bounds := range [][2]int{{45, 62}, {62, len(data)}} {
+		seg := ExtractPacket(mb[2+i])
+		GeneratePacketFromByte(seg, data[bounds[0]:bounds[1]])
+		if !pkt.AppendSegment(seg) {
+			t.Fatalf("Cannot append segment %d", i)
+		}
+	}
+	segments := 0
+	for it := pkt.IterateSegments(); it.Valid(); it.Next() {
+		segments++
+	}
+	if segments != 3 || pkt.GetPacketLen() != uint(len(data)) {
+		t.Errorf("Incorrect chained packet: %d segments, %d bytes", segments, pkt.GetPacketLen())
+	}
+	if !bytes.Equal(pkt.GetRawPacketBytes(), data) {
+		t.Errorf("Incorrect bytes of chained packet:\ngot:  %x\nwant: %x\n", pkt.GetRawPacketBytes(), data)
+	}
+
+	buf := make([]byte, 30)
+	if !pkt.ReadBytes(40, buf) || !bytes.Equal(buf, data[40:70]) {
+		t.Errorf("Incorrect bytes were read across segments: %x", buf)
+	}
+	if pkt.ReadBytes(uint(len(data))-10, buf) {
+		t.Errorf("Bytes were read beyond end of packet")
+	}
+	if pkt.WriteBytes(uint(len(data))-10, buf) {
+		t.Errorf("Bytes were written beyond end of packet")
+	}
+
+	if err := pkt.SafeParseData(); err != nil {
+		t.Fatalf("Chained packet was not parsed: %v", err)
+	}
+	if got := CalculateIPv4UDPChecksum(pkt); got != cksum {
+		t.Errorf("Incorrect checksum of chained packet %04x, want %04x", got, cksum)
+	}
+
+	if !pkt.WriteBytes(60, []byte("CHANGED")) {
+		t.Errorf("Bytes were not written across segments")
+	}
+	copy(data[60:], "CHANGED")
+
+	// All segments are written to pcap file as one packet
+	f, err := ioutil.TempFile("", "segments")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	WritePcapGlobalHdr(f)
+	pkt.WritePcapOnePacket(f)
+	f.Seek(PcapGlobHdrSize, io.SeekStart)
+	low.AllocateMbufs(mb[:1], mempool)
+	read := ExtractPacket(mb[0])
+	read.ReadPcapOnePacket(f)
+	f.Close()
+	if !bytes.Equal(read.GetRawPacketBytes(), data) {
+		t.Errorf("Incorrect packet was read from pcap file:\ngot:  %x\nwant: %x\n", read.GetRawPacketBytes(), data)
+	}
+
+	dataOffset := uintptr(pkt.Data) - pkt.Start()
+	if !pkt.Linearize() || pkt.Next != nil || pkt.GetPacketSegmentLen() != uint(len(data)) {
+		t.Fatalf("Packet was not linearized")
+	}
+	if !bytes.Equal(pkt.GetRawPacketBytes(), data) || uintptr(pkt.Data)-pkt.Start() != dataOffset {
+		t.Errorf("Incorrect bytes of linearized packet:\ngot:  %x\nwant: %x\n", pkt.GetRawPacketBytes(), data)
+	}
+}
+
+func TestClone(t *testing.T) {
+	payload := []byte("payload of packet which is cloned")
+	mb := make([]uintptr, 3)
+	low.AllocateMbufs(mb, mempool)
+	pkt := ExtractPacket(mb[0])
+	InitEmptyIPv4UDPPacket(pkt, uint(len(payload)))
+	copy((*[64]byte)(pkt.Data)[:], payload)
+	data := pkt.GetRawPacketBytes()
+
+	clone, ok := pkt.Clone(mempool, 0)
+	if !ok || clone.CMbuf == pkt.CMbuf {
+		t.Fatalf("Packet was not cloned")
+	}
+	if !bytes.Equal(clone.GetRawPacketBytes(), data) {
+		t.Errorf("Incorrect bytes of clone:\ngot:  %x\nwant: %x\n", clone.GetRawPacketBytes(), data)
+	}
+	if uintptr(clone.L3)-clone.Start() != uintptr(pkt.L3)-pkt.Start() ||
+		uintptr(clone.L4)-clone.Start() != uintptr(pkt.L4)-pkt.Start() ||
+		uintptr(clone.Data)-clone.Start() != uintptr(pkt.Data)-pkt.Start() {
+		t.Errorf("Headers of clone point to incorrect offsets")
+	}
+	clone.GetUDPForIPv4().DstPort = SwapBytesUint16(1234)
+	if !bytes.Equal(pkt.GetRawPacketBytes(), data) {
+		t.Errorf("Original packet was changed with clone")
+	}
+
+	// Truncated clone keeps only pointers to copied bytes
+	snaplen := uint(EtherLen + IPv4MinLen + 4)
+	clone, ok = pkt.Clone(mempool, snaplen)
+	if !ok || !bytes.Equal(clone.GetRawPacketBytes(), data[:snaplen]) {
+		t.Fatalf("Incorrect bytes of truncated clone: %x", clone.GetRawPacketBytes())
+	}
+	if clone.L3 == nil || clone.L4 == nil || clone.Data != nil {
+		t.Errorf("Incorrect headers of truncated clone: %v %v %v", clone.L3, clone.L4, clone.Data)
+	}
+	// Pointer to the end of copied bytes is not kept
+	clone, ok = pkt.Clone(mempool, EtherLen+IPv4MinLen)
+	if !ok || clone.L3 == nil || clone.L4 != nil {
+		t.Errorf("Incorrect headers of clone truncated before L4: %v %v", clone.L3, clone.L4)
+	}
+
+	// Chained packet which doesn't fit into one mbuf is cloned to chain
+	big := make([]byte, 1500)
+	for i := range big {
+		big[i] = byte(i)
+	}
+	chained := ExtractPacket(mb[1])
+	GeneratePacketFromByte(chained, big)
+	seg := ExtractPacket(mb[2])
+	GeneratePacketFromByte(seg, big)
+	chained.AppendSegment(seg)
+	clone, ok = chained.Clone(mempool, 0)
+	if !ok || clone.Next == nil {
+		t.Fatalf("Long packet was not cloned to chain")
+	}
+	if !bytes.Equal(clone.GetRawPacketBytes(), chained.GetRawPacketBytes()) {
+		t.Errorf("Incorrect bytes of chained clone")
+	}
+}
+
+func TestTCPOptions(t *testing.T) {
+	options, _ := hex.DecodeString("020405b401030307" + "0402080a0000000100000002" + "0101050a0000001000000020")
+	mb := make([]uintptr, 1)
+	low.AllocateMbufs(mb, mempool)
+	pkt := ExtractPacket(mb[0])
+	InitEmptyIPv4TCPPacket(pkt, uint(len(options)))
+	copy((*[64]byte)(pkt.Data)[:], options)
+	tcp := pkt.GetTCPForIPv4()
+	tcp.DataOff = uint8(TCPMinLen+len(options)) << 2
+	tcp.TCPFlags = TCPFlagSyn
+	tcp.Cksum = SwapBytesUint16(CalculateIPv4TCPChecksum(pkt))
+
+	var kinds []uint8
+	for it := tcp.IterateOptions(); it.Valid(); it.Next() {
+		kinds = append(kinds, it.Kind())
+		switch it.Kind() {
+		case TCPOptionMSS:
+			if mss, ok := it.MSS(); !ok || mss != 1460 {
+				t.Errorf("Incorrect MSS %d", mss)
+			}
+		case TCPOptionWindowScale:
+			if shift, ok := it.WindowScale(); !ok || shift != 7 {
+				t.Errorf("Incorrect window scale %d", shift)
+			}
+		case TCPOptionSACKPermitted:
+			if !it.SACKPermitted() {
+				t.Errorf("Incorrect SACK permitted option")
+			}
+		case TCPOptionTimestamps:
+			if value, echo, ok := it.Timestamps(); !ok || value != 1 || echo != 2 {
+				t.Errorf("Incorrect timestamps %d %d", value, echo)
+			}
+		case TCPOptionSACK:
+			if blocks, ok := it.SACKBlocks(); !ok || len(blocks) != 1 || blocks[0] != (TCPSACKBlock{0x10, 0x20}) {
+				t.Errorf("Incorrect SACK blocks %v", blocks)
+			}
+		}
+	}
+	want := []uint8{TCPOptionMSS, TCPOptionWindowScale, TCPOptionSACKPermitted, TCPOptionTimestamps, TCPOptionSACK}
+	if !reflect.DeepEqual(kinds, want) {
+		t.Errorf("Incorrect options %v, want %v", kinds, want)
+	}
+
+	if !pkt.ClampTCPMSS(1400) || pkt.ClampTCPMSS(1450) {
+		t.Errorf("Incorrect result of MSS clamping")
+	}
+	for it := tcp.IterateOptions(); it.Valid(); it.Next() {
+		if mss, ok := it.MSS(); ok && mss != 1400 {
+			t.Errorf("MSS was not clamped: %d", mss)
+		}
+		// Window scale data has odd offset
+		if it.Kind() == TCPOptionWindowScale && !it.SetWindowScale(9) {
+			t.Errorf("Window scale was not set")
+		}
+		if it.Kind() == TCPOptionTimestamps && !it.SetTimestamps(0x01020304, 0x05060708) {
+			t.Errorf("Timestamps were not set")
+		}
+		if it.Kind() == TCPOptionSACK {
+			it.Remove()
+		}
+	}
+	if !VerifyIPv4TCPChecksum(pkt) {
+		t.Errorf("Checksum was not adjusted after options rewriting")
+	}
+	kinds = kinds[:0]
+	for it := tcp.IterateOptions(); it.Valid(); it.Next() {
+		kinds = append(kinds, it.Kind())
+		if value, echo, ok := it.Timestamps(); ok && (value != 0x01020304 || echo != 0x05060708) {
+			t.Errorf("Incorrect timestamps %x %x", value, echo)
+		}
+	}
+	if !reflect.DeepEqual(kinds, want[:4]) {
+		t.Errorf("Incorrect options after removal %v", kinds)
+	}
+
+	// Malformed option stops iteration
+	copy((*[64]byte)(unsafe.Pointer(uintptr(pkt.L4) + TCPMinLen))[:], []byte{TCPOptionMSS, 40})
+	if it := tcp.IterateOptions(); it.Valid() {
+		t.Errorf("Malformed option is valid")
+	}
+}
+
+func TestSCTP(t *testing.T) {
+	// HEARTBEAT chunk and unknown chunk which is padded
+	chunks, _ := hex.DecodeString("0400000812345678" + "c0000005aa000000")
+	mb := make([]uintptr, 2)
+	low.AllocateMbufs(mb, mempool)
+	pkt := ExtractPacket(mb[0])
+	InitEmptyIPv4SCTPPacket(pkt, uint(len(chunks)))
+	copy((*[64]byte)(pkt.Data)[:], chunks)
+	sctp := pkt.GetSCTPForIPv4()
+	sctp.SrcPort = SwapBytesUint16(2905)
+	sctp.DstPort = SwapBytesUint16(2905)
+	sctp.VerTag = SwapBytesUint32(1)
+
+	var types []uint8
+	var lens []uintptr
+	for it := pkt.IterateSCTPChunks(); it.Valid(); it.Next() {
+		types = append(types, it.Type())
+		lens = append(lens, it.Len())
+		if it.Type() == SCTPChunkHeartbeat && !bytes.Equal(it.Data(), chunks[4:8]) {
+			t.Errorf("Incorrect chunk data %x", it.Data())
+		}
+	}
+	if !reflect.DeepEqual(types, []uint8{SCTPChunkHeartbeat, 0xc0}) || !reflect.DeepEqual(lens, []uintptr{8, 5}) {
+		t.Errorf("Incorrect chunks %v with lengths %v", types, lens)
+	}
+
+	// Checksum is calculated independently over SCTP packet
+	if cksum := CalculateSCTPChecksum(pkt); cksum != 0xc4908eb5 {
+		t.Errorf("Incorrect SCTP checksum %08x", cksum)
+	}
+	sctp.Cksum = CalculateSCTPChecksum(pkt)
+	if !VerifySCTPChecksum(pkt) || !VerifyL4Checksum(pkt) {
+		t.Errorf("Correct SCTP checksum was not verified")
+	}
+	if pkt.ParseData() != 0 || uintptr(pkt.Data) != uintptr(pkt.L4)+SCTPLen {
+		t.Errorf("SCTP packet was not parsed")
+	}
+	chunks[4] = 0
+	copy((*[64]byte)(pkt.Data)[:], chunks)
+	if VerifySCTPChecksum(pkt) {
+		t.Errorf("Incorrect SCTP checksum was verified")
+	}
+
+	pkt6 := ExtractPacket(mb[1])
+	InitEmptyIPv6SCTPPacket(pkt6, 0)
+	if pkt6.GetSCTPForIPv6() == nil || pkt6.GetPacketLen() != EtherLen+IPv6Len+SCTPLen {
+		t.Errorf("Incorrect IPv6 SCTP packet")
+	}
+	if _, _, _, err := pkt6.SafeParseL4ForIPv6(); err != nil {
+		t.Errorf("IPv6 SCTP packet was not parsed: %v", err)
+	}
+}
+
+func TestBuilder(t *testing.T) {
+	dstMAC := net.HardwareAddr{0x01, 0x11, 0x21, 0x31, 0x41, 0x51}
+	srcMAC := net.HardwareAddr{0x00, 0x11, 0x22, 0x33, 0x44, 0x55}
+	payload := []byte{0xde, 0xad, 0xbe, 0xef}
+	mb := make([]uintptr, 5)
+	low.AllocateMbufs(mb, mempool)
+
+	pkt := ExtractPacket(mb[0])
+	if !Build(pkt).Ether(dstMAC, srcMAC).VLAN(100).IPv4(net.IPv4(10, 0, 0, 1), net.IPv4(10, 0, 0, 2)).UDP(1234, 5678).Payload(payload) {
+		t.Fatal("Build IPv4 UDP failed")
+	}
+	// Checksums are calculated independently
+	want, _ := hex.DecodeString("0111213141510011223344558100006408004500002000000000401166cb0a0000010a00000204d2162e000c3336deadbeef")
+	if !bytes.Equal(pkt.GetRawPacketBytes(), want) {
+		t.Errorf("Incorrect IPv4 UDP packet:\ngot:  %x\nwant: %x\n", pkt.GetRawPacketBytes(), want)
+	}
+	if pkt.GetUDPForIPv4() == nil || !bytes.Equal((*[4]byte)(pkt.Data)[:], payload) {
+		t.Errorf("Incorrect pointers of built packet")
+	}
+
+	pkt = ExtractPacket(mb[1])
+	src6, dst6 := net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::2")
+	if !Build(pkt).Ether(dstMAC, srcMAC).IPv6(src6, dst6).TCP(80, 8080, 100, TCPFlagSyn).Ack(7).Payload(payload) {
+		t.Fatal("Build IPv6 TCP failed")
+	}
+	tcp := pkt.GetTCPForIPv6()
+	if tcp == nil || SwapBytesUint32(tcp.SentSeq) != 100 || SwapBytesUint32(tcp.RecvAck) != 7 ||
+		tcp.TCPFlags != TCPFlagSyn|TCPFlagAck || SwapBytesUint16(pkt.GetIPv6().PayloadLen) != TCPMinLen+4 {
+		t.Errorf("Incorrect IPv6 TCP packet %x", pkt.GetRawPacketBytes())
+	}
+	if !VerifyChecksums(pkt) {
+		t.Errorf("Incorrect checksum of IPv6 TCP packet")
+	}
+
+	pkt = ExtractPacket(mb[2])
+	if !Build(pkt).IPv4(net.IPv4(10, 0, 0, 1), net.IPv4(10, 0, 0, 2)).ICMP(ICMPTypeEchoRequest, 0, 1, 2).Payload(payload) {
+		t.Fatal("Build IPv4 ICMP failed")
+	}
+	icmp := pkt.GetICMPForIPv4()
+	if icmp == nil || SwapBytesUint16(icmp.SeqNum) != 2 || !VerifyIPv4Checksum(pkt) || !VerifyIPv4ICMPChecksum(pkt) {
+		t.Errorf("Incorrect IPv4 ICMP packet %x", pkt.GetRawPacketBytes())
+	}
+
+	pkt = ExtractPacket(mb[3])
+	if !Build(pkt).VLAN(1).VLAN(2).IPv6(src6, dst6).ICMP(ICMPv6TypeEchoRequest, 0, 1, 2).Payload(nil) {
+		t.Fatal("Build IPv6 ICMP failed")
+	}
+	if pkt.Ether.EtherType != SwapBytesUint16(QinQNumber) || pkt.GetInnerVLAN() == nil || pkt.GetInnerVLAN().GetVLANTagIdentifier() != 2 {
+		t.Errorf("Incorrect VLAN tags %x", pkt.GetRawPacketBytes())
+	}
+	if pkt.GetICMPForIPv6() == nil || !VerifyIPv6ICMPChecksum(pkt) {
+		t.Errorf("Incorrect IPv6 ICMP packet %x", pkt.GetRawPacketBytes())
+	}
+
+	pkt = ExtractPacket(mb[4])
+	if Build(pkt).UDP(1, 2).Payload(nil) || Build(pkt).IPv4(src6, dst6).Payload(nil) ||
+		Build(pkt).IPv4(net.IPv4(10, 0, 0, 1), net.IPv4(10, 0, 0, 2)).VLAN(1).Payload(nil) ||
+		Build(pkt).Ether(net.HardwareAddr{1}, nil).Payload(nil) {
+		t.Errorf("Incorrect layers are accepted")
+	}
+	if pkt.GetPacketLen() != 0 {
+		t.Errorf("Packet is changed by failed builder")
+	}
+}
+
+func TestPcapMagic(t *testing.T) {
+	f, err := ioutil.TempFile("", "pcap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	// Big endian file with nanosecond timestamps and one record
+	be, _ := hex.DecodeString("a1b23c4d00020004000000000000000000000040" + "00000001" +
+		"5968c6f0075bcd150000000300000003" + "0a0b0c")
+	f.Write(be)
+	f.Seek(0, io.SeekStart)
+	var glHdr PcapGlobHdr
+	ReadPcapGlobalHdr(f, &glHdr)
+	if !glHdr.IsNano() || glHdr.VersionMajor != 2 || glHdr.Snaplen != 64 || glHdr.Network != 1 {
+		t.Errorf("Incorrect global header %+v", glHdr)
+	}
+	mb := make([]uintptr, 3)
+	low.AllocateMbufs(mb, mempool)
+	read := ExtractPacket(mb[2])
+	if read.ReadPcapPacket(f, &glHdr) || !bytes.Equal(read.GetRawPacketBytes(), []byte{10, 11, 12}) {
+		t.Errorf("Incorrect big endian record %x", read.GetRawPacketBytes())
+	}
+	if !read.ReadPcapPacket(f, &glHdr) {
+		t.Errorf("End of big endian file is not reached")
+	}
+
+	// Written file has microsecond timestamps in little endian
+	pkt := ExtractPacket(mb[0])
+	GeneratePacketFromByte(pkt, []byte{10, 11, 12})
+	if _, ok := pkt.GetRXTimestamp(); ok {
+		t.Errorf("RX timestamp is found in generated packet")
+	}
+	f.Truncate(0)
+	f.Seek(0, io.SeekStart)
+	WritePcapGlobalHdr(f)
+	pkt.WritePcapOnePacket(f)
+	f.Seek(0, io.SeekStart)
+	ReadPcapGlobalHdr(f, &glHdr)
+	read = ExtractPacket(mb[1])
+	if glHdr.IsNano() || read.ReadPcapOnePacket(f) || !bytes.Equal(read.GetRawPacketBytes(), []byte{10, 11, 12}) {
+		t.Errorf("Incorrect written record %+v %x", glHdr, read.GetRawPacketBytes())
+	}
+}
@@ -13,12 +13,18 @@ import (
 	"unsafe"
 
 	"github.com/intel-go/yanff/common"
-	"github.com/intel-go/yanff/low"
 )
 
 // PcapGlobHdrSize is a size of cap global header.
 const PcapGlobHdrSize int64 = 24
 
+// Magic numbers of pcap files with microsecond and nanosecond timestamps.
+// Files which are written in big endian byte order have these numbers swapped.
+const (
+	PcapMagicMicro uint32 = 0xa1b2c3d4
+	PcapMagicNano  uint32 = 0xa1b23c4d
+)
+
 // PcapGlobHdr is a Pcap global header.
 type PcapGlobHdr struct {
 	MagicNumber  uint32 /* magic number */
@@ -30,10 +36,24 @@ type PcapGlobHdr struct {
 	Network      uint32 /* data link type */
 }
 
+// byteOrder returns byte order of pcap file. MagicNumber is kept as it
+// is read in little endian, so it is swapped for big endian files.
+func (hdr *PcapGlobHdr) byteOrder() binary.ByteOrder {
+	if hdr.MagicNumber == SwapBytesUint32(PcapMagicMicro) || hdr.MagicNumber == SwapBytesUint32(PcapMagicNano) {
+		return binary.BigEndian
+	}
+	return binary.LittleEndian
+}
+
+// IsNano returns true if timestamps of pcap file have nanosecond resolution.
+func (hdr *PcapGlobHdr) IsNano() bool {
+	return hdr.MagicNumber == PcapMagicNano || hdr.MagicNumber == SwapBytesUint32(PcapMagicNano)
+}
+
 // PcapRecHdr is a Pcap packet header.
 type PcapRecHdr struct {
 	TsSec   uint32 /* timestamp seconds */
-	TsUsec  uint32 /* timestamp microseconds */
+	TsUsec  uint32 /* timestamp microseconds or nanoseconds */
 	InclLen uint32 /* number of octets of packet saved in file */
 	OrigLen uint32 /* actual length of packet */
 }
@@ -41,7 +61,7 @@ type PcapRecHdr struct {
 // WritePcapGlobalHdr writes global pcap header into file.
 func WritePcapGlobalHdr(f *os.File) {
 	glHdr := PcapGlobHdr{
-		MagicNumber:  0xa1b2c3d4,
+		MagicNumber:  PcapMagicMicro,
 		VersionMajor: 2,
 		VersionMinor: 4,
 		Snaplen:      65535,
@@ -59,18 +79,19 @@ func WritePcapGlobalHdr(f *os.File) {
 }
 
 // WritePcapOnePacket writes one packet with pcap header in file.
+// All segments of chained packet are written as one record.
 // Assumes global pcap header is already present in file.
 func (pkt *Packet) WritePcapOnePacket(f *os.File) {
-	bytes := low.GetRawPacketBytesMbuf(pkt.CMbuf)
+	bytes := pkt.GetRawPacketBytes()
 	writePcapRecHdr(f, bytes)
 	writePacketBytes(f, bytes)
 }
 
-func writePcapRecHdr(f *os.File, pktBytes []byte) error {
+func writePcapRecHdr(f *os.File, pktBytes []byte) {
 	t := time.Now()
 	hdr := PcapRecHdr{
 		TsSec:   uint32(t.Unix()),
-		TsUsec:  uint32(t.UnixNano() - t.Unix()*1e9),
+		TsUsec:  uint32(t.Nanosecond() / 1000),
 		InclLen: uint32(len(pktBytes)),
 		OrigLen: uint32(len(pktBytes)),
 	}
@@ -83,7 +104,6 @@ func writePcapRecHdr(f *os.File, pktBytes []byte) error {
 	if err != nil {
 		common.LogError(common.Debug, err)
 	}
-	return nil
 }
 
 func writePacketBytes(f *os.File, pktBytes []byte) {
@@ -94,6 +114,9 @@ func writePacketBytes(f *os.File, pktBytes []byte) {
 }
 
 // ReadPcapGlobalHdr read global pcap header into file.
+// Files with microsecond and nanosecond timestamps in both
+// byte orders are accepted. Fields are converted to host byte
+// order except MagicNumber which keeps byte order of file.
 func ReadPcapGlobalHdr(f *os.File, glHdr *PcapGlobHdr) {
 	data := make([]byte, unsafe.Sizeof(*glHdr))
 	_, err := f.Read(data)
@@ -101,14 +124,22 @@ func ReadPcapGlobalHdr(f *os.File, glHdr *PcapGlobHdr) {
 		common.LogError(common.Debug, err)
 	}
 
+	magic := binary.LittleEndian.Uint32(data)
+	switch magic {
+	case PcapMagicMicro, PcapMagicNano, SwapBytesUint32(PcapMagicMicro), SwapBytesUint32(PcapMagicNano):
+	default:
+		common.LogError(common.Debug, "Unknown magic number of pcap file:", magic)
+	}
+	glHdr.MagicNumber = magic
 	buffer := bytes.NewBuffer(data)
-	err = binary.Read(buffer, binary.LittleEndian, glHdr)
+	err = binary.Read(buffer, glHdr.byteOrder(), glHdr)
 	if err != nil {
 		common.LogError(common.Debug, err)
 	}
+	glHdr.MagicNumber = magic
 }
 
-func readPcapRecHdr(f *os.File, hdr *PcapRecHdr) error {
+func readPcapRecHdr(f *os.File, order binary.ByteOrder, hdr *PcapRecHdr) error {
 	data := make([]byte, unsafe.Sizeof(*hdr))
 	_, err := f.Read(data)
 
@@ -117,7 +148,7 @@ func readPcapRecHdr(f *os.File, hdr *PcapRecHdr) error {
 	}
 
 	buffer := bytes.NewBuffer(data)
-	err = binary.Read(buffer, binary.LittleEndian, hdr)
+	err = binary.Read(buffer, order, hdr)
 	if err != nil {
 		common.LogError(common.Debug, err)
 	}
@@ -134,10 +165,20 @@ func readPacketBytes(f *os.File, inclLen uint32) []byte {
 }
 
 // ReadPcapOnePacket read one packet with pcap header from file.
-// Assumes that global pcap header is already read.
+// Assumes that global pcap header is already read and file
+// is in little endian byte order. ReadPcapPacket should be used
+// for files in both byte orders.
 func (pkt *Packet) ReadPcapOnePacket(f *os.File) bool {
+	return pkt.ReadPcapPacket(f, &PcapGlobHdr{MagicNumber: PcapMagicMicro})
+}
+
+// ReadPcapPacket read one packet with pcap header from file which
+// global header glHdr is already read by ReadPcapGlobalHdr. Record
+// header is read in byte order of file. Returns true if end of file
+// is reached and packet is not read.
+func (pkt *Packet) ReadPcapPacket(f *os.File, glHdr *PcapGlobHdr) bool {
 	var hdr PcapRecHdr
-	err := readPcapRecHdr(f, &hdr)
+	err := readPcapRecHdr(f, glHdr.byteOrder(), &hdr)
 	if err == io.EOF {
 		return true
 	} else if err != nil {
@@ -0,0 +1,268 @@
+// Copyright 2017 Intel Corporation.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package packet
+
+import (
+	"errors"
+	"unsafe"
+
+	. "github.com/intel-go/yanff/common"
+	"github.com/intel-go/yanff/low"
+)
+
+// Errors returned by safe parsing functions.
+var (
+	// ErrTruncated means that header or length field points beyond the end of packet.
+	ErrTruncated = errors.New("packet is truncated")
+	// ErrHeaderSplit means that header crosses mbuf segment boundary of
+	// chained packet, so it can't be accessed through pointer.
+	ErrHeaderSplit = errors.New("header is split between mbuf segments")
+	// ErrBadHeader means that header field like IPv4 IHL or TCP data offset
+	// has incorrect value.
+	ErrBadHeader = errors.New("incorrect header field")
+	// ErrUnsupported means that packet is not TCP, UDP or ICMP over IPv4 or IPv6.
+	ErrUnsupported = errors.New("unsupported protocol")
+)
+
+// Safe parsing functions set the same pointers as ParseL3, ParseL4ForIPv4
+// and others but before this they check all header fields which are used
+// for pointer calculation against real length of packet. Length of chained
+// packet is summed over all segments linked by Next field. Headers should be
+// located in the first segment, Data can point to any byte after it.
+// Returned headers can be accessed safely if error is nil.
+
+// parseBounds returns end of the first segment and end of the whole packet
+// as if all segments were placed after the first one.
+func (packet *Packet) parseBounds() (uintptr, uintptr) {
+	segEnd := low.GetPacketDataStartPointer(packet.CMbuf) + uintptr(packet.GetPacketSegmentLen())
+	end := segEnd
+	for seg := packet.Next; seg != nil; seg = seg.Next {
+		end += uintptr(seg.GetPacketSegmentLen())
+	}
+	return segEnd, end
+}
+
+// checkBounds checks that length bytes starting from ptr are located
+// inside the first segment.
+func checkBounds(ptr, length, segEnd, end uintptr) error {
+	if ptr+length > end {
+		return ErrTruncated
+	}
+	if ptr+length > segEnd {
+		return ErrHeaderSplit
+	}
+	return nil
+}
+
+// safeL2Len is l2Len which doesn't read VLAN tags and MPLS labels
+// beyond the end of the first segment.
+func (packet *Packet) safeL2Len(segEnd, end uintptr) (uintptr, uint16, error) {
+	if err := checkBounds(packet.Start(), EtherLen, segEnd, end); err != nil {
+		return 0, 0, err
+	}
+	length := uintptr(EtherLen)
+	etherType := packet.Ether.EtherType
+	for isVLANType(etherType) {
+		if err := checkBounds(packet.Start()+length, VLANLen, segEnd, end); err != nil {
+			return 0, 0, err
+		}
+		etherType = (*VLANHdr)(unsafe.Pointer(packet.Start() + length)).EtherType
+		length += VLANLen
+	}
+	if etherType == SwapBytesUint16(MPLSNumber) {
+		for {
+			if err := checkBounds(packet.Start()+length, MPLSLen, segEnd, end); err != nil {
+				return 0, 0, err
+			}
+			entry := (*MPLSHdr)(unsafe.Pointer(packet.Start() + length))
+			length += MPLSLen
+			if entry.IsBottomOfStack() {
+				break
+			}
+		}
+		_, etherType = packet.skipMPLS(length - MPLSLen)
+	}
+	return length, etherType, nil
+}
+
+// SafeParseL3 sets L3 pointer like ParseL3 and returns pointer to IPv4 or
+// IPv6 header. Both pointers are nil if packet is not IP. Header length,
+// IPv4 total length and IPv6 payload length are checked against packet length.
+func (packet *Packet) SafeParseL3() (*IPv4Hdr, *IPv6Hdr, error) {
+	segEnd, end := packet.parseBounds()
+	l2len, etherType, err := packet.safeL2Len(segEnd, end)
+	if err != nil {
+		return nil, nil, err
+	}
+	packet.L3 = unsafe.Pointer(packet.Start() + l2len)
+	l3 := uintptr(packet.L3)
+
+	switch etherType {
+	case SwapBytesUint16(IPV4Number):
+		if err := checkBounds(l3, IPv4MinLen, segEnd, end); err != nil {
+			return nil, nil, err
+		}
+		ipv4 := (*IPv4Hdr)(packet.L3)
+		ihl := uintptr(ipv4.VersionIhl&0x0f) << 2
+		if ipv4.VersionIhl>>4 != 4 || ihl < IPv4MinLen {
+			return nil, nil, ErrBadHeader
+		}
+		if err := checkBounds(l3, ihl, segEnd, end); err != nil {
+			return nil, nil, err
+		}
+		totalLength := uintptr(SwapBytesUint16(ipv4.TotalLength))
+		if totalLength < ihl {
+			return nil, nil, ErrBadHeader
+		}
+		if l3+totalLength > end {
+			return nil, nil, ErrTruncated
+		}
+		return ipv4, nil, nil
+	case SwapBytesUint16(IPV6Number):
+		if err := checkBounds(l3, IPv6Len, segEnd, end); err != nil {
+			return nil, nil, err
+		}
+		ipv6 := (*IPv6Hdr)(packet.L3)
+		if SwapBytesUint32(ipv6.VtcFlow)>>28 != 6 {
+			return nil, nil, ErrBadHeader
+		}
+		if l3+IPv6Len+uintptr(SwapBytesUint16(ipv6.PayloadLen)) > end {
+			return nil, nil, ErrTruncated
+		}
+		return nil, ipv6, nil
+	}
+	return nil, nil, nil
+}
+
+// SafeParseL4ForIPv4 sets L4 pointer like ParseL4ForIPv4 and Data pointer
+// like ParseL7 and returns pointer to L4 header. L3 supposed to be parsed
+// by SafeParseL3 before and be of IPv4 type. L4 headers are not returned
+// for non first fragments because they don't contain them.
+func (packet *Packet) SafeParseL4ForIPv4() (*TCPHdr, *UDPHdr, *ICMPHdr, error) {
+	ipv4 := packet.GetIPv4()
+	ihl := uintptr(ipv4.VersionIhl&0x0f) << 2
+	packet.L4 = unsafe.Pointer(uintptr(packet.L3) + ihl)
+	packet.Data = packet.L4
+	fragment := SwapBytesUint16(ipv4.FragmentOffset)
+	if fragment&0x1fff != 0 {
+		return nil, nil, nil, nil
+	}
+	l4Len := uintptr(SwapBytesUint16(ipv4.TotalLength)) - ihl
+	// More fragments flag means that only part of L4 payload is present
+	whole := fragment&0x2000 == 0
+	return packet.safeParseL4(ipv4.NextProtoID, ICMPNumber, l4Len, whole)
+}
+
+// SafeParseL4ForIPv6 sets L4 pointer like ParseL4ForIPv6 and Data pointer
+// like ParseL7 and returns pointer to L4 header. L3 supposed to be parsed
+// by SafeParseL3 before and be of IPv6 type. Extension headers are checked
+// against payload length. L4 headers are not returned for non first fragments.
+func (packet *Packet) SafeParseL4ForIPv6() (*TCPHdr, *UDPHdr, *ICMPHdr, error) {
+	segEnd, _ := packet.parseBounds()
+	it := packet.IterateIPv6ExtHdrs()
+	payloadEnd := it.end
+	if it.end > segEnd {
+		it.end = segEnd
+	}
+	var frag *IPv6FragmentHdr
+	for ; it.Valid(); it.Next() {
+		if it.Type() == IPv6FragmentNumber {
+			frag = (*IPv6FragmentHdr)(it.Header())
+		}
+	}
+	if isIPv6ExtHdr(it.Type()) {
+		if payloadEnd > segEnd {
+			return nil, nil, nil, ErrHeaderSplit
+		}
+		return nil, nil, nil, ErrTruncated
+	}
+	packet.L4 = unsafe.Pointer(it.hdr)
+	packet.Data = packet.L4
+	if frag != nil && frag.GetFragmentOffset() != 0 {
+		return nil, nil, nil, nil
+	}
+	whole := frag == nil || !frag.MoreFragments()
+	return packet.safeParseL4(it.Type(), ICMPv6Number, payloadEnd-it.hdr, whole)
+}
+
+// safeParseL4 checks L4 header of given protocol which has l4Len bytes
+// and sets Data pointer. If whole is false packet contains only first
+// fragment of L4 payload.
+func (packet *Packet) safeParseL4(proto, icmpProto uint8, l4Len uintptr, whole bool) (*TCPHdr, *UDPHdr, *ICMPHdr, error) {
+	segEnd, end := packet.parseBounds()
+	l4 := uintptr(packet.L4)
+	if l4+l4Len < end {
+		// Data after IP payload is Ethernet padding
+		end = l4 + l4Len
+	}
+	switch proto {
+	case TCPNumber:
+		if err := checkBounds(l4, TCPMinLen, segEnd, end); err != nil {
+			return nil, nil, nil, err
+		}
+		tcp := (*TCPHdr)(packet.L4)
+		dataOff := uintptr(tcp.DataOff&0xf0) >> 2
+		if dataOff < TCPMinLen {
+			return nil, nil, nil, ErrBadHeader
+		}
+		if err := checkBounds(l4, dataOff, segEnd, end); err != nil {
+			return nil, nil, nil, err
+		}
+		packet.Data = unsafe.Pointer(l4 + dataOff)
+		return tcp, nil, nil, nil
+	case UDPNumber:
+		if err := checkBounds(l4, UDPLen, segEnd, end); err != nil {
+			return nil, nil, nil, err
+		}
+		udp := (*UDPHdr)(packet.L4)
+		dgramLen := uintptr(SwapBytesUint16(udp.DgramLen))
+		if dgramLen < UDPLen {
+			return nil, nil, nil, ErrBadHeader
+		}
+		if whole && dgramLen > l4Len {
+			return nil, nil, nil, ErrTruncated
+		}
+		packet.Data = unsafe.Pointer(l4 + UDPLen)
+		return nil, udp, nil, nil
+	case icmpProto:
+		if err := checkBounds(l4, ICMPLen, segEnd, end); err != nil {
+			return nil, nil, nil, err
+		}
+		packet.Data = unsafe.Pointer(l4 + ICMPLen)
+		return nil, nil, (*ICMPHdr)(packet.L4), nil
+	case SCTPNumber:
+		// SCTP header is not returned, use GetSCTPForIPv4 or GetSCTPForIPv6
+		if err := checkBounds(l4, SCTPLen, segEnd, end); err != nil {
+			return nil, nil, nil, err
+		}
+		packet.Data = unsafe.Pointer(l4 + SCTPLen)
+	}
+	return nil, nil, nil, nil
+}
+
+// SafeParseData is safe version of ParseData. It parses L3 and L4 and
+// fills Data pointer. Returns ErrUnsupported if packet is not TCP, UDP
+// or ICMP over IPv4 or IPv6.
+func (packet *Packet) SafeParseData() error {
+	var tcp *TCPHdr
+	var udp *UDPHdr
+	var icmp *ICMPHdr
+	ipv4, ipv6, err := packet.SafeParseL3()
+	if err != nil {
+		return err
+	}
+	if ipv4 != nil {
+		tcp, udp, icmp, err = packet.SafeParseL4ForIPv4()
+	} else if ipv6 != nil {
+		tcp, udp, icmp, err = packet.SafeParseL4ForIPv6()
+	}
+	if err != nil {
+		return err
+	}
+	if tcp == nil && udp == nil && icmp == nil {
+		return ErrUnsupported
+	}
+	return nil
+}
@@ -0,0 +1,181 @@
+// Copyright 2017 Intel Corporation.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package packet
+
+import (
+	"fmt"
+	"hash/crc32"
+	"unsafe"
+
+	. "github.com/intel-go/yanff/common"
+	"github.com/intel-go/yanff/low"
+)
+
+// SCTPHdr is SCTP common header (RFC 4960).
+type SCTPHdr struct {
+	SrcPort uint16 // SCTP source port
+	DstPort uint16 // SCTP destination port
+	VerTag  uint32 // Verification tag
+	Cksum   uint32 // CRC32c checksum
+}
+
+func (hdr *SCTPHdr) String() string {
+	r0 := "        L4 protocol: SCTP\n"
+	r1 := fmt.Sprintf("        L4 Source: %d\n", SwapBytesUint16(hdr.SrcPort))
+	r2 := fmt.Sprintf("        L4 Destination: %d\n", SwapBytesUint16(hdr.DstPort))
+	r3 := fmt.Sprintf("        SCTP Verification tag: %#x\n", SwapBytesUint32(hdr.VerTag))
+	return r0 + r1 + r2 + r3
+}
+
+// SCTPChunkHdr is common beginning of all SCTP chunks.
+type SCTPChunkHdr struct {
+	Type   uint8  // Chunk type
+	Flags  uint8  // Chunk flags, depend on type
+	Length uint16 // Length of chunk in bytes without padding
+}
+
+// GetSCTPForIPv4 ensures if L4 type is SCTP and cast L4 pointer to *SCTPHdr type.
+// Returns nil for non first fragments which don't contain L4 header.
+func (packet *Packet) GetSCTPForIPv4() *SCTPHdr {
+	ipv4 := packet.GetIPv4()
+	if ipv4.NextProtoID == SCTPNumber && SwapBytesUint16(ipv4.FragmentOffset)&0x1fff == 0 {
+		return (*SCTPHdr)(packet.L4)
+	}
+	return nil
+}
+
+// GetSCTPForIPv6 ensures if L4 type is SCTP and cast L4 pointer to *SCTPHdr type.
+// Returns nil for non first fragments which don't contain L4 header.
+func (packet *Packet) GetSCTPForIPv6() *SCTPHdr {
+	if packet.getL4TypeForIPv6() == SCTPNumber {
+		return (*SCTPHdr)(packet.L4)
+	}
+	return nil
+}
+
+// sctpLen returns length of SCTP packet taken from IPv4 or IPv6 header.
+func (packet *Packet) sctpLen() uintptr {
+	if packet.GetIPv4() != nil {
+		return uintptr(packet.ipv4L4Len())
+	}
+	return uintptr(packet.getL4LenForIPv6())
+}
+
+// SCTPChunkIterator walks through chunks of SCTP packet. Typical usage is:
+//
+//	for it := pkt.IterateSCTPChunks(); it.Valid(); it.Next() {
+//		if it.Type() == SCTPChunkData {
+//			data := it.Data()
+//		}
+//	}
+//
+// Only chunks located in the first segment of chained packet are walked.
+type SCTPChunkIterator struct {
+	chunk uintptr // Current chunk
+	end   uintptr // End of SCTP packet
+}
+
+// IterateSCTPChunks returns iterator pointing to the first chunk of SCTP
+// packet. L3 and L4 supposed to be parsed before and L4 be of SCTP type.
+func (packet *Packet) IterateSCTPChunks() SCTPChunkIterator {
+	start := uintptr(packet.L4) + SCTPLen
+	end := uintptr(packet.L4) + packet.sctpLen()
+	segEnd := low.GetPacketDataStartPointer(packet.CMbuf) + uintptr(packet.GetPacketSegmentLen())
+	if end > segEnd {
+		end = segEnd
+	}
+	return SCTPChunkIterator{
+		chunk: start,
+		end:   end,
+	}
+}
+
+// Valid returns true if iterator points to chunk.
+func (it *SCTPChunkIterator) Valid() bool {
+	if it.chunk+SCTPChunkHdrLen > it.end {
+		return false
+	}
+	length := it.Len()
+	return length >= SCTPChunkHdrLen && it.chunk+length <= it.end
+}
+
+// Next moves iterator to the following chunk. Chunks are padded to
+// multiple of 4 bytes.
+func (it *SCTPChunkIterator) Next() {
+	it.chunk += (it.Len() + 3) &^ 3
+}
+
+// Header returns pointer to header of current chunk.
+func (it *SCTPChunkIterator) Header() *SCTPChunkHdr {
+	return (*SCTPChunkHdr)(unsafe.Pointer(it.chunk))
+}
+
+// Type returns type of current chunk.
+func (it *SCTPChunkIterator) Type() uint8 {
+	return it.Header().Type
+}
+
+// Flags returns flags of current chunk.
+func (it *SCTPChunkIterator) Flags() uint8 {
+	return it.Header().Flags
+}
+
+// Len returns length of current chunk including header and without padding.
+func (it *SCTPChunkIterator) Len() uintptr {
+	return uintptr(SwapBytesUint16(it.Header().Length))
+}
+
+// Data returns value of current chunk after chunk header. Slice points
+// to packet, so it is zero-copy.
+func (it *SCTPChunkIterator) Data() []byte {
+	return (*[1 << 16]byte)(unsafe.Pointer(it.chunk + SCTPChunkHdrLen))[:it.Len()-SCTPChunkHdrLen]
+}
+
+var castagnoliTable = crc32.MakeTable(crc32.Castagnoli)
+
+// updateCRC32c adds bytes of packet from start to end offset to CRC.
+// Bytes can be located in several segments.
+func (packet *Packet) updateCRC32c(crc uint32, start, end uint) uint32 {
+	for it := packet.IterateSegments(); it.Valid() && start < end; it.Next() {
+		data := it.Bytes()
+		segEnd := it.Offset() + uint(len(data))
+		if start >= segEnd {
+			continue
+		}
+		stop := end
+		if stop > segEnd {
+			stop = segEnd
+		}
+		crc = crc32.Update(crc, castagnoliTable, data[start-it.Offset():stop-it.Offset()])
+		start = stop
+	}
+	return crc
+}
+
+// CalculateSCTPChecksum calculates CRC32c checksum of SCTP packet which
+// is carried over IPv4 or IPv6. L3 and L4 supposed to be parsed before
+// and L4 be of SCTP type. Checksum field is treated as zero. Data can be
+// located in several chained segments. Unlike other checksums CRC32c is
+// transmitted in little endian byte order, so result is in SCTPHdr field
+// format and should be assigned to Cksum without swapping bytes.
+// Hardware offloading is not used for SCTP.
+func CalculateSCTPChecksum(p *Packet) uint32 {
+	start, _ := p.offsetOf(uintptr(p.L4))
+	end := start + uint(p.sctpLen())
+	var zero [4]byte
+	crc := p.updateCRC32c(0, start, start+8)
+	crc = crc32.Update(crc, castagnoliTable, zero[:])
+	return p.updateCRC32c(crc, start+SCTPLen, end)
+}
+
+// VerifySCTPChecksum returns true if CRC32c checksum of SCTP packet
+// is correct. L3 and L4 supposed to be parsed before and L4 be of SCTP type.
+func VerifySCTPChecksum(p *Packet) bool {
+	start, ok := p.offsetOf(uintptr(p.L4))
+	if !ok || start+uint(p.sctpLen()) > p.getChainedLen() {
+		return false
+	}
+	return CalculateSCTPChecksum(p) == (*SCTPHdr)(p.L4).Cksum
+}
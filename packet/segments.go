@@ -0,0 +1,189 @@
+// Copyright 2017 Intel Corporation.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package packet
+
+import (
+	"unsafe"
+
+	"github.com/intel-go/yanff/low"
+)
+
+// Chained packets consist of several mbufs. Each mbuf has its own Packet
+// structure and they are linked by Next field. Only the first segment
+// contains protocol headers, so header pointers always point to it. Functions
+// below allow to access the whole packet regardless of number of segments.
+
+// SegmentIterator walks through segments of chained packet.
+// Typical usage is:
+//
+//	for it := pkt.IterateSegments(); it.Valid(); it.Next() {
+//		data := it.Bytes()
+//	}
+//
+// Packet which is not chained has exactly one segment.
+type SegmentIterator struct {
+	packet *Packet // The first segment
+	seg    *Packet // Current segment
+	offset uint    // Offset of current segment from beginning of packet
+}
+
+// IterateSegments returns iterator pointing to the first segment of packet.
+func (packet *Packet) IterateSegments() SegmentIterator {
+	return SegmentIterator{
+		packet: packet,
+		seg:    packet,
+	}
+}
+
+// Valid returns true if iterator points to segment.
+func (it *SegmentIterator) Valid() bool {
+	return it.seg != nil
+}
+
+// Next moves iterator to the following segment.
+func (it *SegmentIterator) Next() {
+	start, end := it.bounds()
+	it.offset += uint(end - start)
+	it.seg = it.seg.Next
+}
+
+// Segment returns current segment.
+func (it *SegmentIterator) Segment() *Packet {
+	return it.seg
+}
+
+// Offset returns offset of the first byte of current segment from
+// beginning of packet.
+func (it *SegmentIterator) Offset() uint {
+	return it.offset
+}
+
+// Bytes returns data of current segment. Slice points to mbuf, so it is
+// zero-copy. Data of the first segment starts from Ethernet header.
+func (it *SegmentIterator) Bytes() []byte {
+	start, end := it.bounds()
+	return (*[1 << 30]byte)(unsafe.Pointer(start))[:end-start]
+}
+
+// bounds returns addresses of the first byte of current segment and of
+// the byte after its end.
+func (it *SegmentIterator) bounds() (uintptr, uintptr) {
+	end := low.GetPacketDataStartPointer(it.seg.CMbuf) + uintptr(it.seg.GetPacketSegmentLen())
+	if it.seg == it.packet {
+		return it.packet.Start(), end
+	}
+	return low.GetPacketDataStartPointer(it.seg.CMbuf), end
+}
+
+// offsetOf returns offset from beginning of packet of byte which is
+// located at given address in any segment. Returns false if address
+// doesn't belong to packet.
+func (packet *Packet) offsetOf(ptr uintptr) (uint, bool) {
+	for it := packet.IterateSegments(); it.Valid(); it.Next() {
+		start, end := it.bounds()
+		if ptr >= start && ptr <= end {
+			return it.Offset() + uint(ptr-start), true
+		}
+	}
+	return 0, false
+}
+
+// addrOf returns address of byte which has given offset from beginning
+// of packet. Offset equal to packet length corresponds to the byte after
+// the end of the last segment.
+func (packet *Packet) addrOf(offset uint) (uintptr, bool) {
+	for it := packet.IterateSegments(); it.Valid(); it.Next() {
+		start, end := it.bounds()
+		segEnd := it.Offset() + uint(end-start)
+		if offset < segEnd || (offset == segEnd && it.seg.Next == nil) {
+			return start + uintptr(offset-it.Offset()), true
+		}
+	}
+	return 0, false
+}
+
+// copyBytes copies bytes between buffer and packet starting from
+// given offset. Returns false if packet is shorter.
+func (packet *Packet) copyBytes(start uint, buffer []byte, toPacket bool) bool {
+	for it := packet.IterateSegments(); it.Valid() && len(buffer) > 0; it.Next() {
+		data := it.Bytes()
+		end := it.Offset() + uint(len(data))
+		if start >= end {
+			continue
+		}
+		data = data[start-it.Offset():]
+		var n int
+		if toPacket {
+			n = copy(data, buffer)
+		} else {
+			n = copy(buffer, data)
+		}
+		buffer = buffer[n:]
+		start += uint(n)
+	}
+	return len(buffer) == 0
+}
+
+// ReadBytes copies len(buffer) bytes of packet starting from start byte
+// to buffer. Bytes can be located in several segments. Return false if
+// packet is shorter.
+func (packet *Packet) ReadBytes(start uint, buffer []byte) bool {
+	return packet.copyBytes(start, buffer, false)
+}
+
+// WriteBytes copies bytes to packet starting from start byte. Bytes can be
+// located in several segments. Return false if packet is shorter, in this
+// case packet is not changed.
+func (packet *Packet) WriteBytes(start uint, bytes []byte) bool {
+	if start+uint(len(bytes)) > packet.getChainedLen() {
+		return false
+	}
+	return packet.copyBytes(start, bytes, true)
+}
+
+// getChainedLen returns length of packet from Ether header summed over all segments.
+func (packet *Packet) getChainedLen() uint {
+	var length uint
+	for it := packet.IterateSegments(); it.Valid(); it.Next() {
+		start, end := it.bounds()
+		length += uint(end - start)
+	}
+	return length
+}
+
+// AppendSegment adds seg with all segments linked to it to the end
+// of packet. Return false if error.
+func (packet *Packet) AppendSegment(seg *Packet) bool {
+	if low.ChainMbuf(packet.CMbuf, seg.CMbuf) == false {
+		return false
+	}
+	last := packet
+	for last.Next != nil {
+		last = last.Next
+	}
+	last.Next = seg
+	// Following segments contain only data as after reassembly
+	seg.Data = unsafe.Pointer(seg.Ether)
+	return true
+}
+
+// Linearize copies data of all segments to the first one, so packet is
+// not chained any more. Other segments are freed. L3 and L4 pointers remain
+// valid, Data pointer is moved if it pointed to other segment. Return false
+// if first mbuf doesn't have enough space for the whole packet.
+func (packet *Packet) Linearize() bool {
+	if packet.Next == nil {
+		return true
+	}
+	dataOffset, dataFound := packet.offsetOf(uintptr(packet.Data))
+	if low.LinearizeMbuf(packet.CMbuf) == false {
+		return false
+	}
+	packet.Next = nil
+	if dataFound {
+		packet.Data = unsafe.Pointer(packet.Start() + uintptr(dataOffset))
+	}
+	return true
+}
@@ -30,6 +30,49 @@ func calculateDataChecksum(ptr unsafe.Pointer, length, offset int) uint32 {
 	return sum
 }
 
+// sumChained returns not reduced sum of length bytes starting from ptr.
+// Bytes which don't fit into segment are read from following segments
+// of chained packet. Returns false if packet is shorter.
+func (packet *Packet) sumChained(ptr uintptr, length int) (uint32, bool) {
+	start, found := packet.offsetOf(ptr)
+	if !found {
+		return 0, false
+	}
+	var sum uint32
+	odd := false
+	for it := packet.IterateSegments(); it.Valid() && length > 0; it.Next() {
+		data := it.Bytes()
+		if start >= it.Offset()+uint(len(data)) {
+			continue
+		}
+		data = data[start-it.Offset():]
+		n := len(data)
+		if n > length {
+			n = length
+		}
+		part := reduceChecksum(calculateDataChecksum(unsafe.Pointer(&data[0]), n, 0))
+		if odd {
+			// Part starts from the second byte of 16 bit word (RFC 1071)
+			part = SwapBytesUint16(part)
+		}
+		sum += uint32(part)
+		odd = odd != (n&1 != 0)
+		length -= n
+		start += uint(n)
+	}
+	return sum, length == 0
+}
+
+// calculateChainedChecksum is calculateDataChecksum for data which can
+// be located in several segments of chained packet.
+func (packet *Packet) calculateChainedChecksum(ptr unsafe.Pointer, length int) uint32 {
+	if packet.Next == nil {
+		return calculateDataChecksum(ptr, length, 0)
+	}
+	sum, _ := packet.sumChained(uintptr(ptr), length)
+	return sum
+}
+
 // CalculatePseudoHdrIPv4TCPCksum implements one step of TCP checksum calculation. Separately computes checksum
 // for TCP pseudo-header for case if L3 protocol is IPv4.
 // This precalculation is required for checksum compute by hardware offload.
@@ -136,7 +179,7 @@ func CalculateIPv4UDPChecksum(p *Packet) uint16 {
 	udp := p.GetUDPForIPv4()
 	dataLength := SwapBytesUint16(hdr.TotalLength) - IPv4MinLen
 
-	sum := calculateDataChecksum(p.Data, int(dataLength-UDPLen), 0)
+	sum := p.calculateChainedChecksum(p.Data, int(dataLength-UDPLen))
 
 	sum += calculateIPv4AddrChecksum(hdr) +
 		uint32(hdr.NextProtoID) +
@@ -168,7 +211,7 @@ func CalculateIPv4TCPChecksum(p *Packet) uint16 {
 
 	dataLength := SwapBytesUint16(hdr.TotalLength) - IPv4MinLen
 
-	sum := calculateDataChecksum(p.Data, int(dataLength-TCPMinLen), 0)
+	sum := p.calculateChainedChecksum(p.Data, int(dataLength-TCPMinLen))
 
 	sum += calculateIPv4AddrChecksum(hdr) +
 		uint32(hdr.NextProtoID) +
@@ -201,13 +244,13 @@ func calculateIPv6AddrChecksum(hdr *IPv6Hdr) uint32 {
 func CalculateIPv6UDPChecksum(p *Packet) uint16 {
 	hdr := p.GetIPv6()
 	udp := p.GetUDPForIPv6()
-	dataLength := SwapBytesUint16(hdr.PayloadLen)
+	dataLength := p.getL4LenForIPv6()
 
-	sum := calculateDataChecksum(p.Data, int(dataLength-UDPLen), 0)
+	sum := p.calculateChainedChecksum(p.Data, int(dataLength-UDPLen))
 
 	sum += calculateIPv6AddrChecksum(hdr) +
 		uint32(SwapBytesUint16(udp.DgramLen)) +
-		uint32(hdr.Proto) +
+		uint32(UDPNumber) +
 		uint32(SwapBytesUint16(udp.SrcPort)) +
 		uint32(SwapBytesUint16(udp.DstPort)) +
 		uint32(SwapBytesUint16(udp.DgramLen))
@@ -219,13 +262,13 @@ func CalculateIPv6UDPChecksum(p *Packet) uint16 {
 func CalculateIPv6TCPChecksum(p *Packet) uint16 {
 	hdr := p.GetIPv6()
 	tcp := p.GetTCPForIPv6()
-	dataLength := SwapBytesUint16(hdr.PayloadLen)
+	dataLength := p.getL4LenForIPv6()
 
-	sum := calculateDataChecksum(p.Data, int(dataLength-TCPMinLen), 0)
+	sum := p.calculateChainedChecksum(p.Data, int(dataLength-TCPMinLen))
 
 	sum += calculateIPv6AddrChecksum(hdr) +
 		uint32(dataLength) +
-		uint32(hdr.Proto) +
+		uint32(TCPNumber) +
 		calculateTCPChecksum(tcp)
 
 	return ^reduceChecksum(sum)
@@ -236,17 +279,32 @@ func CalculateIPv4ICMPChecksum(p *Packet) uint16 {
 	hdr := p.GetIPv4()
 	dataLength := SwapBytesUint16(hdr.TotalLength) - IPv4MinLen
 
-	sum := calculateDataChecksum(unsafe.Pointer(p.GetICMPForIPv4()), int(dataLength), 0)
+	sum := p.calculateChainedChecksum(unsafe.Pointer(p.GetICMPForIPv4()), int(dataLength))
 
 	return ^reduceChecksum(sum)
 }
 
-// CalculateIPv6ICMPChecksum calculates ICMP checksum in case if L3 protocol is IPv6.
+// CalculateIPv6ICMPChecksum calculates ICMPv6 checksum in case if L3 protocol is IPv6.
+// Unlike ICMP for IPv4 it covers IPv6 pseudo-header. Checksum field
+// should be zero before calculation.
 func CalculateIPv6ICMPChecksum(p *Packet) uint16 {
 	hdr := p.GetIPv6()
-	dataLength := SwapBytesUint16(hdr.PayloadLen)
+	dataLength := p.getL4LenForIPv6()
+
+	sum := p.calculateChainedChecksum(unsafe.Pointer(p.GetICMPForIPv6()), int(dataLength))
+
+	sum += calculateIPv6AddrChecksum(hdr) +
+		uint32(dataLength) +
+		uint32(ICMPv6Number)
+
+	return ^reduceChecksum(sum)
+}
 
-	sum := calculateDataChecksum(unsafe.Pointer(p.GetICMPForIPv6()), int(dataLength), 0)
+// CalculateGREChecksum calculates GRE checksum which covers GRE header
+// and payload. Checksum field should be zero before calculation.
+// L4 supposed to be parsed before.
+func CalculateGREChecksum(p *Packet) uint16 {
+	sum := p.calculateChainedChecksum(p.L4, int(p.getTunnelPayloadLen()))
 
 	return ^reduceChecksum(sum)
 }
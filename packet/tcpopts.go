@@ -0,0 +1,255 @@
+// Copyright 2017 Intel Corporation.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package packet
+
+import (
+	"encoding/binary"
+	"unsafe"
+
+	. "github.com/intel-go/yanff/common"
+)
+
+// TCPSACKBlock is a block of data which was received by sender of SACK
+// option. Edges are sequence numbers in host byte order.
+type TCPSACKBlock struct {
+	Left  uint32 // First sequence number of block
+	Right uint32 // Sequence number following the last byte of block
+}
+
+// TCPOptionIterator walks through options of TCP header. No-Operation
+// options are skipped, iteration stops at End of Option List or at
+// malformed option. Typical usage is:
+//
+//	for it := tcp.IterateOptions(); it.Valid(); it.Next() {
+//		if mss, ok := it.MSS(); ok {
+//			...
+//		}
+//	}
+//
+// Options are accessed in place, so set functions change packet.
+type TCPOptionIterator struct {
+	hdr *TCPHdr
+	opt uintptr // Offset of current option from beginning of TCP header
+	end uintptr // Length of TCP header with options
+}
+
+// IterateOptions returns iterator pointing to the first TCP option.
+// Whole TCP header should be located in packet, for example it is
+// checked by SafeParseL4ForIPv4 and SafeParseL4ForIPv6.
+func (hdr *TCPHdr) IterateOptions() TCPOptionIterator {
+	it := TCPOptionIterator{
+		hdr: hdr,
+		opt: TCPMinLen,
+		end: uintptr(hdr.DataOff&0xf0) >> 2,
+	}
+	it.skipNop()
+	return it
+}
+
+func (it *TCPOptionIterator) skipNop() {
+	for it.opt < it.end && it.Kind() == TCPOptionNop {
+		it.opt++
+	}
+}
+
+// bytes returns TCP header with options.
+func (it *TCPOptionIterator) bytes() []byte {
+	return (*[60]byte)(unsafe.Pointer(it.hdr))[:it.end]
+}
+
+// Valid returns true if iterator points to option.
+func (it *TCPOptionIterator) Valid() bool {
+	if it.opt+2 > it.end || it.Kind() == TCPOptionEnd {
+		return false
+	}
+	length := it.Len()
+	return length >= 2 && it.opt+length <= it.end
+}
+
+// Next moves iterator to the following option.
+func (it *TCPOptionIterator) Next() {
+	it.opt += it.Len()
+	it.skipNop()
+}
+
+// Kind returns kind of current option.
+func (it *TCPOptionIterator) Kind() uint8 {
+	return it.bytes()[it.opt]
+}
+
+// Len returns length of current option including kind and length fields.
+func (it *TCPOptionIterator) Len() uintptr {
+	if it.Kind() == TCPOptionNop || it.Kind() == TCPOptionEnd {
+		return 1
+	}
+	return uintptr(it.bytes()[it.opt+1])
+}
+
+// Data returns data of current option without kind and length fields.
+// Slice points to packet, use SetData to change it.
+func (it *TCPOptionIterator) Data() []byte {
+	return it.bytes()[it.opt+2 : it.opt+it.Len()]
+}
+
+// MSS returns maximum segment size if current option is MSS.
+func (it *TCPOptionIterator) MSS() (uint16, bool) {
+	if it.Kind() != TCPOptionMSS || it.Len() != TCPOptionMSSLen {
+		return 0, false
+	}
+	return binary.BigEndian.Uint16(it.Data()), true
+}
+
+// WindowScale returns shift count if current option is Window Scale.
+func (it *TCPOptionIterator) WindowScale() (uint8, bool) {
+	if it.Kind() != TCPOptionWindowScale || it.Len() != TCPOptionWindowScaleLen {
+		return 0, false
+	}
+	return it.Data()[0], true
+}
+
+// SACKPermitted returns true if current option is SACK Permitted.
+func (it *TCPOptionIterator) SACKPermitted() bool {
+	return it.Kind() == TCPOptionSACKPermitted && it.Len() == TCPOptionSACKPermittedLen
+}
+
+// SACKBlocks returns blocks of data if current option is SACK.
+func (it *TCPOptionIterator) SACKBlocks() ([]TCPSACKBlock, bool) {
+	if it.Kind() != TCPOptionSACK || (it.Len()-TCPOptionSACKMinLen)%TCPSACKBlockLen != 0 {
+		return nil, false
+	}
+	data := it.Data()
+	blocks := make([]TCPSACKBlock, len(data)/TCPSACKBlockLen)
+	for i := range blocks {
+		blocks[i].Left = binary.BigEndian.Uint32(data[i*TCPSACKBlockLen:])
+		blocks[i].Right = binary.BigEndian.Uint32(data[i*TCPSACKBlockLen+4:])
+	}
+	return blocks, true
+}
+
+// Timestamps returns timestamp value and timestamp echo reply if current
+// option is Timestamps.
+func (it *TCPOptionIterator) Timestamps() (uint32, uint32, bool) {
+	if it.Kind() != TCPOptionTimestamps || it.Len() != TCPOptionTimestampsLen {
+		return 0, 0, false
+	}
+	data := it.Data()
+	return binary.BigEndian.Uint32(data), binary.BigEndian.Uint32(data[4:]), true
+}
+
+// SetData replaces data of current option and adjusts TCP checksum.
+// Length of data can't be changed. Return false if length is different.
+func (it *TCPOptionIterator) SetData(data []byte) bool {
+	if uintptr(len(data)) != it.Len()-2 {
+		return false
+	}
+	it.write(it.opt+2, data)
+	return true
+}
+
+// SetMSS sets maximum segment size if current option is MSS.
+func (it *TCPOptionIterator) SetMSS(mss uint16) bool {
+	if _, ok := it.MSS(); !ok {
+		return false
+	}
+	var data [TCPOptionMSSLen - 2]byte
+	binary.BigEndian.PutUint16(data[:], mss)
+	return it.SetData(data[:])
+}
+
+// SetWindowScale sets shift count if current option is Window Scale.
+func (it *TCPOptionIterator) SetWindowScale(shift uint8) bool {
+	if _, ok := it.WindowScale(); !ok {
+		return false
+	}
+	return it.SetData([]byte{shift})
+}
+
+// SetSACKBlocks sets blocks of data if current option is SACK. Number of
+// blocks can't be changed.
+func (it *TCPOptionIterator) SetSACKBlocks(blocks []TCPSACKBlock) bool {
+	if _, ok := it.SACKBlocks(); !ok {
+		return false
+	}
+	data := make([]byte, len(blocks)*TCPSACKBlockLen)
+	for i := range blocks {
+		binary.BigEndian.PutUint32(data[i*TCPSACKBlockLen:], blocks[i].Left)
+		binary.BigEndian.PutUint32(data[i*TCPSACKBlockLen+4:], blocks[i].Right)
+	}
+	return it.SetData(data)
+}
+
+// SetTimestamps sets timestamp value and timestamp echo reply if current
+// option is Timestamps.
+func (it *TCPOptionIterator) SetTimestamps(value, echo uint32) bool {
+	if _, _, ok := it.Timestamps(); !ok {
+		return false
+	}
+	var data [TCPOptionTimestampsLen - 2]byte
+	binary.BigEndian.PutUint32(data[:], value)
+	binary.BigEndian.PutUint32(data[4:], echo)
+	return it.SetData(data[:])
+}
+
+// Remove replaces current option with No-Operation options and adjusts
+// TCP checksum. Length of TCP header is not changed.
+func (it *TCPOptionIterator) Remove() {
+	nops := make([]byte, it.Len())
+	for i := range nops {
+		nops[i] = TCPOptionNop
+	}
+	it.write(it.opt, nops)
+}
+
+// write copies bytes to TCP header starting from offset and adjusts
+// checksum for each changed 16 bit word. Nothing is adjusted if hardware
+// offloading is used because options are not part of pseudo header.
+func (it *TCPOptionIterator) write(offset uintptr, data []byte) {
+	raw := it.bytes()
+	start := offset &^ 1
+	end := (offset + uintptr(len(data)) + 1) &^ 1
+	old := make([]byte, end-start)
+	copy(old, raw[start:end])
+	copy(raw[offset:], data)
+	if hwtxchecksum {
+		return
+	}
+	cksum := SwapBytesUint16(it.hdr.Cksum)
+	for i := uintptr(0); i < end-start; i += 2 {
+		cksum = UpdateChecksum16(cksum, binary.BigEndian.Uint16(old[i:]), binary.BigEndian.Uint16(raw[start+i:]))
+	}
+	it.hdr.Cksum = SwapBytesUint16(cksum)
+}
+
+// ClampMSS reduces maximum segment size in MSS option to mss if it is
+// higher and adjusts checksum. Returns true if option was changed. MSS
+// option is not added if it is absent.
+func (hdr *TCPHdr) ClampMSS(mss uint16) bool {
+	for it := hdr.IterateOptions(); it.Valid(); it.Next() {
+		if current, ok := it.MSS(); ok && current > mss {
+			return it.SetMSS(mss)
+		}
+	}
+	return false
+}
+
+// ClampTCPMSS parses packet and reduces MSS option of TCP SYN segment
+// to mss like ClampMSS. Packets which are not TCP SYN segments or can't
+// be parsed are not changed. Returns true if option was changed.
+func (packet *Packet) ClampTCPMSS(mss uint16) bool {
+	ipv4, ipv6, err := packet.SafeParseL3()
+	if err != nil {
+		return false
+	}
+	var tcp *TCPHdr
+	if ipv4 != nil {
+		tcp, _, _, err = packet.SafeParseL4ForIPv4()
+	} else if ipv6 != nil {
+		tcp, _, _, err = packet.SafeParseL4ForIPv6()
+	}
+	if err != nil || tcp == nil || tcp.TCPFlags&TCPFlagSyn == 0 {
+		return false
+	}
+	return tcp.ClampMSS(mss)
+}
@@ -0,0 +1,243 @@
+// Copyright 2017 Intel Corporation.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package packet
+
+import (
+	"unsafe"
+
+	. "github.com/intel-go/yanff/common"
+	"github.com/intel-go/yanff/low"
+)
+
+// TunnelEndpoints describes outer headers which are built by tunnel
+// encapsulation functions like EncapVXLAN. Outer IPv4 header is built
+// unless IPv6 is set. Inner packet checksums should be calculated before
+// encapsulation because hardware offloading is used only for outer headers.
+type TunnelEndpoints struct {
+	SrcMAC  [EtherAddrLen]uint8 // Outer source MAC address
+	DstMAC  [EtherAddrLen]uint8 // Outer destination MAC address
+	IPv6    bool                // Build outer IPv6 header instead of IPv4
+	SrcIPv4 uint32              // Outer IPv4 source address in IPv4Hdr field format
+	DstIPv4 uint32              // Outer IPv4 destination address in IPv4Hdr field format
+	SrcIPv6 [IPv6AddrLen]uint8  // Outer IPv6 source address
+	DstIPv6 [IPv6AddrLen]uint8  // Outer IPv6 destination address
+	TTL     uint8               // Outer TTL or hop limit, 64 is used if zero
+	// Outer UDP source port in host byte order. If zero it is calculated
+	// from inner addresses and ports, so packets of one flow use one port.
+	SrcPort uint16
+}
+
+func (endpoints *TunnelEndpoints) l3Len() uint {
+	if endpoints.IPv6 {
+		return IPv6Len
+	}
+	return IPv4MinLen
+}
+
+// initOuterIP fills outer Ethernet and IP headers in space which was
+// already added to the beginning of packet and parses packet up to
+// outer L4 header. Outer IPv4 checksum is set by setOuterIPv4Checksum.
+func initOuterIP(packet *Packet, endpoints *TunnelEndpoints, proto uint8) {
+	packet.Ether.DAddr = endpoints.DstMAC
+	packet.Ether.SAddr = endpoints.SrcMAC
+	ttl := endpoints.TTL
+	if ttl == 0 {
+		ttl = 64
+	}
+	payloadLen := packet.GetPacketLen() - EtherLen - endpoints.l3Len()
+	if endpoints.IPv6 {
+		packet.Ether.EtherType = SwapBytesUint16(IPV6Number)
+		packet.ParseL3()
+		ipv6 := packet.GetIPv6()
+		ipv6.VtcFlow = SwapBytesUint32(0x60 << 24) // IP version
+		ipv6.PayloadLen = SwapBytesUint16(uint16(payloadLen))
+		ipv6.Proto = proto
+		ipv6.HopLimits = ttl
+		ipv6.SrcAddr = endpoints.SrcIPv6
+		ipv6.DstAddr = endpoints.DstIPv6
+	} else {
+		packet.Ether.EtherType = SwapBytesUint16(IPV4Number)
+		packet.ParseL3()
+		ipv4 := packet.GetIPv4()
+		ipv4.VersionIhl = 0x45 // Ipv4, IHL = 5 (min header len)
+		ipv4.TypeOfService = 0
+		ipv4.TotalLength = SwapBytesUint16(uint16(IPv4MinLen + payloadLen))
+		ipv4.PacketID = 0
+		ipv4.FragmentOffset = 0
+		ipv4.TimeToLive = ttl
+		ipv4.NextProtoID = proto
+		ipv4.HdrChecksum = 0
+		ipv4.SrcAddr = endpoints.SrcIPv4
+		ipv4.DstAddr = endpoints.DstIPv4
+	}
+	packet.L4 = unsafe.Pointer(uintptr(packet.L3) + uintptr(endpoints.l3Len()))
+	packet.Data = packet.L4
+}
+
+// setOuterIPv4Checksum calculates outer IPv4 header checksum or sets
+// hardware offloading flags for it.
+func setOuterIPv4Checksum(packet *Packet) {
+	if hwtxchecksum {
+		low.SetTXIPv4OLFlags(packet.CMbuf, EtherLen, IPv4MinLen)
+	} else {
+		packet.GetIPv4().HdrChecksum = SwapBytesUint16(CalculateIPv4Checksum(packet))
+	}
+}
+
+// initOuterUDP fills outer Ethernet, IP and UDP headers in space which
+// was already added to the beginning of packet. srcPort should be in host
+// byte order. Data is set to the beginning of UDP payload.
+func initOuterUDP(packet *Packet, endpoints *TunnelEndpoints, srcPort, dstPort uint16) {
+	initOuterIP(packet, endpoints, UDPNumber)
+	udp := (*UDPHdr)(packet.L4)
+	udp.SrcPort = SwapBytesUint16(srcPort)
+	udp.DstPort = SwapBytesUint16(dstPort)
+	udp.DgramLen = SwapBytesUint16(uint16(packet.GetPacketLen() - EtherLen - endpoints.l3Len()))
+	udp.DgramCksum = 0
+	packet.Data = unsafe.Pointer(uintptr(packet.L4) + UDPLen)
+
+	if !endpoints.IPv6 {
+		// Zero UDP checksum is recommended for IPv4 tunnels (RFC 7348)
+		setOuterIPv4Checksum(packet)
+		return
+	}
+	// Zero UDP checksum is not allowed by default for IPv6
+	if hwtxchecksum {
+		udp.DgramCksum = SwapBytesUint16(CalculatePseudoHdrIPv6UDPCksum(packet.GetIPv6(), udp))
+		low.SetTXIPv6UDPOLFlags(packet.CMbuf, EtherLen, IPv6Len)
+	} else {
+		cksum := CalculateIPv6UDPChecksum(packet)
+		if cksum == 0 {
+			cksum = 0xffff
+		}
+		udp.DgramCksum = SwapBytesUint16(cksum)
+	}
+}
+
+// tunnelSrcPort returns outer UDP source port from dynamic port range
+// which is calculated from inner L3 addresses and L4 ports of packet.
+// Packet should contain inner Ethernet frame.
+func (packet *Packet) tunnelSrcPort() uint16 {
+	var hash uint32 = 2166136261
+	ipv4, ipv6 := packet.ParseAllKnownL3()
+	if ipv4 != nil {
+		hash = hashBytes(hash, uintptr(unsafe.Pointer(&ipv4.SrcAddr)), 2*IPv4AddrLen)
+		hash = hashBytes(hash, uintptr(unsafe.Pointer(&ipv4.NextProtoID)), 1)
+		if ipv4.NextProtoID == TCPNumber || ipv4.NextProtoID == UDPNumber {
+			packet.ParseL4ForIPv4()
+			hash = hashBytes(hash, uintptr(packet.L4), 4)
+		}
+	} else if ipv6 != nil {
+		hash = hashBytes(hash, uintptr(unsafe.Pointer(&ipv6.SrcAddr)), 2*IPv6AddrLen)
+		if proto := packet.GetL4ProtoForIPv6(); proto == TCPNumber || proto == UDPNumber {
+			packet.ParseL4ForIPv6()
+			hash = hashBytes(hash, uintptr(packet.L4), 4)
+		}
+	} else {
+		hash = hashBytes(hash, packet.Start(), 2*EtherAddrLen)
+	}
+	return uint16(49152 + hash%16384)
+}
+
+// hashBytes continues FNV-1a hash with length bytes from ptr.
+func hashBytes(hash uint32, ptr uintptr, length uintptr) uint32 {
+	for i := uintptr(0); i < length; i++ {
+		hash ^= uint32(*(*uint8)(unsafe.Pointer(ptr + i)))
+		hash *= 16777619
+	}
+	return hash
+}
+
+// parseTunnelUDP parses L3 and L4 headers of outer packet. Returns
+// outer UDP header or nil if outer L4 is not UDP.
+func (packet *Packet) parseTunnelUDP() *UDPHdr {
+	ipv4, ipv6 := packet.ParseAllKnownL3()
+	if ipv4 != nil {
+		_, udp, _ := packet.ParseAllKnownL4ForIPv4()
+		return udp
+	} else if ipv6 != nil {
+		_, udp, _ := packet.ParseAllKnownL4ForIPv6()
+		return udp
+	}
+	return nil
+}
+
+// getTunnelUDP returns UDP header for both IPv4 and IPv6 packets.
+// L4 supposed to be parsed before.
+func (packet *Packet) getTunnelUDP() *UDPHdr {
+	if packet.GetIPv4() != nil {
+		return packet.GetUDPForIPv4()
+	} else if packet.GetIPv6() != nil {
+		return packet.GetUDPForIPv6()
+	}
+	return nil
+}
+
+// initInnerView makes inner packet a view of Ethernet frame which
+// starts at given address inside packet.
+func (packet *Packet) initInnerView(inner *Packet, start uintptr) {
+	inner.L3 = nil
+	inner.L4 = nil
+	inner.Data = nil
+	inner.Ether = (*EtherHdr)(unsafe.Pointer(start))
+	inner.CMbuf = packet.CMbuf
+	inner.Next = nil
+}
+
+// decapTunnel removes all headers before inner Ethernet frame which starts
+// at given address and parses L3 of inner frame.
+func (packet *Packet) decapTunnel(start uintptr) bool {
+	if packet.DecapsulateHead(0, uint(start-packet.Start())) == false {
+		return false
+	}
+	packet.ParseL3()
+	return true
+}
+
+// replaceL2 replaces L2 header of packet including VLAN tags with
+// space of given length for outer headers of L3 tunnel.
+func (packet *Packet) replaceL2(length uint) bool {
+	l2len := uint(packet.l2Len())
+	if length >= l2len {
+		return packet.EncapsulateHead(0, length-l2len)
+	}
+	return packet.DecapsulateHead(0, l2len-length)
+}
+
+// decapL3Tunnel removes all headers between L2 header and inner L3 packet
+// which starts at given address. EtherType should have network byte order.
+// L3 pointer is set to inner L3 header.
+func (packet *Packet) decapL3Tunnel(start uintptr, etherType uint16) bool {
+	l2len, _ := packet.skipVLAN()
+	if packet.DecapsulateHead(uint(l2len), uint(start-packet.Start()-l2len)) == false {
+		return false
+	}
+	*(*uint16)(unsafe.Pointer(packet.Start() + l2len - 2)) = etherType
+	packet.ParseL3()
+	return true
+}
+
+// parseTunnelProto returns protocol which follows outer IPv4 or IPv6 header
+// and parses outer L4. Returns IPv6NoNextHeader if packet is not IP.
+func (packet *Packet) parseTunnelProto() uint8 {
+	ipv4, ipv6 := packet.ParseAllKnownL3()
+	if ipv4 != nil {
+		packet.ParseL4ForIPv4()
+		return ipv4.NextProtoID
+	} else if ipv6 != nil {
+		packet.ParseL4ForIPv6()
+		return packet.getL4TypeForIPv6()
+	}
+	return IPv6NoNextHeader
+}
+
+// getTunnelPayloadLen returns length of outer IP payload after extension
+// headers. L4 supposed to be parsed before.
+func (packet *Packet) getTunnelPayloadLen() uint {
+	if ipv4 := packet.GetIPv4(); ipv4 != nil {
+		return uint(SwapBytesUint16(ipv4.TotalLength)) - uint(uintptr(packet.L4)-uintptr(packet.L3))
+	}
+	return uint(packet.getL4LenForIPv6())
+}
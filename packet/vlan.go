@@ -0,0 +1,211 @@
+// Copyright 2017 Intel Corporation.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package packet
+
+import (
+	"fmt"
+	"unsafe"
+
+	. "github.com/intel-go/yanff/common"
+	"github.com/intel-go/yanff/low"
+)
+
+// VLANHdr is 802.1Q VLAN tag. It is placed right after EtherHdr, so
+// EtherHdr.EtherType contains TPID (VLANNumber or QinQNumber) and VLANHdr.EtherType
+// contains EtherType of encapsulated frame or TPID of inner tag in case of QinQ.
+type VLANHdr struct {
+	TCI       uint16 // Tag control information: priority, DEI and VLAN ID
+	EtherType uint16 // Frame type after this tag
+}
+
+func (hdr *VLANHdr) String() string {
+	r0 := "    VLAN tag\n"
+	r1 := fmt.Sprintf("    VLAN ID: %d\n", hdr.GetVLANTagIdentifier())
+	r2 := fmt.Sprintf("    VLAN Priority: %d\n", hdr.GetPriority())
+	return r0 + r1 + r2
+}
+
+// GetVLANTagIdentifier returns VLAN ID (12 lower bits of TCI) in host byte order.
+func (hdr *VLANHdr) GetVLANTagIdentifier() uint16 {
+	return SwapBytesUint16(hdr.TCI) & 0x0fff
+}
+
+// SetVLANTagIdentifier sets VLAN ID (12 lower bits of TCI). Other TCI bits are not changed.
+func (hdr *VLANHdr) SetVLANTagIdentifier(id uint16) {
+	hdr.TCI = SwapBytesUint16(SwapBytesUint16(hdr.TCI)&0xf000 | id&0x0fff)
+}
+
+// GetPriority returns priority code point (3 upper bits of TCI).
+func (hdr *VLANHdr) GetPriority() uint8 {
+	return uint8(SwapBytesUint16(hdr.TCI) >> 13)
+}
+
+// SetPriority sets priority code point (3 upper bits of TCI). Other TCI bits are not changed.
+func (hdr *VLANHdr) SetPriority(pcp uint8) {
+	hdr.TCI = SwapBytesUint16(SwapBytesUint16(hdr.TCI)&0x1fff | uint16(pcp&0x7)<<13)
+}
+
+// maxVLANTags limits number of VLAN tags which are skipped in header.
+// It is more than two tags of QinQ, so packets with more tags are still
+// parsed.
+const maxVLANTags = 4
+
+func isVLANType(etherType uint16) bool {
+	return etherType == SwapBytesUint16(VLANNumber) || etherType == SwapBytesUint16(QinQNumber)
+}
+
+// skipVLAN returns length of Ethernet header with all VLAN tags and
+// EtherType which follows them. Tags are skipped up to maxVLANTags and
+// only inside first segment, VLAN TPID is returned if tags are left.
+func (packet *Packet) skipVLAN() (uintptr, uint16) {
+	length := uintptr(EtherLen)
+	etherType := packet.Ether.EtherType
+	for i := 0; i < maxVLANTags && isVLANType(etherType); i++ {
+		if length+VLANLen > uintptr(packet.GetPacketSegmentLen()) {
+			break
+		}
+		etherType = (*VLANHdr)(unsafe.Pointer(packet.Start() + length)).EtherType
+		length += VLANLen
+	}
+	return length, etherType
+}
+
+// l2Len returns length of L2 header including all VLAN tags and MPLS labels.
+func (packet *Packet) l2Len() uintptr {
+	length, etherType := packet.skipVLAN()
+	if etherType == SwapBytesUint16(MPLSNumber) {
+		length, _ = packet.skipMPLS(length)
+	}
+	return length
+}
+
+// GetEtherType returns EtherType of frame skipping all VLAN tags. Result
+// has network byte order as EtherHdr.EtherType field. For MPLS packets
+// EtherType of packet below label stack is returned.
+func (packet *Packet) GetEtherType() uint16 {
+	length, etherType := packet.skipVLAN()
+	if etherType == SwapBytesUint16(MPLSNumber) {
+		_, etherType = packet.skipMPLS(length)
+	}
+	return etherType
+}
+
+// GetVLAN returns pointer to outer VLAN tag or nil if packet is not tagged.
+func (packet *Packet) GetVLAN() *VLANHdr {
+	if isVLANType(packet.Ether.EtherType) && packet.GetPacketSegmentLen() >= EtherLen+VLANLen {
+		return (*VLANHdr)(unsafe.Pointer(packet.Start() + EtherLen))
+	}
+	return nil
+}
+
+// GetInnerVLAN returns pointer to inner VLAN tag of double tagged (QinQ)
+// packet or nil if packet has less than two tags.
+func (packet *Packet) GetInnerVLAN() *VLANHdr {
+	outer := packet.GetVLAN()
+	if outer != nil && isVLANType(outer.EtherType) && packet.GetPacketSegmentLen() >= EtherLen+2*VLANLen {
+		return (*VLANHdr)(unsafe.Pointer(packet.Start() + EtherLen + VLANLen))
+	}
+	return nil
+}
+
+// PushVLAN adds new outer 802.1Q tag with given TCI in host byte order.
+// Tag is inserted after MAC addresses, so L3, L4 and Data pointers
+// remain valid. Return false if error.
+func (packet *Packet) PushVLAN(tci uint16) bool {
+	return packet.PushVLANWithTPID(VLANNumber, tci)
+}
+
+// PushVLANWithTPID is the same as PushVLAN but allows to set TPID of
+// new tag, for example QinQNumber for service tag of double tagged packet.
+func (packet *Packet) PushVLANWithTPID(tpid uint16, tci uint16) bool {
+	if packet.EncapsulateHead(EtherAddrLen*2, VLANLen) == false {
+		return false
+	}
+	packet.Ether.EtherType = SwapBytesUint16(tpid)
+	packet.GetVLAN().TCI = SwapBytesUint16(tci)
+	return true
+}
+
+// PopVLAN removes outer VLAN tag. L3, L4 and Data pointers remain valid.
+// Return false if packet is not tagged or if error.
+func (packet *Packet) PopVLAN() bool {
+	if packet.GetVLAN() == nil {
+		return false
+	}
+	return packet.DecapsulateHead(EtherAddrLen*2, VLANLen)
+}
+
+func initVLAN(packet *Packet, tci uint16) bool {
+	if packet.PushVLAN(tci) == false {
+		LogWarning(Debug, "initVLAN: Cannot prepend VLAN tag")
+		return false
+	}
+	if hwtxchecksum {
+		low.SetTXL2Len(packet.CMbuf, uint32(packet.l2Len()))
+	}
+	return true
+}
+
+// All following functions are the same as corresponding InitEmpty functions
+// but additionally insert 802.1Q tag with given TCI after MAC addresses.
+
+// InitEmptyVLANPacket initializes input packet with preallocated plSize of bytes for payload
+// and init pointers to Ethernet header and VLAN tag.
+func InitEmptyVLANPacket(packet *Packet, plSize uint, tci uint16) bool {
+	if InitEmptyPacket(packet, plSize) == false {
+		return false
+	}
+	// Frame type is unknown here and should be set by user after tag
+	packet.Ether.EtherType = 0
+	return initVLAN(packet, tci)
+}
+
+// InitEmptyIPv4VLANPacket initializes input packet with preallocated plSize of bytes for payload
+// and init pointers to Ethernet, VLAN and IPv4 headers.
+func InitEmptyIPv4VLANPacket(packet *Packet, plSize uint, tci uint16) bool {
+	return InitEmptyIPv4Packet(packet, plSize) && initVLAN(packet, tci)
+}
+
+// InitEmptyIPv6VLANPacket initializes input packet with preallocated plSize of bytes for payload
+// and init pointers to Ethernet, VLAN and IPv6 headers.
+func InitEmptyIPv6VLANPacket(packet *Packet, plSize uint, tci uint16) bool {
+	return InitEmptyIPv6Packet(packet, plSize) && initVLAN(packet, tci)
+}
+
+// InitEmptyIPv4TCPVLANPacket initializes input packet with preallocated plSize of bytes for payload
+// and init pointers to Ethernet, VLAN, IPv4 and TCP headers.
+func InitEmptyIPv4TCPVLANPacket(packet *Packet, plSize uint, tci uint16) bool {
+	return InitEmptyIPv4TCPPacket(packet, plSize) && initVLAN(packet, tci)
+}
+
+// InitEmptyIPv4UDPVLANPacket initializes input packet with preallocated plSize of bytes for payload
+// and init pointers to Ethernet, VLAN, IPv4 and UDP headers.
+func InitEmptyIPv4UDPVLANPacket(packet *Packet, plSize uint, tci uint16) bool {
+	return InitEmptyIPv4UDPPacket(packet, plSize) && initVLAN(packet, tci)
+}
+
+// InitEmptyIPv4ICMPVLANPacket initializes input packet with preallocated plSize of bytes for payload
+// and init pointers to Ethernet, VLAN, IPv4 and ICMP headers.
+func InitEmptyIPv4ICMPVLANPacket(packet *Packet, plSize uint, tci uint16) bool {
+	return InitEmptyIPv4ICMPPacket(packet, plSize) && initVLAN(packet, tci)
+}
+
+// InitEmptyIPv6TCPVLANPacket initializes input packet with preallocated plSize of bytes for payload
+// and init pointers to Ethernet, VLAN, IPv6 and TCP headers.
+func InitEmptyIPv6TCPVLANPacket(packet *Packet, plSize uint, tci uint16) bool {
+	return InitEmptyIPv6TCPPacket(packet, plSize) && initVLAN(packet, tci)
+}
+
+// InitEmptyIPv6UDPVLANPacket initializes input packet with preallocated plSize of bytes for payload
+// and init pointers to Ethernet, VLAN, IPv6 and UDP headers.
+func InitEmptyIPv6UDPVLANPacket(packet *Packet, plSize uint, tci uint16) bool {
+	return InitEmptyIPv6UDPPacket(packet, plSize) && initVLAN(packet, tci)
+}
+
+// InitEmptyIPv6ICMPVLANPacket initializes input packet with preallocated plSize of bytes for payload
+// and init pointers to Ethernet, VLAN, IPv6 and ICMP headers.
+func InitEmptyIPv6ICMPVLANPacket(packet *Packet, plSize uint, tci uint16) bool {
+	return InitEmptyIPv6ICMPPacket(packet, plSize) && initVLAN(packet, tci)
+}
@@ -0,0 +1,201 @@
+// Copyright 2017 Intel Corporation.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package packet
+
+import (
+	"fmt"
+	"unsafe"
+
+	. "github.com/intel-go/yanff/common"
+)
+
+// vxlanFlagI is VXLAN flag which means that VNI is valid
+const vxlanFlagI = 0x08000000
+
+// VXLANHdr is VXLAN header (RFC 7348). It is placed after outer UDP header
+// and followed by inner Ethernet frame.
+type VXLANHdr struct {
+	Flags uint32 // I flag and reserved bits
+	VNI   uint32 // VXLAN network identifier in 24 upper bits and reserved byte
+}
+
+func (hdr *VXLANHdr) String() string {
+	r0 := "            Tunnel protocol: VXLAN\n"
+	r1 := fmt.Sprintf("            VXLAN VNI: %d\n", hdr.GetVNI())
+	return r0 + r1
+}
+
+// GetVNI returns VXLAN network identifier in host byte order.
+func (hdr *VXLANHdr) GetVNI() uint32 {
+	return SwapBytesUint32(hdr.VNI) >> 8
+}
+
+// SetVNI sets VXLAN network identifier given in host byte order.
+func (hdr *VXLANHdr) SetVNI(vni uint32) {
+	hdr.VNI = SwapBytesUint32(vni << 8)
+}
+
+// GeneveHdr is fixed part of Geneve header (RFC 8926). It is placed after
+// outer UDP header and followed by variable length options and inner frame.
+type GeneveHdr struct {
+	VerOptLen    uint8  // Version in 2 upper bits and length of options in 4 bytes units
+	Flags        uint8  // OAM and critical options flags
+	ProtocolType uint16 // EtherType of inner frame, TEBNumber for Ethernet
+	VNI          uint32 // Virtual network identifier in 24 upper bits and reserved byte
+}
+
+func (hdr *GeneveHdr) String() string {
+	r0 := "            Tunnel protocol: Geneve\n"
+	r1 := fmt.Sprintf("            Geneve VNI: %d\n", hdr.GetVNI())
+	r2 := fmt.Sprintf("            Geneve options length: %d\n", hdr.GetOptionsLen())
+	return r0 + r1 + r2
+}
+
+// GetVNI returns Geneve virtual network identifier in host byte order.
+func (hdr *GeneveHdr) GetVNI() uint32 {
+	return SwapBytesUint32(hdr.VNI) >> 8
+}
+
+// SetVNI sets Geneve virtual network identifier given in host byte order.
+func (hdr *GeneveHdr) SetVNI(vni uint32) {
+	hdr.VNI = SwapBytesUint32(vni << 8)
+}
+
+// GetOptionsLen returns length of Geneve options in bytes.
+func (hdr *GeneveHdr) GetOptionsLen() uint {
+	return uint(hdr.VerOptLen&0x3f) << 2
+}
+
+// GetOptions returns Geneve options as slice which points to packet data.
+func (hdr *GeneveHdr) GetOptions() []byte {
+	start := uintptr(unsafe.Pointer(hdr)) + GeneveMinLen
+	return (*[1 << 8]byte)(unsafe.Pointer(start))[:hdr.GetOptionsLen()]
+}
+
+// GetVXLAN ensures if L4 type is UDP with VXLANPort destination port and
+// cast UDP payload to *VXLANHdr type. L4 supposed to be parsed before.
+func (packet *Packet) GetVXLAN() *VXLANHdr {
+	udp := packet.getTunnelUDP()
+	if udp == nil || udp.DstPort != SwapBytesUint16(VXLANPort) ||
+		SwapBytesUint16(udp.DgramLen) < UDPLen+VXLANLen+EtherLen {
+		return nil
+	}
+	return (*VXLANHdr)(unsafe.Pointer(uintptr(packet.L4) + UDPLen))
+}
+
+// GetGeneve ensures if L4 type is UDP with GenevePort destination port and
+// cast UDP payload to *GeneveHdr type. L4 supposed to be parsed before.
+func (packet *Packet) GetGeneve() *GeneveHdr {
+	udp := packet.getTunnelUDP()
+	if udp == nil || udp.DstPort != SwapBytesUint16(GenevePort) ||
+		SwapBytesUint16(udp.DgramLen) < UDPLen+GeneveMinLen {
+		return nil
+	}
+	geneve := (*GeneveHdr)(unsafe.Pointer(uintptr(packet.L4) + UDPLen))
+	if uint(SwapBytesUint16(udp.DgramLen)) < UDPLen+GeneveMinLen+geneve.GetOptionsLen() {
+		return nil
+	}
+	return geneve
+}
+
+// GetVXLANInnerPacket fills inner with view of Ethernet frame encapsulated
+// into VXLAN. View shares mbuf with packet, so only parsing and header access
+// functions should be used with it. L4 supposed to be parsed before.
+// Return false if packet is not VXLAN.
+func (packet *Packet) GetVXLANInnerPacket(inner *Packet) bool {
+	vxlan := packet.GetVXLAN()
+	if vxlan == nil {
+		return false
+	}
+	packet.initInnerView(inner, uintptr(unsafe.Pointer(vxlan))+VXLANLen)
+	return true
+}
+
+// GetGeneveInnerPacket fills inner with view of Ethernet frame encapsulated
+// into Geneve in the same way as GetVXLANInnerPacket. Return false if packet
+// is not Geneve or if it doesn't contain Ethernet frame.
+func (packet *Packet) GetGeneveInnerPacket(inner *Packet) bool {
+	geneve := packet.GetGeneve()
+	if geneve == nil || geneve.ProtocolType != SwapBytesUint16(TEBNumber) {
+		return false
+	}
+	packet.initInnerView(inner, uintptr(unsafe.Pointer(geneve))+uintptr(GeneveMinLen+geneve.GetOptionsLen()))
+	return true
+}
+
+// EncapVXLAN encapsulates packet into VXLAN with given VNI. Outer Ethernet,
+// IP and UDP headers are built from endpoints, their lengths and checksums
+// are set. After encapsulation packet is parsed up to outer L4 and Data
+// points to VXLAN header. Return false if error.
+func (packet *Packet) EncapVXLAN(endpoints *TunnelEndpoints, vni uint32) bool {
+	srcPort := endpoints.SrcPort
+	if srcPort == 0 {
+		srcPort = packet.tunnelSrcPort()
+	}
+	outerLen := EtherLen + endpoints.l3Len() + UDPLen
+	if packet.EncapsulateHead(0, outerLen+VXLANLen) == false {
+		return false
+	}
+	vxlan := (*VXLANHdr)(unsafe.Pointer(packet.Start() + uintptr(outerLen)))
+	vxlan.Flags = SwapBytesUint32(vxlanFlagI)
+	vxlan.SetVNI(vni)
+	initOuterUDP(packet, endpoints, srcPort, VXLANPort)
+	return true
+}
+
+// EncapGeneve encapsulates packet into Geneve with given VNI and options.
+// Options should be already encoded and have length multiple of 4 bytes.
+// Outer headers are built in the same way as in EncapVXLAN.
+// Return false if error.
+func (packet *Packet) EncapGeneve(endpoints *TunnelEndpoints, vni uint32, options []byte) bool {
+	if len(options)&3 != 0 || len(options) > 0x3f<<2 {
+		LogWarning(Debug, "EncapGeneve: Incorrect length of options", len(options))
+		return false
+	}
+	srcPort := endpoints.SrcPort
+	if srcPort == 0 {
+		srcPort = packet.tunnelSrcPort()
+	}
+	outerLen := EtherLen + endpoints.l3Len() + UDPLen
+	if packet.EncapsulateHead(0, outerLen+GeneveMinLen+uint(len(options))) == false {
+		return false
+	}
+	geneve := (*GeneveHdr)(unsafe.Pointer(packet.Start() + uintptr(outerLen)))
+	geneve.VerOptLen = uint8(len(options) >> 2)
+	geneve.Flags = 0
+	geneve.ProtocolType = SwapBytesUint16(TEBNumber)
+	geneve.SetVNI(vni)
+	copy(geneve.GetOptions(), options)
+	initOuterUDP(packet, endpoints, srcPort, GenevePort)
+	return true
+}
+
+// DecapVXLAN removes outer Ethernet, IP, UDP and VXLAN headers, so inner
+// Ethernet frame becomes packet. L3 pointer is set to inner L3 header.
+// Return false if packet is not VXLAN or if error.
+func (packet *Packet) DecapVXLAN() bool {
+	if packet.parseTunnelUDP() == nil {
+		return false
+	}
+	vxlan := packet.GetVXLAN()
+	if vxlan == nil {
+		return false
+	}
+	return packet.decapTunnel(uintptr(unsafe.Pointer(vxlan)) + VXLANLen)
+}
+
+// DecapGeneve removes outer Ethernet, IP, UDP and Geneve headers with
+// options in the same way as DecapVXLAN. Return false if packet is not
+// Geneve with inner Ethernet frame or if error.
+func (packet *Packet) DecapGeneve() bool {
+	if packet.parseTunnelUDP() == nil {
+		return false
+	}
+	var inner Packet
+	if !packet.GetGeneveInnerPacket(&inner) {
+		return false
+	}
+	return packet.decapTunnel(inner.Start())
+}
@@ -0,0 +1,117 @@
+// Copyright 2017 Intel Corporation.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package pcap
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+// Compression is compression format of capture stream.
+type Compression int
+
+// Values of Compression
+const (
+	NoCompression Compression = iota
+	Gzip
+	Zstd
+)
+
+const zstdMagic = 0xfd2fb528
+
+// CompressionFromName returns compression format according to extension
+// of file name: ".gz" for gzip and ".zst" for zstd.
+func CompressionFromName(name string) Compression {
+	switch {
+	case strings.HasSuffix(name, ".gz"):
+		return Gzip
+	case strings.HasSuffix(name, ".zst"):
+		return Zstd
+	}
+	return NoCompression
+}
+
+// Extension returns file name extension of compression format.
+func (c Compression) Extension() string {
+	switch c {
+	case Gzip:
+		return ".gz"
+	case Zstd:
+		return ".zst"
+	}
+	return ""
+}
+
+type flusher interface {
+	Flush() error
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// ErrNoZstd is returned for zstd streams if zstd support isn't registered.
+var ErrNoZstd = errors.New("pcap: zstd is not supported, import github.com/intel-go/yanff/pcap/zstd")
+
+var newZstdWriter func(io.Writer) (io.WriteCloser, error)
+var newZstdReader func(io.Reader) (io.ReadCloser, error)
+
+// RegisterZstd sets functions which create zstd compressor and
+// decompressor. Package pcap/zstd calls it when it is imported, so zstd
+// dependency is needed only by applications which use zstd.
+func RegisterZstd(newWriter func(io.Writer) (io.WriteCloser, error), newReader func(io.Reader) (io.ReadCloser, error)) {
+	newZstdWriter = newWriter
+	newZstdReader = newReader
+}
+
+// NewCompressor returns writer which compresses data to w. Close should be
+// called to finish compressed stream, it doesn't close w. Zstd compression
+// requires package pcap/zstd to be imported.
+func NewCompressor(w io.Writer, c Compression) (io.WriteCloser, error) {
+	switch c {
+	case NoCompression:
+		return nopWriteCloser{w}, nil
+	case Gzip:
+		return gzip.NewWriter(w), nil
+	case Zstd:
+		if newZstdWriter == nil {
+			return nil, ErrNoZstd
+		}
+		return newZstdWriter(w)
+	}
+	return nil, errors.New("pcap: unknown compression")
+}
+
+// NewDecompressor detects gzip or zstd stream by its magic number and
+// returns reader of decompressed data. ErrNoZstd is returned for zstd
+// stream if package pcap/zstd isn't imported. Uncompressed data is returned as is.
+// Returned reader is buffered. Close releases decompressor and doesn't
+// close r.
+func NewDecompressor(r io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(4)
+	if err != nil {
+		return ioutil.NopCloser(br), nil
+	}
+	if magic[0] == 0x1f && magic[1] == 0x8b {
+		return gzip.NewReader(br)
+	}
+	if binary.LittleEndian.Uint32(magic) == zstdMagic {
+		if newZstdReader == nil {
+			return nil, ErrNoZstd
+		}
+		return newZstdReader(br)
+	}
+	return ioutil.NopCloser(br), nil
+}
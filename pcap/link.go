@@ -0,0 +1,118 @@
+// Copyright 2017 Intel Corporation.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package pcap
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+const (
+	etherLen      = 14
+	sllLen        = 16
+	etherTypeIPv4 = 0x0800
+	etherTypeIPv6 = 0x86dd
+	etherTypeVLAN = 0x8100
+	etherTypeQinQ = 0x88a8
+
+	// Packet types of Linux cooked capture header
+	sllHost      = 0
+	sllBroadcast = 1
+	sllMulticast = 2
+	arphrdEther  = 1
+)
+
+// ToEthernet converts packet of given link type to Ethernet frame. Ethernet
+// frames are returned as is. IP packets get Ethernet header with zero
+// addresses. Linux cooked capture packets get Ethernet header with source
+// address and protocol of cooked header.
+func ToEthernet(linkType uint32, data []byte) ([]byte, error) {
+	var frame []byte
+	switch linkType {
+	case LinkTypeEthernet:
+		return data, nil
+	case LinkTypeRaw, LinkTypeIPv4, LinkTypeIPv6:
+		if len(data) == 0 {
+			return nil, errors.New("pcap: empty IP packet")
+		}
+		frame = make([]byte, etherLen+len(data))
+		switch data[0] >> 4 {
+		case 4:
+			binary.BigEndian.PutUint16(frame[12:], etherTypeIPv4)
+		case 6:
+			binary.BigEndian.PutUint16(frame[12:], etherTypeIPv6)
+		default:
+			return nil, fmt.Errorf("pcap: unknown IP version %d", data[0]>>4)
+		}
+		copy(frame[etherLen:], data)
+	case LinkTypeLinuxSLL:
+		if len(data) < sllLen {
+			return nil, errors.New("pcap: Linux cooked header is truncated")
+		}
+		protocol := binary.BigEndian.Uint16(data[14:16])
+		if protocol < 0x0600 {
+			return nil, fmt.Errorf("pcap: Linux cooked protocol %#x can't be converted to Ethernet", protocol)
+		}
+		frame = make([]byte, etherLen+len(data)-sllLen)
+		switch binary.BigEndian.Uint16(data[0:2]) {
+		case sllBroadcast:
+			copy(frame[0:6], []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff})
+		case sllMulticast:
+			frame[0] = 1
+		}
+		if binary.BigEndian.Uint16(data[4:6]) == 6 {
+			copy(frame[6:12], data[6:12])
+		}
+		binary.BigEndian.PutUint16(frame[12:], protocol)
+		copy(frame[etherLen:], data[sllLen:])
+	default:
+		return nil, fmt.Errorf("pcap: unsupported link type %d", linkType)
+	}
+	return frame, nil
+}
+
+// FromEthernet converts Ethernet frame to packet of given link type. VLAN
+// tags are removed for link types without Ethernet header. Only IPv4 and
+// IPv6 packets can be converted to IP link types.
+func FromEthernet(linkType uint32, frame []byte) ([]byte, error) {
+	if linkType == LinkTypeEthernet {
+		return frame, nil
+	}
+	if len(frame) < etherLen {
+		return nil, errors.New("pcap: Ethernet frame is truncated")
+	}
+	l3 := etherLen
+	etherType := binary.BigEndian.Uint16(frame[12:14])
+	for (etherType == etherTypeVLAN || etherType == etherTypeQinQ) && len(frame) >= l3+4 {
+		etherType = binary.BigEndian.Uint16(frame[l3+2 : l3+4])
+		l3 += 4
+	}
+	switch linkType {
+	case LinkTypeRaw, LinkTypeIPv4, LinkTypeIPv6:
+		if (etherType != etherTypeIPv4 || linkType == LinkTypeIPv6) &&
+			(etherType != etherTypeIPv6 || linkType == LinkTypeIPv4) {
+			return nil, fmt.Errorf("pcap: EtherType %#x can't be converted to link type %d", etherType, linkType)
+		}
+		return frame[l3:], nil
+	case LinkTypeLinuxSLL:
+		data := make([]byte, sllLen+len(frame)-l3)
+		switch {
+		case frame[0]&frame[1]&frame[2]&frame[3]&frame[4]&frame[5] == 0xff:
+			binary.BigEndian.PutUint16(data[0:2], sllBroadcast)
+		case frame[0]&1 != 0:
+			binary.BigEndian.PutUint16(data[0:2], sllMulticast)
+		default:
+			binary.BigEndian.PutUint16(data[0:2], sllHost)
+		}
+		binary.BigEndian.PutUint16(data[2:4], arphrdEther)
+		binary.BigEndian.PutUint16(data[4:6], 6)
+		copy(data[6:12], frame[6:12])
+		binary.BigEndian.PutUint16(data[14:16], etherType)
+		copy(data[sllLen:], frame[l3:])
+		return data, nil
+	}
+	return nil, fmt.Errorf("pcap: unsupported link type %d", linkType)
+}
@@ -0,0 +1,263 @@
+// Copyright 2017 Intel Corporation.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package pcap reads and writes pcap capture files over any io.Reader and
+// io.Writer, so captures can be read from pipes, sockets or memory. Unlike
+// pcap functions of packet package all errors are returned to caller.
+// Compressed captures are supported: gzip and zstd streams are detected
+// by Reader automatically and can be produced by Writer. Zstd support is
+// provided by package pcap/zstd which should be imported for side effect. Packets of
+// non-Ethernet link types like raw IP and Linux cooked capture can be
+// converted to Ethernet frames and back by ToEthernet and FromEthernet.
+// Pcapng files are read and written by NgReader and NgWriter.
+package pcap
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"time"
+)
+
+// Magic numbers of pcap file header with microsecond and nanosecond
+// timestamps as read in little endian byte order.
+const (
+	MagicMicro        = 0xa1b2c3d4
+	MagicNano         = 0xa1b23c4d
+	magicMicroSwapped = 0xd4c3b2a1
+	magicNanoSwapped  = 0x4d3cb2a1
+)
+
+// Link types of captured packets.
+const (
+	LinkTypeEthernet = 1
+	LinkTypeRaw      = 101 // IPv4 or IPv6 packet without L2 header
+	LinkTypeLinuxSLL = 113 // Linux cooked capture
+	LinkTypeIPv4     = 228 // IPv4 packet without L2 header
+	LinkTypeIPv6     = 229 // IPv6 packet without L2 header
+)
+
+// DefaultSnapLen is used by Writer if snapshot length isn't set.
+const DefaultSnapLen = 262144
+
+const (
+	fileHdrLen   = 24
+	recordHdrLen = 16
+	// maxRecordLen limits length of record in files with incorrect
+	// snapshot length, so corrupted file doesn't cause huge allocation.
+	maxRecordLen = 1 << 24
+)
+
+// ErrBadMagic is returned by NewReader if stream is not pcap file.
+var ErrBadMagic = errors.New("pcap: incorrect magic number")
+
+// PacketInfo describes one packet record.
+type PacketInfo struct {
+	Timestamp time.Time
+	// OrigLen is length of packet on wire, it can be higher than captured
+	// length. Writer uses captured length if it is zero.
+	OrigLen uint32
+}
+
+// Reader reads packets from pcap stream.
+type Reader struct {
+	dec      io.ReadCloser
+	order    binary.ByteOrder
+	nano     bool
+	snapLen  uint32
+	linkType uint32
+	hdr      [recordHdrLen]byte
+}
+
+// NewReader reads pcap file header from r and returns reader of packets.
+// Gzip and zstd compressed streams are decompressed transparently. Both
+// byte orders and both microsecond and nanosecond timestamps are supported.
+func NewReader(r io.Reader) (*Reader, error) {
+	dec, err := NewDecompressor(r)
+	if err != nil {
+		return nil, err
+	}
+	pr, err := newReader(dec)
+	if err != nil {
+		dec.Close()
+		return nil, err
+	}
+	return pr, nil
+}
+
+// NewUncompressedReader is like NewReader, but compression isn't detected,
+// so r should be decompressed already, for example by NewDecompressor.
+func NewUncompressedReader(r io.Reader) (*Reader, error) {
+	return newReader(ioutil.NopCloser(r))
+}
+
+func newReader(dec io.ReadCloser) (*Reader, error) {
+	var hdr [fileHdrLen]byte
+	if _, err := io.ReadFull(dec, hdr[:]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, fmt.Errorf("pcap: can't read file header: %v", err)
+	}
+	pr := &Reader{dec: dec}
+	switch binary.LittleEndian.Uint32(hdr[0:4]) {
+	case MagicMicro:
+		pr.order = binary.LittleEndian
+	case MagicNano:
+		pr.order, pr.nano = binary.LittleEndian, true
+	case magicMicroSwapped:
+		pr.order = binary.BigEndian
+	case magicNanoSwapped:
+		pr.order, pr.nano = binary.BigEndian, true
+	default:
+		return nil, ErrBadMagic
+	}
+	pr.snapLen = pr.order.Uint32(hdr[16:20])
+	pr.linkType = pr.order.Uint32(hdr[20:24]) & 0x0fffffff
+	return pr, nil
+}
+
+// LinkType returns link type of packets.
+func (r *Reader) LinkType() uint32 {
+	return r.linkType
+}
+
+// SnapLen returns snapshot length of file.
+func (r *Reader) SnapLen() uint32 {
+	return r.snapLen
+}
+
+// Nano returns true if timestamps have nanosecond resolution.
+func (r *Reader) Nano() bool {
+	return r.nano
+}
+
+// ReadPacketData reads the next packet record. Returns io.EOF if there are
+// no more records and io.ErrUnexpectedEOF if the last record is truncated.
+func (r *Reader) ReadPacketData() ([]byte, PacketInfo, error) {
+	if _, err := io.ReadFull(r.dec, r.hdr[:]); err != nil {
+		return nil, PacketInfo{}, err
+	}
+	sec := r.order.Uint32(r.hdr[0:4])
+	frac := r.order.Uint32(r.hdr[4:8])
+	inclLen := r.order.Uint32(r.hdr[8:12])
+	info := PacketInfo{OrigLen: r.order.Uint32(r.hdr[12:16])}
+	if !r.nano {
+		frac *= 1000
+	}
+	info.Timestamp = time.Unix(int64(sec), int64(frac))
+	if inclLen > maxRecordLen || (r.snapLen > maxRecordLen && inclLen > r.snapLen) {
+		return nil, info, fmt.Errorf("pcap: incorrect record length %d", inclLen)
+	}
+	data := make([]byte, inclLen)
+	if _, err := io.ReadFull(r.dec, data); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, info, err
+	}
+	return data, info, nil
+}
+
+// Close releases decompressor. Underlying reader is not closed.
+func (r *Reader) Close() error {
+	return r.dec.Close()
+}
+
+// WriterOptions describes pcap file produced by Writer.
+type WriterOptions struct {
+	// LinkType of packets, LinkTypeEthernet if zero.
+	LinkType uint32
+	// SnapLen is maximum number of bytes of packet which are written,
+	// DefaultSnapLen if zero.
+	SnapLen uint32
+	// Nano means that timestamps are written with nanosecond resolution.
+	Nano bool
+	// Compression of stream.
+	Compression Compression
+}
+
+// Writer writes packets to pcap stream in little endian byte order.
+// Writer doesn't buffer data itself, so w should be buffered if many small
+// writes are expensive.
+type Writer struct {
+	comp    io.WriteCloser
+	options WriterOptions
+	hdr     [recordHdrLen]byte
+}
+
+// NewWriter writes pcap file header to w and returns writer of packets.
+func NewWriter(w io.Writer, options WriterOptions) (*Writer, error) {
+	if options.LinkType == 0 {
+		options.LinkType = LinkTypeEthernet
+	}
+	if options.SnapLen == 0 {
+		options.SnapLen = DefaultSnapLen
+	}
+	comp, err := NewCompressor(w, options.Compression)
+	if err != nil {
+		return nil, err
+	}
+	var hdr [fileHdrLen]byte
+	magic := uint32(MagicMicro)
+	if options.Nano {
+		magic = MagicNano
+	}
+	binary.LittleEndian.PutUint32(hdr[0:4], magic)
+	binary.LittleEndian.PutUint16(hdr[4:6], 2)
+	binary.LittleEndian.PutUint16(hdr[6:8], 4)
+	binary.LittleEndian.PutUint32(hdr[16:20], options.SnapLen)
+	binary.LittleEndian.PutUint32(hdr[20:24], options.LinkType)
+	if _, err := comp.Write(hdr[:]); err != nil {
+		return nil, err
+	}
+	return &Writer{comp: comp, options: options}, nil
+}
+
+// LinkType returns link type of written packets.
+func (w *Writer) LinkType() uint32 {
+	return w.options.LinkType
+}
+
+// WritePacketData writes one packet record. Data longer than snapshot
+// length is truncated.
+func (w *Writer) WritePacketData(data []byte, info PacketInfo) error {
+	if info.OrigLen == 0 {
+		info.OrigLen = uint32(len(data))
+	}
+	if uint32(len(data)) > w.options.SnapLen {
+		data = data[:w.options.SnapLen]
+	}
+	if info.Timestamp.IsZero() {
+		info.Timestamp = time.Now()
+	}
+	frac := uint32(info.Timestamp.Nanosecond())
+	if !w.options.Nano {
+		frac /= 1000
+	}
+	binary.LittleEndian.PutUint32(w.hdr[0:4], uint32(info.Timestamp.Unix()))
+	binary.LittleEndian.PutUint32(w.hdr[4:8], frac)
+	binary.LittleEndian.PutUint32(w.hdr[8:12], uint32(len(data)))
+	binary.LittleEndian.PutUint32(w.hdr[12:16], info.OrigLen)
+	if _, err := w.comp.Write(w.hdr[:]); err != nil {
+		return err
+	}
+	_, err := w.comp.Write(data)
+	return err
+}
+
+// Flush writes data pending in compressor to underlying writer.
+func (w *Writer) Flush() error {
+	if f, ok := w.comp.(flusher); ok {
+		return f.Flush()
+	}
+	return nil
+}
+
+// Close finishes compressed stream. Underlying writer is not closed.
+func (w *Writer) Close() error {
+	return w.comp.Close()
+}
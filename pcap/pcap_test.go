@@ -0,0 +1,167 @@
+// Copyright 2017 Intel Corporation.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package pcap
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestReadWrite(t *testing.T) {
+	packets := [][]byte{
+		bytes.Repeat([]byte{0xab}, 60),
+		bytes.Repeat([]byte{0xcd}, 100),
+	}
+	ts := time.Unix(1500000000, 123456789)
+	for _, c := range []Compression{NoCompression, Gzip} {
+		for _, nano := range []bool{false, true} {
+			var buf bytes.Buffer
+			w, err := NewWriter(&buf, WriterOptions{SnapLen: 80, Nano: nano, Compression: c})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, data := range packets {
+				if err := w.WritePacketData(data, PacketInfo{Timestamp: ts}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			r, err := NewReader(&buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if r.LinkType() != LinkTypeEthernet || r.SnapLen() != 80 || r.Nano() != nano {
+				t.Errorf("Compression %d: incorrect file header", c)
+			}
+			want := ts.Truncate(time.Microsecond)
+			if nano {
+				want = ts
+			}
+			for _, data := range packets {
+				got, info, err := r.ReadPacketData()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(data) > 80 {
+					data = data[:80]
+				}
+				if !bytes.Equal(got, data) || !info.Timestamp.Equal(want) || info.OrigLen < uint32(len(data)) {
+					t.Errorf("Compression %d: incorrect packet %x %v", c, got, info)
+				}
+			}
+			if _, _, err := r.ReadPacketData(); err != io.EOF {
+				t.Errorf("Compression %d: EOF expected, got %v", c, err)
+			}
+			r.Close()
+		}
+	}
+}
+
+func TestNoZstd(t *testing.T) {
+	if _, err := NewWriter(new(bytes.Buffer), WriterOptions{Compression: Zstd}); err != ErrNoZstd {
+		t.Errorf("ErrNoZstd expected, got %v", err)
+	}
+	if _, err := NewReader(bytes.NewReader([]byte{0x28, 0xb5, 0x2f, 0xfd, 0})); err != ErrNoZstd {
+		t.Errorf("ErrNoZstd expected, got %v", err)
+	}
+}
+
+func TestUncompressedReader(t *testing.T) {
+	var buf bytes.Buffer
+	w, _ := NewWriter(&buf, WriterOptions{Compression: Gzip})
+	w.WritePacketData([]byte{1, 2, 3}, PacketInfo{})
+	w.Close()
+	gz := buf.Bytes()
+
+	if _, err := NewUncompressedReader(bytes.NewReader(gz)); err != ErrBadMagic {
+		t.Errorf("Compressed stream is accepted: %v", err)
+	}
+	dec, err := NewDecompressor(bytes.NewReader(gz))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dec.Close()
+	r, err := NewUncompressedReader(dec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _, err := r.ReadPacketData(); err != nil || !bytes.Equal(got, []byte{1, 2, 3}) {
+		t.Errorf("Incorrect packet %x %v", got, err)
+	}
+}
+
+func TestReadBigEndian(t *testing.T) {
+	file, _ := hex.DecodeString("a1b2c3d40002000400000000000000000000004000000065" +
+		"5968c6f00001e240000000040000000845000004")
+	r, err := NewReader(bytes.NewReader(file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.LinkType() != LinkTypeRaw || r.SnapLen() != 64 {
+		t.Error("Incorrect file header")
+	}
+	data, info, err := r.ReadPacketData()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, []byte{0x45, 0, 0, 4}) || info.OrigLen != 8 ||
+		!info.Timestamp.Equal(time.Unix(1500038896, 123456000)) {
+		t.Errorf("Incorrect packet %x %v", data, info)
+	}
+
+	if _, err := NewReader(bytes.NewReader(file[:20])); err == nil {
+		t.Error("Error expected for truncated header")
+	}
+	if _, err := NewReader(bytes.NewReader(make([]byte, 24))); err != ErrBadMagic {
+		t.Error("ErrBadMagic expected")
+	}
+	r, _ = NewReader(bytes.NewReader(file[:len(file)-1]))
+	if _, _, err := r.ReadPacketData(); err != io.ErrUnexpectedEOF {
+		t.Errorf("ErrUnexpectedEOF expected, got %v", err)
+	}
+}
+
+func TestLinkTypes(t *testing.T) {
+	ip := []byte{0x45, 0, 0, 20}
+	frame, _ := hex.DecodeString("ffffffffffff0a0b0c0d0e0f81000064080045000014")
+	eth, _ := hex.DecodeString("ffffffffffff0a0b0c0d0e0f080045000014")
+	sll, _ := hex.DecodeString("000100010006" + "0a0b0c0d0e0f0000" + "080045000014")
+
+	tests := []struct {
+		linkType uint32
+		data     []byte
+	}{
+		{LinkTypeRaw, ip},
+		{LinkTypeIPv4, ip},
+		{LinkTypeLinuxSLL, sll},
+	}
+	for _, test := range tests {
+		got, err := FromEthernet(test.linkType, frame)
+		if err != nil || !bytes.Equal(got, test.data) {
+			t.Errorf("FromEthernet %d: got %x, %v, want %x", test.linkType, got, err, test.data)
+		}
+		got, err = ToEthernet(test.linkType, test.data)
+		want := eth
+		if test.linkType != LinkTypeLinuxSLL {
+			want = append(make([]byte, 12), eth[12:]...)
+		}
+		if err != nil || !reflect.DeepEqual(got, want) {
+			t.Errorf("ToEthernet %d: got %x, %v, want %x", test.linkType, got, err, want)
+		}
+	}
+	if _, err := FromEthernet(LinkTypeIPv6, frame); err == nil {
+		t.Error("Error expected for IPv4 packet with IPv6 link type")
+	}
+	if _, err := ToEthernet(LinkTypeRaw, []byte{0x10}); err == nil {
+		t.Error("Error expected for unknown IP version")
+	}
+}
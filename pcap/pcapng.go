@@ -0,0 +1,386 @@
+// Copyright 2017 Intel Corporation.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package pcap
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"time"
+)
+
+// MagicNg is type of Section Header Block which starts every pcapng
+// file. It is the same in both byte orders.
+const MagicNg = 0x0a0d0d0a
+
+// Block types and options of pcapng format
+const (
+	pcapngIDB uint32 = 1 // Interface Description Block
+	pcapngPB  uint32 = 2 // Packet Block, obsolete
+	pcapngSPB uint32 = 3 // Simple Packet Block
+	pcapngEPB uint32 = 6 // Enhanced Packet Block
+
+	pcapngByteOrderMagic        uint32 = 0x1a2b3c4d
+	pcapngByteOrderMagicSwapped uint32 = 0x4d3c2b1a
+	pcapngMaxBlockLen           uint32 = 1 << 24
+
+	pcapngOptEnd     uint16 = 0
+	pcapngOptTsResol uint16 = 9
+)
+
+var errPcapngBlockLen = errors.New("pcapng: incorrect block length")
+
+// NgInterface describes capture interface of pcapng file.
+type NgInterface struct {
+	LinkType uint16 // Link type, LinkTypeEthernet for Ethernet frames
+	SnapLen  uint32 // Maximum captured length of packet, 0 means unlimited
+	// TsResol is timestamp resolution in format of if_tsresol option.
+	// Value n means 10^-n seconds, value 0x80|n means 2^-n seconds.
+	// Default resolution is microseconds (6).
+	TsResol uint8
+}
+
+// NgPacketInfo describes packet record of pcapng file.
+type NgPacketInfo struct {
+	Timestamp time.Time // Zero for Simple Packet Blocks without timestamp
+	Interface int       // Index of interface in current section
+	OrigLen   uint32    // Length of packet on wire, can be higher than captured length
+}
+
+func pow10(n uint8) uint64 {
+	r := uint64(1)
+	for i := uint8(0); i < n; i++ {
+		r *= 10
+	}
+	return r
+}
+
+func checkTsResol(resol uint8) error {
+	if (resol&0x80 == 0 && resol > 19) || resol&0x7f > 63 {
+		return errors.New("pcapng: unsupported timestamp resolution")
+	}
+	return nil
+}
+
+// toTime converts timestamp in units of interface resolution to time.
+func (iface *NgInterface) toTime(ts uint64) time.Time {
+	var sec, nsec uint64
+	if n := iface.TsResol &^ 0x80; iface.TsResol&0x80 != 0 {
+		sec = ts >> n
+		frac := ts & (1<<n - 1)
+		if n > 30 {
+			frac >>= n - 30
+			n = 30
+		}
+		nsec = frac * 1e9 >> n
+	} else {
+		units := pow10(n)
+		sec = ts / units
+		if n <= 9 {
+			nsec = ts % units * pow10(9-n)
+		} else {
+			nsec = ts % units / pow10(n-9)
+		}
+	}
+	return time.Unix(int64(sec), int64(nsec))
+}
+
+// fromTime converts time to timestamp in units of interface resolution.
+func (iface *NgInterface) fromTime(t time.Time) uint64 {
+	sec, nsec := uint64(t.Unix()), uint64(t.Nanosecond())
+	if n := iface.TsResol &^ 0x80; iface.TsResol&0x80 != 0 {
+		if n > 33 {
+			return sec<<n | (nsec<<33/1e9)<<(n-33)
+		}
+		return sec<<n | nsec<<n/1e9
+	} else if n <= 9 {
+		return sec*pow10(n) + nsec/pow10(9-n)
+	} else {
+		return sec*pow10(n) + nsec*pow10(n-9)
+	}
+}
+
+// NgReader reads packets from pcapng file. Files with several sections
+// and both byte orders are supported. Blocks of unknown types are skipped.
+type NgReader struct {
+	r          io.Reader
+	order      binary.ByteOrder
+	interfaces []NgInterface
+}
+
+// NewNgReader reads Section Header Block and returns reader of
+// packets which follow it. Unlike NewReader it doesn't detect compression,
+// compressed streams should be passed through NewDecompressor.
+func NewNgReader(r io.Reader) (*NgReader, error) {
+	reader := &NgReader{r: r, order: binary.LittleEndian}
+	typ, body, err := reader.readBlock()
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return nil, err
+	}
+	if typ != MagicNg {
+		return nil, errors.New("pcapng: file doesn't start with section header block")
+	}
+	return reader, reader.parseSHB(body)
+}
+
+// Interfaces returns interfaces of current section which were read so far.
+func (r *NgReader) Interfaces() []NgInterface {
+	return r.interfaces
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// readBlock returns type and body of the next block. Byte order is changed
+// when Section Header Block is read. io.EOF is returned only if there are
+// no more blocks.
+func (r *NgReader) readBlock() (uint32, []byte, error) {
+	var hdr [12]byte
+	if _, err := io.ReadFull(r.r, hdr[:8]); err != nil {
+		return 0, nil, err
+	}
+	typ := r.order.Uint32(hdr[:])
+	hdrLen := uint32(8)
+	if typ == MagicNg {
+		// Byte order of section is known only after its magic is read
+		if _, err := io.ReadFull(r.r, hdr[8:]); err != nil {
+			return 0, nil, unexpectedEOF(err)
+		}
+		switch binary.LittleEndian.Uint32(hdr[8:]) {
+		case pcapngByteOrderMagic:
+			r.order = binary.LittleEndian
+		case pcapngByteOrderMagicSwapped:
+			r.order = binary.BigEndian
+		default:
+			return 0, nil, errors.New("pcapng: incorrect byte order magic")
+		}
+		hdrLen = 12
+	}
+	length := r.order.Uint32(hdr[4:])
+	if length%4 != 0 || length < hdrLen+4 || length > pcapngMaxBlockLen {
+		return 0, nil, errPcapngBlockLen
+	}
+	block := make([]byte, length-8)
+	copy(block, hdr[8:hdrLen])
+	if _, err := io.ReadFull(r.r, block[hdrLen-8:]); err != nil {
+		return 0, nil, unexpectedEOF(err)
+	}
+	if r.order.Uint32(block[len(block)-4:]) != length {
+		return 0, nil, errPcapngBlockLen
+	}
+	return typ, block[:len(block)-4], nil
+}
+
+func (r *NgReader) parseSHB(body []byte) error {
+	if len(body) < 16 {
+		return errPcapngBlockLen
+	}
+	if major := r.order.Uint16(body[4:]); major != 1 {
+		return errors.New("pcapng: unsupported version")
+	}
+	r.interfaces = nil
+	return nil
+}
+
+func (r *NgReader) parseIDB(body []byte) error {
+	if len(body) < 8 {
+		return errPcapngBlockLen
+	}
+	iface := NgInterface{
+		LinkType: r.order.Uint16(body),
+		SnapLen:  r.order.Uint32(body[4:]),
+		TsResol:  6,
+	}
+	opts := body[8:]
+	for len(opts) >= 4 {
+		code, length := r.order.Uint16(opts), int(r.order.Uint16(opts[2:]))
+		if code == pcapngOptEnd || 4+length > len(opts) {
+			break
+		}
+		if code == pcapngOptTsResol && length == 1 {
+			iface.TsResol = opts[4]
+		}
+		opts = opts[4+(length+3)&^3:]
+	}
+	if err := checkTsResol(iface.TsResol); err != nil {
+		return err
+	}
+	r.interfaces = append(r.interfaces, iface)
+	return nil
+}
+
+func (r *NgReader) iface(index int) (*NgInterface, error) {
+	if index >= len(r.interfaces) {
+		return nil, errors.New("pcapng: packet refers to unknown interface")
+	}
+	return &r.interfaces[index], nil
+}
+
+// parsePacket parses Enhanced Packet Block or obsolete Packet Block which
+// have the same layout except for size of interface ID.
+func (r *NgReader) parsePacket(typ uint32, body []byte) ([]byte, NgPacketInfo, error) {
+	var info NgPacketInfo
+	if len(body) < 20 {
+		return nil, info, errPcapngBlockLen
+	}
+	if typ == pcapngEPB {
+		info.Interface = int(r.order.Uint32(body))
+	} else {
+		info.Interface = int(r.order.Uint16(body))
+	}
+	iface, err := r.iface(info.Interface)
+	if err != nil {
+		return nil, info, err
+	}
+	ts := uint64(r.order.Uint32(body[4:]))<<32 | uint64(r.order.Uint32(body[8:]))
+	info.Timestamp = iface.toTime(ts)
+	capLen := r.order.Uint32(body[12:])
+	info.OrigLen = r.order.Uint32(body[16:])
+	if capLen > uint32(len(body)-20) {
+		return nil, info, errPcapngBlockLen
+	}
+	return body[20 : 20+capLen], info, nil
+}
+
+func (r *NgReader) parseSPB(body []byte) ([]byte, NgPacketInfo, error) {
+	var info NgPacketInfo
+	if len(body) < 4 {
+		return nil, info, errPcapngBlockLen
+	}
+	iface, err := r.iface(0)
+	if err != nil {
+		return nil, info, err
+	}
+	info.OrigLen = r.order.Uint32(body)
+	capLen := uint32(len(body) - 4)
+	if info.OrigLen < capLen {
+		capLen = info.OrigLen
+	}
+	if iface.SnapLen != 0 && iface.SnapLen < capLen {
+		capLen = iface.SnapLen
+	}
+	return body[4 : 4+capLen], info, nil
+}
+
+// ReadPacketData returns data of the next packet and its description.
+// Data is captured part of packet which can be shorter than original.
+// io.EOF is returned at the end of file.
+func (r *NgReader) ReadPacketData() ([]byte, NgPacketInfo, error) {
+	for {
+		typ, body, err := r.readBlock()
+		if err != nil {
+			return nil, NgPacketInfo{}, err
+		}
+		switch typ {
+		case MagicNg:
+			err = r.parseSHB(body)
+		case pcapngIDB:
+			err = r.parseIDB(body)
+		case pcapngEPB, pcapngPB:
+			return r.parsePacket(typ, body)
+		case pcapngSPB:
+			return r.parseSPB(body)
+		}
+		if err != nil {
+			return nil, NgPacketInfo{}, err
+		}
+	}
+}
+
+// NgWriter writes packets to pcapng file with one section in little
+// endian byte order.
+type NgWriter struct {
+	w          io.Writer
+	interfaces []NgInterface
+}
+
+// NewNgWriter writes Section Header Block and returns writer.
+// Interfaces should be added by AddInterface before packets are written.
+func NewNgWriter(w io.Writer) (*NgWriter, error) {
+	writer := &NgWriter{w: w}
+	var body [16]byte
+	binary.LittleEndian.PutUint32(body[0:], pcapngByteOrderMagic)
+	binary.LittleEndian.PutUint16(body[4:], 1) // Major version
+	binary.LittleEndian.PutUint16(body[6:], 0) // Minor version
+	binary.LittleEndian.PutUint64(body[8:], ^uint64(0))
+	return writer, writer.writeBlock(MagicNg, body[:], nil)
+}
+
+// writeBlock writes block with given body and data which is padded
+// to multiple of 4 bytes.
+func (w *NgWriter) writeBlock(typ uint32, body []byte, data []byte) error {
+	pad := (4 - len(data)%4) % 4
+	length := uint32(12 + len(body) + len(data) + pad)
+	block := make([]byte, 0, length)
+	block = appendUint32(block, typ)
+	block = appendUint32(block, length)
+	block = append(block, body...)
+	block = append(block, data...)
+	block = append(block, make([]byte, pad)...)
+	block = appendUint32(block, length)
+	_, err := w.w.Write(block)
+	return err
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	var buf [4]byte
+	binary.LittleEndian.PutUint32(buf[:], v)
+	return append(b, buf[:]...)
+}
+
+// AddInterface writes Interface Description Block and returns index of
+// interface which should be used in NgPacketInfo of its packets.
+// Zero TsResol means microseconds like in classic pcap.
+func (w *NgWriter) AddInterface(iface NgInterface) (int, error) {
+	if iface.TsResol == 0 {
+		iface.TsResol = 6
+	}
+	if err := checkTsResol(iface.TsResol); err != nil {
+		return 0, err
+	}
+	var body [20]byte
+	binary.LittleEndian.PutUint16(body[0:], iface.LinkType)
+	binary.LittleEndian.PutUint32(body[4:], iface.SnapLen)
+	binary.LittleEndian.PutUint16(body[8:], pcapngOptTsResol)
+	binary.LittleEndian.PutUint16(body[10:], 1)
+	body[12] = iface.TsResol
+	binary.LittleEndian.PutUint16(body[16:], pcapngOptEnd)
+	if err := w.writeBlock(pcapngIDB, body[:], nil); err != nil {
+		return 0, err
+	}
+	w.interfaces = append(w.interfaces, iface)
+	return len(w.interfaces) - 1, nil
+}
+
+// WritePacketData writes packet as Enhanced Packet Block. Data is
+// truncated to snapshot length of interface. Zero OrigLen means that
+// whole packet is in data.
+func (w *NgWriter) WritePacketData(data []byte, info NgPacketInfo) error {
+	if info.Interface < 0 || info.Interface >= len(w.interfaces) {
+		return errors.New("pcapng: packet refers to unknown interface")
+	}
+	iface := &w.interfaces[info.Interface]
+	if info.OrigLen == 0 {
+		info.OrigLen = uint32(len(data))
+	}
+	if iface.SnapLen != 0 && uint32(len(data)) > iface.SnapLen {
+		data = data[:iface.SnapLen]
+	}
+	ts := iface.fromTime(info.Timestamp)
+	var body [20]byte
+	binary.LittleEndian.PutUint32(body[0:], uint32(info.Interface))
+	binary.LittleEndian.PutUint32(body[4:], uint32(ts>>32))
+	binary.LittleEndian.PutUint32(body[8:], uint32(ts))
+	binary.LittleEndian.PutUint32(body[12:], uint32(len(data)))
+	binary.LittleEndian.PutUint32(body[16:], info.OrigLen)
+	return w.writeBlock(pcapngEPB, body[:], data)
+}
@@ -0,0 +1,85 @@
+// Copyright 2017 Intel Corporation.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package pcap
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestPcapng(t *testing.T) {
+	f, err := ioutil.TempFile("", "pcapng")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	w, err := NewNgWriter(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ns, _ := w.AddInterface(NgInterface{LinkType: LinkTypeEthernet, TsResol: 9})
+	bin, _ := w.AddInterface(NgInterface{LinkType: LinkTypeEthernet, SnapLen: 4, TsResol: 0x80 | 20})
+	if _, err := w.AddInterface(NgInterface{TsResol: 20}); err == nil {
+		t.Errorf("Incorrect timestamp resolution is accepted")
+	}
+	ts := time.Unix(1500000000, 123456789)
+	data := []byte{1, 2, 3, 4, 5, 6, 7}
+	w.WritePacketData(data, NgPacketInfo{Timestamp: ts, Interface: ns})
+	w.WritePacketData(data, NgPacketInfo{Timestamp: ts, Interface: bin})
+	if err := w.WritePacketData(data, NgPacketInfo{Interface: 2}); err == nil {
+		t.Errorf("Packet of unknown interface is written")
+	}
+
+	f.Seek(0, io.SeekStart)
+	r, err := NewNgReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, info, err := r.ReadPacketData()
+	if err != nil || !bytes.Equal(got, data) || !info.Timestamp.Equal(ts) || info.OrigLen != 7 || info.Interface != ns {
+		t.Errorf("Incorrect packet with nanosecond timestamp %x %+v %v", got, info, err)
+	}
+	// 2^-20 seconds resolution is about a microsecond
+	got, info, err = r.ReadPacketData()
+	if err != nil || !bytes.Equal(got, data[:4]) || info.Timestamp.Sub(ts) > 0 || ts.Sub(info.Timestamp) > time.Microsecond ||
+		info.OrigLen != 7 || info.Interface != bin {
+		t.Errorf("Incorrect truncated packet with binary timestamp %x %+v %v", got, info, err)
+	}
+	if ifaces := r.Interfaces(); len(ifaces) != 2 || ifaces[1].SnapLen != 4 || ifaces[1].TsResol != 0x80|20 {
+		t.Errorf("Incorrect interfaces %+v", ifaces)
+	}
+	if _, _, err = r.ReadPacketData(); err != io.EOF {
+		t.Errorf("End of file is not reached: %v", err)
+	}
+
+	// Big endian section with unknown block, enhanced and simple packet blocks
+	be, _ := hex.DecodeString("0a0d0d0a0000001c1a2b3c4d00010000ffffffffffffffff0000001c" +
+		"0000000100000014000100000000000000000014" +
+		"00000bad0000000c0000000c" +
+		"00000006000000240000000000000000000f42410000000300000003aabbcc0000000024" +
+		"000000030000001400000002ddee000000000014")
+	r, err = NewNgReader(bytes.NewReader(be))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, info, err = r.ReadPacketData()
+	if err != nil || !bytes.Equal(got, []byte{0xaa, 0xbb, 0xcc}) || !info.Timestamp.Equal(time.Unix(1, 1000)) {
+		t.Errorf("Incorrect big endian enhanced packet %x %+v %v", got, info, err)
+	}
+	got, info, err = r.ReadPacketData()
+	if err != nil || !bytes.Equal(got, []byte{0xdd, 0xee}) || info.OrigLen != 2 {
+		t.Errorf("Incorrect simple packet %x %+v %v", got, info, err)
+	}
+	if _, err = NewNgReader(bytes.NewReader(be[:20])); err != io.ErrUnexpectedEOF {
+		t.Errorf("Truncated section header is accepted: %v", err)
+	}
+}
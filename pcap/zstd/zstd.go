@@ -0,0 +1,38 @@
+// Copyright 2017 Intel Corporation.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package zstd registers zstd compression in pcap package. It is separated
+// from pcap package, so only applications which import it depend on
+// github.com/klauspost/compress/zstd:
+//
+//	import _ "github.com/intel-go/yanff/pcap/zstd"
+package zstd
+
+import (
+	"io"
+
+	"github.com/intel-go/yanff/pcap"
+	"github.com/klauspost/compress/zstd"
+)
+
+type readCloser struct {
+	*zstd.Decoder
+}
+
+func (d readCloser) Close() error {
+	d.Decoder.Close()
+	return nil
+}
+
+func init() {
+	pcap.RegisterZstd(func(w io.Writer) (io.WriteCloser, error) {
+		return zstd.NewWriter(w)
+	}, func(r io.Reader) (io.ReadCloser, error) {
+		d, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return readCloser{d}, nil
+	})
+}
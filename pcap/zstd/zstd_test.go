@@ -0,0 +1,37 @@
+// Copyright 2017 Intel Corporation.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package zstd
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/intel-go/yanff/pcap"
+)
+
+func TestReadWrite(t *testing.T) {
+	data := bytes.Repeat([]byte{0xab}, 60)
+	var buf bytes.Buffer
+	w, err := pcap.NewWriter(&buf, pcap.WriterOptions{Compression: pcap.Zstd})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.WritePacketData(data, pcap.PacketInfo{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := pcap.NewReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	got, _, err := r.ReadPacketData()
+	if err != nil || !bytes.Equal(got, data) {
+		t.Errorf("Incorrect packet %x %v", got, err)
+	}
+}
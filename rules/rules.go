@@ -19,6 +19,16 @@
 // These functions should be used before any usage of rules, however they also can be
 // used dynamically in parallel which make a possibility of changing rules during execution.
 //
+// L2 rules can also match VLAN ID and priority of outer VLAN tag with optional
+// "VLANID" and "PCP" fields. Packets without VLAN tag don't match such rules.
+// Similarly optional "MPLSLabel" field matches top MPLS label.
+// L2 ID field is compared with EtherType after all VLAN tags. For MPLS packets
+// it is compared with EtherType of packet below label stack.
+//
+// L3 rules in JSON format can also match tunnel endpoint identifier of GTP-U
+// packets with optional "TEID" field. Packets which are not GTP-U don't match
+// such rules.
+//
 // After rules are constructed the four functions can be used to filter packets according to rules:
 // 		L2ACLPermit
 //		L2ACLPort
@@ -44,6 +54,9 @@ type rawL2Rule struct {
 	Source      string
 	Destination string
 	ID          string
+	VLANID      string
+	PCP         string
+	MPLSLabel   string
 }
 
 type rawL2Rules struct {
@@ -56,6 +69,7 @@ type rawL3Rule struct {
 	ID           string
 	SrcPort      string
 	DstPort      string
+	TEID         string
 	OutputNumber string
 }
 
@@ -172,7 +186,26 @@ func rawL2Parse(rules *rawL2Rules, jp *L2Rules) {
 		default:
 			common.LogError(common.Debug, "Incorrect JSON request: ", jup[i].ID)
 		}
+		vlanID, vlanIDMask := parseOptionalField(jup[i].VLANID, 0x0fff)
+		jp.eth[i].VLANID, jp.eth[i].VLANIDMask = uint16(vlanID), uint16(vlanIDMask)
+		pcp, pcpMask := parseOptionalField(jup[i].PCP, 0x7)
+		jp.eth[i].PCP, jp.eth[i].PCPMask = uint8(pcp), uint8(pcpMask)
+		jp.eth[i].MPLSLabel, jp.eth[i].MPLSLabelMask = parseOptionalField(jup[i].MPLSLabel, 0xfffff)
+	}
+}
+
+// parseOptionalField parses VLAN ID, priority or MPLS label of L2 rule or TEID
+// of L3 rule. Absent field means ANY, so old rules without these fields match
+// all packets.
+func parseOptionalField(field string, max uint32) (uint32, uint32) {
+	if field == "" || field == "ANY" {
+		return 0, 0
+	}
+	t, err := strconv.ParseUint(field, 0, 32)
+	if err != nil || t > uint64(max) {
+		common.LogError(common.Debug, "Incorrect JSON request: ", field)
 	}
+	return uint32(t), max
 }
 
 func rawL3Parse(rules *rawL3Rules, jp *L3Rules) {
@@ -199,6 +232,9 @@ func rawL3Parse(rules *rawL3Rules, jp *L3Rules) {
 		case "udp", "UDP", "Udp", "0x11", "17":
 			l4temp.ID = common.UDPNumber
 			l4temp.IDMask = 0xff
+		case "sctp", "SCTP", "Sctp", "0x84", "132":
+			l4temp.ID = common.SCTPNumber
+			l4temp.IDMask = 0xff
 		default:
 			common.LogError(common.Debug, "Incorrect JSON request: ", jup[i].ID)
 		}
@@ -206,7 +242,8 @@ func rawL3Parse(rules *rawL3Rules, jp *L3Rules) {
 		// Parse L4 ports
 		l4temp.SrcPortMin, l4temp.SrcPortMax, validSrc = parseL4Port(jup[i].SrcPort)
 		l4temp.DstPortMin, l4temp.DstPortMax, validDst = parseL4Port(jup[i].DstPort)
-		l4temp.valid = validSrc || validDst
+		l4temp.TEID, l4temp.TEIDMask = parseOptionalField(jup[i].TEID, 0xffffffff)
+		l4temp.valid = validSrc || validDst || l4temp.TEIDMask != 0
 
 		// Parse L3 addresses
 		if jup[i].SrcAddr == "ANY" {
@@ -332,13 +369,19 @@ func parseAddr6(addr *net.IPNet) ([16]uint8, [16]uint8) {
 }
 
 type l2Rules struct {
-	OutputNumber uint
-	DAddrNotAny  bool
-	SAddrNotAny  bool
-	DAddr        [6]uint8
-	SAddr        [6]uint8
-	IDMask       uint16
-	ID           uint16
+	OutputNumber  uint
+	DAddrNotAny   bool
+	SAddrNotAny   bool
+	DAddr         [6]uint8
+	SAddr         [6]uint8
+	IDMask        uint16
+	ID            uint16
+	VLANIDMask    uint16
+	VLANID        uint16
+	PCPMask       uint8
+	PCP           uint8
+	MPLSLabelMask uint32
+	MPLSLabel     uint32
 }
 
 type l4Rules struct {
@@ -349,6 +392,8 @@ type l4Rules struct {
 	SrcPortMax uint16
 	DstPortMin uint16
 	DstPortMax uint16
+	TEIDMask   uint32
+	TEID       uint32
 }
 
 type l3Rules4 struct {
@@ -403,9 +448,27 @@ func l2ACL(pkt *packet.Packet, rules *L2Rules) uint {
 		if rule.DAddrNotAny == true && rule.DAddr != pkt.Ether.DAddr {
 			continue
 		}
-		if (rule.ID^packet.SwapBytesUint16(pkt.Ether.EtherType))&rule.IDMask != 0 {
+		if (rule.ID^packet.SwapBytesUint16(pkt.GetEtherType()))&rule.IDMask != 0 {
 			continue
 		}
+		if rule.VLANIDMask != 0 || rule.PCPMask != 0 {
+			vlan := pkt.GetVLAN()
+			if vlan == nil {
+				continue
+			}
+			if (rule.VLANID^vlan.GetVLANTagIdentifier())&rule.VLANIDMask != 0 {
+				continue
+			}
+			if (rule.PCP^vlan.GetPriority())&rule.PCPMask != 0 {
+				continue
+			}
+		}
+		if rule.MPLSLabelMask != 0 {
+			mpls := pkt.GetMPLS()
+			if mpls == nil || (rule.MPLSLabel^mpls.GetLabel())&rule.MPLSLabelMask != 0 {
+				continue
+			}
+		}
 		return rule.OutputNumber
 	}
 	return 0
@@ -427,7 +490,7 @@ func L3ACLPort(pkt *packet.Packet, rules *L3Rules) uint {
 }
 
 func l4ACL(pkt *packet.Packet, L4 *l4Rules) bool {
-	// Src and Dst port numbers placed at the same offset from L4 start in both tcp and udp
+	// Src and Dst port numbers placed at the same offset from L4 start in tcp, udp and sctp
 	l4 := (*packet.UDPHdr)(pkt.L4)
 	srcPort := packet.SwapBytesUint16(l4.SrcPort)
 	if srcPort < L4.SrcPortMin || srcPort > L4.SrcPortMax {
@@ -437,11 +500,25 @@ func l4ACL(pkt *packet.Packet, L4 *l4Rules) bool {
 	if dstPort < L4.DstPortMin || dstPort > L4.DstPortMax {
 		return false
 	}
+	if L4.TEIDMask != 0 {
+		gtpu := pkt.GetGTPU()
+		if gtpu == nil || (L4.TEID^gtpu.GetTEID())&L4.TEIDMask != 0 {
+			return false
+		}
+	}
 	return true
 }
 
 func l3ACL(pkt *packet.Packet, rules *L3Rules) uint {
-	ipv4, ipv6 := pkt.ParseAllKnownL3()
+	ipv4, ipv6, err := pkt.SafeParseL3()
+	if err != nil {
+		// Malformed packets don't match any rule
+		return 0
+	}
+	// L4 is parsed only once when the first port rule is checked. Ports
+	// can be matched only if packet has correct TCP, UDP or SCTP header, so
+	// malformed packets and non first fragments don't match port rules.
+	var l4ok, l4parsed bool
 	if ipv4 != nil {
 		for _, rule := range rules.ip4 {
 			if ((rule.SrcAddr ^ ipv4.SrcAddr) & rule.SrcMask) != 0 {
@@ -454,14 +531,20 @@ func l3ACL(pkt *packet.Packet, rules *L3Rules) uint {
 				continue
 			}
 			if rule.L4.valid {
-				pkt.ParseL4ForIPv4()
-				if !l4ACL(pkt, &rule.L4) {
+				if !l4parsed {
+					tcp, udp, _, err := pkt.SafeParseL4ForIPv4()
+					l4ok = err == nil && (tcp != nil || udp != nil || pkt.GetSCTPForIPv4() != nil)
+					l4parsed = true
+				}
+				if !l4ok || !l4ACL(pkt, &rule.L4) {
 					continue
 				}
 			}
 			return rule.OutputNumber
 		}
 	} else if ipv6 != nil {
+		// Protocol is matched against upper layer protocol after extension headers
+		proto := pkt.GetL4ProtoForIPv6()
 	IPv6:
 		for _, rule := range rules.ip6 {
 			for i := 0; i < 16; i++ {
@@ -470,12 +553,18 @@ func l3ACL(pkt *packet.Packet, rules *L3Rules) uint {
 					continue IPv6
 				}
 			}
-			if ((rule.L4.ID ^ ipv6.Proto) & rule.L4.IDMask) != 0 {
+			if ((rule.L4.ID ^ proto) & rule.L4.IDMask) != 0 {
 				continue
 			}
-			pkt.ParseL4ForIPv6()
-			if !l4ACL(pkt, &rule.L4) {
-				continue
+			if rule.L4.valid {
+				if !l4parsed {
+					tcp, udp, _, err := pkt.SafeParseL4ForIPv6()
+					l4ok = err == nil && (tcp != nil || udp != nil || pkt.GetSCTPForIPv6() != nil)
+					l4parsed = true
+				}
+				if !l4ok || !l4ACL(pkt, &rule.L4) {
+					continue
+				}
 			}
 			return rule.OutputNumber
 		}
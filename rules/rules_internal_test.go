@@ -223,6 +223,7 @@ func TestL3RulesReadingGen(t *testing.T) {
 			{"ANY", gtID{0, 0x0000}},
 			{"TCP", gtID{0x06, 0xff}},
 			{"UDP", gtID{0x11, 0xff}},
+			{"SCTP", gtID{0x84, 0xff}},
 		},
 		srcports: []portTest{
 			{"ANY", gtPort{0, 65535, false}},
@@ -1010,6 +1011,205 @@ func TestInternal_l2_ACL(t *testing.T) {
 	}
 }
 
+// Tests for l2ACL with VLAN tag
+func TestInternal_l2_ACL_VLAN(t *testing.T) {
+	// Packet 1 with VLAN tag: VLAN ID = 100, priority = 5
+	buffer := "0011223344550111213141518100a064080045000028bffd00000406eec37f0000018009090504d2162e1234567812345690501020009b540000000000000000"
+	decoded, _ := hex.DecodeString(buffer)
+	mb := make([]uintptr, 1)
+	low.AllocateMbufs(mb, mempool)
+	pkt := packet.ExtractPacket(mb[0])
+	packet.GeneratePacketFromByte(pkt, decoded)
+
+	rulesCtxt := []struct {
+		rule l2Rules
+		ok   bool
+	}{
+		{l2Rules{OutputNumber: 1}, true},
+		{l2Rules{OutputNumber: 1, ID: 0x0800, IDMask: 0xffff}, true},
+		{l2Rules{OutputNumber: 1, VLANID: 100, VLANIDMask: 0x0fff}, true},
+		{l2Rules{OutputNumber: 1, VLANID: 101, VLANIDMask: 0x0fff}, false},
+		{l2Rules{OutputNumber: 1, PCP: 5, PCPMask: 0x7}, true},
+		{l2Rules{OutputNumber: 1, PCP: 0, PCPMask: 0x7}, false},
+		{l2Rules{OutputNumber: 1, VLANID: 100, VLANIDMask: 0x0fff, PCP: 5, PCPMask: 0x7}, true},
+	}
+
+	for i, ctx := range rulesCtxt {
+		l2rule := L2Rules{
+			eth: []l2Rules{ctx.rule},
+		}
+		got := l2ACL(pkt, &l2rule)
+		var want uint
+		if ctx.ok {
+			want = ctx.rule.OutputNumber
+		}
+		if got != want {
+			t.Errorf("Incorrect result for rule %d:\n got: %d\n want: %d\n %+v", i, got, want, ctx.rule)
+		}
+	}
+
+	// The same rules shouldn't match untagged packet if VLAN fields are set
+	buffer = "001122334455011121314151080045000028bffd00000406eec37f0000018009090504d2162e1234567812345690501020009b540000000000000000"
+	decoded, _ = hex.DecodeString(buffer)
+	low.AllocateMbufs(mb, mempool)
+	pkt = packet.ExtractPacket(mb[0])
+	packet.GeneratePacketFromByte(pkt, decoded)
+	l2rule := L2Rules{
+		eth: []l2Rules{rulesCtxt[2].rule},
+	}
+	if l2ACL(pkt, &l2rule) != 0 {
+		t.Errorf("Untagged packet matches VLAN rule %+v", rulesCtxt[2].rule)
+	}
+}
+
+func TestInternal_l3_ACL_packetIPv6_Fragment(t *testing.T) {
+	// First fragment of TCP packet: Fragment header is placed before TCP header
+	buffer := "00112233445501112131415186dd60000000001c2c00dead000000000000000000000000beafdead000000000000000000000000ddfd" +
+		"0600000112345678" + "04d2162e123456781234569050102000495b0000"
+	decoded, _ := hex.DecodeString(buffer)
+	mb := make([]uintptr, 1)
+	low.AllocateMbufs(mb, mempool)
+	pkt := packet.ExtractPacket(mb[0])
+	packet.GeneratePacketFromByte(pkt, decoded)
+
+	anyPorts := l4Rules{SrcPortMax: 65535, DstPortMax: 65535}
+	rulesCtxt := []struct {
+		l4          l4Rules
+		first, next bool
+	}{
+		{anyPorts, true, true},
+		{l4Rules{ID: 6, IDMask: 0xff, SrcPortMax: 65535, DstPortMax: 65535}, true, true},
+		{l4Rules{ID: 17, IDMask: 0xff, SrcPortMax: 65535, DstPortMax: 65535}, false, false},
+		{l4Rules{ID: 6, IDMask: 0xff, valid: true, SrcPortMin: 1234, SrcPortMax: 1234, DstPortMax: 65535}, true, false},
+		{l4Rules{ID: 6, IDMask: 0xff, valid: true, SrcPortMin: 1, SrcPortMax: 2, DstPortMax: 65535}, false, false},
+	}
+
+	check := func(first bool) {
+		for i, ctx := range rulesCtxt {
+			l3rule := L3Rules{
+				ip6: []l3Rules6{{OutputNumber: 1, L4: ctx.l4}},
+			}
+			want := ctx.next
+			if first {
+				want = ctx.first
+			}
+			if got := L3ACLPermit(pkt, &l3rule); got != want {
+				t.Errorf("Incorrect result for rule %d, first fragment %t:\n got: %t\n want: %t\n %+v", i, first, got, want, ctx.l4)
+			}
+		}
+	}
+
+	check(true)
+	// Make packet non first fragment with offset 1480
+	pkt.GetIPv6Fragment().FragmentOffset = packet.SwapBytesUint16(1480 | 1)
+	check(false)
+}
+
+func TestInternal_l3_ACL_packetIPv4_Malformed(t *testing.T) {
+	anyRule := L3Rules{ip4: []l3Rules4{{OutputNumber: 1}}}
+	portRule := L3Rules{ip4: []l3Rules4{{OutputNumber: 1, L4: l4Rules{valid: true, SrcPortMax: 65535, DstPortMax: 65535}}}}
+	tests := []struct {
+		name   string
+		buffer string
+		rules  *L3Rules
+		want   uint
+	}{
+		{"correct", "001122334455011121314151080045000028bffd00000406eec37f0000018009090504d2162e1234567812345690501020009b540000000000000000", &portRule, 1},
+		// Total length is larger than packet
+		{"truncated IPv4", "001122334455011121314151080045000128bffd00000406eec37f0000018009090504d2162e1234567812345690501020009b540000000000000000", &anyRule, 0},
+		// TCP data offset is larger than L4 length
+		{"truncated TCP", "001122334455011121314151080045000028bffd00000406eec37f0000018009090504d2162e12345678123456906f1020009b540000000000000000", &portRule, 0},
+		{"truncated TCP without port rule", "001122334455011121314151080045000028bffd00000406eec37f0000018009090504d2162e12345678123456906f1020009b540000000000000000", &anyRule, 1},
+	}
+
+	for _, test := range tests {
+		decoded, _ := hex.DecodeString(test.buffer)
+		mb := make([]uintptr, 1)
+		low.AllocateMbufs(mb, mempool)
+		pkt := packet.ExtractPacket(mb[0])
+		packet.GeneratePacketFromByte(pkt, decoded)
+		if got := l3ACL(pkt, test.rules); got != test.want {
+			t.Errorf("Incorrect result for %s packet:\n got: %d\n want: %d", test.name, got, test.want)
+		}
+	}
+}
+
+func TestInternal_l3_ACL_packetIPv4_SCTP(t *testing.T) {
+	// SCTP packet with ports 2905 and HEARTBEAT chunk
+	buffer := "0011223344550111213141510800450000280bfd000040840000c0a80001c0a80002" +
+		"0b590b5900000001000000000400000812345678"
+	decoded, _ := hex.DecodeString(buffer)
+	mb := make([]uintptr, 1)
+	low.AllocateMbufs(mb, mempool)
+	pkt := packet.ExtractPacket(mb[0])
+	packet.GeneratePacketFromByte(pkt, decoded)
+
+	rulesCtxt := []struct {
+		l4          l4Rules
+		first, next bool
+	}{
+		{l4Rules{ID: 0x84, IDMask: 0xff, SrcPortMax: 65535, DstPortMax: 65535}, true, true},
+		{l4Rules{ID: 6, IDMask: 0xff, SrcPortMax: 65535, DstPortMax: 65535}, false, false},
+		{l4Rules{ID: 0x84, IDMask: 0xff, valid: true, SrcPortMin: 2900, SrcPortMax: 2910, DstPortMin: 2905, DstPortMax: 2905}, true, false},
+		{l4Rules{ID: 0x84, IDMask: 0xff, valid: true, SrcPortMin: 1, SrcPortMax: 2, DstPortMax: 65535}, false, false},
+	}
+
+	check := func(first bool) {
+		for i, ctx := range rulesCtxt {
+			l3rule := L3Rules{
+				ip4: []l3Rules4{{OutputNumber: 1, L4: ctx.l4}},
+			}
+			want := ctx.next
+			if first {
+				want = ctx.first
+			}
+			if got := L3ACLPermit(pkt, &l3rule); got != want {
+				t.Errorf("Incorrect result for rule %d, first fragment %t:\n got: %t\n want: %t\n %+v", i, first, got, want, ctx.l4)
+			}
+		}
+	}
+
+	check(true)
+	// Make packet non first fragment, it doesn't contain SCTP header
+	pkt.GetIPv4().FragmentOffset = packet.SwapBytesUint16(185)
+	check(false)
+}
+
+func TestInternal_l2_ACL_MPLS(t *testing.T) {
+	// Packet with MPLS labels 100 and 200 above IPv4
+	buffer := "001122334455011121314151884700064040000c814045000028bffd00000406eec37f0000018009090504d2162e1234567812345690501020009b540000000000000000"
+	decoded, _ := hex.DecodeString(buffer)
+	mb := make([]uintptr, 1)
+	low.AllocateMbufs(mb, mempool)
+	pkt := packet.ExtractPacket(mb[0])
+	packet.GeneratePacketFromByte(pkt, decoded)
+
+	rulesCtxt := []struct {
+		rule l2Rules
+		ok   bool
+	}{
+		{l2Rules{OutputNumber: 1}, true},
+		{l2Rules{OutputNumber: 1, ID: 0x0800, IDMask: 0xffff}, true},
+		{l2Rules{OutputNumber: 1, MPLSLabel: 100, MPLSLabelMask: 0xfffff}, true},
+		{l2Rules{OutputNumber: 1, MPLSLabel: 200, MPLSLabelMask: 0xfffff}, false},
+		{l2Rules{OutputNumber: 1, ID: 0x86dd, IDMask: 0xffff, MPLSLabel: 100, MPLSLabelMask: 0xfffff}, false},
+	}
+
+	for i, ctx := range rulesCtxt {
+		l2rule := L2Rules{
+			eth: []l2Rules{ctx.rule},
+		}
+		got := l2ACL(pkt, &l2rule)
+		var want uint
+		if ctx.ok {
+			want = ctx.rule.OutputNumber
+		}
+		if got != want {
+			t.Errorf("Incorrect result for rule %d:\n got: %d\n want: %d\n %+v", i, got, want, ctx.rule)
+		}
+	}
+}
+
 // Helper structs for parsing
 type rawL2RulesTest struct {
 	L2Rules []rawL2Rule
@@ -1154,3 +1354,41 @@ type MacAddr struct {
 	addrNotAny bool
 	ok         bool
 }
+
+func TestInternal_l3_ACL_packetIPv4_GTPU(t *testing.T) {
+	// G-PDU with TEID 0x1234 carrying IPv4 packet
+	buffer := "00112233445501112131415108004500003c000000004011f9ae0a0000010a000002" +
+		"0868086800280000" + "30ff001800001234" +
+		"45000018000000004011f9c9c0a80001c0a8000204d204d200040000"
+	decoded, _ := hex.DecodeString(buffer)
+	mb := make([]uintptr, 1)
+	low.AllocateMbufs(mb, mempool)
+	pkt := packet.ExtractPacket(mb[0])
+	packet.GeneratePacketFromByte(pkt, decoded)
+
+	rulesCtxt := []struct {
+		l4   l4Rules
+		want bool
+	}{
+		{l4Rules{ID: 17, IDMask: 0xff, valid: true, SrcPortMax: 65535, DstPortMax: 65535, TEID: 0x1234, TEIDMask: 0xffffffff}, true},
+		{l4Rules{ID: 17, IDMask: 0xff, valid: true, SrcPortMax: 65535, DstPortMax: 65535, TEID: 0x1235, TEIDMask: 0xffffffff}, false},
+		{l4Rules{ID: 17, IDMask: 0xff, valid: true, SrcPortMax: 65535, DstPortMax: 65535, TEID: 0x1200, TEIDMask: 0xff00}, true},
+		{l4Rules{ID: 17, IDMask: 0xff, SrcPortMax: 65535, DstPortMax: 65535}, true},
+	}
+
+	for i, ctx := range rulesCtxt {
+		l3rule := L3Rules{
+			ip4: []l3Rules4{{OutputNumber: 1, L4: ctx.l4}},
+		}
+		if got := L3ACLPermit(pkt, &l3rule); got != ctx.want {
+			t.Errorf("Incorrect result for rule %d:\n got: %t\n want: %t\n %+v", i, got, ctx.want, ctx.l4)
+		}
+	}
+
+	// Packet to other port doesn't match TEID rule
+	pkt.GetUDPForIPv4().DstPort = packet.SwapBytesUint16(2153)
+	l3rule := L3Rules{ip4: []l3Rules4{{OutputNumber: 1, L4: rulesCtxt[0].l4}}}
+	if L3ACLPermit(pkt, &l3rule) {
+		t.Errorf("TEID rule matches non GTP-U packet")
+	}
+}
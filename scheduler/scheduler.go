@@ -8,6 +8,8 @@ import (
 	"github.com/intel-go/yanff/common"
 	"github.com/intel-go/yanff/low"
 	"runtime"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -28,8 +30,11 @@ type UserContext interface {
 	Copy() interface{}
 }
 
-// Function types which are used inside flow functions
-type uncloneFlowFunction func(interface{}, uint8)
+// Function types which are used inside flow functions.
+// Unclonable flow function should return when value of stop flag
+// becomes non zero. Clonable flow function should return when it
+// receives -1 from its stopper channel.
+type uncloneFlowFunction func(interface{}, *int32, uint8)
 type cloneFlowFunction func(interface{}, chan int, chan uint64, UserContext)
 type conditionFlowFunction func(interface{}, bool) bool
 
@@ -67,6 +72,13 @@ type FlowFunction struct {
 	context     UserContext
 	targetSpeed float64
 	pause       int
+	// Stop flag of unclonable function
+	stop int32
+	// Number of running goroutines of function itself and its clones
+	running sync.WaitGroup
+	started bool
+	// Core of function itself (not clones)
+	core int
 }
 
 // NewUnclonableFlowFunction is a function for adding unclonable flow functions. Is used inside flow package
@@ -109,6 +121,22 @@ func (scheduler *Scheduler) NewGenerateFlowFunction(name string, id int, cfn clo
 	return ff
 }
 
+// Name returns name of flow function. Is used inside flow package
+func (ff *FlowFunction) Name() string {
+	return ff.name
+}
+
+// Identifier returns identifier of flow function. Is used inside flow package
+func (ff *FlowFunction) Identifier() int {
+	return ff.identifier
+}
+
+// CloneNumber returns number of started clones of flow function. It should
+// be called from goroutine of Schedule. Is used inside flow package
+func (ff *FlowFunction) CloneNumber() int {
+	return ff.cloneNumber
+}
+
 // Scheduler is a main structure for scheduler. Is used inside flow package
 type Scheduler struct {
 	Clonable          []*FlowFunction
@@ -119,6 +147,9 @@ type Scheduler struct {
 	offRemove         bool
 	stopDedicatedCore bool
 	StopRing          *low.Queue
+	stopRingFlag      *int32
+	stopRingDone      chan struct{}
+	requests          chan func()
 	usedCores         uint8
 	checkTime         uint
 	debugTime         uint
@@ -142,69 +173,184 @@ func NewScheduler(coresNumber uint, schedulerOff bool, schedulerOffRemove bool,
 	scheduler.checkTime = checkTime
 	scheduler.debugTime = debugTime
 	scheduler.Dropped = 0
+	scheduler.requests = make(chan func())
 
 	return *scheduler
 }
 
 // SystemStart starts whole system. Is used inside flow package
 func (scheduler *Scheduler) SystemStart() {
-	core := scheduler.getCore(true)
+	core := scheduler.getCore()
 	common.LogDebug(common.Initialization, "Start SCHEDULER at", core, "core")
 	low.SetAffinity(uint8(core))
 	if scheduler.stopDedicatedCore {
-		core = scheduler.getCore(true)
+		core = scheduler.getCore()
 		common.LogDebug(common.Initialization, "Start STOP at", core, "core")
 	} else {
 		common.LogDebug(common.Initialization, "Start STOP at scheduler", core, "core")
 	}
+	stopRingFlag := new(int32)
+	stopRingDone := make(chan struct{})
+	scheduler.stopRingFlag = stopRingFlag
+	scheduler.stopRingDone = stopRingDone
 	go func() {
 		low.SetAffinity(uint8(core))
-		low.Stop(scheduler.StopRing)
+		low.Stop(scheduler.StopRing, stopRingFlag)
+		close(stopRingDone)
 	}()
 	for i := range scheduler.UnClonable {
-		ff := scheduler.UnClonable[i]
-		core := scheduler.getCore(true)
-		common.LogDebug(common.Initialization, "Start unclonable FlowFunction", ff.name, ff.identifier, "at", core, "core")
-		go func() {
-			ff.uncloneFunction(ff.Parameters, uint8(core))
-		}()
+		scheduler.startFlowFunction(scheduler.UnClonable[i], scheduler.getCore())
 	}
 	for i := range scheduler.Clonable {
-		scheduler.startClonable(scheduler.Clonable[i])
+		scheduler.startFlowFunction(scheduler.Clonable[i], scheduler.getCore())
 	}
 	for i := range scheduler.Generate {
-		scheduler.startClonable(scheduler.Generate[i])
+		scheduler.startFlowFunction(scheduler.Generate[i], scheduler.getCore())
 	}
 	// We need this to get a chance to all started goroutines to log their warnings.
 	time.Sleep(time.Millisecond)
 }
 
-func (scheduler *Scheduler) startClonable(ff *FlowFunction) {
-	core := scheduler.getCore(true)
+func (scheduler *Scheduler) startFlowFunction(ff *FlowFunction, core int) {
+	ff.core = core
+	ff.started = true
+	if ff.uncloneFunction != nil {
+		common.LogDebug(common.Initialization, "Start unclonable FlowFunction", ff.name, ff.identifier, "at", core, "core")
+		atomic.StoreInt32(&ff.stop, 0)
+		ff.running.Add(1)
+		go func() {
+			ff.uncloneFunction(ff.Parameters, &ff.stop, uint8(core))
+			ff.running.Done()
+		}()
+		return
+	}
 	common.LogDebug(common.Initialization, "Start clonable FlowFunction", ff.name, ff.identifier, "at", core, "core")
+	ff.channel = make(chan int)
+	ff.cloneNumber = 0
+	ff.clone = nil
+	ff.pause = 0
+	ff.running.Add(1)
 	go func() {
-		ff.channel = make(chan int)
 		low.SetAffinity(uint8(core))
-		ff.cloneNumber = 0
 		if ff.context != nil {
 			ff.cloneFunction(ff.Parameters, ff.channel, ff.report, (ff.context.Copy()).(UserContext))
 		} else {
 			ff.cloneFunction(ff.Parameters, ff.channel, ff.report, nil)
 		}
+		ff.running.Done()
 	}()
 }
 
-// Schedule - main execution. Is used inside flow package
-func (scheduler *Scheduler) Schedule(schedTime uint) {
-	tick := time.Tick(time.Duration(scheduler.checkTime) * time.Millisecond)
-	debugTick := time.Tick(time.Duration(scheduler.debugTime) * time.Millisecond)
+// StartFlowFunction starts flow function when system is already started.
+// Returns false if there is no free core for it. Is used inside flow package
+func (scheduler *Scheduler) StartFlowFunction(ff *FlowFunction) bool {
+	core := scheduler.getCore()
+	if core == -1 {
+		return false
+	}
+	scheduler.startFlowFunction(ff, core)
+	return true
+}
+
+// StopFlowFunction stops flow function and all its clones and waits until
+// they return. Function finishes processing of packets which it has already
+// taken from its input ring. Stopped function can be started again by
+// StartFlowFunction, it continues to take packets from its input ring.
+// Function which isn't started is ignored. Returns true if function was
+// started. Is used inside flow package
+func (scheduler *Scheduler) StopFlowFunction(ff *FlowFunction) bool {
+	if !ff.started {
+		return false
+	}
+	if ff.uncloneFunction != nil {
+		atomic.StoreInt32(&ff.stop, 1)
+	} else {
+		for ff.cloneNumber != 0 {
+			scheduler.removeClone(ff)
+		}
+		ff.channel <- -1
+	}
+	ff.running.Wait()
+	ff.started = false
+	scheduler.setCore(ff.core)
+	return true
+}
+
+// StartCoresNumber returns number of cores which are needed by SystemStart:
+// one core per flow function, core of scheduler and core of stop routine
+// if it is dedicated. Is used inside flow package
+func (scheduler *Scheduler) StartCoresNumber() int {
+	n := len(scheduler.UnClonable) + len(scheduler.Clonable) + len(scheduler.Generate) + 1
+	if scheduler.stopDedicatedCore {
+		n++
+	}
+	return n
+}
+
+// FreeCoresNumber returns number of cores which can be used by started
+// flow functions and their clones. Is used inside flow package
+func (scheduler *Scheduler) FreeCoresNumber() int {
+	return len(scheduler.freeCores) - int(scheduler.usedCores)
+}
+
+// Execute runs f in goroutine of Schedule between scheduling steps, so f
+// can change flow functions of started system. Returns false without running
+// f if stop channel of Schedule is closed. Is used inside flow package
+func (scheduler *Scheduler) Execute(f func(), stop <-chan struct{}) bool {
+	done := make(chan struct{})
+	select {
+	case scheduler.requests <- func() {
+		f()
+		close(done)
+	}:
+		<-done
+		return true
+	case <-stop:
+		return false
+	}
+}
+
+// StopStopRing stops freeing of packets from StopRing. It returns when all
+// packets from StopRing are freed. Is used inside flow package
+func (scheduler *Scheduler) StopStopRing() {
+	atomic.StoreInt32(scheduler.stopRingFlag, 1)
+	<-scheduler.stopRingDone
+}
+
+// Reset removes all stopped flow functions and frees all cores, so
+// new flow graph can be started. Is used inside flow package
+func (scheduler *Scheduler) Reset() {
+	scheduler.Clonable = nil
+	scheduler.UnClonable = nil
+	scheduler.Generate = nil
+	for i := range scheduler.freeCores {
+		scheduler.freeCores[i] = true
+	}
+	scheduler.usedCores = 0
+	scheduler.Dropped = 0
+}
+
+// Schedule - main execution. Returns when stop channel is closed.
+// Is used inside flow package
+func (scheduler *Scheduler) Schedule(schedTime uint, stop <-chan struct{}) {
+	tick := time.NewTicker(time.Duration(scheduler.checkTime) * time.Millisecond)
+	defer tick.Stop()
+	debugTick := time.NewTicker(time.Duration(scheduler.debugTime) * time.Millisecond)
+	defer debugTick.Stop()
 	checkRequired := false
 	for {
-		time.Sleep(time.Millisecond * time.Duration(schedTime))
 		select {
-		case <-tick:
+		case <-stop:
+			return
+		case request := <-scheduler.requests:
+			request()
+			continue
+		case <-time.After(time.Millisecond * time.Duration(schedTime)):
+		}
+		select {
+		case <-tick.C:
 			checkRequired = true
-		case <-debugTick:
+		case <-debugTick.C:
 			// Report current state of system
 			common.LogDebug(common.Debug, "---------------")
 			common.LogDebug(common.Debug, "System is using", scheduler.usedCores, "cores now.", uint8(len(scheduler.freeCores))-scheduler.usedCores, "cores are left available.")
@@ -311,7 +457,7 @@ func (scheduler *Scheduler) Schedule(schedTime uint) {
 }
 
 func (scheduler *Scheduler) startClone(ff *FlowFunction) bool {
-	core := scheduler.getCore(false)
+	core := scheduler.getCore()
 	if core != -1 {
 		quit := make(chan int)
 		cp := new(clonePair)
@@ -319,6 +465,7 @@ func (scheduler *Scheduler) startClone(ff *FlowFunction) bool {
 		cp.core = core
 		ff.clone = append(ff.clone, cp)
 		ff.cloneNumber++
+		ff.running.Add(1)
 		go func() {
 			low.SetAffinity(uint8(core))
 			if ff.context != nil {
@@ -326,6 +473,7 @@ func (scheduler *Scheduler) startClone(ff *FlowFunction) bool {
 			} else {
 				ff.cloneFunction(ff.Parameters, quit, ff.report, nil)
 			}
+			ff.running.Done()
 		}()
 		return true
 	} else {
@@ -390,7 +538,9 @@ func (scheduler *Scheduler) setCore(i int) {
 	scheduler.usedCores--
 }
 
-func (scheduler *Scheduler) getCore(startStage bool) int {
+// getCore returns free core or -1 if there are no free cores. Number of
+// cores which are needed at start is checked before by StartCoresNumber.
+func (scheduler *Scheduler) getCore() int {
 	for i := range scheduler.freeCores {
 		if scheduler.freeCores[i] == true {
 			scheduler.freeCores[i] = false
@@ -398,8 +548,5 @@ func (scheduler *Scheduler) getCore(startStage bool) int {
 			return i
 		}
 	}
-	if startStage == true {
-		common.LogError(common.Initialization, "Requested number of cores isn't enough. System needs at least one core per each Set function (except Merger and Stopper) plus one additional core.")
-	}
 	return -1
 }
@@ -7,4 +7,6 @@ go get -v github.com/pkg/errors
 go get -v golang.org/x/net/proxy
 go get -v github.com/docker/go-connections
 go get -v golang.org/x/tools/cmd/stringer
+# Needed only by pcap/zstd package
+go get -v github.com/klauspost/compress/zstd
 